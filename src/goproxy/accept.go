@@ -0,0 +1,226 @@
+// accept.go -- accept and drop counters of the listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+)
+
+// Why a client's connection (or request) was dropped
+const (
+	dropRatelimit = iota // global or per-host ratelimit
+	dropACL              // denied by the ACL
+	dropBanned           // client IP is banned
+	dropOverload         // shed due to overload
+	dropDestLimit        // destination at its connection limit
+	dropSchedule         // listener is outside its schedule
+	dropChaos            // dropped by fault injection
+	dropKnock            // client didn't knock on a hidden listener
+	dropMemory           // buffer memory is used up
+	dropMaxConns         // max_conns connections are open
+	nDrops
+)
+
+var dropNames = [nDrops]string{"ratelimit", "acl", "banned", "overload", "destlimit", "schedule", "chaos", "knock", "memory", "maxconns"}
+
+// Why a connection (or request) failed. The first few are us blocking
+// the client; the rest the destination or the client going wrong.
+const (
+	failACL         = iota // denied by the ACL, a ban or a missed knock
+	failRatelimit          // a rate, connection or overload limit
+	failAuth               // bad login
+	failPolicy             // blocklist, category, protocol or schedule
+	failDNS                // destination doesn't resolve
+	failDialTimeout        // destination didn't answer in time
+	failRefused            // destination refused the connection
+	failUnreachable        // no route to the destination
+	failNoPorts            // out of local ports to the destination
+	failTLS                // TLS handshake or certificate failed
+	failUpstream           // any other error of the destination
+	failClientAbort        // client went away mid request
+	nFails
+)
+
+var failNames = [nFails]string{"acl", "ratelimit", "auth", "policy", "dns", "dial-timeout", "refused", "unreachable", "no-ports", "tls", "upstream", "client-abort"}
+
+// The failure each drop counts as; -1 for none
+var dropFails = [nDrops]int{failRatelimit, failACL, failACL, failRatelimit, failRatelimit, failPolicy, -1, failACL, failRatelimit, failRatelimit}
+
+// The accept counters of a listener; a nil acceptStats counts nothing.
+type acceptStats struct {
+	ln       *net.TCPListener
+	accepted uint64
+	drops    [nDrops]uint64
+	fails    [nFails]uint64
+	leaks    uint64
+	prl      *perIPLimiter
+
+	name        string
+	transported bool          // behind a transport: clients are all loopback
+	cluster     *clusterStore // may be nil
+}
+
+// Report the client IPs of per-IP rate limiter 'l' -- which counts the
+// clients of the whole fleet, if we are in one; returns 'a'
+func (a *acceptStats) RateLimiter(l *perIPLimiter) *acceptStats {
+	if a != nil {
+		a.prl = l
+		l.share(a.cluster, a.name)
+	}
+	return a
+}
+
+// A connection passed the accept checks
+func (a *acceptStats) Accepted() {
+	if a != nil {
+		atomic.AddUint64(&a.accepted, 1)
+	}
+}
+
+// A connection was dropped for reason 'why'
+func (a *acceptStats) Dropped(why int) {
+	if a != nil {
+		atomic.AddUint64(&a.drops[why], 1)
+		a.Failed(dropFails[why])
+	}
+}
+
+// A connection or request failed for reason 'why'
+func (a *acceptStats) Failed(why int) {
+	if a != nil && why >= 0 {
+		atomic.AddUint64(&a.fails[why], 1)
+	}
+}
+
+// A client asked for an address it resolved from a name on its own
+func (a *acceptStats) Leaked() {
+	if a != nil {
+		atomic.AddUint64(&a.leaks, 1)
+	}
+}
+
+// Return why connecting to (or talking to) a destination failed with
+// 'err'
+func failure(err error) int {
+	var dns *net.DNSError
+	var ne net.Error
+	var cv *tls.CertificateVerificationError
+	var rh tls.RecordHeaderError
+	var al tls.AlertError
+
+	switch {
+	case errors.As(err, &dns):
+		return failDNS
+	case errors.Is(err, context.Canceled):
+		return failClientAbort
+	case errors.As(err, &cv) || errors.As(err, &rh) || errors.As(err, &al):
+		return failTLS
+	case errors.As(err, &ne) && ne.Timeout():
+		return failDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failRefused
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH):
+		return failUnreachable
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return failNoPorts
+	}
+	return failUpstream
+}
+
+// A listener as described by GET /accept. Queue is the number of
+// connections the kernel has queued for us to accept and Backlog its
+// limit; both are -1 if unknown. Errors counts the failures by cause.
+// Clients is the number of client IPs the per-IP rate limit tracks
+// and Forgotten those it dropped for being idle.
+type acceptInfo struct {
+	Accepted uint64            `json:"accepted"`
+	Drops    map[string]uint64 `json:"drops"`
+	Errors   map[string]uint64 `json:"errors"`
+	Queue    int               `json:"queue"`
+	Backlog  int               `json:"backlog"`
+
+	Clients   int    `json:"ratelimit_clients"`
+	Forgotten uint64 `json:"ratelimit_forgotten"`
+
+	DNSLeaks uint64 `json:"dns_leaks"`
+}
+
+func (a *acceptStats) info() acceptInfo {
+	i := acceptInfo{
+		Accepted: atomic.LoadUint64(&a.accepted),
+		Drops:    make(map[string]uint64),
+		Errors:   make(map[string]uint64),
+		Queue:    -1,
+		Backlog:  -1,
+		DNSLeaks: atomic.LoadUint64(&a.leaks),
+	}
+	for k, s := range dropNames {
+		i.Drops[s] = atomic.LoadUint64(&a.drops[k])
+	}
+	for k, s := range failNames {
+		i.Errors[s] = atomic.LoadUint64(&a.fails[k])
+	}
+	i.Clients, i.Forgotten = a.prl.Len()
+	if q, b, err := listenQueue(a.ln); err == nil {
+		i.Queue, i.Backlog = q, b
+	}
+	return i
+}
+
+// Register listener 'lc' on 'ln'; returns its accept counters
+func (c *control) Listener(lc *ListenConf, ln *net.TCPListener) *acceptStats {
+	if c == nil {
+		return nil
+	}
+
+	a := &acceptStats{
+		ln:          ln,
+		name:        lc.String(),
+		transported: len(lc.Transport.Exec) > 0,
+		cluster:     c.cluster,
+	}
+	c.mu.Lock()
+	c.lis[a.name] = a
+	c.mu.Unlock()
+	return a
+}
+
+// GET /accept: the accept and error counters and queue of each listener; and the
+// kernel's counts of connections dropped because an accept queue
+// overflowed (for all listening sockets of the host).
+func (c *control) ServeAccept(w http.ResponseWriter, r *http.Request) {
+	v := struct {
+		Listeners map[string]acceptInfo `json:"listeners"`
+		Kernel    map[string]uint64     `json:"kernel,omitempty"`
+	}{
+		Listeners: make(map[string]acceptInfo),
+	}
+
+	c.mu.Lock()
+	lis := make(map[string]*acceptStats, len(c.lis))
+	for k, a := range c.lis {
+		lis[k] = a
+	}
+	c.mu.Unlock()
+
+	for k, a := range lis {
+		v.Listeners[k] = a.info()
+	}
+	v.Kernel, _ = kernelListenDrops()
+
+	writeJSON(w, &v)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,84 @@
+// accept_linux.go -- accept queue stats from the kernel
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Return the accept queue length and limit of 'ln'; for a listening
+// socket TCP_INFO has them in place of the unacked and sacked counts.
+func listenQueue(ln *net.TCPListener) (int, int, error) {
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var ti syscall.TCPInfo
+	var e syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		n := uint32(syscall.SizeofTCPInfo)
+		_, _, e = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&n)), 0)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if e != 0 {
+		return 0, 0, e
+	}
+	return int(ti.Unacked), int(ti.Sacked), nil
+}
+
+// Return the ListenOverflows and ListenDrops counters of the kernel
+func kernelListenDrops() (map[string]uint64, error) {
+	fd, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	// Pairs of lines: "TcpExt: names .." then "TcpExt: values .."
+	var names []string
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		v := strings.Fields(sc.Text())
+		if len(v) == 0 || v[0] != "TcpExt:" {
+			continue
+		}
+		if names == nil {
+			names = v
+			continue
+		}
+
+		m := make(map[string]uint64)
+		for i := 1; i < len(v) && i < len(names); i++ {
+			switch names[i] {
+			case "ListenOverflows":
+				m["listen_overflows"], _ = strconv.ParseUint(v[i], 10, 64)
+			case "ListenDrops":
+				m["listen_drops"], _ = strconv.ParseUint(v[i], 10, 64)
+			}
+		}
+		return m, nil
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no TcpExt counters")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,29 @@
+// accept_other.go -- accept queue stats where the kernel has none
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoQueueStats = errors.New("not supported on this platform")
+
+func listenQueue(ln *net.TCPListener) (int, int, error) {
+	return 0, 0, errNoQueueStats
+}
+
+func kernelListenDrops() (map[string]uint64, error) {
+	return nil, errNoQueueStats
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
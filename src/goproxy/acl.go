@@ -0,0 +1,228 @@
+// acl.go -- client ACLs of the listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// The ACLs of every listener; a reload replaces them while the
+// listeners keep running.
+type aclTable struct {
+	mu sync.Mutex
+	m  map[string]*listenerACL
+}
+
+// The allow and deny sets of one listener; they are swapped as a whole
+// so a lookup never sees a mix of old and new.
+type listenerACL struct {
+	v atomic.Value // *aclSets
+}
+
+type aclSets struct {
+	allow *cidrSet
+	deny  *cidrSet
+
+	// the rules of each set in order and the one for clients that
+	// match neither: allowed if there is no allow list, else denied
+	allowRules []*aclRule
+	denyRules  []*aclRule
+	other      *aclRule
+
+	// rules that are only logged; nil if there are none
+	shadow *shadowRules
+}
+
+// An entry of an allow or deny list and the decisions it made
+type aclRule struct {
+	Kind string `json:"kind"` // allow or deny
+	Net  string `json:"net"`  // "*" for the default rule
+	Name string `json:"name,omitempty"`
+	Hits uint64 `json:"hits"`
+}
+
+// Return the rule's name for logs: its name if it has one
+func (r *aclRule) String() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	if r.Net == "*" {
+		return "default " + r.Kind
+	}
+	return r.Kind + " " + r.Net
+}
+
+func newACLTable() *aclTable {
+	return &aclTable{
+		m: make(map[string]*listenerACL),
+	}
+}
+
+// Return the ACL of listener 'lc'
+func (t *aclTable) For(lc *ListenConf) *listenerACL {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.m[lc.String()]
+	if !ok {
+		a = &listenerACL{}
+		a.Set(lc)
+		t.m[lc.String()] = a
+	}
+	return a
+}
+
+// Replace the ACLs of the listeners in 'cfg' that we have; returns the
+// number replaced.
+func (t *aclTable) Update(cfg *Conf) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, v := range cfg.listeners() {
+		for i := range v {
+			if a, ok := t.m[v[i].String()]; ok {
+				a.Set(&v[i])
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Set the ACL from the allow and deny lists of 'lc' and its shadow
+// rules. The rules keep their counts if they were in the old ACL.
+func (a *listenerACL) Set(lc *ListenConf) {
+	old := make(map[aclRule]uint64)
+	if s, ok := a.v.Load().(*aclSets); ok {
+		for _, r := range s.rules() {
+			k := *r
+			k.Hits = 0
+			old[k] = atomic.LoadUint64(&r.Hits)
+		}
+	}
+
+	s := newACLSets(lc.Allow, lc.Deny, "", old)
+	s.shadow = newShadowRules(&lc.Shadow, old)
+	a.v.Store(s)
+}
+
+// Make the sets of 'allow' and 'deny'; the kind of their rules is
+// 'prefix' and allow or deny, their counts those in 'old'
+func newACLSets(allow, deny []subnet, prefix string, old map[aclRule]uint64) *aclSets {
+	rules := func(kind string, v []subnet) []*aclRule {
+		var rv []*aclRule
+		for i := range v {
+			r := &aclRule{Kind: kind, Net: v[i].IPNet.String(), Name: v[i].Name}
+			r.Hits = old[*r]
+			rv = append(rv, r)
+		}
+		return rv
+	}
+
+	s := &aclSets{
+		allow:      newCIDRSet(allow),
+		deny:       newCIDRSet(deny),
+		allowRules: rules(prefix+"allow", allow),
+		denyRules:  rules(prefix+"deny", deny),
+		other:      &aclRule{Kind: prefix + "allow", Net: "*"},
+	}
+	if len(allow) > 0 {
+		s.other.Kind = prefix + "deny"
+	}
+	s.other.Hits = old[*s.other]
+	return s
+}
+
+// Return the rules of the sets: deny, allow, the default and those of
+// the shadow ACL
+func (s *aclSets) rules() []*aclRule {
+	v := append([]*aclRule{}, s.denyRules...)
+	v = append(v, s.allowRules...)
+	v = append(v, s.other)
+	if s.shadow != nil && s.shadow.acl != nil {
+		v = append(v, s.shadow.acl.rules()...)
+	}
+	return v
+}
+
+// Return true if the ACL allows client 'ip': it isn't denied and the
+// allow list is empty or has it.
+func (a *listenerACL) Allows(ip net.IP) bool {
+	ok, _ := a.match(ip)
+	return ok
+}
+
+// Return true if the ACL allows client 'ip' and the rule that decided
+// it; and count the decision for the rule.
+func (a *listenerACL) Decide(ip net.IP) (bool, *aclRule) {
+	ok, r := a.match(ip)
+	if r != nil {
+		atomic.AddUint64(&r.Hits, 1)
+	}
+	return ok, r
+}
+
+func (a *listenerACL) match(ip net.IP) (bool, *aclRule) {
+	return a.v.Load().(*aclSets).match(ip)
+}
+
+func (s *aclSets) match(ip net.IP) (bool, *aclRule) {
+	if ip == nil {
+		return false, nil
+	}
+
+	if i := s.deny.Match(ip); i >= 0 {
+		return false, s.denyRules[i]
+	}
+	if s.allow.Len() == 0 {
+		return true, s.other
+	}
+	if i := s.allow.Match(ip); i >= 0 {
+		return true, s.allowRules[i]
+	}
+	return false, s.other
+}
+
+// Admin API for the ACL rules:
+//
+//	GET /acl         the rules of each listener and their hit counts
+func (t *aclTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type listenerRules struct {
+		Listener string     `json:"listener"`
+		Rules    []*aclRule `json:"rules"`
+	}
+
+	t.mu.Lock()
+	var v []listenerRules
+	for name, a := range t.m {
+		lr := listenerRules{Listener: name}
+		for _, r := range a.v.Load().(*aclSets).rules() {
+			x := *r
+			x.Hits = atomic.LoadUint64(&r.Hits)
+			lr.Rules = append(lr.Rules, &x)
+		}
+		v = append(v, lr)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(v, func(i, j int) bool { return v[i].Listener < v[j].Listener })
+	writeJSON(w, v)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
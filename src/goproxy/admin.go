@@ -0,0 +1,167 @@
+// admin.go -- admin HTTP API for stats and control
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// The admin server; it is a Proxy only so main can start and stop it
+// along with the others.
+type adminServer struct {
+	ln     net.Listener
+	mux    *http.ServeMux
+	srv    *http.Server
+	tokens map[string]string
+	log    *L.Logger
+
+	wg sync.WaitGroup
+}
+
+// Make a new admin server per 'cfg'; every request is recorded in
+// 'audit'.
+func NewAdminServer(cfg *AdminConf, audit *auditLog, log *L.Logger) (*adminServer, error) {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &adminServer{
+		ln:     ln,
+		mux:    http.NewServeMux(),
+		tokens: cfg.Tokens,
+		log:    log.New("admin-"+ln.Addr().String(), 0),
+	}
+
+	a.srv = &http.Server{
+		Handler:      a.identify(audit.Handler(a.authorize(a.mux))),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return a, nil
+}
+
+// Context key for the operator an admin request authenticated as
+type adminWhoKey struct{}
+
+// Return the operator request 'r' authenticated as; "" if none
+func adminWho(r *http.Request) string {
+	who, _ := r.Context().Value(adminWhoKey{}).(string)
+	return who
+}
+
+// Wrap 'h' so requests bearing one of our tokens carry the name of its
+// operator
+func (a *adminServer) identify(h http.Handler) http.Handler {
+	if len(a.tokens) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := r.Header.Get("Authorization")
+		if len(s) > 7 && strings.EqualFold(s[:7], "bearer ") {
+			tok := []byte(strings.TrimSpace(s[7:]))
+			for who, t := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(t), tok) == 1 {
+					r = r.WithContext(context.WithValue(r.Context(), adminWhoKey{}, who))
+					break
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Wrap 'h' so only requests identify() recognized get to it when we
+// have tokens
+func (a *adminServer) authorize(h http.Handler) http.Handler {
+	if len(a.tokens) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminWho(r)) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Register a handler for 'path'
+func (a *adminServer) Handle(path string, h http.HandlerFunc) {
+	a.mux.HandleFunc(path, h)
+}
+
+func (a *adminServer) Start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.log.Info("Starting admin API ..")
+		a.srv.Serve(a.ln)
+	}()
+}
+
+func (a *adminServer) Stop() {
+	cx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	a.srv.Shutdown(cx)
+	cancel()
+
+	a.wg.Wait()
+	a.log.Info("admin API shutdown")
+}
+
+// A listener as described by GET /listeners
+type listenerInfo struct {
+	Name   string            `json:"name,omitempty"`
+	Type   string            `json:"type"`
+	Listen string            `json:"listen"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+func newListenerInfo(typ string, lc *ListenConf) listenerInfo {
+	return listenerInfo{
+		Name:   lc.Name,
+		Type:   typ,
+		Listen: lc.Listen,
+		Tags:   lc.Tags,
+	}
+}
+
+// Return a handler that lists the listeners 'v'
+func listenersHandler(v []listenerInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, v)
+	}
+}
+
+// Write 'v' as an indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
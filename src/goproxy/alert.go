@@ -0,0 +1,157 @@
+// alert.go -- send alerts to a webhook or by email
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// An alerter logs alerts and sends them to the configured webhook
+// and/or mail recipients. Sending is done in the background so the
+// caller never waits on a slow remote; alerts that arrive while the
+// queue is full are only logged.
+type alerter struct {
+	cfg AlertConf
+	clt *http.Client
+	log *L.Logger
+
+	q    chan *alert
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// An alert as POSTed to the webhook
+type alert struct {
+	Time    time.Time   `json:"time"`
+	Kind    string      `json:"kind"`
+	Subject string      `json:"subject"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func newAlerter(cfg *AlertConf, log *L.Logger) *alerter {
+	return &alerter{
+		cfg:  *cfg,
+		clt:  &http.Client{Timeout: 30 * time.Second},
+		log:  log.New("alert", 0),
+		q:    make(chan *alert, 64),
+		stop: make(chan bool),
+	}
+}
+
+func (a *alerter) Start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case x := <-a.q:
+				a.send(x)
+			}
+		}
+	}()
+}
+
+func (a *alerter) Stop() {
+	close(a.stop)
+	a.wg.Wait()
+}
+
+// Raise an alert of 'kind' with the summary 'subject'; 'details' is
+// marshaled to JSON for the webhook and the mail body.
+func (a *alerter) Alert(kind, subject string, details interface{}) {
+	if a == nil {
+		return
+	}
+
+	a.log.Warn("%s", subject)
+	if len(a.cfg.Webhook) == 0 && len(a.cfg.Mail.To) == 0 {
+		return
+	}
+
+	x := &alert{
+		Time:    time.Now().UTC(),
+		Kind:    kind,
+		Subject: subject,
+		Details: details,
+	}
+
+	select {
+	case a.q <- x:
+	default:
+		a.log.Error("alert queue full; not sent: %s", subject)
+	}
+}
+
+func (a *alerter) send(x *alert) {
+	b, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		a.log.Error("can't marshal alert: %s", err)
+		return
+	}
+
+	if len(a.cfg.Webhook) > 0 {
+		if err := a.post(b); err != nil {
+			a.log.Error("webhook %s: %s", a.cfg.Webhook, err)
+		}
+	}
+
+	if len(a.cfg.Mail.To) > 0 {
+		if err := a.mail(x.Subject, b); err != nil {
+			a.log.Error("mail to %s: %s", strings.Join(a.cfg.Mail.To, ", "), err)
+		}
+	}
+}
+
+func (a *alerter) post(b []byte) error {
+	res, err := a.clt.Post(a.cfg.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
+func (a *alerter) mail(subject string, body []byte) error {
+	m := &a.cfg.Mail
+
+	var auth smtp.Auth
+	if len(m.User) > 0 {
+		host, _, _ := net.SplitHostPort(m.Server)
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: application/json\r\n\r\n")
+	msg.Write(body)
+	msg.WriteString("\r\n")
+
+	return smtp.SendMail(m.Server, auth, m.From, m.To, msg.Bytes())
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
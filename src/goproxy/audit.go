@@ -0,0 +1,138 @@
+// audit.go -- append-only audit log of administrative actions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An auditLog records who did what, when and from where -- admin API
+// calls, config reloads and signals -- one JSON object per line. The
+// file is only ever appended to and is never rotated by us; it is
+// reopened on SIGUSR1 if something else rotates it. A nil auditLog
+// records nothing.
+type auditLog struct {
+	name string
+
+	mu sync.Mutex
+	fd *os.File
+}
+
+// One audit record
+type auditRecord struct {
+	Time   string `json:"time"`
+	Who    string `json:"who"`
+	From   string `json:"from,omitempty"`
+	What   string `json:"what"`
+	Result string `json:"result,omitempty"`
+}
+
+// Open the audit log 'fn'; returns nil if 'fn' is empty
+func newAuditLog(fn string) (*auditLog, error) {
+	if len(fn) == 0 {
+		return nil, nil
+	}
+
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %s", err)
+	}
+	return &auditLog{name: fn, fd: fd}, nil
+}
+
+// Record an action
+func (a *auditLog) Record(who, from, what, result string) error {
+	if a == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(&auditRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Who:    who,
+		From:   from,
+		What:   what,
+		Result: result,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// one write per record so concurrent writers never interleave
+	_, err = a.fd.Write(append(b, '\n'))
+	if err == nil {
+		err = a.fd.Sync()
+	}
+	return err
+}
+
+// Close and reopen the file after it was rotated
+func (a *auditLog) Reopen() error {
+	if a == nil {
+		return nil
+	}
+
+	fd, err := os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("audit log: %s", err)
+	}
+
+	a.mu.Lock()
+	a.fd.Close()
+	a.fd = fd
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *auditLog) Close() {
+	if a != nil {
+		a.fd.Close()
+	}
+}
+
+// Wrap 'h' so every admin API request is recorded with its status.
+// Who is the operator whose admin token the request bore -- never what
+// the client claims -- or "-".
+func (a *auditLog) Handler(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		who := adminWho(r)
+		if len(who) == 0 {
+			who = "-"
+		}
+		a.Record(who, r.RemoteAddr, fmt.Sprintf("%s %s", r.Method, r.URL.RequestURI()),
+			fmt.Sprintf("%d", sw.status))
+	})
+}
+
+// Remembers the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
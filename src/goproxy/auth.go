@@ -0,0 +1,681 @@
+// auth.go -- user authentication for SOCKS and HTTP listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// An authenticator checks the user names and passwords of clients of
+// the listeners with "auth: true": SOCKSv5 username/password (RFC 1929)
+// and HTTP Proxy-Authorization Basic. Users are looked up in the users
+// file first; users it doesn't have are checked by the backend, if
+// there is one.
+//
+// The backend's answers are cached per client address and credentials:
+// a client it let in gets a session, during which its connections are
+// let in without asking the backend again; one it turned away is
+// turned away for the negative time. Chatty clients open many
+// connections and a brute force many more; this keeps them from
+// costing a backend round trip each. Reloading the users file empties
+// the cache.
+//
+// Failed logins are counted per address and per user. Each one makes
+// the next answer to that address or user wait twice as long; enough
+// of them ban the address and lock the user out for a while. This
+// blunts password guessing and credential stuffing.
+//
+// Users with a TOTP secret append the code of their authenticator app
+// to their password. A code is good for one client address: from
+// there it is taken again (HTTP clients send it with each request)
+// until the session time is up, from anywhere else it is refused.
+//
+// A fleet behind a load balancer can share the cached answers and the
+// TOTP codes in use via Redis, so a client sent to another proxy isn't
+// asked about again. What Redis has is looked up when our own cache
+// doesn't have it; when Redis is away each proxy goes on by itself.
+type authenticator struct {
+	users    atomic.Value // map[string]string: user -> password or sha256:hex
+	totp     atomic.Value // map[string][]byte: user -> TOTP secret
+	backend  string
+	client   *http.Client
+	session  time.Duration
+	negative time.Duration
+	lockout  LockoutConf
+	ctl      *control      // bans addresses; may be nil
+	cluster  *clusterStore // shares sessions and codes; may be nil
+	log      *L.Logger
+
+	mu    sync.Mutex
+	cache map[authKey]authResult
+	last  time.Time // when expired results and failures were last removed
+
+	// failed logins by address and by user
+	ipFails   map[string]*authFails
+	userFails map[string]*authFails
+
+	// TOTP codes in use: user:code -> who
+	codes map[string]totpUse
+
+	// lookups of the cache: answered yes, answered no, or not
+	hits, rejects, misses uint64
+
+	banned, locked uint64
+}
+
+// The client that used a TOTP code and until when it may again
+type totpUse struct {
+	ip  string
+	exp time.Time
+}
+
+// Recent failed logins of an address or user
+type authFails struct {
+	n     int
+	last  time.Time
+	until time.Time // the user is locked out until then
+}
+
+// A cached answer of the backend
+type authResult struct {
+	ok  bool
+	exp time.Time
+}
+
+// A client's credentials: its address, user and a hash of its password
+type authKey struct {
+	ip   string
+	user string
+	pass [sha256.Size]byte
+}
+
+const (
+	defaultAuthTimeout = 5 * time.Second
+
+	defaultLockoutMaxDelay = 10 * time.Second
+	defaultLockoutWindow   = 15 * time.Minute
+	defaultLockoutBan      = 15 * time.Minute
+
+	// how often expired answers are removed from the cache
+	authSweep = time.Minute
+)
+
+// Make the authenticator in 'c'; nil if there is none
+func newAuthenticator(c *AuthConf, log *L.Logger) (*authenticator, error) {
+	if len(c.Users) == 0 && len(c.URL) == 0 {
+		return nil, nil
+	}
+
+	a := &authenticator{
+		backend:  c.URL,
+		session:  time.Duration(c.Session),
+		negative: time.Duration(c.Negative),
+		lockout:  c.Lockout,
+		log:      log,
+		cache:    make(map[authKey]authResult),
+
+		ipFails:   make(map[string]*authFails),
+		userFails: make(map[string]*authFails),
+		codes:     make(map[string]totpUse),
+	}
+
+	lo := &a.lockout
+	if lo.MaxDelay <= 0 {
+		lo.MaxDelay = duration(defaultLockoutMaxDelay)
+	}
+	if lo.Window <= 0 {
+		lo.Window = duration(defaultLockoutWindow)
+	}
+	if lo.Ban <= 0 {
+		lo.Ban = duration(defaultLockoutBan)
+	}
+
+	if len(c.URL) > 0 {
+		t := time.Duration(c.Timeout)
+		if t <= 0 {
+			t = defaultAuthTimeout
+		}
+		a.client = &http.Client{Timeout: t}
+	}
+
+	if err := a.Load(c); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Ban the addresses that fail to log in too often via 'c'
+func (a *authenticator) BanVia(c *control) {
+	if a != nil {
+		a.ctl = c
+	}
+}
+
+// Share the backend's answers and the TOTP codes in use via 's'
+func (a *authenticator) ShareVia(s *clusterStore) {
+	if a != nil {
+		a.cluster = s
+	}
+}
+
+// Return the authenticator of listener 'lc'; nil if it is open to all
+func (a *authenticator) For(lc *ListenConf) *authenticator {
+	if !lc.Auth {
+		return nil
+	}
+	return a
+}
+
+// Read the users file of 'c': lines of "user:password" where the
+// password is in the clear or "sha256:" and its hex digest. Blank
+// lines and those that start with '#' are ignored. The cached answers
+// of the backend are dropped: users may have moved to or from the
+// file. The TOTP secrets are taken from 'c' too.
+func (a *authenticator) Load(c *AuthConf) error {
+	totp := make(map[string][]byte)
+	for u, s := range c.TOTP {
+		k, err := parseTOTPSecret(s)
+		if err != nil {
+			return fmt.Errorf("auth: totp %s: %s", u, err)
+		}
+		totp[u] = k
+	}
+
+	fn := c.Users
+	m := make(map[string]string)
+	if len(fn) > 0 {
+		fd, err := os.Open(fn)
+		if err != nil {
+			return fmt.Errorf("auth: %s", err)
+		}
+		defer fd.Close()
+
+		sc := bufio.NewScanner(fd)
+		for n := 1; sc.Scan(); n++ {
+			s := strings.TrimSpace(sc.Text())
+			if len(s) == 0 || s[0] == '#' {
+				continue
+			}
+
+			i := strings.IndexByte(s, ':')
+			if i <= 0 {
+				return fmt.Errorf("auth: %s:%d: not user:password", fn, n)
+			}
+			m[s[:i]] = s[i+1:]
+		}
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("auth: %s: %s", fn, err)
+		}
+	}
+
+	a.users.Store(m)
+	a.totp.Store(totp)
+
+	a.mu.Lock()
+	a.cache = make(map[authKey]authResult)
+	a.mu.Unlock()
+	return nil
+}
+
+// Return the number of users in the users file
+func (a *authenticator) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.users.Load().(map[string]string))
+}
+
+// Return true if 'user' with 'pass' may use the proxy from 'ip'. The
+// answer is delayed if either has failed to log in recently.
+func (a *authenticator) Check(ip net.IP, user, pass string) bool {
+	now := time.Now()
+	d, locked := a.penalty(ip.String(), user, now)
+	if d > 0 {
+		time.Sleep(d)
+	}
+
+	ok := !locked && a.check(ip, user, pass)
+	a.record(ip, user, ok, locked, time.Now())
+	return ok
+}
+
+// Return how long to delay the answer to 'user' from 'ip' at 'now', and
+// whether the user is locked out.
+func (a *authenticator) penalty(ip, user string, now time.Time) (time.Duration, bool) {
+	lo := &a.lockout
+	w := time.Duration(lo.Window)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	var locked bool
+	if f := a.ipFails[ip]; f != nil && now.Sub(f.last) < w {
+		n = f.n
+	}
+	if f := a.userFails[user]; f != nil {
+		if now.Sub(f.last) < w {
+			n = max(n, f.n)
+		}
+		locked = now.Before(f.until)
+	}
+
+	if n == 0 || lo.Delay <= 0 {
+		return 0, locked
+	}
+
+	d, top := time.Duration(lo.Delay), time.Duration(lo.MaxDelay)
+	for i := 1; i < n && d < top; i++ {
+		d *= 2
+	}
+	return min(d, top), locked
+}
+
+// Count the login of 'user' from 'ip' at 'now'; ban the address or lock
+// out the user if they failed too often.
+func (a *authenticator) record(ip net.IP, user string, ok, locked bool, now time.Time) {
+	lo := &a.lockout
+	w := time.Duration(lo.Window)
+	ban := time.Duration(lo.Ban)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ok {
+		delete(a.userFails, user)
+		return
+	}
+
+	fail := func(m map[string]*authFails, k string) *authFails {
+		f := m[k]
+		if f == nil {
+			f = &authFails{}
+			m[k] = f
+		}
+		if now.Sub(f.last) >= w {
+			f.n = 0
+		}
+		f.n++
+		f.last = now
+		return f
+	}
+
+	if f := fail(a.ipFails, ip.String()); lo.Failures > 0 && f.n >= lo.Failures {
+		a.log.Info("%s failed to log in %d times; banned for %s", ip, f.n, ban)
+		delete(a.ipFails, ip.String())
+		a.banned++
+		if a.ctl != nil {
+			// without a lock; Ban kills the address' connections
+			defer a.ctl.Ban(ip, ban)
+		}
+	}
+
+	// a locked out user's failures don't extend the lockout
+	if !locked {
+		if f := fail(a.userFails, user); lo.Failures > 0 && f.n >= lo.Failures {
+			a.log.Info("user %q failed to log in %d times; locked out for %s", user, f.n, ban)
+			f.n, f.until = 0, now.Add(ban)
+			a.locked++
+		}
+	}
+	a.sweep(now)
+}
+
+// Remove the expired answers and failures; with a.mu held
+func (a *authenticator) sweep(now time.Time) {
+	if now.Sub(a.last) < authSweep {
+		return
+	}
+
+	for k, r := range a.cache {
+		if !now.Before(r.exp) {
+			delete(a.cache, k)
+		}
+	}
+
+	for k, u := range a.codes {
+		if !now.Before(u.exp) {
+			delete(a.codes, k)
+		}
+	}
+
+	w := time.Duration(a.lockout.Window)
+	for _, m := range []map[string]*authFails{a.ipFails, a.userFails} {
+		for k, f := range m {
+			if now.Sub(f.last) >= w && !now.Before(f.until) {
+				delete(m, k)
+			}
+		}
+	}
+	a.last = now
+}
+
+// Return true if 'pass' is the password of 'user' -- and the TOTP code
+// after it, if the user has a secret
+func (a *authenticator) check(ip net.IP, user, pass string) bool {
+	key, ok := a.totp.Load().(map[string][]byte)[user]
+	if !ok {
+		return a.checkPass(ip, user, pass)
+	}
+
+	n := len(pass) - totpDigits
+	if n < 0 {
+		return false
+	}
+	pass, code := pass[:n], pass[n:]
+
+	now := time.Now()
+	k := user + ":" + code
+
+	a.mu.Lock()
+	u, used := a.codes[k]
+	a.mu.Unlock()
+	if !used && a.cluster != nil {
+		u.ip, u.exp, used = a.cluster.Code(k)
+	}
+	if used && now.Before(u.exp) {
+		if u.ip != ip.String() {
+			a.log.Info("%s: TOTP code of %q was used by %s", ip, user, u.ip)
+			return false
+		}
+	} else if !checkTOTP(key, code, now) {
+		return false
+	}
+
+	if !a.checkPass(ip, user, pass) {
+		return false
+	}
+
+	if !used || !now.Before(u.exp) {
+		u = totpUse{ip.String(), now.Add(max(a.session, (2*totpSkew+1)*totpStep))}
+
+		// another proxy of the fleet may have taken it first
+		if a.cluster != nil {
+			if who, err := a.cluster.ClaimCode(k, u.ip, u.exp); err == nil && who != u.ip {
+				a.log.Info("%s: TOTP code of %q was used by %s", ip, user, who)
+				return false
+			}
+		}
+
+		a.mu.Lock()
+		a.codes[k] = u
+		a.mu.Unlock()
+	}
+	return true
+}
+
+// Return true if 'pass' is the password of 'user' in the users file or
+// by the backend
+func (a *authenticator) checkPass(ip net.IP, user, pass string) bool {
+	users := a.users.Load().(map[string]string)
+	if want, ok := users[user]; ok {
+		return checkPassword(want, pass)
+	}
+	if a.client == nil {
+		return false
+	}
+
+	k := authKey{ip: ip.String(), user: user, pass: sha256.Sum256([]byte(pass))}
+	now := time.Now()
+
+	a.mu.Lock()
+	r, ok := a.cache[k]
+	switch {
+	case !ok || !now.Before(r.exp):
+		a.misses++
+	case r.ok:
+		a.hits++
+	default:
+		a.rejects++
+	}
+	a.mu.Unlock()
+	if ok && now.Before(r.exp) {
+		return r.ok
+	}
+
+	// another proxy of the fleet may have asked
+	if a.cluster != nil {
+		if r, ok := a.cluster.Session(k); ok {
+			a.mu.Lock()
+			a.cache[k] = r
+			a.mu.Unlock()
+			return r.ok
+		}
+	}
+
+	ok, err := a.ask(ip, user, pass)
+	if err != nil {
+		// the backend's trouble isn't the client's; don't remember it
+		a.log.Warn("auth backend: %s", err)
+		return false
+	}
+
+	ttl := a.session
+	if !ok {
+		ttl = a.negative
+	}
+	if ttl > 0 {
+		r := authResult{ok, now.Add(ttl)}
+		a.mu.Lock()
+		a.cache[k] = r
+		a.sweep(now)
+		a.mu.Unlock()
+
+		if a.cluster != nil {
+			a.cluster.SetSession(k, r)
+		}
+	}
+	return ok
+}
+
+// Counters of the authenticator as shown by GET /stats
+type authStats struct {
+	Users   int     `json:"users"`
+	Cached  int     `json:"cached"`
+	Hits    uint64  `json:"hits"`
+	Rejects uint64  `json:"rejects"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"` // percent of lookups the cache answered
+
+	// addresses banned and users locked out for failed logins
+	Banned uint64 `json:"banned"`
+	Locked uint64 `json:"locked"`
+}
+
+func (a *authenticator) Stats() *authStats {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := &authStats{
+		Users:   a.Len(),
+		Cached:  len(a.cache),
+		Hits:    a.hits,
+		Rejects: a.rejects,
+		Misses:  a.misses,
+		Banned:  a.banned,
+		Locked:  a.locked,
+	}
+	if n := s.Hits + s.Rejects + s.Misses; n > 0 {
+		s.HitRate = math.Round(float64(s.Hits+s.Rejects)*1000/float64(n)) / 10
+	}
+	return s
+}
+
+// Return true if the password 'pass' is 'want' from the users file
+func checkPassword(want, pass string) bool {
+	if h := strings.TrimPrefix(want, "sha256:"); len(h) < len(want) {
+		d := sha256.Sum256([]byte(pass))
+		want, pass = strings.ToLower(h), hex.EncodeToString(d[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+// Ask the backend about 'user' with 'pass' from 'ip'. It gets them as
+// JSON; a 2xx answer lets the user in, 401 and 403 don't and anything
+// else is an error.
+func (a *authenticator) ask(ip net.IP, user, pass string) (bool, error) {
+	b, _ := json.Marshal(map[string]string{
+		"user":     user,
+		"password": pass,
+		"client":   ip.String(),
+	})
+
+	res, err := a.client.Post(a.backend, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return true, nil
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s", res.Status)
+}
+
+// Pick the method of SOCKSv5 client 'lhs' that offers 'm' and, if the
+// listener has users, do the username/password (RFC 1929) exchange.
+// Returns the user and true if the client may go on to its request.
+func (px *socksProxy) login(lhs net.Conn, m Methods) (string, bool) {
+	ls := lhs.RemoteAddr().String()
+	if px.auth == nil {
+		lhs.Write([]byte{5, 0})
+		return "", true
+	}
+
+	if bytes.IndexByte(m.methods, 2) < 0 {
+		px.acc.Failed(failAuth)
+		px.log.Debug("%s SOCKSv5: no username/password method; denied", ls)
+		lhs.Write([]byte{5, 0xff})
+		return "", false
+	}
+	lhs.Write([]byte{5, 2})
+
+	// VER(1) ULEN UNAME PLEN PASSWD
+	b := make([]byte, 513)
+	n, err := lhs.Read(b)
+	if err != nil && n == 0 {
+		px.acc.Failed(failClientAbort)
+		px.log.Debug("%s Unable to read login: %s", ls, err)
+		return "", false
+	}
+	user, pass, ok := parseLogin(b[:n])
+	if !ok {
+		px.log.Debug("%s SOCKSv5: bad login", ls)
+		lhs.Write([]byte{1, 1})
+		return "", false
+	}
+
+	if !px.auth.Check(remoteIP(ls), user, pass) {
+		px.acc.Failed(failAuth)
+		px.log.Info("%s SOCKSv5: login failed for %q", ls, user)
+		px.ctl.Trace(px.log, ls, "login as %q failed", user)
+		lhs.Write([]byte{1, 1})
+		return "", false
+	}
+	px.ctl.TraceLogin(ls, user)
+	px.ctl.Trace(px.log, ls, "logged in as %q", user)
+	lhs.Write([]byte{1, 0})
+	return user, true
+}
+
+// Parse the RFC 1929 login in 'b':
+//
+//	VER(1) ULEN UNAME PLEN PASSWD
+func parseLogin(b []byte) (user, pass string, ok bool) {
+	// the lengths are bytes; sums of them would wrap
+	if len(b) < 2 || b[0] != 1 {
+		return
+	}
+	ul := int(b[1])
+	if len(b) < 2+ul+1 {
+		return
+	}
+	user = string(b[2 : 2+ul])
+	b = b[2+ul:]
+	pl := int(b[0])
+	if len(b) < 1+pl {
+		return
+	}
+	return user, string(b[1 : 1+pl]), true
+}
+
+// Check the Proxy-Authorization of 'r'; ask for one if it isn't of a
+// user. Returns true if the request may go on.
+func (p *HTTPProxy) login(w http.ResponseWriter, r *http.Request) bool {
+	if p.auth == nil {
+		return true
+	}
+
+	user, pass, ok := proxyAuth(r)
+	if ok && p.auth.Check(remoteIP(r.RemoteAddr), user, pass) {
+		p.ctl.TraceLogin(r.RemoteAddr, user)
+		p.ctl.Trace(p.log, r.RemoteAddr, "logged in as %q", user)
+		return true
+	}
+	if ok {
+		p.acc.Failed(failAuth)
+		p.log.Info("%s: login failed for %q", r.RemoteAddr, user)
+	}
+
+	p.ulogDenied(r, http.StatusProxyAuthRequired, "auth")
+	w.Header().Set("Proxy-Authenticate", `Basic realm="goproxy"`)
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+	return false
+}
+
+// Return the user request 'r' logged in as; "" if the listener is open
+// to all
+func (p *HTTPProxy) user(r *http.Request) string {
+	if p.auth == nil {
+		return ""
+	}
+	user, _, _ := proxyAuth(r)
+	return user
+}
+
+// Return the user and password of the Basic Proxy-Authorization of 'r'
+func proxyAuth(r *http.Request) (user, pass string, ok bool) {
+	s := r.Header.Get("Proxy-Authorization")
+	if len(s) < 6 || !strings.EqualFold(s[:6], "basic ") {
+		return
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[6:]))
+	if err != nil {
+		return
+	}
+	user, pass, ok = strings.Cut(string(b), ":")
+	return
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,300 @@
+// bench.go -- "goproxy bench": drive load against a running proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+// A load generator: 'conns' workers each open a tunnel through the
+// proxy, send 'size' bytes to an echo server and read them back, close
+// and repeat until the time is up. We report the tunnels per second,
+// the throughput and percentiles of the time to set up a tunnel and of
+// the whole round trip.
+type bench struct {
+	target string // proxy host:port
+	proto  string // socks or http
+	dest   string // echo server host:port, as seen by the proxy
+	conns  int
+	size   int
+	tout   time.Duration
+
+	ok     uint64
+	failed uint64
+	bytes  uint64
+
+	mu    sync.Mutex
+	setup []time.Duration
+	rtt   []time.Duration
+	errs  map[string]int
+}
+
+// Run the bench subcommand with 'args'; return the exit code
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.StringP("target", "t", "", "Proxy to load as host:port")
+	proto := fs.StringP("proto", "p", "socks", "Proxy protocol: socks or http (CONNECT)")
+	dest := fs.StringP("dest", "D", "",
+		"Echo server host:port to tunnel to; default: one we start on --echo")
+	echo := fs.StringP("echo", "e", "127.0.0.1:0", "Listen address of our echo server")
+	conns := fs.IntP("conns", "c", 100, "Concurrent connections")
+	dur := fs.DurationP("duration", "d", 10*time.Second, "How long to run")
+	size := fs.IntP("size", "s", 16384, "Bytes sent (and echoed) per connection")
+	tout := fs.DurationP("timeout", "T", 10*time.Second, "Timeout of each connection")
+
+	fs.Usage = func() {
+		fmt.Printf("goproxy bench - load a proxy with tunnels\nUsage: %s bench [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(*target) == 0 {
+		warn("bench: no --target proxy")
+		return exitUsage
+	}
+	if *proto != "socks" && *proto != "http" {
+		warn("bench: unknown protocol %q", *proto)
+		return exitUsage
+	}
+	if *conns <= 0 || *size < 0 || *dur <= 0 {
+		warn("bench: conns and duration must be positive")
+		return exitUsage
+	}
+
+	b := &bench{
+		target: *target,
+		proto:  *proto,
+		dest:   *dest,
+		conns:  *conns,
+		size:   *size,
+		tout:   *tout,
+		errs:   make(map[string]int),
+	}
+
+	if len(b.dest) == 0 {
+		ln, err := startEcho(*echo)
+		if err != nil {
+			warn("bench: %s", err)
+			return exitFatal
+		}
+		defer ln.Close()
+		b.dest = ln.Addr().String()
+	}
+
+	fmt.Printf("bench: %d conns via %s proxy %s to %s for %s, %d bytes each\n",
+		b.conns, b.proto, b.target, b.dest, *dur, b.size)
+
+	t0 := time.Now()
+	b.run(*dur)
+	b.report(os.Stdout, time.Since(t0))
+
+	if b.ok == 0 {
+		return exitFatal
+	}
+	return 0
+}
+
+// Start an echo server on 'addr'
+func startEcho(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+func (b *bench) run(d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(b.conns)
+	for i := 0; i < b.conns; i++ {
+		go func() {
+			defer wg.Done()
+			b.worker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *bench) worker(ctx context.Context) {
+	out := make([]byte, b.size)
+	in := make([]byte, b.size)
+	for i := range out {
+		out[i] = byte(i)
+	}
+
+	var setup, rtt []time.Duration
+	defer func() {
+		b.mu.Lock()
+		b.setup = append(b.setup, setup...)
+		b.rtt = append(b.rtt, rtt...)
+		b.mu.Unlock()
+	}()
+
+	for ctx.Err() == nil {
+		t0 := time.Now()
+		c, err := b.dial(ctx)
+		if err != nil {
+			b.fail(ctx, err)
+			continue
+		}
+		t1 := time.Now()
+
+		c.SetDeadline(t0.Add(b.tout))
+		err = b.echo(c, out, in)
+		c.Close()
+		if err != nil {
+			b.fail(ctx, err)
+			continue
+		}
+
+		setup = append(setup, t1.Sub(t0))
+		rtt = append(rtt, time.Since(t0))
+		atomic.AddUint64(&b.ok, 1)
+		atomic.AddUint64(&b.bytes, uint64(2*b.size))
+	}
+}
+
+// Count error 'err' unless it is due to the end of the run
+func (b *bench) fail(ctx context.Context, err error) {
+	// a socket deadline from 'ctx' can fire before ctx itself is done
+	if dl, ok := ctx.Deadline(); ctx.Err() != nil || (ok && !time.Now().Before(dl)) {
+		return
+	}
+
+	atomic.AddUint64(&b.failed, 1)
+
+	s := err.Error()
+	if i := strings.LastIndex(s, ": "); i >= 0 {
+		s = s[i+2:]
+	}
+
+	b.mu.Lock()
+	b.errs[s]++
+	b.mu.Unlock()
+
+	// don't spin on a proxy that refuses us
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Open a tunnel to b.dest via the proxy
+func (b *bench) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.tout)
+	defer cancel()
+
+	d := &net.Dialer{}
+	if b.proto == "socks" {
+		s, err := newSocks5Client("socks5://"+b.target, d)
+		if err != nil {
+			return nil, err
+		}
+		return s.DialContext(ctx, "tcp", b.dest)
+	}
+
+	c, err := d.DialContext(ctx, "tcp", b.target)
+	if err != nil {
+		return nil, err
+	}
+
+	dl, _ := ctx.Deadline()
+	c.SetDeadline(dl)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", b.dest, b.dest)
+
+	// The tunnel starts right after the response; the echo server
+	// sends nothing until we do, so the reader can't buffer any of it.
+	// A CONNECT response has no body.
+	tp := textproto.NewReader(bufio.NewReaderSize(c, 1024))
+	line, err := tp.ReadLine()
+	if err == nil {
+		_, err = tp.ReadMIMEHeader()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if f := strings.Fields(line); len(f) < 2 || f[1] != "200" {
+		c.Close()
+		return nil, fmt.Errorf("CONNECT: %s", line)
+	}
+
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Write 'out' to 'c' and read it back into 'in'
+func (b *bench) echo(c net.Conn, out, in []byte) error {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := c.Write(out)
+		errch <- err
+	}()
+
+	if _, err := io.ReadFull(c, in); err != nil {
+		return err
+	}
+	return <-errch
+}
+
+func (b *bench) report(w io.Writer, d time.Duration) {
+	secs := d.Seconds()
+
+	fmt.Fprintf(w, "\n%d tunnels ok, %d failed in %.1fs: %.1f tunnels/s, %.2f MB/s\n",
+		b.ok, b.failed, secs, float64(b.ok)/secs, float64(b.bytes)/secs/(1<<20))
+
+	pct := func(name string, v []time.Duration) {
+		if len(v) == 0 {
+			return
+		}
+		sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+		at := func(p float64) time.Duration {
+			return v[int(p*float64(len(v)-1))]
+		}
+		fmt.Fprintf(w, "%-8s p50 %-10s p90 %-10s p99 %-10s max %s\n", name,
+			at(.50), at(.90), at(.99), v[len(v)-1])
+	}
+	pct("setup", b.setup)
+	pct("total", b.rtt)
+
+	if len(b.errs) > 0 {
+		fmt.Fprintf(w, "errors:\n")
+		for s, n := range b.errs {
+			fmt.Fprintf(w, "  %6d %s\n", n, s)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,204 @@
+// blocklist.go -- large domain blocklists
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A blocklist denies destination domains -- and their subdomains --
+// listed in one or more files. Lists of millions of names are common;
+// so we keep only a 64-bit hash of each name in a sorted array (8
+// bytes a name) behind a Bloom filter that answers most lookups of
+// names not on the list without touching the array. A reload swaps in
+// a new set; a nil blocklist blocks nothing.
+type blocklist struct {
+	v atomic.Value // *domainSet
+
+	mu    sync.Mutex // serializes loads
+	files []string
+}
+
+// An immutable set of domain name hashes
+type domainSet struct {
+	hashes []uint64 // sorted, unique
+	bloom  []uint64 // bit array
+	nbits  uint64
+}
+
+// Bloom filter parameters: bits per name and probes per lookup; about
+// 1% false positives (which then cost a binary search).
+const (
+	bloomBitsPerName = 10
+	bloomProbes      = 7
+)
+
+// Make a blocklist from the files 'fv'; it is empty if there are none
+func newBlocklist(fv []string) (*blocklist, error) {
+	b := &blocklist{}
+	if err := b.Load(fv); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Read the files 'fv' and replace the set with their names
+func (b *blocklist) Load(fv []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var h []uint64
+	for _, fn := range fv {
+		var err error
+		if h, err = readBlocklist(fn, h); err != nil {
+			return err
+		}
+	}
+
+	b.v.Store(newDomainSet(h))
+	b.files = fv
+	return nil
+}
+
+// Read the files of the last Load again
+func (b *blocklist) Reload() error {
+	b.mu.Lock()
+	fv := b.files
+	b.mu.Unlock()
+	return b.Load(fv)
+}
+
+// Return true if 'fn' is one of the files of the list
+func (b *blocklist) has(fn string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.files {
+		if f == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the number of names on the list
+func (b *blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.v.Load().(*domainSet).hashes)
+}
+
+// Return true if 'host' or one of its parent domains is on the list
+func (b *blocklist) Blocked(host string) bool {
+	if b == nil {
+		return false
+	}
+
+	s := b.v.Load().(*domainSet)
+	return len(lookupSuffix(host, func(h string) (string, bool) {
+		return h, s.has(nameHash(h))
+	})) > 0
+}
+
+// Append the hashes of the names in 'fn' to 'h'. Each line is a domain
+// name or a hosts(5) style "address name"; '#' starts a comment.
+func readBlocklist(fn string, h []uint64) ([]uint64, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("blocklist: %s", err)
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		s := sc.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+
+		v := strings.Fields(s)
+		if len(v) == 0 {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.ToLower(v[len(v)-1]), ".")
+		if len(name) > 0 {
+			h = append(h, nameHash(name))
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("blocklist: %s: %s", fn, err)
+	}
+	return h, nil
+}
+
+func newDomainSet(h []uint64) *domainSet {
+	sort.Slice(h, func(i, j int) bool { return h[i] < h[j] })
+
+	// dedup in place
+	n := 0
+	for i := range h {
+		if i == 0 || h[i] != h[n-1] {
+			h[n] = h[i]
+			n++
+		}
+	}
+	h = h[:n:n]
+
+	s := &domainSet{
+		hashes: h,
+		nbits:  uint64(n*bloomBitsPerName) | 63,
+	}
+	s.nbits++
+	s.bloom = make([]uint64, s.nbits/64)
+
+	for _, x := range h {
+		for i := uint64(0); i < bloomProbes; i++ {
+			bit := s.probe(x, i)
+			s.bloom[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return s
+}
+
+func (s *domainSet) has(x uint64) bool {
+	for i := uint64(0); i < bloomProbes; i++ {
+		bit := s.probe(x, i)
+		if s.bloom[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	i := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= x })
+	return i < len(s.hashes) && s.hashes[i] == x
+}
+
+// The i'th Bloom filter bit of hash 'x' (double hashing with its
+// halves)
+func (s *domainSet) probe(x, i uint64) uint64 {
+	return ((x & 0xffffffff) + i*(x>>32)) % s.nbits
+}
+
+// 64-bit FNV-1a hash of 's'; done inline so lookups don't allocate
+func nameHash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
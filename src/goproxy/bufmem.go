@@ -0,0 +1,134 @@
+// bufmem.go -- admission of connections: their number and buffer memory
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// The buffers of a connection. Each is of a fixed size; so is what a
+// connection needs at most, which it reserves when accepted.
+const (
+	relayBufSize     = 16384 // each direction of a tunnel
+	handshakeBufSize = 16384 // the first read of a client
+
+	// SOCKS, Trojan and VLESS: the first read and the tunnel
+	socksConnMem = handshakeBufSize + 2*relayBufSize
+
+	// HTTP: the request head, the server's bufio reader and writer
+	// and a CONNECT tunnel
+	httpConnMem = httpMaxHeaderBytes + 2*4096 + 2*relayBufSize
+)
+
+// Admit 'conn' if it is within max_conns and 'n' bytes of buffer
+// memory can be reserved for it. Returns the connection to use, which
+// gives them back when closed; or the reason to drop it (-1 if none).
+func (c *control) Admit(conn net.Conn, n int64) (net.Conn, int) {
+	if c == nil {
+		return conn, -1
+	}
+
+	if o := atomic.AddInt64(&c.open, 1); c.maxConns > 0 && o > c.maxConns {
+		atomic.AddInt64(&c.open, -1)
+		return conn, dropMaxConns
+	}
+	if !c.mem.Get(n) {
+		atomic.AddInt64(&c.open, -1)
+		return conn, dropMemory
+	}
+	return &admitConn{halfConn: conn.(halfConn), c: c, n: n}, -1
+}
+
+// A memBudget bounds the buffer memory of all connections; new ones
+// are refused when it is used up rather than the process running out
+// of memory. A nil memBudget has no bound.
+type memBudget struct {
+	max     int64
+	used    int64
+	refused uint64
+}
+
+// Return a budget of 'max' bytes; nil if there is no bound
+func newMemBudget(max int64) *memBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &memBudget{max: max}
+}
+
+// Reserve 'n' bytes; return false if the budget can't cover them
+func (m *memBudget) Get(n int64) bool {
+	if m == nil {
+		return true
+	}
+	if atomic.AddInt64(&m.used, n) > m.max {
+		atomic.AddInt64(&m.used, -n)
+		atomic.AddUint64(&m.refused, 1)
+		return false
+	}
+	return true
+}
+
+// Release 'n' bytes reserved with Get
+func (m *memBudget) Put(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.used, -n)
+	}
+}
+
+// The buffer memory as described by GET /stats
+type memStats struct {
+	Max     int64  `json:"max"`
+	Used    int64  `json:"used"`
+	Refused uint64 `json:"refused"`
+}
+
+func (m *memBudget) Stats() *memStats {
+	if m == nil {
+		return nil
+	}
+	return &memStats{
+		Max:     m.max,
+		Used:    atomic.LoadInt64(&m.used),
+		Refused: atomic.LoadUint64(&m.refused),
+	}
+}
+
+// Why Admit refused a connection, for the logs
+var admitNames = map[int]string{
+	dropMemory:   "buffer memory is used up",
+	dropMaxConns: "max_conns connections are open",
+}
+
+// An admitted connection; it holds its place in max_conns and its
+// buffer memory until closed
+type admitConn struct {
+	halfConn
+	c      *control
+	n      int64
+	closed int32
+}
+
+func (a *admitConn) Close() error {
+	if atomic.CompareAndSwapInt32(&a.closed, 0, 1) {
+		a.c.mem.Put(a.n)
+		atomic.AddInt64(&a.c.open, -1)
+	}
+	return a.halfConn.Close()
+}
+
+func (c *admitConn) CloseRead() error {
+	if r, ok := c.halfConn.(interface{ CloseRead() error }); ok {
+		return r.CloseRead()
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,239 @@
+// cassette.go -- record HTTP traffic to disk and replay it later
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A cassette records the request/response pairs of an HTTP listener
+// into a directory, one file per request; or replays them from there
+// without touching the network, for hermetic integration tests behind
+// the proxy. Requests match on their method, URL and body. CONNECT
+// tunnels are opaque: they are passed through when recording and
+// refused when replaying.
+type cassette struct {
+	rt      http.RoundTripper
+	dir     string
+	replay  bool
+	maxBody int64
+	log     *L.Logger
+}
+
+// One recorded request and its response
+type tape struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Recorded time.Time   `json:"recorded"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	Trailer  http.Header `json:"trailer,omitempty"`
+}
+
+// Cassette modes
+const (
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+)
+
+// Record responses up to this size unless told otherwise
+const defaultCassetteBody = 16 * 1024 * 1024
+
+// Return a round tripper that records the requests made via 'rt' or
+// replays them as 'c' says; 'rt' itself if 'c' is off.
+func newCassette(c *CassetteConf, rt http.RoundTripper, log *L.Logger) (http.RoundTripper, error) {
+	switch c.Mode {
+	case "":
+		return rt, nil
+	case cassetteRecord, cassetteReplay:
+	default:
+		return nil, fmt.Errorf("cassette: unknown mode %q", c.Mode)
+	}
+
+	if len(c.Dir) == 0 {
+		return nil, fmt.Errorf("cassette: no dir")
+	}
+
+	k := &cassette{
+		rt:      rt,
+		dir:     c.Dir,
+		replay:  c.Mode == cassetteReplay,
+		maxBody: int64(c.MaxBody),
+		log:     log,
+	}
+	if k.maxBody <= 0 {
+		k.maxBody = defaultCassetteBody
+	}
+
+	if k.replay {
+		if fi, err := os.Stat(k.dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("cassette: %s is not a directory", k.dir)
+		}
+	} else if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return nil, fmt.Errorf("cassette: %s", err)
+	}
+	return k, nil
+}
+
+// Return true if 'rt' replays a cassette
+func replaying(rt http.RoundTripper) bool {
+	k, ok := rt.(*cassette)
+	return ok && k.replay
+}
+
+func (k *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is part of the key; read it so we can hash it and still
+	// send it
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	fn := k.file(req, body)
+	if k.replay {
+		return k.play(req, fn)
+	}
+
+	res, err := k.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ContentLength > k.maxBody {
+		k.log.Debug("cassette: not recording %s %s: %d byte response", req.Method,
+			req.URL.String(), res.ContentLength)
+		return res, nil
+	}
+
+	res.Body = &tapeRecorder{
+		ReadCloser: res.Body,
+		k:          k,
+		fn:         fn,
+		res:        res,
+		t: tape{
+			Method:   req.Method,
+			URL:      req.URL.String(),
+			Recorded: time.Now().UTC(),
+			Status:   res.StatusCode,
+			Header:   cloneHeader(res.Header),
+		},
+	}
+	return res, nil
+}
+
+// Return the file that holds the recording of 'req'
+func (k *cassette) file(req *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.String())
+	h.Write(body)
+	return filepath.Join(k.dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// Replay the recording of 'req' in 'fn'
+func (k *cassette) play(req *http.Request, fn string) (*http.Response, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cassette: no recording of %s %s", req.Method, req.URL.String())
+	}
+
+	var t tape
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("cassette: %s: %s", fn, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.Status, http.StatusText(t.Status)),
+		StatusCode:    t.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        t.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(t.Body)),
+		ContentLength: int64(len(t.Body)),
+		Trailer:       t.Trailer,
+		Request:       req,
+	}, nil
+}
+
+// Save 't' to 'fn'; via a temporary file so a replay never sees half
+// of it
+func (k *cassette) save(fn string, t *tape) {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err == nil {
+		tmp := fn + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, fn)
+		}
+	}
+
+	if err != nil {
+		k.log.Warn("cassette: can't record %s %s: %s", t.Method, t.URL, err)
+		return
+	}
+	k.log.Debug("cassette: recorded %s %s", t.Method, t.URL)
+}
+
+// A response body that keeps a copy of what is read; the recording is
+// saved when the whole body has been read.
+type tapeRecorder struct {
+	io.ReadCloser
+	k   *cassette
+	fn  string
+	res *http.Response
+	t   tape
+	buf bytes.Buffer
+
+	// too large or already saved
+	done bool
+}
+
+func (r *tapeRecorder) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if r.done {
+		return n, err
+	}
+
+	r.buf.Write(b[:n])
+	if int64(r.buf.Len()) > r.k.maxBody {
+		r.k.log.Debug("cassette: not recording %s %s: response too large", r.t.Method, r.t.URL)
+		r.done = true
+		r.buf = bytes.Buffer{}
+		return n, err
+	}
+
+	if err == io.EOF {
+		// the trailers are only known at the end of the body
+		r.done = true
+		r.t.Body = r.buf.Bytes()
+		r.t.Trailer = cloneHeader(r.res.Trailer)
+		r.k.save(r.fn, &r.t)
+	}
+	return n, err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
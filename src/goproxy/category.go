@@ -0,0 +1,234 @@
+// category.go -- domain categorization for destination policies
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CategoryDB maps a domain name to a category such as "gambling" or
+// "malware". Lookup returns an empty string for uncategorized names.
+type CategoryDB interface {
+	Lookup(host string) string
+}
+
+// Make a category DB from the config; returns nil if none is
+// configured.
+func NewCategoryDB(cfg *CategoryConf) (CategoryDB, error) {
+	switch {
+	case len(cfg.File) > 0 && len(cfg.URL) > 0:
+		return nil, fmt.Errorf("categories: only one of file or url can be set")
+
+	case len(cfg.File) > 0:
+		return newFileCategoryDB(cfg.File)
+
+	case len(cfg.URL) > 0:
+		return newHTTPCategoryDB(cfg.URL, time.Duration(cfg.CacheTTL))
+	}
+	return nil, nil
+}
+
+// Return the category of 'host' or any of its parent domains
+func lookupSuffix(host string, fn func(string) (string, bool)) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for len(host) > 0 {
+		if c, ok := fn(host); ok {
+			return c
+		}
+
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return ""
+}
+
+// Return the category of 'host' if it is one of 'deny'
+func categoryDenied(db CategoryDB, deny []string, host string) string {
+	if db == nil || len(deny) == 0 {
+		return ""
+	}
+
+	c := db.Lookup(host)
+	if len(c) == 0 {
+		return ""
+	}
+
+	for _, d := range deny {
+		if strings.EqualFold(d, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// A category DB read from a local file; each line is "domain category".
+// Load re-reads the file.
+type fileCategoryDB struct {
+	file string
+
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+func newFileCategoryDB(fn string) (*fileCategoryDB, error) {
+	db := &fileCategoryDB{file: fn}
+	if err := db.Load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Read the file and replace the categories with its own
+func (db *fileCategoryDB) Load() error {
+	m, err := readCategories(db.file)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.m = m
+	db.mu.Unlock()
+	return nil
+}
+
+func readCategories(fn string) (map[string]string, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("categories: %s", err)
+	}
+	defer fd.Close()
+
+	m := make(map[string]string)
+	sc := bufio.NewScanner(fd)
+	for ln := 1; sc.Scan(); ln++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		v := strings.Fields(s)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("categories: %s:%d: expected 'domain category'", fn, ln)
+		}
+		m[strings.ToLower(v[0])] = strings.ToLower(v[1])
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("categories: %s: %s", fn, err)
+	}
+	return m, nil
+}
+
+func (db *fileCategoryDB) Lookup(host string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return lookupSuffix(host, func(h string) (string, bool) {
+		c, ok := db.m[h]
+		return c, ok
+	})
+}
+
+// A category DB backed by an HTTP lookup service. The service is
+// queried as GET url?domain=NAME and returns the category as the
+// response body. Answers are cached for 'ttl'.
+type httpCategoryDB struct {
+	url string
+	ttl time.Duration
+	clt *http.Client
+
+	sync.Mutex
+	cache map[string]catEntry
+}
+
+const maxCategoryCache = 65536
+
+type catEntry struct {
+	cat string
+	exp time.Time
+}
+
+func newHTTPCategoryDB(u string, ttl time.Duration) (*httpCategoryDB, error) {
+	if _, err := url.Parse(u); err != nil {
+		return nil, fmt.Errorf("categories: %s", err)
+	}
+
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	db := &httpCategoryDB{
+		url:   u,
+		ttl:   ttl,
+		clt:   &http.Client{Timeout: 3 * time.Second},
+		cache: make(map[string]catEntry),
+	}
+	return db, nil
+}
+
+func (db *httpCategoryDB) Lookup(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	now := time.Now()
+
+	db.Lock()
+	e, ok := db.cache[host]
+	db.Unlock()
+	if ok && now.Before(e.exp) {
+		return e.cat
+	}
+
+	c, err := db.query(host)
+	if err != nil {
+		// don't cache failures; the next lookup will retry
+		return ""
+	}
+
+	db.Lock()
+	// crude bound on the cache size; it refills on demand
+	if len(db.cache) >= maxCategoryCache {
+		db.cache = make(map[string]catEntry)
+	}
+	db.cache[host] = catEntry{cat: c, exp: now.Add(db.ttl)}
+	db.Unlock()
+	return c
+}
+
+func (db *httpCategoryDB) query(host string) (string, error) {
+	res, err := db.clt.Get(db.url + "?domain=" + url.QueryEscape(host))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("categories: %s: %s", db.url, res.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSpace(string(b))), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,109 @@
+// chaos.go -- fault injection for testing clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// chaos injects faults into a listener's traffic so teams can see how
+// their clients cope with a bad network: it drops a percentage of new
+// connections, delays requests and tunnels before we connect to the
+// destination, and truncates a percentage of HTTP responses. It is
+// meant for test environments only. A nil chaos injects nothing.
+type chaos struct {
+	cfg ChaosConf
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// Return the fault injector for 'c'; nil if it injects nothing
+func newChaos(c *ChaosConf) *chaos {
+	if c.Drop <= 0 && c.Latency <= 0 && c.Jitter <= 0 && c.Truncate <= 0 {
+		return nil
+	}
+
+	return &chaos{
+		cfg: *c,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (c *chaos) String() string {
+	return fmt.Sprintf("drop %d%%, latency %s+%s, truncate %d%%", c.cfg.Drop,
+		time.Duration(c.cfg.Latency), time.Duration(c.cfg.Jitter), c.cfg.Truncate)
+}
+
+// Return true with probability 'pct' percent
+func (c *chaos) chance(pct int) bool {
+	if pct <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rnd.Intn(100) < pct
+}
+
+// Return a random number in [0, n)
+func (c *chaos) int63n(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rnd.Int63n(n)
+}
+
+// Return true if a new connection must be dropped
+func (c *chaos) Drop() bool {
+	return c != nil && c.chance(c.cfg.Drop)
+}
+
+// Wait for the configured latency plus a random jitter; return early
+// if 'ctx' is done.
+func (c *chaos) Delay(ctx context.Context) {
+	if c == nil {
+		return
+	}
+
+	d := time.Duration(c.cfg.Latency)
+	if j := int64(c.cfg.Jitter); j > 0 {
+		d += time.Duration(c.int63n(j))
+	}
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+	}
+}
+
+// Return the number of bytes after which a response body of length
+// 'n' (-1 if unknown) must be cut off; false if it is sent whole.
+func (c *chaos) Truncate(n int64) (int64, bool) {
+	if c == nil || !c.chance(c.cfg.Truncate) {
+		return 0, false
+	}
+
+	// somewhere in the body; in the first 64k if we don't know its
+	// length
+	if n <= 0 {
+		n = 64 * 1024
+	}
+	return c.int63n(n), true
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
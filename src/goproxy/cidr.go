@@ -0,0 +1,137 @@
+// cidr.go -- a set of IP networks for large ACLs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+)
+
+// A cidrSet is a set of IPv4 and IPv6 networks kept in binary tries --
+// one per address family -- so a lookup takes at most 32 (or 128)
+// steps no matter how many networks there are. A cidrSet is not
+// modified once built; it is safe for concurrent lookups.
+type cidrSet struct {
+	v4, v6 cidrTrie
+	n      int
+}
+
+// A binary trie of network prefixes; node 0 is the root. A node that
+// ends a prefix covers every address below it, so nothing is kept
+// below it.
+type cidrTrie struct {
+	nodes []cidrNode
+}
+
+type cidrNode struct {
+	child [2]uint32 // 0 is none; the root is never a child
+	end   uint32    // 1 + the index of the network that ends here; 0 if none
+}
+
+// Make a new set of the networks in 'v'
+func newCIDRSet(v []subnet) *cidrSet {
+	s := &cidrSet{}
+	for i := range v {
+		s.Add(&v[i].IPNet)
+	}
+	return s
+}
+
+// Add the network 'n' to the set; it is the set's network number
+// Len() from here on, even if it isn't added.
+func (s *cidrSet) Add(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	switch {
+	case bits == 32 && n.IP.To4() != nil:
+		s.v4.add(n.IP.To4(), ones, uint32(s.n+1))
+	case bits == 128:
+		s.v6.add(n.IP.To16(), ones, uint32(s.n+1))
+	}
+	s.n++
+}
+
+// Return true if 'ip' is in one of the networks of the set
+func (s *cidrSet) Contains(ip net.IP) bool {
+	return s.Match(ip) >= 0
+}
+
+// Return the number of the network that has 'ip' -- the shortest prefix
+// of those that do -- or -1 if none does
+func (s *cidrSet) Match(ip net.IP) int {
+	if a := ip.To4(); a != nil {
+		return s.v4.match(a)
+	}
+	if a := ip.To16(); a != nil {
+		return s.v6.match(a)
+	}
+	return -1
+}
+
+// Return the number of networks added to the set, including those
+// that weren't valid
+func (s *cidrSet) Len() int {
+	return s.n
+}
+
+func (t *cidrTrie) add(ip net.IP, ones int, end uint32) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, cidrNode{})
+	}
+
+	var n uint32
+	for i := 0; i < ones; i++ {
+		if t.nodes[n].end > 0 {
+			// a shorter prefix already covers this one
+			return
+		}
+
+		b := ipBit(ip, i)
+		c := t.nodes[n].child[b]
+		if c == 0 {
+			c = uint32(len(t.nodes))
+			t.nodes = append(t.nodes, cidrNode{})
+			t.nodes[n].child[b] = c
+		}
+		n = c
+	}
+
+	// Longer prefixes below this one are covered by it; they are left
+	// unreachable rather than compacted. The same prefix again is
+	// covered by the first.
+	if t.nodes[n].end == 0 {
+		t.nodes[n].end = end
+	}
+	t.nodes[n].child = [2]uint32{}
+}
+
+func (t *cidrTrie) match(ip net.IP) int {
+	if len(t.nodes) == 0 {
+		return -1
+	}
+
+	var n uint32
+	for i := 0; ; i++ {
+		x := &t.nodes[n]
+		if x.end > 0 {
+			return int(x.end) - 1
+		}
+		if i == len(ip)*8 {
+			return -1
+		}
+		if n = x.child[ipBit(ip, i)]; n == 0 {
+			return -1
+		}
+	}
+}
+
+// Return bit 'i' of 'ip' counting from the most significant bit
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
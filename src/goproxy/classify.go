@@ -0,0 +1,71 @@
+// classify.go -- classify tunneled traffic by its first bytes
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Protocol classes of tunneled traffic
+const (
+	protoTLS        = "tls"
+	protoSSH        = "ssh"
+	protoHTTP       = "http"
+	protoBitTorrent = "bittorrent"
+	protoUnknown    = "unknown"
+)
+
+var protoClasses = []string{protoTLS, protoSSH, protoHTTP, protoBitTorrent, protoUnknown}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "), []byte("PRI * HTTP/2"),
+}
+
+var btHandshake = []byte("\x13BitTorrent protocol")
+
+// Return the protocol class of a tunnel whose client first sent 'b'.
+// Protocols where the server speaks first (SMTP, FTP, ...) look like
+// whatever the client answers with; usually "unknown".
+func classify(b []byte) string {
+	switch {
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 3:
+		return protoTLS
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return protoSSH
+	case bytes.HasPrefix(b, btHandshake):
+		return protoBitTorrent
+	}
+
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return protoHTTP
+		}
+	}
+	return protoUnknown
+}
+
+// Return true if 'class' is one of 'deny'
+func protoDenied(deny []string, class string) bool {
+	for _, d := range deny {
+		if strings.EqualFold(d, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if 's' names a protocol class
+func isProtoClass(s string) bool {
+	return protoDenied(protoClasses, s)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
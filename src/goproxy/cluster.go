@@ -0,0 +1,441 @@
+// cluster.go -- rate limits, bans and quotas shared by a fleet via Redis
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Defaults of the shared store
+const (
+	defaultClusterPrefix  = "goproxy:"
+	defaultClusterTimeout = 250 * time.Millisecond
+	defaultClusterSync    = 5 * time.Second
+
+	// quota counters outlive their period by this much
+	clusterQuotaTTL = 40 * 24 * time.Hour
+)
+
+// A clusterStore keeps the state that must hold across a fleet of
+// proxies behind a load balancer in Redis: the per-IP rate limits of
+// the listeners, the bans and the quota usage. Rate limits are checked
+// as each connection comes in; bans and quota usage are synced every
+// interval. When Redis can't be reached each proxy falls back on what
+// it knows by itself, and catches up once it is back. A nil
+// clusterStore shares nothing.
+type clusterStore struct {
+	rc     *redisClient
+	prefix string
+	sync   time.Duration
+	log    *L.Logger
+
+	ctl *control
+	qm  *quotaMeter
+
+	errors uint64 // atomic
+	mu     sync.Mutex
+	last   time.Time // of the last sync that succeeded
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// Return the store in 'c'; nil if there is none
+func newClusterStore(c *ClusterConf, log *L.Logger) *clusterStore {
+	if len(c.Redis) == 0 {
+		return nil
+	}
+
+	timeout := time.Duration(c.Timeout)
+	if timeout <= 0 {
+		timeout = defaultClusterTimeout
+	}
+
+	s := &clusterStore{
+		rc:     newRedisClient(c.Redis, c.Password, c.DB, timeout),
+		prefix: c.Prefix,
+		sync:   time.Duration(c.Sync),
+		log:    log.New("cluster", 0),
+		stop:   make(chan bool),
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = defaultClusterPrefix
+	}
+	if s.sync <= 0 {
+		s.sync = defaultClusterSync
+	}
+	return s
+}
+
+// Sync the bans of 'ctl' and the usage of the quotas of 'qm'
+func (s *clusterStore) Share(ctl *control, qm *quotaMeter) {
+	if s == nil {
+		return
+	}
+
+	s.ctl, s.qm = ctl, qm
+	ctl.cluster = s
+	if qm != nil {
+		qm.cluster = s
+	}
+}
+
+func (s *clusterStore) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		t := time.NewTicker(s.sync)
+		defer t.Stop()
+		for {
+			s.Sync()
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Stop syncing; the last sync pushes out the usage counted since
+func (s *clusterStore) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	s.Sync()
+	s.rc.Close()
+}
+
+// Push out our bans and quota usage and take in those of the others
+func (s *clusterStore) Sync() {
+	e1 := s.ctl.syncBans(s)
+	e2 := s.qm.sync(s)
+	if err := firstErr(e1, e2); err != nil {
+		s.failed(err)
+		return
+	}
+
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+}
+
+func firstErr(v ...error) error {
+	for _, err := range v {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count and log 'err'; a Redis that is down is logged once a sync
+func (s *clusterStore) failed(err error) {
+	atomic.AddUint64(&s.errors, 1)
+	s.log.Warn("%s; using local state", err)
+}
+
+// Return true if the client 'ip' of 'listener' has made more than
+// 'rate' connections in this second across the fleet; false and the
+// error if Redis can't tell.
+func (s *clusterStore) RateLimit(listener, ip string, rate int) (bool, error) {
+	k := fmt.Sprintf("%srl:%s:%s:%d", s.prefix, listener, ip, time.Now().Unix())
+	v, err := s.rc.Pipeline([][]string{
+		{"INCR", k},
+		{"EXPIRE", k, "2"},
+	})
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return false, err
+	}
+
+	n, ok := v[0].(int64)
+	if !ok {
+		return false, errRedisProto
+	}
+	return n > int64(rate), nil
+}
+
+// Publish the ban of 'ip' until 'until' (zero is forever)
+func (s *clusterStore) Ban(ip string, until time.Time) error {
+	var t int64
+	if !until.IsZero() {
+		t = until.Unix()
+	}
+	_, err := s.rc.Do("HSET", s.prefix+"bans", ip, strconv.FormatInt(t, 10))
+	return err
+}
+
+// Lift the ban of 'ip' across the fleet
+func (s *clusterStore) Unban(ip string) error {
+	_, err := s.rc.Do("HDEL", s.prefix+"bans", ip)
+	return err
+}
+
+// Return the bans of the fleet; lapsed ones are removed
+func (s *clusterStore) Bans() (map[string]time.Time, error) {
+	v, err := s.rc.Do("HGETALL", s.prefix+"bans")
+	if err != nil {
+		return nil, err
+	}
+	a, ok := v.([]interface{})
+	if !ok || len(a)%2 != 0 {
+		return nil, errRedisProto
+	}
+
+	now := time.Now()
+	m := make(map[string]time.Time)
+	var lapsed []string
+	for i := 0; i < len(a); i += 2 {
+		ip, _ := a[i].(string)
+		ts, _ := a[i+1].(string)
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var t time.Time
+		if n > 0 {
+			t = time.Unix(n, 0)
+		}
+		if !t.IsZero() && now.After(t) {
+			lapsed = append(lapsed, ip)
+			continue
+		}
+		m[ip] = t
+	}
+
+	if len(lapsed) > 0 {
+		args := append([]string{"HDEL", s.prefix + "bans"}, lapsed...)
+		s.rc.Do(args...)
+	}
+	return m, nil
+}
+
+// Add 'n' bytes -- which may be 0 -- to the usage of quota 'q' in its
+// current period and return the usage of the fleet
+func (s *clusterStore) AddQuota(q *quota, n int64) (int64, error) {
+	k := s.quotaKey(q)
+	v, err := s.rc.Pipeline([][]string{
+		{"INCRBY", k, strconv.FormatInt(n, 10)},
+		{"EXPIRE", k, strconv.Itoa(int(clusterQuotaTTL / time.Second))},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	used, ok := v[0].(int64)
+	if !ok {
+		return 0, errRedisProto
+	}
+	return used, nil
+}
+
+// Return true if we are the first of the fleet to raise the alert at
+// 'pct' percent of 'q' in its current period
+func (s *clusterStore) FirstAlert(q *quota, pct int) bool {
+	k := fmt.Sprintf("%s:alert:%d", s.quotaKey(q), pct)
+	v, err := s.rc.Do("SET", k, "1", "NX", "EX", strconv.Itoa(int(clusterQuotaTTL/time.Second)))
+
+	// if Redis can't tell, better an alert twice than never
+	return err != nil || v != nil
+}
+
+func (s *clusterStore) quotaKey(q *quota) string {
+	return fmt.Sprintf("%squota:%s:%s:%s", s.prefix, q.Kind, q.Name, q.Start.Format("2006-01-02"))
+}
+
+// Return the backend's answer about 'k' that a proxy of the fleet
+// cached; false if there is none or Redis can't tell
+func (s *clusterStore) Session(k authKey) (authResult, bool) {
+	v, err := s.rc.Pipeline([][]string{
+		{"GET", s.sessionKey(k)},
+		{"PTTL", s.sessionKey(k)},
+	})
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return authResult{}, false
+	}
+
+	ans, _ := v[0].(string)
+	ttl, _ := v[1].(int64)
+	if len(ans) == 0 || ttl <= 0 {
+		return authResult{}, false
+	}
+	return authResult{ans == "1", time.Now().Add(time.Duration(ttl) * time.Millisecond)}, true
+}
+
+// Cache the backend's answer 'r' about 'k' for the fleet
+func (s *clusterStore) SetSession(k authKey, r authResult) {
+	ans := "0"
+	if r.ok {
+		ans = "1"
+	}
+
+	ms := time.Until(r.exp).Milliseconds()
+	if ms <= 0 {
+		return
+	}
+	if _, err := s.rc.Do("SET", s.sessionKey(k), ans, "PX", strconv.FormatInt(ms, 10)); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+}
+
+// The credentials are hashed again: Redis sees neither user nor password
+func (s *clusterStore) sessionKey(k authKey) string {
+	h := sha256.New()
+	h.Write([]byte(k.ip))
+	h.Write([]byte{0})
+	h.Write([]byte(k.user))
+	h.Write([]byte{0})
+	h.Write(k.pass[:])
+	return s.prefix + "auth:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Return the client that used TOTP code 'k' ("user:code") and until
+// when; false if none has or Redis can't tell
+func (s *clusterStore) Code(k string) (string, time.Time, bool) {
+	v, err := s.rc.Pipeline([][]string{
+		{"GET", s.codeKey(k)},
+		{"PTTL", s.codeKey(k)},
+	})
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return "", time.Time{}, false
+	}
+
+	ip, _ := v[0].(string)
+	ttl, _ := v[1].(int64)
+	if len(ip) == 0 || ttl <= 0 {
+		return "", time.Time{}, false
+	}
+	return ip, time.Now().Add(time.Duration(ttl) * time.Millisecond), true
+}
+
+// Claim TOTP code 'k' for client 'ip' until 'exp'; return the client
+// that has it, which is 'ip' unless another got there first
+func (s *clusterStore) ClaimCode(k, ip string, exp time.Time) (string, error) {
+	ms := strconv.FormatInt(max(time.Until(exp).Milliseconds(), 1), 10)
+	v, err := s.rc.Pipeline([][]string{
+		{"SET", s.codeKey(k), ip, "NX", "PX", ms},
+		{"GET", s.codeKey(k)},
+	})
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return "", err
+	}
+
+	who, _ := v[1].(string)
+	if len(who) == 0 {
+		return ip, nil
+	}
+	return who, nil
+}
+
+func (s *clusterStore) codeKey(k string) string {
+	d := sha256.Sum256([]byte(k))
+	return s.prefix + "totp:" + hex.EncodeToString(d[:])
+}
+
+// The shared store as described by GET /stats
+type clusterStats struct {
+	Redis    string    `json:"redis"`
+	LastSync time.Time `json:"last_sync"`
+	Errors   uint64    `json:"errors"`
+}
+
+func (s *clusterStore) Stats() *clusterStats {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &clusterStats{
+		Redis:    s.rc.addr,
+		LastSync: s.last,
+		Errors:   atomic.LoadUint64(&s.errors),
+	}
+}
+
+// Publish our new bans and unbans and take in the bans of the fleet;
+// they replace ours. Those made while Redis was away are published
+// when it is back.
+func (c *control) syncBans(s *clusterStore) error {
+	if c == nil {
+		return nil
+	}
+
+	c.bmu.Lock()
+	pend := make(map[string]time.Time, len(c.unpub))
+	for k, t := range c.unpub {
+		pend[k] = t
+	}
+	lift := make([]string, 0, len(c.unlift))
+	for k := range c.unlift {
+		lift = append(lift, k)
+	}
+	c.bmu.Unlock()
+
+	for _, k := range lift {
+		if err := s.Unban(k); err != nil {
+			return err
+		}
+	}
+	for k, t := range pend {
+		if err := s.Ban(k, t); err != nil {
+			return err
+		}
+	}
+
+	m, err := s.Bans()
+	if err != nil {
+		return err
+	}
+
+	var kill []net.IP
+	c.bmu.Lock()
+	for k := range pend {
+		delete(c.unpub, k)
+	}
+	for _, k := range lift {
+		delete(c.unlift, k)
+	}
+	for k, t := range c.unpub {
+		m[k] = t
+	}
+	for k := range c.unlift {
+		delete(m, k)
+	}
+	for k := range m {
+		if _, ok := c.bans[k]; !ok {
+			kill = append(kill, net.ParseIP(k))
+		}
+	}
+	c.bans = m
+	atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+	c.bmu.Unlock()
+
+	// the connections of those banned elsewhere go too
+	for _, ip := range kill {
+		c.kill(ip)
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,489 @@
+// control.go -- runtime control: active connections, stats and bans
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// control tracks the active connections of all listeners so they can
+// be listed and killed via the admin API; and the client IPs banned at
+// runtime. A nil control tracks nothing and bans no one.
+//
+// Connections are kept in shards, each with its own lock, so that
+// those of tens of thousands of clients coming and going don't wait
+// on one another.
+type control struct {
+	start time.Time
+	flows *flowExporter  // export of closed connections; may be nil
+	ovl   *overloadGuard // may be nil
+	quota *quotaMeter    // may be nil
+	auth  *authenticator // may be nil
+	mem   *memBudget     // may be nil
+	trace *tracer        // clients whose connections are traced
+
+	cluster *clusterStore // bans shared with the fleet; may be nil
+	gossip  *gossipNode   // bans passed to peers; may be nil
+
+	next   uint64 // atomic
+	total  uint64 // atomic
+	up     int64  // atomic
+	down   int64  // atomic
+	banned uint64 // atomic; connections refused due to a ban
+	open   int64  // atomic; connections admitted and not yet closed
+	shards [ctlShards]ctlShard
+
+	maxConns int64 // bound on open; 0 is none
+
+	mu  sync.Mutex
+	lis map[string]*acceptStats
+
+	bmu    sync.Mutex
+	nbans  int32                // atomic; len(bans)
+	bans   map[string]time.Time // IP -> expiry; zero is forever
+	unpub  map[string]time.Time // bans not yet shared with the fleet
+	unlift map[string]bool      // nor these unbans
+}
+
+// Number of connection shards; a power of 2
+const ctlShards = 64
+
+// A shard of the active connections: those whose id falls in it, and
+// the counts of the client IPs that hash to it.
+type ctlShard struct {
+	mu    sync.Mutex
+	conns map[uint64]*connInfo
+	perIP map[string]int // active connections of each client IP
+}
+
+// Return the shard of connection 'id'
+func (c *control) connShard(id uint64) *ctlShard {
+	return &c.shards[id&(ctlShards-1)]
+}
+
+// Return the shard of client IP 'ip' (FNV-1a)
+func (c *control) ipShard(ip string) *ctlShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(ip); i++ {
+		h ^= uint32(ip[i])
+		h *= 16777619
+	}
+	return &c.shards[h&(ctlShards-1)]
+}
+
+// An active connection as described by GET /conns
+type connInfo struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Dest     string    `json:"dest"`
+	Start    time.Time `json:"start"`
+
+	cancel context.CancelFunc
+}
+
+func newControl(flows *flowExporter, ovl *overloadGuard, quota *quotaMeter, auth *authenticator, mem *memBudget, maxConns int) *control {
+	c := &control{
+		start:  time.Now(),
+		flows:  flows,
+		ovl:    ovl,
+		quota:  quota,
+		auth:   auth,
+		mem:    mem,
+		trace:  newTracer(),
+		lis:    make(map[string]*acceptStats),
+		bans:   make(map[string]time.Time),
+		unpub:  make(map[string]time.Time),
+		unlift: make(map[string]bool),
+
+		maxConns: int64(maxConns),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.conns = make(map[uint64]*connInfo)
+		s.perIP = make(map[string]int)
+	}
+	return c
+}
+
+// Track a connection from 'client' -- logged in as 'user' if at all --
+// to 'dest' on 'listener'; 'cancel' ends it. Returns its id.
+func (c *control) Track(listener, client, user, dest string, cancel context.CancelFunc) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	id := atomic.AddUint64(&c.next, 1)
+	atomic.AddUint64(&c.total, 1)
+
+	s := c.connShard(id)
+	s.mu.Lock()
+	s.conns[id] = &connInfo{
+		ID:       id,
+		Listener: listener,
+		Client:   client,
+		User:     user,
+		Dest:     dest,
+		Start:    time.Now(),
+		cancel:   cancel,
+	}
+	s.mu.Unlock()
+
+	k := remoteIP(client).String()
+	s = c.ipShard(k)
+	s.mu.Lock()
+	s.perIP[k]++
+	s.mu.Unlock()
+	return id
+}
+
+// Connection 'id' ended after moving 'up' and 'down' bytes
+func (c *control) Done(id uint64, up, down int64) {
+	if c == nil {
+		return
+	}
+
+	atomic.AddInt64(&c.up, up)
+	atomic.AddInt64(&c.down, down)
+
+	s := c.connShard(id)
+	s.mu.Lock()
+	ci, ok := s.conns[id]
+	delete(s.conns, id)
+	s.mu.Unlock()
+
+	if !ok {
+		c.quota.Add("", "", up+down)
+		return
+	}
+
+	k := remoteIP(ci.Client).String()
+	s = c.ipShard(k)
+	s.mu.Lock()
+	if s.perIP[k]--; s.perIP[k] <= 0 {
+		delete(s.perIP, k)
+	}
+	s.mu.Unlock()
+
+	c.quota.Add(ci.Listener, ci.User, up+down)
+}
+
+// Tunnel 'id' closed as described by 'r'
+func (c *control) Closed(id uint64, r *closeRecord) {
+	if c == nil {
+		return
+	}
+
+	c.Done(id, r.up, r.down)
+	c.flows.Export(r)
+}
+
+// Kill connection 'id'; returns false if there is no such connection
+func (c *control) Kill(id uint64) bool {
+	s := c.connShard(id)
+	s.mu.Lock()
+	ci, ok := s.conns[id]
+	s.mu.Unlock()
+
+	if ok {
+		ci.cancel()
+	}
+	return ok
+}
+
+// Return true if 'ip' is banned
+func (c *control) Banned(ip net.IP) bool {
+	if c == nil || ip == nil || atomic.LoadInt32(&c.nbans) == 0 {
+		return false
+	}
+
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	k := ip.String()
+	t, ok := c.bans[k]
+	if ok && !t.IsZero() && time.Now().After(t) {
+		delete(c.bans, k)
+		atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+		return false
+	}
+	if ok {
+		atomic.AddUint64(&c.banned, 1)
+	}
+	return ok
+}
+
+// Return true if a new connection from 'ip' must be shed because we
+// are overloaded; clients with many connections are shed first.
+func (c *control) Shed(ip net.IP) bool {
+	if c == nil || c.ovl == nil || ip == nil {
+		return false
+	}
+
+	k := ip.String()
+	s := c.ipShard(k)
+	s.mu.Lock()
+	n := s.perIP[k]
+	s.mu.Unlock()
+
+	return c.ovl.Shed(n)
+}
+
+// Ban 'ip' for 'ttl' (0 is until restart) and kill its connections
+func (c *control) Ban(ip net.IP, ttl time.Duration) {
+	var until time.Time
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+	}
+
+	k := ip.String()
+	c.bmu.Lock()
+	c.bans[k] = until
+	delete(c.unlift, k)
+	atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+	c.bmu.Unlock()
+
+	if c.cluster != nil {
+		if err := c.cluster.Ban(k, until); err != nil {
+			c.cluster.failed(err)
+			c.bmu.Lock()
+			c.unpub[k] = until
+			c.bmu.Unlock()
+		}
+	}
+	c.gossip.Ban(k, until)
+	c.kill(ip)
+}
+
+// Ban 'ip' until 'until' as a peer told us to; unlike Ban it isn't
+// passed on. Returns false if it was banned that long already.
+func (c *control) peerBan(ip net.IP, until time.Time) bool {
+	k := ip.String()
+	c.bmu.Lock()
+	t, ok := c.bans[k]
+	if ok && t.Equal(until) {
+		c.bmu.Unlock()
+		return false
+	}
+	c.bans[k] = until
+	atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+	c.bmu.Unlock()
+
+	c.kill(ip)
+	return true
+}
+
+// Lift the ban on 'ip' as a peer told us to; returns false if there
+// was none
+func (c *control) peerUnban(ip net.IP) bool {
+	k := ip.String()
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	_, ok := c.bans[k]
+	delete(c.bans, k)
+	atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+	return ok
+}
+
+// Kill the connections of client 'ip'
+func (c *control) kill(ip net.IP) {
+	// every client of a transport comes from loopback; a ban of it
+	// isn't for them
+	skip := make(map[string]bool)
+	if ip.IsLoopback() {
+		c.mu.Lock()
+		for k, a := range c.lis {
+			skip[k] = a.transported
+		}
+		c.mu.Unlock()
+	}
+
+	var kill []context.CancelFunc
+	c.each(func(ci *connInfo) {
+		if remoteIP(ci.Client).Equal(ip) && !skip[ci.Listener] {
+			kill = append(kill, ci.cancel)
+		}
+	})
+
+	for _, fp := range kill {
+		fp()
+	}
+}
+
+func (c *control) Unban(ip net.IP) {
+	k := ip.String()
+	c.bmu.Lock()
+	delete(c.bans, k)
+	delete(c.unpub, k)
+	atomic.StoreInt32(&c.nbans, int32(len(c.bans)))
+	c.bmu.Unlock()
+
+	if c.cluster != nil {
+		if err := c.cluster.Unban(k); err != nil {
+			c.cluster.failed(err)
+			c.bmu.Lock()
+			c.unlift[k] = true
+			c.bmu.Unlock()
+		}
+	}
+	c.gossip.Unban(k)
+}
+
+// Call 'fp' for each active connection, a shard at a time; it must not
+// call back into the control.
+func (c *control) each(fp func(ci *connInfo)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for _, ci := range s.conns {
+			fp(ci)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// GET /conns lists the active connections; POST /conns/kill?id=N
+// kills one.
+func (c *control) ServeConns(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/conns/kill" {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if !c.Kill(id) {
+			http.Error(w, fmt.Sprintf("no connection %d", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]uint64{"killed": id})
+		return
+	}
+
+	var v []connInfo
+	c.each(func(ci *connInfo) {
+		v = append(v, *ci)
+	})
+	if v == nil {
+		v = []connInfo{}
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	writeJSON(w, v)
+}
+
+// Summary counters as described by GET /stats
+type ctlStats struct {
+	Uptime    string         `json:"uptime"`
+	Open      int64          `json:"open"`
+	Active    int            `json:"active"`
+	Total     uint64         `json:"total"`
+	BytesUp   int64          `json:"bytes_up"`
+	BytesDown int64          `json:"bytes_down"`
+	Bans      int            `json:"bans"`
+	Banned    uint64         `json:"banned"`
+	Listeners map[string]int `json:"listeners"`
+
+	Overload *overloadStats `json:"overload,omitempty"`
+	Auth     *authStats     `json:"auth,omitempty"`
+	Buffers  *memStats      `json:"buffers,omitempty"`
+	Cluster  *clusterStats  `json:"cluster,omitempty"`
+	Gossip   *gossipStats   `json:"gossip,omitempty"`
+}
+
+func (c *control) ServeStats(w http.ResponseWriter, r *http.Request) {
+	s := ctlStats{
+		Uptime:    (time.Since(c.start) / time.Second * time.Second).String(),
+		Open:      atomic.LoadInt64(&c.open),
+		Total:     atomic.LoadUint64(&c.total),
+		BytesUp:   atomic.LoadInt64(&c.up),
+		BytesDown: atomic.LoadInt64(&c.down),
+		Bans:      int(atomic.LoadInt32(&c.nbans)),
+		Banned:    atomic.LoadUint64(&c.banned),
+		Listeners: make(map[string]int),
+		Overload:  c.ovl.Stats(),
+		Auth:      c.auth.Stats(),
+		Buffers:   c.mem.Stats(),
+		Cluster:   c.cluster.Stats(),
+		Gossip:    c.gossip.Stats(),
+	}
+	c.each(func(ci *connInfo) {
+		s.Active++
+		s.Listeners[ci.Listener]++
+	})
+
+	writeJSON(w, &s)
+}
+
+// Admin API for bans:
+//
+//	GET    /bans                     banned IPs and their expiry
+//	POST   /bans?ip=A[&ttl=1h]       ban A (without ttl: until restart)
+//	DELETE /bans?ip=A                lift the ban on A
+func (c *control) ServeBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		m := make(map[string]string)
+		now := time.Now()
+
+		c.bmu.Lock()
+		for k, t := range c.bans {
+			switch {
+			case t.IsZero():
+				m[k] = "never"
+			case now.Before(t):
+				m[k] = t.UTC().Format(time.RFC3339)
+			}
+		}
+		c.bmu.Unlock()
+
+		writeJSON(w, m)
+		return
+	}
+
+	q := r.URL.Query()
+	ip := net.ParseIP(q.Get("ip"))
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("invalid IP %q", q.Get("ip")), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		ttl, err := parseDuration(q.Get("ttl"))
+		if err != nil || ttl < 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", q.Get("ttl")), http.StatusBadRequest)
+			return
+		}
+		c.Ban(ip, ttl)
+
+	case "DELETE":
+		c.Unban(ip)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]string{"ip": ip.String()})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,134 @@
+// control_test.go -- contention benchmark for the connection registry
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Every accept runs Banned, Shed, Track and later Done. Run with
+//
+//	go test -run XXX -bench ControlParallel -cpu 1,8
+//
+// "sharded" is the control as it is; "one-lock" is the registry it
+// replaced: every call serialized on a single mutex. The two are
+// about even at -cpu 1 (and on a single-core host at any -cpu);
+// the difference only shows at -cpu 8 with 8 real cores to run on.
+func BenchmarkControlParallel(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		c := newControl(nil, &overloadGuard{}, nil, nil, nil, 0)
+		benchAccept(b, c.Banned, c.Shed, c.Track, c.Done)
+	})
+
+	b.Run("one-lock", func(b *testing.B) {
+		c := newOneLock()
+		benchAccept(b, c.Banned, c.Shed, c.Track, c.Done)
+	})
+}
+
+func benchAccept(b *testing.B,
+	banned func(net.IP) bool,
+	shed func(net.IP) bool,
+	track func(listener, client, user, dest string, cancel context.CancelFunc) uint64,
+	done func(id uint64, up, down int64)) {
+
+	// a busy proxy: 50k connections already open
+	for i := 0; i < 50000; i++ {
+		track("l", fmt.Sprintf("10.%d.%d.1:1000", i/256%256, i%256), "", "d", func() {})
+	}
+
+	var n uint32
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&n, 1)
+		cl := fmt.Sprintf("172.16.%d.%d:555", i/256%256, i%256)
+		ip := remoteIP(cl)
+		for pb.Next() {
+			if banned(ip) || shed(ip) {
+				b.Fatalf("%s: unexpectedly refused", cl)
+			}
+			id := track("l", cl, "", "d", func() {})
+			done(id, 10, 10)
+		}
+	})
+}
+
+// oneLock is the registry before it was sharded
+type oneLock struct {
+	sync.Mutex
+
+	next  uint64
+	conns map[uint64]*connInfo
+	perIP map[string]int
+	bans  map[string]time.Time
+}
+
+func newOneLock() *oneLock {
+	return &oneLock{
+		conns: make(map[uint64]*connInfo),
+		perIP: make(map[string]int),
+		bans:  make(map[string]time.Time),
+	}
+}
+
+func (c *oneLock) Track(listener, client, user, dest string, cancel context.CancelFunc) uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	c.next++
+	c.conns[c.next] = &connInfo{
+		ID:       c.next,
+		Listener: listener,
+		Client:   client,
+		User:     user,
+		Dest:     dest,
+		Start:    time.Now(),
+		cancel:   cancel,
+	}
+	c.perIP[remoteIP(client).String()]++
+	return c.next
+}
+
+func (c *oneLock) Done(id uint64, up, down int64) {
+	c.Lock()
+	if ci, ok := c.conns[id]; ok {
+		k := remoteIP(ci.Client).String()
+		if c.perIP[k]--; c.perIP[k] <= 0 {
+			delete(c.perIP, k)
+		}
+		delete(c.conns, id)
+	}
+	c.Unlock()
+}
+
+func (c *oneLock) Banned(ip net.IP) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.bans[ip.String()]
+	return ok
+}
+
+func (c *oneLock) Shed(ip net.IP) bool {
+	c.Lock()
+	n := c.perIP[ip.String()]
+	c.Unlock()
+	return n < 0
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
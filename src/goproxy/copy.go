@@ -10,26 +10,91 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// returned by Copy() when either direction exceeds its byte limit
+var errSizeLimit = errors.New("size limit exceeded")
+
+// returned by Copy() when either side is idle for too long
+var errIdleTimeout = errors.New("idle timeout")
+
+// returned by Copy() when LhsFirst rejects what the client sent
+var errDenied = errors.New("denied")
+
+// Why a tunnel was closed; the first thing that ended it
+const (
+	closeClientEOF    = "client eof"
+	closeUpstreamEOF  = "upstream eof"
+	closeClientIdle   = "client idle"
+	closeUpstreamIdle = "upstream idle"
+	closeSizeLimit    = "size limit"
+	closeSession      = "session timeout"
+	closeDenied       = "denied"
+	closeCancelled    = "cancelled"
+	closeError        = "error"
+)
+
+// A connection that can be shut down one direction at a time: a TCP
+// connection, or a TLS connection over one
+type halfConn interface {
+	net.Conn
+	CloseWrite() error
+}
 
 type CancellableCopier struct {
-	Lhs *net.TCPConn
-	Rhs *net.TCPConn
+	Lhs halfConn
+	Rhs halfConn
 
-	ReadTimeout int
-	WriteTimeout int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Max time without reading anything from Lhs and Rhs
+	// respectively; 0 means ReadTimeout. A side idle for this long
+	// only ends the copy if the other side is idle too or done: a
+	// client quiet through a long download keeps its tunnel.
+	LhsIdle time.Duration
+	RhsIdle time.Duration
 
 	IOBufsize  int
+
+	// Max bytes written to Lhs and Rhs respectively; 0 means unlimited
+	LhsLimit int64
+	RhsLimit int64
+
+	// If set, called with the first bytes read from Lhs before they
+	// are written to Rhs; it must not keep them. If it returns false
+	// the bytes are not written and the copy ends with errDenied.
+	LhsFirst func(b []byte) bool
+
+	// If set, called with everything read from Lhs once it is
+	// written to Rhs; it must not keep the bytes or block.
+	LhsTap func(b []byte)
+
+	// Set by Copy() to why the copy ended
+	Reason string
+
+	mu sync.Mutex
+
+	// per direction -- 0 reads Rhs, 1 reads Lhs: the idle time, the
+	// time of the last read (UnixNano) and whether it's done
+	idle [2]time.Duration
+	last [2]int64
+	done [2]int32
 }
 
 // CancellableCopy does bi-directional I/O between two connections d & s. It is cancellable
 // if the context 'ctx' is cancelled.
-// It returns number of bytes transferred in each direction.
+// It returns number of bytes transferred in each direction. If
+// either direction exceeds its limit, both connections are closed
+// and errSizeLimit is returned. If both sides are idle for too long
+// (or one is and the other is done) both connections are closed and
+// errIdleTimeout is returned.
 func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error) {
 
 	bufsz := c.IOBufsize
@@ -38,11 +103,20 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 	}
 
 	if c.ReadTimeout <= 0 {
-		c.ReadTimeout = 10  // seconds
+		c.ReadTimeout = 10 * time.Second
 	}
 
 	if c.WriteTimeout <= 0 {
-		c.WriteTimeout = 15 // seconds
+		c.WriteTimeout = 15 * time.Second
+	}
+
+	c.idle = [2]time.Duration{c.RhsIdle, c.LhsIdle}
+	for i := range c.idle {
+		if c.idle[i] <= 0 {
+			c.idle[i] = c.ReadTimeout
+		}
+		c.last[i] = time.Now().UnixNano()
+		c.done[i] = 0
 	}
 
 	// have to wait until both go-routines are done.
@@ -62,16 +136,24 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 	b0 := make([]byte, bufsz)
 	b1 := make([]byte, bufsz)
 
+	var e0, e1 error
+
+	c.Reason = ""
+
 	// copy #1
 	go func() {
 		defer wg.Done()
-		_, nLhs, _ = c.copyBuf(c.Lhs, c.Rhs, b0)
+		nLhs, e0 = c.copyBuf(0, c.Lhs, c.Rhs, b0, c.LhsLimit, nil, nil)
+		atomic.StoreInt32(&c.done[0], 1)
+		c.ended(e0, closeUpstreamEOF, closeUpstreamIdle)
 	}()
 
 	// copy #2
 	go func() {
 		defer wg.Done()
-		_, nRhs, _ = c.copyBuf(c.Rhs, c.Lhs, b1)
+		nRhs, e1 = c.copyBuf(1, c.Rhs, c.Lhs, b1, c.RhsLimit, c.LhsFirst, c.LhsTap)
+		atomic.StoreInt32(&c.done[1], 1)
+		c.ended(e1, closeClientEOF, closeClientIdle)
 	}()
 
 
@@ -79,6 +161,12 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 	// If parent kills us, we wait for copy-routines to end as well.
 	select {
 	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			c.setReason(closeSession)
+		} else {
+			c.setReason(closeCancelled)
+		}
+
 		// close the sockets and force the i/o loop in copybuf to end.
 		c.Lhs.Close()
 		c.Rhs.Close()
@@ -90,37 +178,117 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 
 	// XXX Gah which error do I report?
 	err = nil
+	switch {
+	case e0 == errSizeLimit || e1 == errSizeLimit:
+		err = errSizeLimit
+	case e0 == errIdleTimeout || e1 == errIdleTimeout:
+		err = errIdleTimeout
+	case e1 == errDenied:
+		err = errDenied
+	}
 	return
 }
 
+// Record why a direction ended unless the copy already has a reason.
+// Anything but EOF ends the other direction too.
+func (c *CancellableCopier) ended(err error, eof, idle string) {
+	switch err {
+	case nil:
+		c.setReason(eof)
+		return
+	case errIdleTimeout:
+		c.setReason(idle)
+	case errSizeLimit:
+		c.setReason(closeSizeLimit)
+	case errDenied:
+		c.setReason(closeDenied)
+	default:
+		c.setReason(closeError)
+	}
 
+	c.Lhs.Close()
+	c.Rhs.Close()
+}
 
-func (c *CancellableCopier) copyBuf(d, s *net.TCPConn, b []byte) (nr, nw int, err error) {
-	rto := time.Duration(c.ReadTimeout) * time.Second
-	wto := time.Duration(c.WriteTimeout) * time.Second
+// Return true if direction 'i' is done or has read nothing for its
+// idle time
+func (c *CancellableCopier) quiet(i int) bool {
+	if atomic.LoadInt32(&c.done[i]) != 0 {
+		return true
+	}
+	last := time.Unix(0, atomic.LoadInt64(&c.last[i]))
+	return time.Since(last) >= c.idle[i]
+}
+
+func (c *CancellableCopier) setReason(r string) {
+	c.mu.Lock()
+	if len(c.Reason) == 0 {
+		c.Reason = r
+	}
+	c.mu.Unlock()
+}
+
+
+
+// copy from 's' to 'd' as direction 'me' and return the total bytes
+// written to 'd'. If 'max' > 0, no more than 'max' bytes are written;
+// errSizeLimit is returned when the limit is exceeded. If nothing is
+// read from 's' for the direction's idle time and the other direction
+// is quiet too, errIdleTimeout is returned. EOF from 's' is passed on
+// as a half-close of 'd' and nil returned; the other direction carries
+// on until it too sees EOF. If 'first' is set, it sees the first read;
+// if 'tap' is set, it sees every read that was written.
+func (c *CancellableCopier) copyBuf(me int, d, s halfConn, b []byte, max int64, first func([]byte) bool, tap func([]byte)) (n int, err error) {
+	wto := c.WriteTimeout
+	idle := c.idle[me]
 	for {
-		s.SetReadDeadline(time.Now().Add(rto))
-		nr, err = s.Read(b)
-		if err != nil && err != io.EOF && err != context.Canceled && !isReset(err) {
-			return
-		}
+		s.SetReadDeadline(time.Now().Add(idle))
+		nr, err := s.Read(b)
 		if nr > 0 {
+			atomic.StoreInt64(&c.last[me], time.Now().UnixNano())
+			if first != nil {
+				if !first(b[:nr]) {
+					return n, errDenied
+				}
+				first = nil
+			}
+			if max > 0 && int64(n+nr) > max {
+				return n, errSizeLimit
+			}
+
 			d.SetWriteDeadline(time.Now().Add(wto))
-			nw, err = d.Write(b[:nr])
-			if err != nil {
-				return
+			nw, ew := d.Write(b[:nr])
+			n += nw
+			if ew == nil && nw != nr {
+				ew = io.ErrShortWrite
+			}
+			if ew != nil {
+				return n, ew
 			}
-			if nw != nr {
-				return
+			if tap != nil {
+				tap(b[:nr])
 			}
 		}
-		if err != nil || nr == 0 {
-			return
+
+		switch {
+		case err == nil:
+			continue
+
+		case err == io.EOF:
+			d.CloseWrite()
+			if r, ok := s.(interface{ CloseRead() error }); ok {
+				r.CloseRead()
+			}
+			return n, nil
 		}
-	}
 
-	d.CloseWrite()
-	s.CloseRead()
-	err = nil
-	return
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the other direction is still moving
+			if !c.quiet(1 - me) {
+				continue
+			}
+			return n, errIdleTimeout
+		}
+		return n, err
+	}
 }
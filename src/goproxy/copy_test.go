@@ -0,0 +1,118 @@
+// copy_test.go -- tests for the tunnel copier
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Return the two ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+// A client quiet for much longer than ReadTimeout keeps its tunnel
+// while the destination streams to it
+func TestCopyOneSideQuiet(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	const chunks = 20
+	go func() {
+		b := make([]byte, 1024)
+		for i := 0; i < chunks; i++ {
+			server.Write(b)
+			time.Sleep(50 * time.Millisecond)
+		}
+		server.Close()
+	}()
+
+	cp := &CancellableCopier{
+		Lhs:         lhs,
+		Rhs:         rhs,
+		ReadTimeout: 200 * time.Millisecond,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := cp.Copy(context.Background())
+		done <- err
+	}()
+
+	b, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != chunks*1024 {
+		t.Fatalf("client got %d bytes, want %d", len(b), chunks*1024)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("copy didn't end after the destination closed")
+	}
+	if cp.Reason != closeUpstreamEOF {
+		t.Fatalf("reason %q, want %q", cp.Reason, closeUpstreamEOF)
+	}
+}
+
+// A tunnel idle both ways is closed
+func TestCopyBothIdle(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cp := &CancellableCopier{
+		Lhs:         lhs,
+		Rhs:         rhs,
+		ReadTimeout: 100 * time.Millisecond,
+		LhsIdle:     300 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, _, err := cp.Copy(context.Background())
+	if err != errIdleTimeout {
+		t.Fatalf("err %v, want %v", err, errIdleTimeout)
+	}
+
+	// the client's longer idle time decides
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("closed after %s", d)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read: %v, want EOF", err)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
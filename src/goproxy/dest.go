@@ -0,0 +1,129 @@
+// dest.go -- per-destination connection and byte counters
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counters for one destination host
+type destStat struct {
+	Host     string `json:"host"`
+	Active   int    `json:"active"`
+	Total    uint64 `json:"total"`
+	Failures uint64 `json:"failures"`
+	Sent     uint64 `json:"bytes_sent"`
+	Received uint64 `json:"bytes_received"`
+}
+
+// Table of destination counters shared by all listeners. If max > 0,
+// no more than 'max' concurrent connections are allowed to any one
+// destination host.
+type destTable struct {
+	sync.Mutex
+	m   map[string]*destStat
+	max int
+}
+
+// Upper bound on the hosts we track; idle ones are evicted beyond this
+const maxDestHosts = 65536
+
+func newDestTable(max int) *destTable {
+	return &destTable{
+		m:   make(map[string]*destStat),
+		max: max,
+	}
+}
+
+// Record a new connection to 'host'. Returns false if 'host' is at
+// its concurrent connection limit.
+func (t *destTable) Open(host string) bool {
+	host = strings.ToLower(host)
+
+	t.Lock()
+	defer t.Unlock()
+
+	d := t.get(host)
+	if t.max > 0 && d.Active >= t.max {
+		return false
+	}
+
+	d.Active++
+	d.Total++
+	return true
+}
+
+// Record the end of a connection to 'host' that sent and received the
+// given bytes.
+func (t *destTable) Close(host string, sent, rcvd int64) {
+	host = strings.ToLower(host)
+
+	t.Lock()
+	d := t.get(host)
+	if d.Active > 0 {
+		d.Active--
+	}
+	d.Sent += uint64(sent)
+	d.Received += uint64(rcvd)
+	t.Unlock()
+}
+
+// Record a failed connection to 'host'
+func (t *destTable) Fail(host string) {
+	host = strings.ToLower(host)
+
+	t.Lock()
+	t.get(host).Failures++
+	t.Unlock()
+}
+
+// must be called with the lock held
+func (t *destTable) get(host string) *destStat {
+	d, ok := t.m[host]
+	if !ok {
+		if len(t.m) >= maxDestHosts {
+			t.evict()
+		}
+		d = &destStat{Host: host}
+		t.m[host] = d
+	}
+	return d
+}
+
+// Drop counters of hosts with no active connections
+func (t *destTable) evict() {
+	for k, d := range t.m {
+		if d.Active == 0 {
+			delete(t.m, k)
+		}
+	}
+}
+
+// Return a snapshot of the counters sorted by host
+func (t *destTable) Stats() []destStat {
+	t.Lock()
+	v := make([]destStat, 0, len(t.m))
+	for _, d := range t.m {
+		v = append(v, *d)
+	}
+	t.Unlock()
+
+	sort.Slice(v, func(i, j int) bool { return v[i].Host < v[j].Host })
+	return v
+}
+
+// admin API handler
+func (t *destTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, t.Stats())
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -12,10 +12,20 @@ import (
 	"os"
 )
 
-// die with error
-func die(f string, v ...interface{}) {
+// Exit codes (from sysexits(3) where one fits) so a supervisor can
+// tell a config that needs fixing from a failure worth a restart.
+const (
+	exitFatal  = 1  // runtime failure; restart
+	exitUsage  = 64 // bad command line
+	exitBind   = 69 // can't listen; the address may be in use
+	exitPriv   = 77 // can't change uid/gid
+	exitConfig = 78 // invalid config; restarting won't help
+)
+
+// die with error and exit 'code'
+func die(code int, f string, v ...interface{}) {
 	warn(f, v...)
-	os.Exit(1)
+	os.Exit(code)
 }
 
 func warn(f string, v ...interface{}) {
@@ -0,0 +1,326 @@
+// dns.go -- minimal DNS client (UDP/TCP and DNS-over-HTTPS)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DNS record types we care about
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// DNS response codes
+const (
+	dnsRcodeOK       = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+// A DNS server that can answer queries in wire format
+type dnsServer interface {
+	Exchange(ctx context.Context, q []byte) ([]byte, error)
+	String() string
+}
+
+// Make a DNS server from the config: a DoH URL or a host[:port] for
+// classic DNS.
+func newDNSServer(c *DNSServerConf) (dnsServer, error) {
+	switch {
+	case len(c.URL) > 0 && len(c.Addr) > 0:
+		return nil, fmt.Errorf("resolver: only one of addr or url can be set")
+
+	case len(c.URL) > 0:
+		if !strings.HasPrefix(c.URL, "https://") {
+			return nil, fmt.Errorf("resolver: DoH url %s is not https", c.URL)
+		}
+		return &dohServer{
+			url: c.URL,
+			clt: &http.Client{Timeout: 5 * time.Second},
+		}, nil
+
+	case len(c.Addr) > 0:
+		a := c.Addr
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "53")
+		}
+		return &udpServer{addr: a}, nil
+	}
+	return nil, fmt.Errorf("resolver: server needs one of addr or url")
+}
+
+// Classic DNS over UDP; retried over TCP if the answer is truncated
+type udpServer struct {
+	addr string
+}
+
+func (s *udpServer) String() string { return s.addr }
+
+func (s *udpServer) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	var d net.Dialer
+
+	dl, ok := ctx.Deadline()
+	if !ok {
+		dl = time.Now().Add(5 * time.Second)
+	}
+
+	c, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(dl)
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 4096)
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// TC bit set: ask again over TCP
+	if n > 2 && b[2]&0x02 != 0 {
+		return s.exchangeTCP(ctx, q, dl)
+	}
+	return b[:n], nil
+}
+
+func (s *udpServer) exchangeTCP(ctx context.Context, q []byte, dl time.Time) ([]byte, error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(dl)
+
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	if _, err = c.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+
+	r := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err = io.ReadFull(c, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DNS over HTTPS (RFC 8484)
+type dohServer struct {
+	url string
+	clt *http.Client
+}
+
+func (s *dohServer) String() string { return s.url }
+
+func (s *dohServer) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := s.clt.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", s.url, res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+// Build a recursive query for 'name' of type 'qtype'. 'opt' if non-nil
+// is the RDATA of an EDNS0 OPT record added to the query.
+func dnsQuery(name string, qtype uint16, opt []byte) ([]byte, uint16, error) {
+	var id [2]byte
+	rand.Read(id[:])
+
+	b := make([]byte, 12, 512)
+	copy(b, id[:])
+	b[2] = 0x01 // RD
+	b[5] = 1    // QDCOUNT
+	if opt != nil {
+		b[11] = 1 // ARCOUNT
+	}
+
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, 0, fmt.Errorf("invalid name %q", name)
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	if opt != nil {
+		// root name, type OPT, UDP size 4096, no extended flags
+		b = append(b, 0, 0, 41, 0x10, 0, 0, 0, 0, 0)
+		b = append(b, byte(len(opt)>>8), byte(len(opt)))
+		b = append(b, opt...)
+	}
+
+	if len(b) > 512 {
+		return nil, 0, fmt.Errorf("name too long: %q", name)
+	}
+	return b, binary.BigEndian.Uint16(id[:]), nil
+}
+
+// Return the EDNS0 option data for a client subnet option (RFC 7871)
+// for 'ecs': "strip" asks servers to not use any client subnet (a /0
+// prefix), a CIDR asks them to answer as if the client were there.
+func ecsOption(ecs string) ([]byte, error) {
+	var fam uint16 = 1
+	var bits int
+	var addr []byte
+
+	if ecs != "strip" {
+		_, n, err := net.ParseCIDR(ecs)
+		if err != nil {
+			return nil, fmt.Errorf("ecs: %s", err)
+		}
+
+		bits, _ = n.Mask.Size()
+		addr = n.IP.To4()
+		if addr == nil {
+			fam = 2
+			addr = n.IP.To16()
+		}
+		addr = addr[:(bits+7)/8]
+	}
+
+	b := make([]byte, 8, 8+len(addr))
+	binary.BigEndian.PutUint16(b[0:], 8) // OPTION-CODE: ECS
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(addr)))
+	binary.BigEndian.PutUint16(b[4:], fam)
+	b[6] = byte(bits) // SOURCE PREFIX-LENGTH
+	b[7] = 0          // SCOPE PREFIX-LENGTH
+	return append(b, addr...), nil
+}
+
+// An answer to a query
+type dnsAnswer struct {
+	rcode int
+	ips   []net.IP
+	ttl   uint32 // min TTL of the answers
+}
+
+var errDNSShort = errors.New("dns: short message")
+
+// Parse the response 'b' to a query with id 'id'; collects the A and
+// AAAA records in the answer section.
+func dnsParse(b []byte, id uint16) (*dnsAnswer, error) {
+	if len(b) < 12 {
+		return nil, errDNSShort
+	}
+
+	if binary.BigEndian.Uint16(b) != id || b[2]&0x80 == 0 {
+		return nil, errors.New("dns: mismatched response")
+	}
+
+	a := &dnsAnswer{
+		rcode: int(b[3] & 0x0f),
+		ttl:   ^uint32(0),
+	}
+
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+
+	i := 12
+	for ; qd > 0; qd-- {
+		n, err := dnsSkipName(b, i)
+		if err != nil {
+			return nil, err
+		}
+		i = n + 4
+	}
+
+	for ; an > 0; an-- {
+		n, err := dnsSkipName(b, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if n+10 > len(b) {
+			return nil, errDNSShort
+		}
+
+		typ := binary.BigEndian.Uint16(b[n:])
+		ttl := binary.BigEndian.Uint32(b[n+4:])
+		rdl := int(binary.BigEndian.Uint16(b[n+8:]))
+		i = n + 10 + rdl
+		if i > len(b) {
+			return nil, errDNSShort
+		}
+
+		rd := b[n+10 : i]
+		switch {
+		case typ == dnsTypeA && rdl == 4, typ == dnsTypeAAAA && rdl == 16:
+			a.ips = append(a.ips, net.IP(append([]byte(nil), rd...)))
+			if ttl < a.ttl {
+				a.ttl = ttl
+			}
+		}
+	}
+
+	if len(a.ips) == 0 {
+		a.ttl = 0
+	}
+	return a, nil
+}
+
+// Return the offset just past the (possibly compressed) name at 'i'
+func dnsSkipName(b []byte, i int) (int, error) {
+	for {
+		if i >= len(b) {
+			return 0, errDNSShort
+		}
+
+		l := int(b[i])
+		switch {
+		case l == 0:
+			return i + 1, nil
+		case l&0xc0 == 0xc0:
+			// compression pointer ends the name
+			return i + 2, nil
+		}
+		i += 1 + l
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,123 @@
+// dnsleak.go -- find clients that resolve names on their own
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Return the name in the dnsleak domains of 'c' that the address
+// 'host' belongs to; empty if 'host' isn't an address or isn't one of
+// theirs we know.
+func leakedName(c *DNSLeakConf, res *Resolver, host string) string {
+	if len(c.Action) == 0 {
+		return ""
+	}
+
+	name := res.NameOf(host)
+	if len(name) == 0 || !domainMatch(domainList(c.Dest), name) {
+		return ""
+	}
+	return name
+}
+
+// A leakWatch resolves the dnsleak domains of the listeners every so
+// often, so their addresses are known before any client asks us for
+// them by name. Subdomains are known once something resolves them.
+type leakWatch struct {
+	res   *Resolver
+	names []string
+	log   *L.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Return a watch for the dnsleak domains of the listeners of 'cfg';
+// nil if none has any. The resolver learns the addresses of names in
+// those domains only.
+func newLeakWatch(cfg *Conf, res *Resolver, log *L.Logger) *leakWatch {
+	seen := make(map[string]bool)
+
+	var names []string
+	for _, v := range cfg.listeners() {
+		for i := range v {
+			c := &v[i].DNSLeak
+			if len(c.Action) == 0 {
+				continue
+			}
+			for _, d := range domainList(c.Dest) {
+				if !seen[d] {
+					seen[d] = true
+					names = append(names, d)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	res.WatchLeaks(names)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &leakWatch{
+		res:    res,
+		names:  names,
+		log:    log.New("dnsleak", 0),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (w *leakWatch) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.loop()
+	}()
+}
+
+func (w *leakWatch) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+func (w *leakWatch) loop() {
+	// well before what we learned expires
+	t := time.NewTicker(revTTL / 2)
+	defer t.Stop()
+
+	for {
+		w.refresh()
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Resolve each of the names once
+func (w *leakWatch) refresh() {
+	for _, n := range w.names {
+		ctx, cancel := context.WithTimeout(w.ctx, 5*time.Second)
+		if _, err := w.res.LookupIP(ctx, n); err != nil && w.ctx.Err() == nil {
+			w.log.Debug("%s: %s", n, err)
+		}
+		cancel()
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,149 @@
+// egress.go -- pools of outbound source addresses
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A pool of source IPs for outbound connections and the strategy
+// for rotating through them:
+//   - connection: round-robin on every new connection
+//   - session: each client IP sticks to one address
+//   - time: all connections use one address; move to the next every
+//     'interval'
+type egressPool struct {
+	addrs    []net.IP
+	v4, v6   []net.IP // addrs by family
+	rotate   string
+	interval time.Duration
+	start    time.Time
+
+	n uint64 // round-robin counter
+}
+
+// Make an egress pool from the listener config. A 'bind' address is a
+// pool of one. Returns nil if neither is configured.
+func newEgressPool(lc *ListenConf) (*egressPool, error) {
+	c := lc.Egress
+	if len(lc.Bind) > 0 {
+		if len(c.Pool) > 0 {
+			return nil, fmt.Errorf("only one of bind or egress pool can be set")
+		}
+
+		// bind may be an IP or an IP:port; we only want the IP
+		h := lc.Bind
+		if hh, _, err := net.SplitHostPort(lc.Bind); err == nil {
+			h = hh
+		}
+		c.Pool = []string{h}
+	}
+	return egressPoolOf(&c)
+}
+
+// Make the egress pool in 'c'; nil if it has no addresses
+func egressPoolOf(c *EgressConf) (*egressPool, error) {
+	pool := c.Pool
+	if len(pool) == 0 {
+		return nil, nil
+	}
+
+	e := &egressPool{
+		rotate:   c.Rotate,
+		interval: time.Duration(c.Interval),
+		start:    time.Now(),
+	}
+
+	for _, s := range pool {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("egress: invalid IP address %q", s)
+		}
+		e.addrs = append(e.addrs, ip)
+		if ip.To4() != nil {
+			e.v4 = append(e.v4, ip)
+		} else {
+			e.v6 = append(e.v6, ip)
+		}
+	}
+
+	switch e.rotate {
+	case "":
+		e.rotate = "connection"
+	case "connection", "session":
+	case "time":
+		if e.interval <= 0 {
+			e.interval = 5 * time.Minute
+		}
+	default:
+		return nil, fmt.Errorf("egress: unknown rotation %q", e.rotate)
+	}
+	return e, nil
+}
+
+// Return the source address for a new connection from 'client' to
+// 'dst'; one of the family of 'dst' if it isn't nil, or nil if the
+// pool has none of that family.
+func (e *egressPool) Pick(client, dst net.IP) net.IP {
+	addrs := e.addrs
+	switch {
+	case dst == nil:
+	case dst.To4() != nil:
+		addrs = e.v4
+	default:
+		addrs = e.v6
+	}
+
+	switch len(addrs) {
+	case 0:
+		return nil
+	case 1:
+		return addrs[0]
+	}
+
+	var i uint64
+	switch e.rotate {
+	case "session":
+		if client != nil {
+			h := fnv.New64a()
+			h.Write(client.To16())
+			i = h.Sum64()
+		}
+
+	case "time":
+		i = uint64(time.Since(e.start) / e.interval)
+
+	default:
+		i = atomic.AddUint64(&e.n, 1)
+	}
+	return addrs[i%uint64(len(addrs))]
+}
+
+// Return a copy of 'd' that binds to a source address for 'client'
+// dialing 'dst'; 'd' itself if the pool has none of its family.
+func (e *egressPool) Dialer(d *net.Dialer, client, dst net.IP) *net.Dialer {
+	if e == nil {
+		return d
+	}
+
+	ip := e.Pick(client, dst)
+	if ip == nil {
+		return d
+	}
+
+	nd := *d
+	nd.LocalAddr = &net.TCPAddr{IP: ip}
+	return &nd
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,359 @@
+// fingerprint.go -- inspect the TLS ClientHello of tunneled clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What we learn from a TLS ClientHello without decrypting anything: the
+// server name and ALPN protocols the client asked for, and its
+// fingerprints. Browsers, TLS libraries and bots each send a
+// recognizable mix of ciphers and extensions; so the fingerprints
+// identify the client software no matter what its User-Agent claims.
+type tlsHello struct {
+	SNI  string
+	ALPN string // comma separated
+	JA3  string
+	JA4  string
+}
+
+// A parsed TLS ClientHello; just the fields the fingerprints need
+type clientHello struct {
+	version  uint16 // legacy version in the hello
+	ciphers  []uint16
+	exts     []uint16 // in the order sent
+	groups   []uint16
+	points   []uint8
+	sigalgs  []uint16
+	versions []uint16 // from the supported_versions extension
+	alpn     []string
+	sni      string
+	hasSNI   bool
+}
+
+// TLS extensions we look inside
+const (
+	extSNI           = 0
+	extGroups        = 10
+	extPointFormats  = 11
+	extSigAlgs       = 13
+	extALPN          = 16
+	extSupportedVers = 43
+)
+
+// Inspect the first bytes 'b' a client sent through a tunnel. We
+// return false if they aren't a complete TLS ClientHello; a hello split
+// across TCP segments is not inspected.
+func inspectTLS(b []byte) (tlsHello, bool) {
+	ch, ok := parseClientHello(b)
+	if !ok {
+		return tlsHello{}, false
+	}
+
+	h := tlsHello{
+		SNI:  ch.sni,
+		ALPN: strings.Join(ch.alpn, ","),
+		JA3:  ch.ja3(),
+		JA4:  ch.ja4(),
+	}
+	return h, true
+}
+
+// Return why a tunnel to the TLS server name 'sni' must be closed: it
+// is on the blocklist or in one of the 'deny' categories. This catches
+// clients that CONNECT to an address or an innocuous name and then ask
+// for a different server. Return "" if it is allowed.
+func sniDenied(bl *blocklist, cat CategoryDB, deny []string, sni string) string {
+	if len(sni) == 0 {
+		return ""
+	}
+
+	if bl.Blocked(sni) {
+		return "blocklist"
+	}
+	if c := categoryDenied(cat, deny, sni); len(c) > 0 {
+		return "category " + c
+	}
+	return ""
+}
+
+// Return true if 'v' is a GREASE value (RFC 8701); these are random
+// and left out of the fingerprints.
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func parseClientHello(b []byte) (*clientHello, bool) {
+	r := &helloReader{b: b}
+
+	// TLS record header: handshake, version, length
+	if r.u8() != 0x16 {
+		return nil, false
+	}
+	r.u16()
+	r.b = r.bytes(int(r.u16()))
+
+	// handshake header: client hello, length
+	if r.u8() != 1 {
+		return nil, false
+	}
+	r.b = r.bytes(r.u24())
+
+	ch := &clientHello{
+		version: r.u16(),
+	}
+	r.bytes(32) // random
+	r.bytes(int(r.u8()))
+
+	cr := &helloReader{b: r.bytes(int(r.u16())), bad: r.bad}
+	for len(cr.b) > 0 && !cr.bad {
+		ch.ciphers = append(ch.ciphers, cr.u16())
+	}
+	r.bytes(int(r.u8())) // compression methods
+	if r.bad || cr.bad {
+		return nil, false
+	}
+
+	// extensions are optional
+	if len(r.b) == 0 {
+		return ch, true
+	}
+
+	er := &helloReader{b: r.bytes(int(r.u16())), bad: r.bad}
+	for len(er.b) > 0 && !er.bad {
+		typ := er.u16()
+		x := &helloReader{b: er.bytes(int(er.u16())), bad: er.bad}
+		ch.exts = append(ch.exts, typ)
+
+		switch typ {
+		case extSNI:
+			ch.hasSNI = true
+			x.b = x.bytes(int(x.u16()))
+			for len(x.b) > 0 && !x.bad {
+				typ := x.u8()
+				name := x.bytes(int(x.u16()))
+				if typ == 0 && len(ch.sni) == 0 {
+					ch.sni = strings.ToLower(string(name))
+				}
+			}
+		case extGroups:
+			x.b = x.bytes(int(x.u16()))
+			for len(x.b) > 0 && !x.bad {
+				ch.groups = append(ch.groups, x.u16())
+			}
+		case extPointFormats:
+			ch.points = append(ch.points, x.bytes(int(x.u8()))...)
+		case extSigAlgs:
+			x.b = x.bytes(int(x.u16()))
+			for len(x.b) > 0 && !x.bad {
+				ch.sigalgs = append(ch.sigalgs, x.u16())
+			}
+		case extALPN:
+			x.b = x.bytes(int(x.u16()))
+			for len(x.b) > 0 && !x.bad {
+				ch.alpn = append(ch.alpn, string(x.bytes(int(x.u8()))))
+			}
+		case extSupportedVers:
+			x.b = x.bytes(int(x.u8()))
+			for len(x.b) > 0 && !x.bad {
+				ch.versions = append(ch.versions, x.u16())
+			}
+		}
+		if x.bad {
+			return nil, false
+		}
+	}
+	return ch, !r.bad && !er.bad
+}
+
+// JA3: md5 of "version,ciphers,extensions,groups,point formats" in
+// decimal with the values of each list joined by '-'.
+func (ch *clientHello) ja3() string {
+	var s strings.Builder
+
+	list := func(v []uint16) {
+		n := 0
+		for _, x := range v {
+			if isGrease(x) {
+				continue
+			}
+			if n > 0 {
+				s.WriteByte('-')
+			}
+			s.WriteString(strconv.Itoa(int(x)))
+			n++
+		}
+	}
+
+	s.WriteString(strconv.Itoa(int(ch.version)))
+	s.WriteByte(',')
+	list(ch.ciphers)
+	s.WriteByte(',')
+	list(ch.exts)
+	s.WriteByte(',')
+	list(ch.groups)
+	s.WriteByte(',')
+	for i, p := range ch.points {
+		if i > 0 {
+			s.WriteByte('-')
+		}
+		s.WriteString(strconv.Itoa(int(p)))
+	}
+
+	h := md5.Sum([]byte(s.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// JA4 (TLS over TCP): "t<version><sni><#ciphers><#exts><alpn>", the
+// truncated sha256 of the sorted ciphers and that of the sorted
+// extensions (less SNI and ALPN) with the signature algorithms.
+func (ch *clientHello) ja4() string {
+	ver := ch.version
+	for _, v := range ch.versions {
+		if !isGrease(v) && v > ver {
+			ver = v
+		}
+	}
+
+	var vs string
+	switch ver {
+	case 0x0304:
+		vs = "13"
+	case 0x0303:
+		vs = "12"
+	case 0x0302:
+		vs = "11"
+	case 0x0301:
+		vs = "10"
+	case 0x0300:
+		vs = "s3"
+	default:
+		vs = "00"
+	}
+
+	sni := "i"
+	if ch.hasSNI {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(ch.alpn) > 0 {
+		if a := ch.alpn[0]; len(a) > 0 {
+			alpn = string([]byte{a[0], a[len(a)-1]})
+		}
+	}
+
+	ciphers := sortedHex(ch.ciphers, nil)
+	exts := sortedHex(ch.exts, func(x uint16) bool { return x == extSNI || x == extALPN })
+
+	next := 0
+	for _, x := range ch.exts {
+		if !isGrease(x) {
+			next++
+		}
+	}
+
+	xs := strings.Join(exts, ",")
+	if len(ch.sigalgs) > 0 {
+		xs += "_" + strings.Join(hexList(ch.sigalgs), ",")
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", vs, sni, min2(len(ciphers)), min2(next), alpn,
+		ja4Hash(strings.Join(ciphers, ",")), ja4Hash(xs))
+}
+
+// Sort the non-GREASE values in 'v' that 'skip' doesn't match and
+// return them in 4 digit hex
+func sortedHex(v []uint16, skip func(uint16) bool) []string {
+	var s []uint16
+	for _, x := range v {
+		if isGrease(x) || (skip != nil && skip(x)) {
+			continue
+		}
+		s = append(s, x)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return hexList(s)
+}
+
+func hexList(v []uint16) []string {
+	var s []string
+	for _, x := range v {
+		if !isGrease(x) {
+			s = append(s, fmt.Sprintf("%04x", x))
+		}
+	}
+	return s
+}
+
+// First 12 hex digits of the sha256 of 's'
+func ja4Hash(s string) string {
+	if len(s) == 0 {
+		return "000000000000"
+	}
+
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:6])
+}
+
+// JA4 counts are two digits
+func min2(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+// A bounds checked reader of TLS wire data; a short read sets 'bad'
+// and returns zeroes from then on.
+type helloReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.bad || n > len(r.b) {
+		r.bad = true
+		r.b = nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) u8() uint8 {
+	if v := r.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *helloReader) u16() uint16 {
+	if v := r.bytes(2); v != nil {
+		return uint16(v[0])<<8 | uint16(v[1])
+	}
+	return 0
+}
+
+func (r *helloReader) u24() int {
+	if v := r.bytes(3); v != nil {
+		return int(v[0])<<16 | int(v[1])<<8 | int(v[2])
+	}
+	return 0
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
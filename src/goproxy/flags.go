@@ -0,0 +1,180 @@
+// flags.go -- runtime feature flags per listener
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Features that can be turned on at runtime; each is turned off
+// automatically when its timer expires so a debug mode can't be left
+// on by accident.
+const (
+	flagPayload = "payload" // log HTTP request headers and SOCKS requests
+)
+
+var knownFlags = map[string]bool{
+	flagPayload: true,
+}
+
+// Bounds on how long a flag stays on
+const (
+	defaultFlagTTL = 15 * time.Minute
+	maxFlagTTL     = 24 * time.Hour
+)
+
+// The feature flags of every listener; managed via the admin API
+type featureFlags struct {
+	mu sync.Mutex
+	m  map[string]*listenerFlags
+}
+
+// The feature flags of one listener; a nil listenerFlags has every
+// flag off.
+type listenerFlags struct {
+	mu sync.Mutex
+	m  map[string]time.Time // flag -> expiry
+}
+
+func newFeatureFlags() *featureFlags {
+	return &featureFlags{
+		m: make(map[string]*listenerFlags),
+	}
+}
+
+// Return the flags of listener 'name'
+func (f *featureFlags) For(name string) *listenerFlags {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	l, ok := f.m[name]
+	if !ok {
+		l = &listenerFlags{m: make(map[string]time.Time)}
+		f.m[name] = l
+	}
+	return l
+}
+
+// Return true if 'flag' is on
+func (l *listenerFlags) On(flag string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.m[flag]
+	if ok && time.Now().After(t) {
+		delete(l.m, flag)
+		return false
+	}
+	return ok
+}
+
+// Turn 'flag' on for 'ttl'
+func (l *listenerFlags) Set(flag string, ttl time.Duration) {
+	l.mu.Lock()
+	l.m[flag] = time.Now().Add(ttl)
+	l.mu.Unlock()
+}
+
+func (l *listenerFlags) Clear(flag string) {
+	l.mu.Lock()
+	delete(l.m, flag)
+	l.mu.Unlock()
+}
+
+// Return the flags that are on and their expiry
+func (l *listenerFlags) active() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	m := make(map[string]string)
+	for k, t := range l.m {
+		if now.After(t) {
+			delete(l.m, k)
+			continue
+		}
+		m[k] = t.UTC().Format(time.RFC3339)
+	}
+	return m
+}
+
+// Admin API for the flags:
+//
+//	GET    /flags                                 flags that are on
+//	POST   /flags?listener=L&flag=F[&ttl=15m]     turn F on for L
+//	DELETE /flags?listener=L&flag=F               turn F off for L
+func (f *featureFlags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		f.mu.Lock()
+		names := make([]string, 0, len(f.m))
+		for k := range f.m {
+			names = append(names, k)
+		}
+		f.mu.Unlock()
+		sort.Strings(names)
+
+		m := make(map[string]map[string]string)
+		for _, k := range names {
+			if a := f.For(k).active(); len(a) > 0 {
+				m[k] = a
+			}
+		}
+		writeJSON(w, m)
+		return
+	}
+
+	q := r.URL.Query()
+	name, flag := q.Get("listener"), q.Get("flag")
+
+	f.mu.Lock()
+	l, ok := f.m[name]
+	f.mu.Unlock()
+
+	switch {
+	case !ok:
+		http.Error(w, fmt.Sprintf("unknown listener %q", name), http.StatusNotFound)
+		return
+	case !knownFlags[flag]:
+		http.Error(w, fmt.Sprintf("unknown flag %q", flag), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		ttl := defaultFlagTTL
+		if s := q.Get("ttl"); len(s) > 0 {
+			d, err := parseDuration(s)
+			if err != nil || d <= 0 || d > maxFlagTTL {
+				http.Error(w, fmt.Sprintf("invalid ttl %q (max %s)", s, maxFlagTTL),
+					http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		l.Set(flag, ttl)
+
+	case "DELETE":
+		l.Clear(flag)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, l.active())
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
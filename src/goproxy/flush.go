@@ -0,0 +1,191 @@
+// flush.go -- when the HTTP proxy flushes responses to the client
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a write of a response to the client may take. Streamed
+// responses get this long for each write rather than for the whole
+// response.
+const httpWriteTimeout = 10 * time.Second
+
+// How the HTTP proxy sends responses to the client: streamed responses
+// are flushed as soon as each piece arrives from the destination;
+// buffered ones only when the buffer fills, at the end or, if an
+// interval is set, at least that often. In "auto" mode server-sent
+// events (text/event-stream) and responses of unknown length (chunked)
+// are streamed; everything else is buffered. Rules set the mode for
+// some destinations. A nil flushPolicy is "auto" everywhere.
+type flushPolicy struct {
+	dflt  flushMode
+	rules []flushRule
+}
+
+type flushMode struct {
+	mode     string
+	interval time.Duration
+}
+
+type flushRule struct {
+	dest []string
+	flushMode
+}
+
+// Flush modes
+const (
+	flushAuto   = "auto"
+	flushStream = "stream"
+	flushBuffer = "buffer"
+)
+
+// Make the policy in 'c'; nil if it is the default
+func newFlushPolicy(c *FlushConf) (*flushPolicy, error) {
+	f := &flushPolicy{}
+
+	var err error
+	if f.dflt, err = flushModeOf(c.Mode, c.Interval); err != nil {
+		return nil, err
+	}
+
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Dest) == 0 {
+			return nil, fmt.Errorf("flush: rule %d has no dest", i)
+		}
+
+		m, err := flushModeOf(r.Mode, r.Interval)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, flushRule{domainList(r.Dest), m})
+	}
+
+	if f.dflt == (flushMode{mode: flushAuto}) && len(f.rules) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func flushModeOf(mode string, iv duration) (flushMode, error) {
+	switch mode {
+	case "":
+		mode = flushAuto
+	case flushAuto, flushStream, flushBuffer:
+	default:
+		return flushMode{}, fmt.Errorf("flush: mode must be auto, stream or buffer, not %q", mode)
+	}
+	return flushMode{mode, time.Duration(iv)}, nil
+}
+
+// Return true if the response 'res' from 'host' must be streamed and
+// the interval at which to flush it otherwise
+func (f *flushPolicy) streamed(host string, res *http.Response) (bool, time.Duration) {
+	m := flushMode{mode: flushAuto}
+	if f != nil {
+		m = f.dflt
+		for i := range f.rules {
+			if domainMatch(f.rules[i].dest, host) {
+				m = f.rules[i].flushMode
+				break
+			}
+		}
+	}
+
+	switch m.mode {
+	case flushStream:
+		return true, 0
+	case flushBuffer:
+		return false, m.interval
+	}
+
+	ct := res.Header.Get("Content-Type")
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	if strings.EqualFold(strings.TrimSpace(ct), "text/event-stream") || res.ContentLength < 0 {
+		return true, 0
+	}
+	return false, m.interval
+}
+
+// Return the writer for sending response 'res' from 'host' to 'w' and
+// a func to call when done with it
+func (f *flushPolicy) Writer(w http.ResponseWriter, host string, res *http.Response) (io.Writer, func()) {
+	rc := http.NewResponseController(w)
+
+	stream, iv := f.streamed(host, res)
+	if stream {
+		// the client sees the headers before the first event
+		s := &streamWriter{w: w, rc: rc}
+		s.Write(nil)
+		return s, func() {}
+	}
+	if iv <= 0 {
+		return w, func() {}
+	}
+
+	lw := &latencyWriter{w: w, rc: rc}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.t = time.AfterFunc(iv, func() {
+		lw.mu.Lock()
+		defer lw.mu.Unlock()
+		if !lw.done {
+			lw.rc.Flush()
+			lw.t.Reset(iv)
+		}
+	})
+	return lw, func() {
+		lw.mu.Lock()
+		lw.done = true
+		lw.t.Stop()
+		lw.mu.Unlock()
+	}
+}
+
+// Flush every write; each write gets httpWriteTimeout to finish, so a
+// long lived stream isn't cut off by the server's write timeout.
+type streamWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	s.rc.SetWriteDeadline(time.Now().Add(httpWriteTimeout))
+	n, err := s.w.Write(b)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return n, err
+}
+
+// Flush at least every interval
+type latencyWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+
+	mu   sync.Mutex
+	t    *time.Timer
+	done bool
+}
+
+func (l *latencyWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
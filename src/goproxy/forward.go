@@ -0,0 +1,217 @@
+// forward.go -- Via, X-Forwarded-For and Forwarded headers of proxied requests
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What we do with each forwarding header of a request: add our hop to
+// it, pass it on as the client sent it or strip it. A listener has a
+// default for each header and rules that override it for some
+// destinations. A nil forwardPolicy passes every header.
+type forwardPolicy struct {
+	dflt  forwardModes
+	rules []forwardRule
+
+	// other headers that reveal the client; always stripped
+	strip []string
+}
+
+type forwardModes struct {
+	via, xff, fwd string
+}
+
+type forwardRule struct {
+	dest []string // domains; each matches itself and its subdomains
+	forwardModes
+}
+
+// Forwarding header modes
+const (
+	fwdPass  = "pass"
+	fwdAdd   = "add"
+	fwdStrip = "strip"
+)
+
+// We call ourselves this in Via
+const viaName = "goproxy"
+
+// The classic proxy anonymity levels: a transparent proxy tells the
+// server it is a proxy and who the client is; an anonymous one that it
+// is a proxy but not who the client is; an elite one neither.
+var anonymityLevels = map[string]struct {
+	forwardModes
+	hideClient bool
+}{
+	"transparent": {forwardModes{fwdAdd, fwdAdd, fwdAdd}, false},
+	"anonymous":   {forwardModes{fwdAdd, fwdStrip, fwdStrip}, true},
+	"elite":       {forwardModes{fwdStrip, fwdStrip, fwdStrip}, true},
+}
+
+// Headers other than X-Forwarded-For and Forwarded that proxies and
+// load balancers use to pass on the client's address
+var clientIPHeaders = []string{
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"Client-Ip",
+	"True-Client-Ip",
+	"X-Originating-Ip",
+	"X-Forwarded",
+	"Forwarded-For",
+	"X-Cluster-Client-Ip",
+}
+
+// Make the policy in 'c' on top of the 'anonymity' level (if any);
+// nil if it passes everything
+func newForwardPolicy(c *ForwardConf, anonymity string) (*forwardPolicy, error) {
+	f := &forwardPolicy{}
+
+	dflt := forwardModes{fwdPass, fwdPass, fwdPass}
+	if len(anonymity) > 0 {
+		a, ok := anonymityLevels[anonymity]
+		if !ok {
+			return nil, fmt.Errorf("anonymity: must be transparent, anonymous or elite, not %q", anonymity)
+		}
+		dflt = a.forwardModes
+		if a.hideClient {
+			f.strip = clientIPHeaders
+		}
+	}
+
+	// the listener's own settings override its anonymity level
+	var err error
+	if f.dflt, err = forwardModesOf(c.Via, c.XFF, c.Forwarded, ""); err != nil {
+		return nil, err
+	}
+	if len(f.dflt.via) == 0 {
+		f.dflt.via = dflt.via
+	}
+	if len(f.dflt.xff) == 0 {
+		f.dflt.xff = dflt.xff
+	}
+	if len(f.dflt.fwd) == 0 {
+		f.dflt.fwd = dflt.fwd
+	}
+
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Dest) == 0 {
+			return nil, fmt.Errorf("forward: rule %d has no dest", i)
+		}
+
+		fr := forwardRule{dest: domainList(r.Dest)}
+
+		// unset modes are the listener's
+		fr.forwardModes, err = forwardModesOf(r.Via, r.XFF, r.Forwarded, "")
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, fr)
+	}
+
+	if f.dflt == (forwardModes{fwdPass, fwdPass, fwdPass}) && len(f.rules) == 0 && len(f.strip) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func forwardModesOf(via, xff, fwd, dflt string) (forwardModes, error) {
+	m := forwardModes{via, xff, fwd}
+	for _, p := range []*string{&m.via, &m.xff, &m.fwd} {
+		switch *p {
+		case "":
+			*p = dflt
+		case fwdPass, fwdAdd, fwdStrip:
+		default:
+			return m, fmt.Errorf("forward: mode must be add, pass or strip, not %q", *p)
+		}
+	}
+	return m, nil
+}
+
+// Return the modes for requests to 'host'
+func (f *forwardPolicy) modes(host string) forwardModes {
+	m := f.dflt
+	for i := range f.rules {
+		r := &f.rules[i]
+		if !domainMatch(r.dest, host) {
+			continue
+		}
+		if len(r.via) > 0 {
+			m.via = r.via
+		}
+		if len(r.xff) > 0 {
+			m.xff = r.xff
+		}
+		if len(r.fwd) > 0 {
+			m.fwd = r.fwd
+		}
+		break
+	}
+	return m
+}
+
+// Apply the policy to 'h', the headers we send for client request 'r'
+func (f *forwardPolicy) Apply(h http.Header, r *http.Request) {
+	if f == nil {
+		return
+	}
+
+	m := f.modes(r.URL.Hostname())
+	ip := hostOnly(r.RemoteAddr)
+
+	for _, k := range f.strip {
+		h.Del(k)
+	}
+
+	switch m.via {
+	case fwdStrip:
+		h.Del("Via")
+	case fwdAdd:
+		// fold any earlier hops into one header
+		v := fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, viaName)
+		if prior := h["Via"]; len(prior) > 0 {
+			v = strings.Join(prior, ", ") + ", " + v
+		}
+		h.Set("Via", v)
+	}
+
+	switch m.xff {
+	case fwdStrip:
+		h.Del("X-Forwarded-For")
+	case fwdAdd:
+		v := ip
+		if prior := h["X-Forwarded-For"]; len(prior) > 0 {
+			v = strings.Join(prior, ", ") + ", " + v
+		}
+		h.Set("X-Forwarded-For", v)
+	}
+
+	switch m.fwd {
+	case fwdStrip:
+		h.Del("Forwarded")
+	case fwdAdd:
+		// RFC 7239: IPv6 addresses are quoted and in brackets
+		node := ip
+		if x := net.ParseIP(ip); x != nil && x.To4() == nil {
+			node = fmt.Sprintf("\"[%s]\"", ip)
+		}
+		v := fmt.Sprintf("for=%s;host=%q;proto=%s", node, r.Host, r.URL.Scheme)
+		if prior := h["Forwarded"]; len(prior) > 0 {
+			v = strings.Join(prior, ", ") + ", " + v
+		}
+		h.Set("Forwarded", v)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
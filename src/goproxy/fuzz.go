@@ -0,0 +1,136 @@
+// fuzz.go -- go-fuzz harnesses for the protocol parsers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build gofuzz
+// +build gofuzz
+
+// Build and run one with go-fuzz, e.g.:
+//
+//	go-fuzz-build -func FuzzSocks5 goproxy
+//	go-fuzz -bin goproxy-fuzz.zip -workdir fuzz/socks5
+//
+// Each returns 1 for input the parser takes, 0 for what it rejects;
+// and panics if the result doesn't hold up. Seeds of the corpus of a
+// harness, where there are some, are in fuzz/NAME/corpus; e.g. logins
+// with the longest user and password RFC 1929 allows in fuzz/login.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// SOCKSv5 requests
+func FuzzSocks5(b []byte) int {
+	cmd, atyp, host, port, n, err := parseSocks5(b)
+	if err != nil {
+		return 0
+	}
+	if n > len(b) || len(host) == 0 {
+		panic(fmt.Sprintf("parseSocks5: %d of %d bytes, host %q", n, len(b), host))
+	}
+
+	// what we parsed must encode back to the request
+	a, err := socksAddr(host, int(port))
+	if err != nil {
+		panic(fmt.Sprintf("socksAddr %q: %s", host, err))
+	}
+	if atyp != 3 && !bytes.Equal(a, b[3:n]) {
+		panic(fmt.Sprintf("cmd %d: %x != %x", cmd, a, b[3:n]))
+	}
+	return 1
+}
+
+// SOCKSv4 and 4a requests
+func FuzzSocks4(b []byte) int {
+	_, atyp, host, _, err := parseSocks4(b)
+	if err != nil {
+		return 0
+	}
+	if atyp == 1 && net.ParseIP(host) == nil {
+		panic(fmt.Sprintf("parseSocks4: bad IP %q", host))
+	}
+	if len(host) == 0 || len(host) > 255 {
+		panic(fmt.Sprintf("parseSocks4: host of %d bytes", len(host)))
+	}
+	return 1
+}
+
+// SOCKSv5 username/password logins
+func FuzzLogin(b []byte) int {
+	user, pass, ok := parseLogin(b)
+	if !ok {
+		return 0
+	}
+	if 3+len(user)+len(pass) > len(b) {
+		panic(fmt.Sprintf("parseLogin: %d+%d bytes of %d", len(user), len(pass), len(b)))
+	}
+	if len(user) != int(b[1]) || len(pass) != int(b[2+len(user)]) {
+		panic(fmt.Sprintf("parseLogin: %d+%d bytes; the lengths say %d+%d", len(user), len(pass), b[1], b[2+len(user)]))
+	}
+	return 1
+}
+
+// SOCKSv5 UDP datagram addresses
+func FuzzSocksAddr(b []byte) int {
+	_, _, n, err := parseSocksAddr(b)
+	if err != nil {
+		return 0
+	}
+	if n > len(b) {
+		panic(fmt.Sprintf("parseSocksAddr: %d of %d bytes", n, len(b)))
+	}
+	return 1
+}
+
+// The first bytes of tunnels: protocol and TLS client hello
+func FuzzTunnel(b []byte) int {
+	classify(b)
+	if _, ok := inspectTLS(b); !ok {
+		return 0
+	}
+	return 1
+}
+
+// Trojan and VLESS headers; the password and user are those of the
+// seeds in the corpus.
+func FuzzTrojan(b []byte) int {
+	t := &trojanServer{pass: map[string]bool{string(bytes.Repeat([]byte("a"), trojanHashLen)): true}}
+	v := &vlessServer{users: map[[16]byte]bool{{}: true}}
+
+	_, _, _, _, rest, ok := t.parse(b)
+	_, _, _, _, rest2, ok2 := v.parse(b)
+	if len(rest) > len(b) || len(rest2) > len(b) {
+		panic("payload longer than the request")
+	}
+	if ok || ok2 {
+		return 1
+	}
+	return 0
+}
+
+// HTTP request heads: what the server parses and the checks we make of
+// them
+func FuzzHTTP(b []byte) int {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return 0
+	}
+	if len(r.Header) > httpMaxHeaders {
+		return 0
+	}
+	proxyAuth(r)
+	hostOnly(r.Host)
+	return 1
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,75 @@
+// gc.go -- GC tuning knobs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A ballast is a large allocation that is never touched: it raises the
+// heap size the GC paces against -- so it runs less often -- without
+// using physical memory.
+var gcBallast []byte
+
+// Parse a GOGC value: a percentage or "off"
+func parseGOGC(s string) (int, error) {
+	if strings.EqualFold(s, "off") {
+		return -1, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid gogc %q; must be a positive percentage or off", s)
+	}
+	return n, nil
+}
+
+// Apply the GC settings in 'cfg' and log the effective values. Unset
+// values keep what the runtime picked (possibly from GOGC and
+// GOMEMLIMIT in the environment).
+func applyGC(cfg *GCConf, log *L.Logger) {
+	if len(cfg.GOGC) > 0 {
+		// validated by ReadYAML
+		n, _ := parseGOGC(cfg.GOGC)
+		debug.SetGCPercent(n)
+	}
+
+	if cfg.MemLimit > 0 {
+		debug.SetMemoryLimit(int64(cfg.MemLimit))
+	}
+
+	gcBallast = nil
+	if cfg.Ballast > 0 {
+		gcBallast = make([]byte, int64(cfg.Ballast))
+	}
+
+	// There is no getter for the GC percent
+	pct := debug.SetGCPercent(100)
+	debug.SetGCPercent(pct)
+
+	gogc := "off"
+	if pct >= 0 {
+		gogc = strconv.Itoa(pct)
+	}
+
+	lim := "none"
+	if n := debug.SetMemoryLimit(-1); n != math.MaxInt64 {
+		lim = humanSize(n)
+	}
+
+	log.Info("GC: gogc %s, memory limit %s, ballast %s", gogc, lim, humanSize(int64(len(gcBallast))))
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
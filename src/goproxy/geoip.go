@@ -0,0 +1,320 @@
+// geoip.go -- country and ASN of destinations and routes by them
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A GeoIP DB: the country and ASN of ranges of addresses, read from a
+// file of lines "start end asn country [description]" (the iptoasn.com
+// format) or "start end country" separated by tabs or commas. A nil
+// geoDB knows no address.
+type geoDB struct {
+	file string
+
+	mu sync.RWMutex
+	r  []geoRange // sorted by start
+}
+
+type geoRange struct {
+	start, end [16]byte
+	asn        uint32
+	cc         string
+}
+
+// Read the DB in 'c'; nil if none is configured
+func newGeoDB(c *GeoIPConf) (*geoDB, error) {
+	if len(c.File) == 0 {
+		return nil, nil
+	}
+
+	g := &geoDB{file: c.File}
+	if err := g.Load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Read the file and replace the ranges with its own
+func (g *geoDB) Load() error {
+	r, err := readGeoFile(g.file)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	g.r = r
+	g.mu.Unlock()
+	return nil
+}
+
+func readGeoFile(fn string) ([]geoRange, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %s", err)
+	}
+	defer fd.Close()
+
+	r, err := readGeo(fd)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %s:%s", fn, err)
+	}
+	return r, nil
+}
+
+// Read the ranges of a GeoIP DB from 'rd'
+func readGeo(rd io.Reader) ([]geoRange, error) {
+	var v []geoRange
+
+	sep := func(c rune) bool { return c == '\t' || c == ',' }
+	sc := bufio.NewScanner(rd)
+	for ln := 1; sc.Scan(); ln++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		f := strings.FieldsFunc(s, sep)
+		if len(f) < 3 {
+			return nil, fmt.Errorf("%d: expected 'start end [asn] country'", ln)
+		}
+
+		a, b := net.ParseIP(strings.TrimSpace(f[0])), net.ParseIP(strings.TrimSpace(f[1]))
+		if a == nil || b == nil || bytes.Compare(a.To16(), b.To16()) > 0 {
+			return nil, fmt.Errorf("%d: invalid range %s-%s", ln, f[0], f[1])
+		}
+
+		g := geoRange{cc: strings.TrimSpace(f[2])}
+		if len(f) > 3 {
+			n, err := strconv.ParseUint(strings.TrimSpace(f[2]), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%d: invalid ASN %q", ln, f[2])
+			}
+			g.asn, g.cc = uint32(n), strings.TrimSpace(f[3])
+		}
+
+		// iptoasn has the unrouted ranges too
+		g.cc = strings.ToUpper(g.cc)
+		if g.cc == "NONE" {
+			g.cc = ""
+		}
+		if g.asn == 0 && len(g.cc) == 0 {
+			continue
+		}
+
+		copy(g.start[:], a.To16())
+		copy(g.end[:], b.To16())
+		v = append(v, g)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(v, func(i, j int) bool {
+		return bytes.Compare(v[i].start[:], v[j].start[:]) < 0
+	})
+	return v, nil
+}
+
+// Return the country and ASN of 'ip'; false if it isn't in the DB
+func (g *geoDB) Lookup(ip net.IP) (string, uint32, bool) {
+	if g == nil || ip == nil {
+		return "", 0, false
+	}
+
+	var k [16]byte
+	copy(k[:], ip.To16())
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	// the last range that starts at or before 'ip'
+	i := sort.Search(len(g.r), func(i int) bool {
+		return bytes.Compare(g.r[i].start[:], k[:]) > 0
+	})
+	if i == 0 {
+		return "", 0, false
+	}
+
+	r := &g.r[i-1]
+	if bytes.Compare(k[:], r.end[:]) > 0 {
+		return "", 0, false
+	}
+	return r.cc, r.asn, true
+}
+
+// Return the number of ranges in the DB
+func (g *geoDB) Len() int {
+	if g == nil {
+		return 0
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.r)
+}
+
+// The routes of a listener: destinations in some countries or ASNs
+// go via an upstream of their own, direct or from egress addresses of
+// their own; the first route that matches wins. A nil routeTable
+// routes all the listener's way.
+type routeTable struct {
+	geo    *geoDB
+	routes []*route
+}
+
+type route struct {
+	name   string // for the logs
+	cc     map[string]bool
+	asn    map[uint32]bool
+	up     *socks5Client
+	direct bool
+	egress *egressPool
+}
+
+// Make the routes of 'lc' looking up destinations in 'geo'; upstreams
+// are dialed with 'd'. Returns nil if there are none.
+func newRouteTable(lc *ListenConf, geo *geoDB, d *net.Dialer) (*routeTable, error) {
+	if len(lc.Routes) == 0 {
+		return nil, nil
+	}
+	if geo == nil {
+		return nil, fmt.Errorf("routes: there is no geoip DB")
+	}
+
+	t := &routeTable{geo: geo}
+	for i := range lc.Routes {
+		rc := &lc.Routes[i]
+		r, err := newRoute(rc, d)
+		if err != nil {
+			return nil, fmt.Errorf("routes: %d: %s", i, err)
+		}
+		t.routes = append(t.routes, r)
+	}
+	return t, nil
+}
+
+func newRoute(rc *RouteConf, d *net.Dialer) (*route, error) {
+	if len(rc.Country) == 0 && len(rc.ASN) == 0 {
+		return nil, fmt.Errorf("no country or asn")
+	}
+
+	r := &route{
+		cc:     make(map[string]bool),
+		asn:    make(map[uint32]bool),
+		direct: rc.Upstream == "direct",
+	}
+
+	var w []string
+	for _, c := range rc.Country {
+		if len(c) != 2 {
+			return nil, fmt.Errorf("invalid country %q", c)
+		}
+		r.cc[strings.ToUpper(c)] = true
+		w = append(w, strings.ToUpper(c))
+	}
+	for _, n := range rc.ASN {
+		r.asn[n] = true
+		w = append(w, fmt.Sprintf("AS%d", n))
+	}
+	r.name = strings.Join(w, ",")
+
+	var err error
+	if len(rc.Upstream) > 0 && !r.direct {
+		if r.up, err = newSocks5Client(rc.Upstream, d); err != nil {
+			return nil, err
+		}
+	}
+	if r.egress, err = egressPoolOf(&rc.Egress); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r.up == nil && !r.direct && r.egress == nil:
+		return nil, fmt.Errorf("no upstream or egress")
+	case r.up != nil && r.egress != nil:
+		return nil, fmt.Errorf("egress is for direct connections, not via an upstream")
+	}
+
+	// egress addresses of its own are for going direct
+	r.direct = r.direct || r.egress != nil
+	return r, nil
+}
+
+// Return the route for destination 'host' -- resolved with 'res' if
+// it is a name; nil if none matches.
+func (t *routeTable) For(ctx context.Context, res *Resolver, host string) *route {
+	if t == nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := res.LookupIP(ctx, host)
+		if err != nil || len(ips) == 0 {
+			return nil
+		}
+		ip = ips[0]
+	}
+
+	cc, asn, ok := t.geo.Lookup(ip)
+	if !ok {
+		return nil
+	}
+	for _, r := range t.routes {
+		if r.cc[cc] || r.asn[asn] {
+			return r
+		}
+	}
+	return nil
+}
+
+// Return the upstream for a connection from 'client' to 'host': the
+// route's own, none if it is direct, else one of the listener's 'pool'
+func (r *route) Upstream(pool *upstreamPool, client net.IP, host string) *socks5Client {
+	switch {
+	case r != nil && r.up != nil:
+		return r.up
+	case r != nil && r.direct, pool == nil:
+		return nil
+	}
+	return pool.Pick(client, host)
+}
+
+// Return the source addresses of a direct connection: the route's
+// own, else the listener's 'dflt'
+func (r *route) Egress(dflt *egressPool) *egressPool {
+	if r != nil && r.egress != nil {
+		return r.egress
+	}
+	return dflt
+}
+
+func (r *route) String() string {
+	switch {
+	case r == nil:
+		return "default"
+	case r.up != nil:
+		return fmt.Sprintf("%s via %s", r.name, r.up)
+	}
+	return fmt.Sprintf("%s direct", r.name)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
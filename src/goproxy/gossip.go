@@ -0,0 +1,402 @@
+// gossip.go -- bans passed between the proxies of a fleet over UDP
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A gossipNode tells the peers of the bans made here and applies
+// theirs, so a client banned on one proxy of a fleet is banned on all
+// of them within a round trip. Each message goes to every peer, which
+// passes it on once to the others -- a peer that missed it from us
+// may hear it from them. Our own bans are sent again every interval
+// for peers that were down; they lapse at the same time everywhere.
+// Bans of exempt addresses aren't applied here.
+//
+// A message is: "GPG1", the op (1 ban, 2 unban), the sender's time and
+// the ban's end (unix seconds, 8 bytes big endian; 0 is forever), a
+// random 16 byte nonce, the length of the IP and the IP, and the
+// HMAC-SHA256 of all of that with the key. As with knocks, messages
+// whose time is more than the window away from ours are ignored, as
+// are nonces seen within the window.
+type gossipNode struct {
+	conn     *net.UDPConn
+	peers    []*net.UDPAddr
+	key      []byte
+	window   time.Duration
+	interval time.Duration
+	exempt   []subnet
+	ctl      *control
+	log      *L.Logger
+
+	mu     sync.Mutex
+	own    map[string]time.Time // bans made here: IP -> end
+	nonces map[[gossipNonce]byte]time.Time
+
+	// messages sent, taken in, passed on and turned away
+	sent, recvd, relayed, bad uint64
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+const (
+	gossipMagic = "GPG1"
+	gossipNonce = 16
+	gossipBan   = 1
+	gossipUnban = 2
+
+	// the message less the IP and the HMAC
+	gossipHdrLen = len(gossipMagic) + 1 + 8 + 8 + gossipNonce + 1
+
+	defaultGossipInterval = 30 * time.Second
+	defaultGossipWindow   = 30 * time.Second
+)
+
+// Make the node in 'c' and bind its UDP port; nil if there is none
+func newGossipNode(c *GossipConf, log *L.Logger) (*gossipNode, error) {
+	if len(c.Listen) == 0 {
+		return nil, nil
+	}
+	if len(c.Key) < 16 {
+		return nil, fmt.Errorf("gossip: key must be at least 16 characters")
+	}
+
+	g := &gossipNode{
+		key:      []byte(c.Key),
+		window:   time.Duration(c.Window),
+		interval: time.Duration(c.Interval),
+		exempt:   c.Exempt,
+		log:      log.New("gossip", 0),
+		own:      make(map[string]time.Time),
+		nonces:   make(map[[gossipNonce]byte]time.Time),
+		stop:     make(chan bool),
+	}
+	if g.window <= 0 {
+		g.window = defaultGossipWindow
+	}
+	if g.interval <= 0 {
+		g.interval = defaultGossipInterval
+	}
+
+	for _, p := range c.Peers {
+		a, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, fmt.Errorf("gossip: peer %s: %s", p, err)
+		}
+		g.peers = append(g.peers, a)
+	}
+
+	a, err := net.ResolveUDPAddr("udp", c.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: %s", err)
+	}
+	if g.conn, err = net.ListenUDP("udp", a); err != nil {
+		return nil, fmt.Errorf("gossip: %s", err)
+	}
+	return g, nil
+}
+
+// Tell the peers of the bans of 'ctl' and apply theirs to it
+func (g *gossipNode) Share(ctl *control) {
+	if g != nil {
+		g.ctl = ctl
+		ctl.gossip = g
+	}
+}
+
+func (g *gossipNode) Start() {
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		g.serve()
+	}()
+
+	go func() {
+		defer g.wg.Done()
+
+		t := time.NewTicker(g.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-t.C:
+				g.resend()
+			}
+		}
+	}()
+}
+
+func (g *gossipNode) Stop() {
+	close(g.stop)
+	g.conn.Close()
+	g.wg.Wait()
+}
+
+// Tell the peers 'ip' is banned until 'until' (zero is forever)
+func (g *gossipNode) Ban(ip string, until time.Time) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	g.own[ip] = until
+	g.mu.Unlock()
+	g.send(gossipBan, ip, until, nil)
+}
+
+// Tell the peers the ban of 'ip' is lifted
+func (g *gossipNode) Unban(ip string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	delete(g.own, ip)
+	g.mu.Unlock()
+	g.send(gossipUnban, ip, time.Time{}, nil)
+}
+
+// Send our bans again; those that have lapsed are forgotten
+func (g *gossipNode) resend() {
+	now := time.Now()
+	bans := make(map[string]time.Time)
+
+	g.mu.Lock()
+	for ip, t := range g.own {
+		if !t.IsZero() && !now.Before(t) {
+			delete(g.own, ip)
+			continue
+		}
+		bans[ip] = t
+	}
+	for n, t := range g.nonces {
+		if now.Sub(t) > 2*g.window {
+			delete(g.nonces, n)
+		}
+	}
+	g.mu.Unlock()
+
+	for ip, t := range bans {
+		g.send(gossipBan, ip, t, nil)
+	}
+}
+
+// Send a new message to the peers
+func (g *gossipNode) send(op byte, ip string, until time.Time, skip *net.UDPAddr) {
+	b, err := makeGossip(g.key, op, net.ParseIP(ip), until, time.Now())
+	if err != nil {
+		g.log.Error("%s: %s", ip, err)
+		return
+	}
+
+	var nonce [gossipNonce]byte
+	copy(nonce[:], b[len(gossipMagic)+17:])
+	g.mu.Lock()
+	g.nonces[nonce] = time.Now()
+	g.mu.Unlock()
+
+	g.sendTo(b, skip)
+}
+
+// Send message 'b' to every peer but 'skip'
+func (g *gossipNode) sendTo(b []byte, skip *net.UDPAddr) {
+	for _, p := range g.peers {
+		if skip != nil && p.IP.Equal(skip.IP) && p.Port == skip.Port {
+			continue
+		}
+		if _, err := g.conn.WriteToUDP(b, p); err != nil {
+			g.log.Debug("%s: %s", p, err)
+			continue
+		}
+		atomic.AddUint64(&g.sent, 1)
+	}
+}
+
+func (g *gossipNode) serve() {
+	b := make([]byte, 512)
+	for {
+		n, from, err := g.conn.ReadFromUDP(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		op, ip, until, err := g.check(b[:n], time.Now())
+		if err != nil {
+			atomic.AddUint64(&g.bad, 1)
+			g.log.Debug("%s: bad message: %s", from, err)
+			continue
+		}
+		atomic.AddUint64(&g.recvd, 1)
+
+		// pass it on before acting on it
+		g.sendTo(b[:n], from)
+		atomic.AddUint64(&g.relayed, 1)
+
+		if g.exempted(ip) {
+			g.log.Info("%s: ignoring the %s of exempt %s", from, gossipOps[op], ip)
+			continue
+		}
+
+		switch op {
+		case gossipBan:
+			if g.ctl.peerBan(ip, until) {
+				g.log.Info("%s: banned %s until %s", from, ip, banEnd(until))
+			}
+		case gossipUnban:
+			if g.ctl.peerUnban(ip) {
+				g.log.Info("%s: lifted the ban on %s", from, ip)
+			}
+		}
+	}
+}
+
+var gossipOps = map[byte]string{gossipBan: "ban", gossipUnban: "unban"}
+
+func banEnd(t time.Time) string {
+	if t.IsZero() {
+		return "restart"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Return true if the bans of 'ip' from peers don't apply here
+func (g *gossipNode) exempted(ip net.IP) bool {
+	for i := range g.exempt {
+		if g.exempt[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify message 'b' received at 'now', remember its nonce and return
+// what it says
+func (g *gossipNode) check(b []byte, now time.Time) (byte, net.IP, time.Time, error) {
+	var none time.Time
+
+	if len(b) < gossipHdrLen+sha256.Size || string(b[:len(gossipMagic)]) != gossipMagic {
+		return 0, nil, none, fmt.Errorf("not a gossip message")
+	}
+
+	body := b[:len(b)-sha256.Size]
+	h := hmac.New(sha256.New, g.key)
+	h.Write(body)
+	if !hmac.Equal(h.Sum(nil), b[len(body):]) {
+		return 0, nil, none, fmt.Errorf("wrong signature")
+	}
+
+	p := body[len(gossipMagic):]
+	op := p[0]
+	t := time.Unix(int64(binary.BigEndian.Uint64(p[1:])), 0)
+	end := int64(binary.BigEndian.Uint64(p[9:]))
+	var nonce [gossipNonce]byte
+	copy(nonce[:], p[17:])
+	ip := net.IP(p[17+gossipNonce+1:])
+
+	if _, ok := gossipOps[op]; !ok {
+		return 0, nil, none, fmt.Errorf("unknown op %d", op)
+	}
+	if n := int(p[17+gossipNonce]); n != len(ip) || (n != net.IPv4len && n != net.IPv6len) {
+		return 0, nil, none, fmt.Errorf("bad IP")
+	}
+	if d := now.Sub(t); d > g.window || d < -g.window {
+		return 0, nil, none, fmt.Errorf("time is off by %s", d)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.nonces[nonce]; ok {
+		return 0, nil, none, fmt.Errorf("seen")
+	}
+	g.nonces[nonce] = now
+
+	var until time.Time
+	if end > 0 {
+		until = time.Unix(end, 0)
+	}
+	return op, append(net.IP(nil), ip...), until, nil
+}
+
+// Return a message of 'op' on 'ip' until 'until' signed with 'key' for
+// time 'now'
+func makeGossip(key []byte, op byte, ip net.IP, until, now time.Time) ([]byte, error) {
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b := make([]byte, 0, gossipHdrLen+len(ip)+sha256.Size)
+	b = append(b, gossipMagic...)
+	b = append(b, op)
+
+	var end int64
+	if !until.IsZero() {
+		end = until.Unix()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(now.Unix()))
+	b = binary.BigEndian.AppendUint64(b, uint64(end))
+
+	var nonce [gossipNonce]byte
+	rand.Read(nonce[:])
+	b = append(b, nonce[:]...)
+	b = append(b, byte(len(ip)))
+	b = append(b, ip...)
+
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(b), nil
+}
+
+// The gossip counters as described by GET /stats
+type gossipStats struct {
+	Peers   int    `json:"peers"`
+	Own     int    `json:"own"` // bans made here
+	Sent    uint64 `json:"sent"`
+	Recvd   uint64 `json:"received"`
+	Relayed uint64 `json:"relayed"`
+	Bad     uint64 `json:"bad"`
+}
+
+func (g *gossipNode) Stats() *gossipStats {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	own := len(g.own)
+	g.mu.Unlock()
+	return &gossipStats{
+		Peers:   len(g.peers),
+		Own:     own,
+		Sent:    atomic.LoadUint64(&g.sent),
+		Recvd:   atomic.LoadUint64(&g.recvd),
+		Relayed: atomic.LoadUint64(&g.relayed),
+		Bad:     atomic.LoadUint64(&g.bad),
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
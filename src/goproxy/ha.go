@@ -0,0 +1,305 @@
+// ha.go -- active/passive pairs: takeover of a failed primary
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// States of a member of a pair; keepalived's FAULT is ours too
+const (
+	haPrimary = "primary"
+	haStandby = "standby"
+	haFault   = "fault"
+)
+
+// Defaults of the peer probes; and how long a hook may run
+const (
+	defaultHAInterval = time.Second
+	defaultHAFailures = 3
+	haHookTimeout     = 30 * time.Second
+	haHistory         = 16
+)
+
+// A haNode is our half of an active/passive pair. A standby probes the
+// primary and takes over when it stops answering; or is told to by
+// keepalived or an operator via the admin API. Each change of state
+// runs the hooks that move the virtual IP and is kept with the number
+// of connections open at the time, so one can see the new primary pick
+// up the clients the old one drops. A nil haNode is always primary.
+type haNode struct {
+	cfg      HAConf
+	interval time.Duration
+	failures int
+	ctl      *control
+	alert    *alerter
+	log      *L.Logger
+
+	mu     sync.Mutex // serializes changes of state and their hooks
+	state  string
+	since  time.Time
+	base   uint64 // connections accepted before 'since'
+	fails  int    // probes of the peer failed in a row
+	peerUp bool
+	hist   []haTransition // last haHistory, newest last
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// A change of state as described by GET /ha
+type haTransition struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Open   int64     `json:"open"` // connections open at the time
+	Error  string    `json:"error,omitempty"`
+}
+
+// Make our half of the pair in 'c'; nil if we aren't in one
+func newHANode(c *HAConf, ctl *control, alert *alerter, log *L.Logger) *haNode {
+	if len(c.State) == 0 && len(c.Peer) == 0 {
+		return nil
+	}
+
+	h := &haNode{
+		cfg:      *c,
+		interval: time.Duration(c.Interval),
+		failures: c.Failures,
+		ctl:      ctl,
+		alert:    alert,
+		log:      log.New("ha", 0),
+		state:    c.State,
+		stop:     make(chan bool),
+	}
+	if h.interval <= 0 {
+		h.interval = defaultHAInterval
+	}
+	if h.failures <= 0 {
+		h.failures = defaultHAFailures
+	}
+	if len(h.state) == 0 {
+		h.state = haStandby
+	}
+	return h
+}
+
+// Take up the configured state -- running the takeover hook if it is
+// primary -- and start probing the peer
+func (h *haNode) Start() {
+	s := h.state
+	h.state = ""
+	h.Set(s, "start")
+
+	if len(h.cfg.Peer) == 0 {
+		return
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		t := time.NewTicker(h.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-t.C:
+				h.probe()
+			}
+		}
+	}()
+}
+
+// Stop probing; a primary gives up the virtual IP so the standby needn't
+// wait for its probes to fail
+func (h *haNode) Stop() {
+	close(h.stop)
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == haPrimary {
+		h.hook(h.cfg.Release, "stopped", haPrimary)
+	}
+}
+
+// Connect to the peer; a standby takes over after enough fail in a row
+func (h *haNode) probe() {
+	c, err := net.DialTimeout("tcp", h.cfg.Peer, h.interval)
+	if err == nil {
+		c.Close()
+	}
+
+	h.mu.Lock()
+	h.peerUp = err == nil
+	if err == nil {
+		h.fails = 0
+		h.mu.Unlock()
+		return
+	}
+
+	h.fails++
+	n, s := h.fails, h.state
+	h.mu.Unlock()
+
+	h.log.Debug("peer %s: %s (%d in a row)", h.cfg.Peer, err, n)
+	if s == haStandby && n >= h.failures {
+		h.Set(haPrimary, fmt.Sprintf("peer %s is down: %s", h.cfg.Peer, err))
+	}
+}
+
+// Change to state 's' for 'reason', running the hooks; an error is
+// that of a hook, and the state changes regardless.
+func (h *haNode) Set(s, reason string) error {
+	switch s {
+	case haPrimary, haStandby, haFault:
+	default:
+		return fmt.Errorf("ha: unknown state %q", s)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s == h.state {
+		return nil
+	}
+
+	x := haTransition{
+		Time:   time.Now(),
+		From:   h.state,
+		To:     s,
+		Reason: reason,
+		Open:   atomic.LoadInt64(&h.ctl.open),
+	}
+	h.state, h.since = s, x.Time
+	h.base = atomic.LoadUint64(&h.ctl.total)
+	h.fails = 0
+
+	var err error
+	switch {
+	case s == haPrimary:
+		err = h.hook(h.cfg.Takeover, s, x.From)
+	case x.From == haPrimary:
+		err = h.hook(h.cfg.Release, s, x.From)
+	}
+	if err != nil {
+		x.Error = err.Error()
+	}
+
+	h.hist = append(h.hist, x)
+	if len(h.hist) > haHistory {
+		h.hist = h.hist[len(h.hist)-haHistory:]
+	}
+
+	if len(x.From) == 0 {
+		h.log.Info("starting as %s", s)
+	} else {
+		h.log.Info("%s -> %s: %s; %d connections open", x.From, s, reason, x.Open)
+		h.alert.Alert("ha", fmt.Sprintf("now %s: %s", s, reason), &x)
+	}
+	return err
+}
+
+// Run 'script' with the new and old state as its arguments. Must be
+// called with the lock held.
+func (h *haNode) hook(script, to, from string) error {
+	if len(script) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), haHookTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, script, to, from).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%s %s: %s: %s", script, to, err, strings.TrimSpace(string(out)))
+		h.log.Error("%s", err)
+	}
+	return err
+}
+
+// Return the current state; primary if we aren't in a pair
+func (h *haNode) State() string {
+	if h == nil {
+		return haPrimary
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Our half of the pair as described by GET /ha
+type haStatus struct {
+	State       string         `json:"state"`
+	Since       time.Time      `json:"since"`
+	Peer        string         `json:"peer,omitempty"`
+	PeerUp      bool           `json:"peer_up"`
+	Open        int64          `json:"open"`
+	Accepted    uint64         `json:"accepted"` // since 'Since'
+	Transitions []haTransition `json:"transitions"`
+}
+
+func (h *haNode) status() *haStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &haStatus{
+		State:       h.state,
+		Since:       h.since,
+		Peer:        h.cfg.Peer,
+		PeerUp:      h.peerUp,
+		Open:        atomic.LoadInt64(&h.ctl.open),
+		Accepted:    atomic.LoadUint64(&h.ctl.total) - h.base,
+		Transitions: append([]haTransition(nil), h.hist...),
+	}
+}
+
+// Admin API for the pair:
+//
+//	GET  /ha                           state, connections and transitions
+//	POST /ha?state=S[&reason=R]        change to S (primary, standby, fault)
+func (h *haNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, h.status())
+
+	case "POST":
+		s := r.URL.Query().Get("state")
+		why := r.URL.Query().Get("reason")
+		if len(why) == 0 {
+			why = "admin API"
+		}
+
+		err := h.Set(s, why)
+		if err != nil && h.State() != s {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, h.status())
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -10,10 +10,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strings"
 	"sync"
@@ -23,79 +25,272 @@ import (
 	"github.com/opencoff/go-ratelimit"
 )
 
+// Bounds on the request headers of clients
+const (
+	httpMaxHeaders     = 100
+	httpMaxHeaderBytes = 64 << 10
+)
+
 type HTTPProxy struct {
 	*net.TCPListener
 
 	// listen address
 	conf *ListenConf
 
+	cat CategoryDB
+	bl  *blocklist
+	dst *destTable
+	res *Resolver
+
 	grl *ratelimit.Ratelimiter
-	prl *ratelimit.PerIPRatelimiter
+	prl *perIPLimiter
+
+	// fault injection; nil unless configured
+	chaos *chaos
+
+	// requests we answer ourselves
+	static []*staticRule
+
+	// the web site that non-proxy requests go to; nil if none
+	web http.Handler
+
+	// set if clients talk to us over TLS
+	tls *tls.Config
+
+	// Via, X-Forwarded-For and Forwarded headers; nil passes them
+	fwd *forwardPolicy
+
+	// security headers added to responses; nil adds none
+	sec *secHeaders
+
+	// shadow copy of requests and tunnels; nil unless configured
+	mirror *mirror
 
 	log  *L.Logger
 	ulog *L.Logger
 
+	sample *logSampler
+	flags  *listenerFlags
+	acl    *listenerACL
+	sch    *listenerSchedule
+	knock  *knockGate
+	auth   *authenticator
+	opa    *opaClient
+	ctl    *control
+	acc    *acceptStats
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	tr *http.Transport
+	tr       *http.Transport
+	rt       http.RoundTripper // tr or a cassette around it
+	dialer   *net.Dialer
+	upstream *upstreamPool
+	routes   *routeTable
+	egress   *egressPool
+	family   *familyPolicy
+	linger   int // SO_LINGER of outbound connections; -1 for the OS default
+	qos      *qosPolicy
+	ka       *keepalivePolicy
 
 	srv *http.Server
 
 	wg sync.WaitGroup
 
-	flush int
+	// the reason the proxy stopped serving on its own
+	failed chan error
+
+	flush *flushPolicy
+
+	// connections handed to us by a sniffing SOCKS listener; nil if
+	// we accept our own
+	sniffed *connQueue
 }
 
-func NewHTTPProxy(lc *ListenConf, log, ulog *L.Logger) (Proxy, error) {
+func NewHTTPProxy(lc *ListenConf, res *Resolver, cat CategoryDB, geo *geoDB, bl *blocklist, dst *destTable, ls *logSampler, ff *listenerFlags, acl *listenerACL, sch *listenerSchedule, kn *knockGate, au *authenticator, oa *opaClient, ctl *control, log, ulog *L.Logger) (Proxy, error) {
 	addr := lc.Listen
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("http listen address is empty")
+	}
+
 	la, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
-		die("Can't resolve %s: %s", addr, err)
+		return nil, fmt.Errorf("can't resolve %s: %s", addr, err)
+	}
+
+	mt, err := newMTUPolicy(&lc.MTU)
+	if err != nil {
+		return nil, err
 	}
 
 	ln, err := net.ListenTCP("tcp", la)
 	if err != nil {
-		die("Can't listen on %s: %s", addr, err)
+		return nil, fmt.Errorf("can't listen on %s: %s", addr, err)
+	}
+	if err = mt.Listener(ln); err != nil {
+		ln.Close()
+		return nil, err
 	}
 
-	// Conf file specifies ratelimit as N conns/sec
-	grl, _ := ratelimit.New(lc.Ratelimit.Global, 1)
-	prl, _ := ratelimit.NewPerIPRatelimiter(lc.Ratelimit.PerHost, 1)
+	p, err := newHTTPProxy(lc, ln, ctl.Listener(lc, ln), res, cat, geo, bl, dst, ls, ff, acl, sch, kn, au, oa, ctl, log, ulog)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return p, nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+// Make the HTTP proxy of 'lc' serving 'ln' whose accept counters are
+// 'acc'
+func newHTTPProxy(lc *ListenConf, ln *net.TCPListener, acc *acceptStats, res *Resolver, cat CategoryDB, geo *geoDB, bl *blocklist, dst *destTable, ls *logSampler, ff *listenerFlags, acl *listenerACL, sch *listenerSchedule, kn *knockGate, au *authenticator, oa *opaClient, ctl *control, log, ulog *L.Logger) (*HTTPProxy, error) {
+	mt, err := newMTUPolicy(&lc.MTU)
+	if err != nil {
+		return nil, err
+	}
 
 	d := &net.Dialer{
-		Timeout:   5 * time.Second,
+		Timeout:   time.Duration(lc.Timeouts.Dial),
 		KeepAlive: 10 * time.Second,
+		Control:   mt.Control(),
+	}
+
+	up, err := newUpstreamPool(lc, d, log)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := newRouteTable(lc, geo, d)
+	if err != nil {
+		return nil, err
+	}
+
+	eg, err := newEgressPool(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := newFamilyPolicy(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	lg, err := parseLinger(lc.Outbound.Linger)
+	if err != nil {
+		return nil, err
+	}
+
+	qos, err := newQoSPolicy(&lc.QoS, cat)
+	if err != nil {
+		return nil, err
+	}
+
+	idle := lc.Outbound.IdlePerHost
+	if idle <= 0 {
+		idle = defaultIdlePerHost
 	}
 
+	st, err := newStaticRules(lc.Static)
+	if err != nil {
+		return nil, err
+	}
+
+	fwd, err := newForwardPolicy(&lc.Forward, lc.Anonymity)
+	if err != nil {
+		return nil, err
+	}
+
+	fl, err := newFlushPolicy(&lc.Flush)
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := newListenerTLS(&lc.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	// Conf file specifies ratelimit as N conns/sec
+	grl, _ := ratelimit.New(lc.Ratelimit.Global, 1)
+	prl := newPerIPLimiter(lc.Ratelimit.PerHost, time.Duration(lc.Ratelimit.Idle))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	p := &HTTPProxy{
 		TCPListener: ln,
+		dialer:      d,
+		upstream:    up,
+		routes:      rt,
+		egress:      eg,
+		family:      fp,
+		linger:      lg,
+		qos:         qos,
+		ka:          newKeepalivePolicy(&lc.Keepalive),
 		conf:        lc,
-		log:         log.New("http-"+ln.Addr().String(), 0),
+		cat:         cat,
+		bl:          bl,
+		dst:         dst,
+		res:         res,
+		log:         log.New(logName("http", lc, ln), 0),
 		ulog:        ulog,
+		sample:      ls,
+		flags:       ff,
+		acl:         acl,
+		sch:         sch,
+		knock:       kn,
+		auth:        au,
+		opa:         oa,
+		ctl:         ctl,
+		acc:         acc.RateLimiter(prl),
 		grl:         grl,
 		prl:         prl,
+		chaos:       newChaos(&lc.Chaos),
+		static:      st,
+		tls:         tc,
+		fwd:         fwd,
+		sec:         newSecHeaders(&lc.SecurityHeaders),
+		flush:       fl,
 		ctx:         ctx,
 		cancel:      cancel,
+		failed:      make(chan error, 1),
 
 		tr: &http.Transport{
-			Dial:                d.Dial,
-			TLSHandshakeTimeout: 8 * time.Second,
-			MaxIdleConnsPerHost: 32,
-			IdleConnTimeout:     60 * time.Second,
+			TLSHandshakeTimeout: time.Duration(lc.Timeouts.TLSHandshake),
+			MaxIdleConnsPerHost: idle,
+			IdleConnTimeout:     time.Duration(lc.Timeouts.Idle),
 		},
 
 		srv: &http.Server{
-			Addr:           addr,
+			Addr:           lc.Listen,
 			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+			WriteTimeout:   httpWriteTimeout,
+			MaxHeaderBytes: httpMaxHeaderBytes,
 		},
 	}
 
 	p.srv.Handler = p
+	p.srv.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			p.ctl.Trace(p.log, c.RemoteAddr().String(), "closed")
+			p.ctl.TraceDone(c.RemoteAddr().String())
+		}
+	}
+	p.tr.DialContext = p.dial
+
+	p.rt, err = newCassette(&lc.Cassette, p.tr, p.log)
+	if err == nil {
+		p.mirror, err = newMirror(&lc.Mirror, p.log)
+	}
+	if err == nil {
+		p.web, err = newWebFallback(lc.Fallback, p.log)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if p.chaos != nil {
+		p.log.Warn("fault injection is on: %s", p.chaos)
+	}
 
 	return p, nil
 }
@@ -103,46 +298,209 @@ func NewHTTPProxy(lc *ListenConf, log, ulog *L.Logger) (Proxy, error) {
 // Start listener
 func (p *HTTPProxy) Start() {
 
+	if p.upstream != nil {
+		p.upstream.Start()
+	}
+
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 		p.log.Info("Starting HTTP proxy ..")
-		p.srv.Serve(p)
+		var ln net.Listener = p
+		if p.sniffed != nil {
+			ln = p.sniffed
+		}
+		if p.tls != nil {
+			ln = tls.NewListener(ln, p.tls)
+		}
+		err := p.srv.Serve(ln)
+		if p.ctx.Err() == nil {
+			p.log.Error("HTTP proxy stopped: %s", err)
+			p.failed <- err
+		}
 	}()
 }
 
+// Failed returns a channel that yields an error if the proxy stops
+// serving without being asked to
+func (p *HTTPProxy) Failed() <-chan error {
+	return p.failed
+}
+
+// Context key for the client IP of a request
+type clientKey struct{}
+
+// Dial the destination for a request or CONNECT tunnel
+func (p *HTTPProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addr = safeSearchAddr(&p.conf.Safesearch, addr)
+	ip, _ := ctx.Value(clientKey{}).(net.IP)
+
+	var c net.Conn
+	var err error
+	h, _, _ := net.SplitHostPort(addr)
+	rt := p.routes.For(ctx, p.res, h)
+	if up := rt.Upstream(p.upstream, ip, h); up != nil {
+		c, err = up.DialContext(ctx, network, addr)
+	} else {
+		eg := rt.Egress(p.egress)
+		d := func(dst net.IP) *net.Dialer {
+			return p.qos.Dialer(eg.Dialer(p.dialer, ip, dst), addr)
+		}
+		c, err = p.res.Dial(ctx, d, p.family, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setLinger(c, p.linger)
+	p.ka.Set(c)
+	return c, nil
+}
+
 // Stop server
 // XXX Hijacked Websocket conns are not shutdown here
 func (p *HTTPProxy) Stop() {
 	p.cancel()
-	p.TCPListener.Close() // causes Accept() to abort
+	if p.sniffed != nil {
+		p.sniffed.Close()
+	} else {
+		p.TCPListener.Close() // causes Accept() to abort
+	}
 
 	cx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
 	p.srv.Shutdown(cx)
 	cancel()
 
 	p.wg.Wait()
+	if p.upstream != nil {
+		p.upstream.Stop()
+	}
 	p.log.Info("HTTP proxy shutdown")
 }
 
 // XXX How do we handle websockets?
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// XXX Error counts written somewhere?
+	if len(r.Header) > httpMaxHeaders {
+		p.log.Debug("%s: %d headers; denied", r.RemoteAddr, len(r.Header))
+		http.Error(w, "Too many headers", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	// Clients denied by the ACL only get this far when we keep a URL
+	// log; see Accept()
+	if !p.acl.Allows(remoteIP(r.RemoteAddr)) {
+		p.sample.Debug(p.log, logACL, "%s: ACL failure", r.RemoteAddr)
+		p.acc.Dropped(dropACL)
+		p.ulogDenied(r, http.StatusForbidden, "acl")
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	p.ctl.Trace(p.log, r.RemoteAddr, "request %s %s", r.Method, r.URL.String())
+
+	if p.flags.On(flagPayload) {
+		if b, err := httputil.DumpRequest(redactedRequest(r), false); err == nil {
+			p.log.Info("%s: request:\n%s", r.RemoteAddr, b)
+		}
+	}
+
+	// non-proxy requests are for the web site; they need no user
+	if (r.Method == "CONNECT" || r.URL.IsAbs()) && !p.login(w, r) {
+		return
+	}
 
 	if r.Method == "CONNECT" {
 		p.handleConnect(w, r)
 		return
 	}
 
+	// A non-proxy request can match too: e.g. a shortlink host that
+	// resolves to us
+	host := r.URL.Hostname()
+	if !r.URL.IsAbs() {
+		host = hostOnly(r.Host)
+	}
+	if s := matchStatic(p.static, host, r.URL.Path); s != nil {
+		u := r.URL.String()
+		if !r.URL.IsAbs() {
+			u = "http://" + r.Host + r.URL.RequestURI()
+		}
+		p.log.Debug("%s: static %d for %s", r.RemoteAddr, s.status, u)
+		if p.ulog != nil {
+			now := time.Now().UTC().Format(time.RFC3339)
+			p.ulog.Info("time=%q url=%q status=\"%d\" static=\"1\" ua=%q",
+				now, u, s.status, r.UserAgent())
+		}
+		s.ServeHTTP(w, r)
+		return
+	}
+
 	if !r.URL.IsAbs() {
+		if p.web != nil {
+			p.log.Debug("%s: non-proxy req for %q; sent to the web site", r.RemoteAddr, r.URL.String())
+			p.web.ServeHTTP(w, r)
+			return
+		}
 		p.log.Debug("%s: non-proxy req for %q", r.Host, r.URL.String())
 		http.Error(w, "No support for non-proxy requests", 500)
 		return
 	}
 
+	if p.dnsLeak(r) {
+		http.Error(w, "Ask for names, not addresses", http.StatusForbidden)
+		return
+	}
+
+	if p.bl.Blocked(r.URL.Hostname()) {
+		p.log.Info("%s: denied %s: blocklist", r.RemoteAddr, r.URL.String())
+		p.ulogDenied(r, http.StatusForbidden, "blocklist")
+		p.acc.Failed(failPolicy)
+		http.Error(w, "Blocked site", http.StatusForbidden)
+		return
+	}
+
+	if c := categoryDenied(p.cat, p.conf.DenyCategories, r.URL.Hostname()); len(c) > 0 {
+		p.log.Info("%s: denied %s: category %s", r.RemoteAddr, r.URL.String(), c)
+		p.ulogDenied(r, http.StatusForbidden, "category "+c)
+		p.acc.Failed(failPolicy)
+		http.Error(w, "Blocked site category "+c, http.StatusForbidden)
+		return
+	}
+	if c := p.acl.Shadow().Category(p.cat, r.URL.Hostname()); len(c) > 0 {
+		p.sample.Info(p.log, logShadow, "shadow: %s would be denied %s: category %s", r.RemoteAddr, r.URL.String(), c)
+	}
+
+	if ok, why := p.opa.Allow(p.opaInput(r)); !ok {
+		p.log.Info("%s: denied %s: %s", r.RemoteAddr, r.URL.String(), why)
+		p.ulogDenied(r, http.StatusForbidden, why)
+		p.acc.Failed(failPolicy)
+		http.Error(w, "Denied by policy", http.StatusForbidden)
+		return
+	}
+
+	if !p.dst.Open(host) {
+		p.acc.Dropped(dropDestLimit)
+		p.sample.Info(p.log, logDestLimit, "%s: %s has too many connections", r.RemoteAddr, host)
+		p.ulogDenied(r, http.StatusServiceUnavailable, "too many connections")
+		http.Error(w, "Too many connections to "+host, http.StatusServiceUnavailable)
+		return
+	}
+
+	lim := &p.conf.Sizelimit
+	body := &limitReader{max: int64(lim.Upload)}
+	var nr int64
+
+	ctx, cancel := context.WithCancel(r.Context())
+	id := p.ctl.Track(p.conf.String(), r.RemoteAddr, p.user(r), r.URL.String(), cancel)
+
+	defer func() {
+		cancel()
+		p.ctl.Done(id, body.n, nr)
+		p.dst.Close(host, body.n, nr)
+	}()
+
 	t0 := time.Now()
 
-	ctx := r.Context()
+	ctx = context.WithValue(ctx, clientKey{}, remoteIP(r.RemoteAddr))
 
 	req := r.WithContext(ctx) // includes shallow copy of maps etc.
 	if r.ContentLength == 0 {
@@ -152,28 +510,83 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	req.Header = cloneCleanHeader(r.Header)
 	req.Close = false
 
-	/* XXX use config file to determine if we want to set XFF
-	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := req.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	// "TE: trailers" is the one TE that is end to end: gRPC servers
+	// refuse requests without it.
+	if hasToken(r.Header["Te"], "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+
+	// Pooled connections to the origin are shared by all clients; so
+	// sticky routing needs a fresh connection via the client's upstream.
+	if p.conf.Sticky.Enable && p.upstream != nil {
+		req.Close = true
+	}
+
+	if req.Body != nil {
+		if lim.Upload > 0 && r.ContentLength > int64(lim.Upload) {
+			p.log.Info("%s: upload of %d bytes exceeds limit %d: %s",
+				r.RemoteAddr, r.ContentLength, lim.Upload, r.URL.String())
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body.ReadCloser = req.Body
+		req.Body = body
+	}
+
+	// The mirror gets a copy of the request once the destination has
+	// had all of its body
+	if mb := p.mirror.Body(req); mb != nil {
+		if req.Body != nil {
+			req.Body = mb
 		}
-		req.Header.Set("X-Forwarded-For", clientIP)
+		defer p.mirror.Request(r, mb)
 	}
-	*/
 
-	res, err := p.tr.RoundTrip(r)
+	p.fwd.Apply(req.Header, r)
+
+	p.chaos.Delay(ctx)
+	res, err := p.rt.RoundTrip(req)
 	if err != nil {
+		p.dst.Fail(host)
+		if body.exceeded {
+			p.log.Info("%s: upload exceeds limit %d: %s",
+				r.RemoteAddr, lim.Upload, r.URL.String())
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		p.acc.Failed(failure(err))
+		p.ctl.Trace(p.log, r.RemoteAddr, "%s failed: %s: %s", r.URL.String(), failNames[failure(err)], err)
 		p.log.Debug("%s: %s", r.Host, err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
+	if lim.Download > 0 && res.ContentLength > int64(lim.Download) {
+		res.Body.Close()
+		p.log.Info("%s: download of %d bytes exceeds limit %d: %s",
+			r.RemoteAddr, res.ContentLength, lim.Download, r.URL.String())
+		http.Error(w, "Response body too large", http.StatusForbidden)
+		return
+	}
+
+	if b := mimeBlocked(&p.conf.Mimefilter, r, p.user(r), res); len(b) > 0 {
+		res.Body.Close()
+		p.log.Info("%s: blocked %s: %s", r.RemoteAddr, b, r.URL.String())
+		if p.ulog != nil {
+			now := time.Now().UTC().Format(time.RFC3339)
+			p.ulog.Info("time=%q url=%q status=\"%d\" blocked=%q ua=%q",
+				now, r.URL.String(), http.StatusForbidden, b, r.UserAgent())
+		}
+		http.Error(w, "Blocked content type", http.StatusForbidden)
+		return
+	}
+
 	t1 := time.Now()
+	p.ctl.Trace(p.log, r.RemoteAddr, "%s: %s", r.URL.String(), res.Status)
 
 	copyHeader(w.Header(), res.Header)
+	p.sec.Apply(w.Header(), host)
 
 	// The "Trailer" header isn't included in the Transport's response,
 	// at least for *http.Transport. Build it up from Trailer.
@@ -196,7 +609,30 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	nr, _ := io.Copy(w, res.Body)
+	out, done := p.flush.Writer(w, host, res)
+	defer done()
+
+	if cut, ok := p.chaos.Truncate(res.ContentLength); ok {
+		nr, _ = io.CopyN(out, res.Body, cut)
+		res.Body.Close()
+		p.log.Debug("%s: chaos: response truncated after %d bytes: %s",
+			r.RemoteAddr, nr, r.URL.String())
+		panic(http.ErrAbortHandler)
+	}
+
+	if lim.Download > 0 {
+		nr, _ = io.Copy(out, io.LimitReader(res.Body, int64(lim.Download)+1))
+		if nr > int64(lim.Download) {
+			res.Body.Close()
+			p.log.Info("%s: download exceeds limit %d; truncated: %s",
+				r.RemoteAddr, lim.Download, r.URL.String())
+
+			// abort the response so the client sees a truncated transfer
+			panic(http.ErrAbortHandler)
+		}
+	} else {
+		nr, _ = io.Copy(out, res.Body)
+	}
 	res.Body.Close() // close now, instead of defer, to populate res.Trailer
 
 	if len(res.Trailer) == announcedTrailers {
@@ -220,9 +656,46 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		now := time.Now().UTC().Format(time.RFC3339)
 
-		p.ulog.Info("time=%q url=%q status=\"%d\" bytes=\"%d\" upstream=%q downstream=%q",
-			now, r.URL.String(), res.StatusCode, nr, d0, d1)
+		p.ulog.Info("time=%q url=%q status=\"%d\" bytes=\"%d\" upstream=%q downstream=%q ua=%q",
+			now, r.URL.String(), res.StatusCode, nr, d0, d1, r.UserAgent())
+	}
+}
+
+// Count and log request 'r' if it is for an address of a name in the
+// dnsleak domains: the client resolved the name on its own. Return
+// true if the request is blocked for it.
+func (p *HTTPProxy) dnsLeak(r *http.Request) bool {
+	host := r.URL.Hostname()
+	name := leakedName(&p.conf.DNSLeak, p.res, host)
+	if len(name) == 0 {
+		return false
+	}
+
+	p.acc.Leaked()
+	p.sample.Info(p.log, logDNSLeak, "%s: dns leak: %s is an address of %s", r.RemoteAddr, host, name)
+	if p.conf.DNSLeak.Action != "block" {
+		return false
+	}
+	p.ulogDenied(r, http.StatusForbidden, "dns leak")
+	p.acc.Failed(failPolicy)
+	return true
+}
+
+// Log a request that was denied for reason 'why' with 'status'
+func (p *HTTPProxy) ulogDenied(r *http.Request, status int, why string) {
+	p.ctl.Trace(p.log, r.RemoteAddr, "denied %s %s: %d %s", r.Method, r.URL.String(), status, why)
+	if p.ulog == nil {
+		return
+	}
+
+	u := r.URL.String()
+	if r.Method == "CONNECT" {
+		u = r.Host
 	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	p.ulog.Info("time=%q client=%q url=%q status=\"%d\" denied=%q ua=%q",
+		now, r.RemoteAddr, u, status, why, r.UserAgent())
 }
 
 func extractHost(u *url.URL) string {
@@ -297,11 +770,72 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	host := extractHost(r.URL)
 
+	if p.dnsLeak(r) {
+		client.Write(_403Forbidden)
+		client.Close()
+		return
+	}
+
+	if p.bl.Blocked(r.URL.Hostname()) {
+		p.log.Info("%s: denied CONNECT %s: blocklist", r.RemoteAddr, host)
+		p.ulogDenied(r, http.StatusForbidden, "blocklist")
+		p.acc.Failed(failPolicy)
+		client.Write(_403Forbidden)
+		client.Close()
+		return
+	}
+
+	if c := categoryDenied(p.cat, p.conf.DenyCategories, r.URL.Hostname()); len(c) > 0 {
+		p.log.Info("%s: denied CONNECT %s: category %s", r.RemoteAddr, host, c)
+		p.ulogDenied(r, http.StatusForbidden, "category "+c)
+		p.acc.Failed(failPolicy)
+		client.Write(_403Forbidden)
+		client.Close()
+		return
+	}
+	if c := p.acl.Shadow().Category(p.cat, r.URL.Hostname()); len(c) > 0 {
+		p.sample.Info(p.log, logShadow, "shadow: %s would be denied CONNECT %s: category %s", r.RemoteAddr, host, c)
+	}
 
-	ctx := r.Context()
+	if ok, why := p.opa.Allow(p.opaInput(r)); !ok {
+		p.log.Info("%s: denied CONNECT %s: %s", r.RemoteAddr, host, why)
+		p.ulogDenied(r, http.StatusForbidden, why)
+		p.acc.Failed(failPolicy)
+		client.Write(_403Forbidden)
+		client.Close()
+		return
+	}
 
-	dest, err := p.tr.DialContext(ctx, "tcp", host)
+	// tunnels can't be replayed and we mustn't touch the network
+	if replaying(p.rt) {
+		p.log.Info("%s: denied CONNECT %s: replaying a cassette", r.RemoteAddr, host)
+		p.ulogDenied(r, http.StatusForbidden, "cassette")
+		client.Write(_403Forbidden)
+		client.Close()
+		return
+	}
+
+
+	dh := r.URL.Hostname()
+	if !p.dst.Open(dh) {
+		p.acc.Dropped(dropDestLimit)
+		p.sample.Info(p.log, logDestLimit, "%s: %s has too many connections", r.RemoteAddr, host)
+		p.ulogDenied(r, http.StatusServiceUnavailable, "too many connections")
+		client.Write(_503Unavailable)
+		client.Close()
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), clientKey{}, remoteIP(r.RemoteAddr))
+
+	p.chaos.Delay(ctx)
+	p.ctl.Trace(p.log, r.RemoteAddr, "connecting to %s", host)
+	dest, err := p.dial(ctx, "tcp", host)
 	if err != nil {
+		p.dst.Fail(dh)
+		p.dst.Close(dh, 0, 0)
+		p.acc.Failed(failure(err))
+		p.ctl.Trace(p.log, r.RemoteAddr, "connect to %s failed: %s: %s", host, failNames[failure(err)], err)
 		p.log.Debug("can't connect to %s: %s", host, err)
 		http.Error(w, fmt.Sprintf("can't connect to %s", host), 500)
 		client.Close()
@@ -309,8 +843,9 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client.Write(_200Ok)
+	p.ctl.Trace(p.log, r.RemoteAddr, "connected to %s [%s]", host, dest.RemoteAddr().String())
 
-	s := client.(*net.TCPConn)
+	s := client.(halfConn)
 	d := dest.(*net.TCPConn)
 
 	p.log.Debug("%s: CONNECT %s", s.RemoteAddr().String(), host)
@@ -319,12 +854,84 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	cp := &CancellableCopier{
 		Lhs:          s,
 		Rhs:          d,
-		ReadTimeout:  10,	// XXX Config file
-		WriteTimeout: 15,	// XXX Config file
-		IOBufsize:    16384,
+		ReadTimeout:  time.Duration(p.conf.Timeouts.Read),
+		WriteTimeout: time.Duration(p.conf.Timeouts.Write),
+		LhsIdle:      time.Duration(p.conf.Timeouts.ClientIdle),
+		RhsIdle:      time.Duration(p.conf.Timeouts.UpstreamIdle),
+		IOBufsize:    relayBufSize,
+		LhsLimit:     int64(p.conf.Sizelimit.Download),
+		RhsLimit:     int64(p.conf.Sizelimit.Upload),
+	}
+
+	// Classify the traffic and see what the client asks of the TLS
+	// server, if it is one
+	var hello tlsHello
+	var proto string
+	cp.LhsFirst = func(b []byte) bool {
+		proto = classify(b)
+		if protoDenied(p.conf.DenyProtocols, proto) {
+			p.log.Info("%s: denied CONNECT %s: protocol %s", r.RemoteAddr, host, proto)
+			p.ulogDenied(r, http.StatusForbidden, "protocol "+proto)
+			p.acc.Failed(failPolicy)
+			return false
+		}
+		if p.acl.Shadow().Protocol(proto) {
+			p.sample.Info(p.log, logShadow, "shadow: %s would be denied CONNECT %s: protocol %s", r.RemoteAddr, host, proto)
+		}
+
+		hello, _ = inspectTLS(b)
+		if why := sniDenied(p.bl, p.cat, p.conf.DenyCategories, hello.SNI); len(why) > 0 {
+			p.log.Info("%s: denied CONNECT %s: SNI %s: %s", r.RemoteAddr, host, hello.SNI, why)
+			p.ulogDenied(r, http.StatusForbidden, "sni "+hello.SNI+": "+why)
+			p.acc.Failed(failPolicy)
+			return false
+		}
+		return true
+	}
+
+	if m := p.mirror.Tunnel(dh); m != nil {
+		cp.LhsTap = m.Write
+		defer m.Close()
 	}
 
-	cp.Copy(ctx)
+	if t := time.Duration(p.conf.Timeouts.Session); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := p.ctl.Track(p.conf.String(), r.RemoteAddr, p.user(r), host, cancel)
+
+	t0 := time.Now()
+	nd, nu, err := cp.Copy(ctx)
+	p.dst.Close(dh, int64(nu), int64(nd))
+	switch err {
+	case errSizeLimit:
+		p.log.Info("%s: CONNECT %s: %s; closed", s.RemoteAddr().String(), host, err)
+	case errIdleTimeout:
+		p.log.Debug("%s: CONNECT %s: %s; closed", s.RemoteAddr().String(), host, err)
+	}
+
+	rec := &closeRecord{
+		listener: p.conf.String(),
+		client:   s.RemoteAddr().String(),
+		dest:     host,
+		remote:   d.RemoteAddr().String(),
+		start:    t0,
+		end:      time.Now(),
+		up:       int64(nu),
+		down:     int64(nd),
+		reason:   cancelReason(p.ctx, cp.Reason),
+		ua:       r.UserAgent(),
+		tls:      hello,
+		proto:    proto,
+	}
+	p.ctl.Closed(id, rec)
+	p.ctl.Trace(p.log, r.RemoteAddr, "tunnel to %s closed: up %d down %d: %s", host, nu, nd, rec.reason)
+	p.ctl.TraceDone(r.RemoteAddr)
+	logClose(p.log, p.ulog, rec)
 }
 
 
@@ -354,28 +961,128 @@ func (p *HTTPProxy) Accept() (net.Conn, error) {
 			return nil, err
 		}
 
+		// a hidden listener says nothing to those who didn't knock
+		if !p.knock.Allowed(remoteIP(nc.RemoteAddr().String())) {
+			nc.Close()
+			p.acc.Dropped(dropKnock)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropKnock])
+			continue
+		}
+
+		if !p.sch.Active() {
+			nc.Close()
+			p.sample.Debug(p.log, logACL, "%s: outside the listener's schedule", nc.RemoteAddr().String())
+			p.acc.Dropped(dropSchedule)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropSchedule])
+			continue
+		}
+
+		if p.chaos.Drop() {
+			nc.Close()
+			p.acc.Dropped(dropChaos)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropChaos])
+			continue
+		}
+
 		if p.grl.Limit() {
 			nc.Close()
-			p.log.Debug("%s: globally ratelimited", nc.RemoteAddr().String())
+			p.sample.Debug(p.log, logRatelimit, "%s: globally ratelimited", nc.RemoteAddr().String())
+			p.acc.Dropped(dropRatelimit)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropRatelimit])
 			continue
 		}
 
 		if p.prl.Limit(nc.RemoteAddr()) {
 			nc.Close()
-			p.log.Debug("%s: per-IP ratelimited", nc.RemoteAddr().String())
+			p.sample.Debug(p.log, logRatelimit, "%s: per-IP ratelimited", nc.RemoteAddr().String())
+			p.acc.Dropped(dropRatelimit)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropRatelimit])
+			continue
+		}
+
+		// a transport's clients are all loopback; see control.kill()
+		if len(p.conf.Transport.Exec) == 0 && p.ctl.Banned(remoteIP(nc.RemoteAddr().String())) {
+			nc.Close()
+			p.sample.Debug(p.log, logACL, "%s: banned", nc.RemoteAddr().String())
+			p.acc.Dropped(dropBanned)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropBanned])
+			continue
+		}
+
+		if p.ctl.Shed(remoteIP(nc.RemoteAddr().String())) {
+			nc.Close()
+			p.sample.Info(p.log, logOverload, "%s: shed; overloaded", nc.RemoteAddr().String())
+			p.acc.Dropped(dropOverload)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropOverload])
 			continue
 		}
 
-		if !AclOK(p.conf, nc) {
-			p.log.Debug("%s: ACL failure", nc.RemoteAddr().String())
+		p.ka.Set(nc)
+		ac, why := p.ctl.Admit(nc, httpConnMem)
+		if why >= 0 {
+			nc.Close()
+			p.sample.Info(p.log, logOverload, "%s: refused; %s", nc.RemoteAddr().String(), admitNames[why])
+			p.acc.Dropped(why)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[why])
+			continue
+		}
+		nc = ac
+
+		// When we keep a URL log, ServeHTTP() denies the request
+		// instead so that we can log what was asked for.
+		ok, rule := AclOK(p.acl, nc)
+		p.acl.Shadow().Client(p.sample, p.log, remoteIP(nc.RemoteAddr().String()), ok)
+		if !ok && p.ulog == nil {
+			p.sample.Debug(p.log, logACL, "%s: ACL failure: %s", nc.RemoteAddr().String(), rule)
+			p.acc.Dropped(dropACL)
+			p.ctl.Trace(p.log, nc.RemoteAddr().String(), "dropped: %s", dropNames[dropACL])
 			nc.Close()
 			continue
 		}
+		if ok {
+			p.log.Debug("%s: accepted: %s", nc.RemoteAddr().String(), rule)
+		}
 
+		p.ctl.Trace(p.log, nc.RemoteAddr().String(), "accepted on %s: %s", p.conf.String(), rule)
+		p.acc.Accepted()
 		return nc, nil
 	}
 }
 
+// limitReader is a request body that counts the bytes read from it;
+// it fails once more than max (if non-zero) bytes are read.
+type limitReader struct {
+	io.ReadCloser
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(b []byte) (int, error) {
+	n, err := l.ReadCloser.Read(b)
+	l.n += int64(n)
+	if l.max > 0 && l.n > l.max {
+		l.exceeded = true
+		return 0, errSizeLimit
+	}
+	return n, err
+}
+
+// Return true if one of the comma separated lists in 'vv' has 'tok'
+func hasToken(vv []string, tok string) bool {
+	for _, v := range vv {
+		for _, t := range strings.Split(v, ",") {
+			if i := strings.IndexByte(t, ';'); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(t), tok) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func cloneCleanHeader(h http.Header) http.Header {
 	x := cloneHeader(h)
 	return cleanHeaders(x)
@@ -389,6 +1096,20 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
+// Headers that carry credentials; payload dumps show them redacted
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Return a copy of 'r' with its secretHeaders redacted
+func redactedRequest(r *http.Request) *http.Request {
+	x := r.Clone(r.Context())
+	for _, k := range secretHeaders {
+		if len(x.Header[k]) > 0 {
+			x.Header.Set(k, "REDACTED")
+		}
+	}
+	return x
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
@@ -434,6 +1155,8 @@ var (
 
 	// used when we hijack for CONNECT
 	_200Ok []byte = []byte("HTTP/1.0 200 OK\r\n\r\n")
+	_403Forbidden []byte = []byte("HTTP/1.0 403 Forbidden\r\n\r\n")
+	_503Unavailable []byte = []byte("HTTP/1.0 503 Service Unavailable\r\n\r\n")
 )
 
 type proxyErr struct {
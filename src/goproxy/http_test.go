@@ -0,0 +1,109 @@
+// http_test.go -- tests for the HTTP proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// gRPC needs "TE: trailers" to reach the origin and the trailers it
+// sends after the body to come back. The origin speaks HTTP/2 over
+// TLS, as gRPC servers do; the client is a plain HTTP/1.1 proxy
+// client and gets the trailers after the last chunk.
+func TestGRPCTrailers(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "not HTTP/2: "+r.Proto, http.StatusHTTPVersionNotSupported)
+			return
+		}
+		if r.Header.Get("Te") != "trailers" {
+			http.Error(w, "no TE: trailers", http.StatusBadRequest)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(b)
+		w.(http.Flusher).Flush()
+
+		// one declared up front, one sent undeclared
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	log, err := L.NewLogger("STDERR", L.LOG_ERR, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewResolver(&ResolverConf{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc := &ListenConf{Listen: "127.0.0.1:0"}
+	px, err := NewHTTPProxy(lc, res, nil, nil, nil, newDestTable(0), nil, nil,
+		newACLTable().For(lc), nil, nil, nil, nil, nil, log, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// trust the test origin and let the transport negotiate h2 with it
+	p := px.(*HTTPProxy)
+	p.tr.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	p.tr.ForceAttemptHTTP2 = true
+
+	px.Start()
+	defer px.Stop()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/pkg.Svc/Call", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Content-Type", "application/grpc")
+	if err := req.WriteProxy(c); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || string(b) != "hello" {
+		t.Fatalf("got %d %q", r.StatusCode, b)
+	}
+	for k, v := range map[string]string{"Grpc-Status": "0", "Grpc-Message": "ok"} {
+		if s := r.Trailer.Get(k); s != v {
+			t.Errorf("trailer %s: got %q, want %q", k, s, v)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
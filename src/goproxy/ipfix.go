@@ -0,0 +1,319 @@
+// ipfix.go -- IPFIX (RFC 7011) export of proxied flows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A flowExporter sends a pair of IPFIX flow records -- one for each
+// direction -- for every tunnel that closes to a collector over UDP.
+// Records are queued and sent in batches; when the queue is full new
+// records are dropped rather than slow down the proxies.
+type flowExporter struct {
+	conn   net.Conn
+	domain uint32
+	log    *L.Logger
+
+	q       chan *closeRecord
+	seq     uint32
+	dropped uint64
+	tsent   time.Time // when the templates were last sent
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// IPFIX information elements we export
+const (
+	ieOctetDeltaCount   = 1
+	iePacketDeltaCount  = 2
+	ieProtocol          = 4
+	ieSrcPort           = 7
+	ieSrcIPv4           = 8
+	ieDstPort           = 11
+	ieDstIPv4           = 12
+	ieSrcIPv6           = 27
+	ieDstIPv6           = 28
+	ieInterfaceName     = 82
+	ieFlowStartMillisec = 152
+	ieFlowEndMillisec   = 153
+)
+
+const (
+	ipfixVersion   = 10
+	ipfixTemplates = 2   // set id of a template set
+	ipfixTmplBase  = 256 // first template id
+
+	// Max size of a message; fits an ethernet MTU
+	ipfixMTU = 1400
+
+	// Templates are resent this often since UDP collectors may restart
+	ipfixTmplInterval = time.Minute
+
+	// Packets are estimated from bytes assuming full segments
+	ipfixMSS = 1460
+)
+
+func newFlowExporter(cfg *IPFIXConf, log *L.Logger) (*flowExporter, error) {
+	if len(cfg.Collector) == 0 {
+		return nil, nil
+	}
+
+	c, err := net.Dial("udp", cfg.Collector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flowExporter{
+		conn:   c,
+		domain: cfg.Domain,
+		log:    log.New("ipfix-"+cfg.Collector, 0),
+		q:      make(chan *closeRecord, 4096),
+		stop:   make(chan bool),
+	}, nil
+}
+
+// Queue the flows of a closed tunnel for export
+func (f *flowExporter) Export(r *closeRecord) {
+	if f == nil {
+		return
+	}
+
+	select {
+	case f.q <- r:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+func (f *flowExporter) Start() {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.loop()
+	}()
+}
+
+func (f *flowExporter) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+	f.conn.Close()
+
+	if n := atomic.LoadUint64(&f.dropped); n > 0 {
+		f.log.Warn("dropped %d flows", n)
+	}
+}
+
+// Collect records and send them once a message is full or every second
+func (f *flowExporter) loop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	var sets [4][]byte
+	var n, size int
+
+	flush := func() {
+		if n > 0 {
+			f.send(&sets, n)
+			for i := range sets {
+				sets[i] = sets[i][:0]
+			}
+			n, size = 0, 0
+		}
+	}
+
+	for {
+		select {
+		case <-f.stop:
+			for {
+				select {
+				case r := <-f.q:
+					f.add(&sets, r, &n, &size)
+				default:
+					flush()
+					return
+				}
+			}
+
+		case r := <-f.q:
+			f.add(&sets, r, &n, &size)
+			if size >= ipfixMTU-200 {
+				flush()
+			}
+
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// Add the two flows of 'r' to the data set of their template
+func (f *flowExporter) add(sets *[4][]byte, r *closeRecord, n, size *int) {
+	ch, cp := splitAddr(r.client)
+	dh, dp := splitAddr(r.remote)
+	if ch == nil || dh == nil {
+		return
+	}
+
+	start := uint64(r.start.UnixNano() / 1e6)
+	end := uint64(r.end.UnixNano() / 1e6)
+
+	for _, x := range []struct {
+		src, dst     net.IP
+		sport, dport uint16
+		bytes        int64
+	}{
+		{ch, dh, cp, dp, r.up},
+		{dh, ch, dp, cp, r.down},
+	} {
+		t := tmplID(x.src, x.dst) - ipfixTmplBase
+		b := sets[t]
+
+		b = append(b, ipBytes(x.src)...)
+		b = appendU16(b, x.sport)
+		b = append(b, ipBytes(x.dst)...)
+		b = appendU16(b, x.dport)
+		b = append(b, 6) // TCP
+		b = appendU64(b, uint64(x.bytes))
+		b = appendU64(b, uint64((x.bytes+ipfixMSS-1)/ipfixMSS))
+		b = appendU64(b, start)
+		b = appendU64(b, end)
+
+		// variable length string
+		name := r.listener
+		if len(name) > 254 {
+			name = name[:254]
+		}
+		b = append(b, byte(len(name)))
+		b = append(b, name...)
+
+		*size += len(b) - len(sets[t])
+		sets[t] = b
+		*n++
+	}
+}
+
+// Send one message with the data sets (and the templates when due)
+func (f *flowExporter) send(sets *[4][]byte, n int) {
+	now := time.Now()
+
+	b := make([]byte, 16, ipfixMTU+256)
+	if now.Sub(f.tsent) >= ipfixTmplInterval {
+		b = appendTemplates(b)
+		f.tsent = now
+	}
+
+	for i, s := range sets {
+		if len(s) == 0 {
+			continue
+		}
+		b = appendU16(b, uint16(ipfixTmplBase+i))
+		b = appendU16(b, uint16(4+len(s)))
+		b = append(b, s...)
+	}
+
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], f.seq)
+	binary.BigEndian.PutUint32(b[12:], f.domain)
+	f.seq += uint32(n)
+
+	if _, err := f.conn.Write(b); err != nil {
+		f.log.Debug("%s", err)
+	}
+}
+
+// The template set: one template for each combination of source and
+// destination address family.
+func appendTemplates(b []byte) []byte {
+	i := len(b)
+	b = append(b, 0, ipfixTemplates, 0, 0)
+	for t := 0; t < 4; t++ {
+		src, dst := uint16(ieSrcIPv4), uint16(ieDstIPv4)
+		sl, dl := uint16(4), uint16(4)
+		if t&1 != 0 {
+			src, sl = ieSrcIPv6, 16
+		}
+		if t&2 != 0 {
+			dst, dl = ieDstIPv6, 16
+		}
+
+		fields := [][2]uint16{
+			{src, sl},
+			{ieSrcPort, 2},
+			{dst, dl},
+			{ieDstPort, 2},
+			{ieProtocol, 1},
+			{ieOctetDeltaCount, 8},
+			{iePacketDeltaCount, 8},
+			{ieFlowStartMillisec, 8},
+			{ieFlowEndMillisec, 8},
+			{ieInterfaceName, 0xffff},
+		}
+
+		b = appendU16(b, uint16(ipfixTmplBase+t))
+		b = appendU16(b, uint16(len(fields)))
+		for _, x := range fields {
+			b = appendU16(b, x[0])
+			b = appendU16(b, x[1])
+		}
+	}
+	binary.BigEndian.PutUint16(b[i+2:], uint16(len(b)-i))
+	return b
+}
+
+// Return the template for flows from 'src' to 'dst'
+func tmplID(src, dst net.IP) int {
+	t := ipfixTmplBase
+	if src.To4() == nil {
+		t |= 1
+	}
+	if dst.To4() == nil {
+		t |= 2
+	}
+	return t
+}
+
+func ipBytes(ip net.IP) []byte {
+	if a := ip.To4(); a != nil {
+		return a
+	}
+	return ip.To16()
+}
+
+// Split "host:port" into its IP and port; nil IP if it isn't one
+func splitAddr(s string) (net.IP, uint16) {
+	h, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0
+	}
+	port, _ := strconv.Atoi(p)
+	return net.ParseIP(h), uint16(port)
+}
+
+func appendU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendU64(b []byte, v uint64) []byte {
+	var x [8]byte
+	binary.BigEndian.PutUint64(x[:], v)
+	return append(b, x[:]...)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
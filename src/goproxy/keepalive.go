@@ -0,0 +1,53 @@
+// keepalive.go -- TCP keepalive probes on both legs of tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// The TCP keepalive probes of a listener's connections: those it
+// accepts and those it dials. A tunnel that goes quiet for Idle -- an
+// IMAP IDLE, a terminal left open -- gets a probe every Interval on
+// both legs, which keeps the state of NATs and firewalls in the path
+// alive; after Count go unanswered the kernel closes the connection. A
+// nil keepalivePolicy leaves Go's defaults.
+type keepalivePolicy struct {
+	cfg net.KeepAliveConfig
+}
+
+// Make the policy in 'c'; nil if it is the default
+func newKeepalivePolicy(c *KeepaliveConf) *keepalivePolicy {
+	if c.Idle <= 0 {
+		return nil
+	}
+
+	// zero interval or count are Go's defaults: 15s and 9
+	return &keepalivePolicy{
+		cfg: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(c.Idle),
+			Interval: time.Duration(c.Interval),
+			Count:    c.Count,
+		},
+	}
+}
+
+// Turn on the probes of connection 'c'; others than TCP are left be
+func (k *keepalivePolicy) Set(c net.Conn) {
+	if k == nil {
+		return
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAliveConfig(k.cfg)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
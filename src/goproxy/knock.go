@@ -0,0 +1,256 @@
+// knock.go -- single packet authorization for hidden listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	flag "github.com/ogier/pflag"
+	L "github.com/opencoff/go-logger"
+)
+
+// A knockGate hides the listeners that use it: they drop every
+// connection except from the addresses that recently sent a valid
+// knock -- a single UDP packet signed with the shared key. An address
+// stays allowed for the TTL after its last knock. We never answer a
+// knock, valid or not, so a scan sees nothing.
+//
+// A knock is: "GPK1", the sender's time (unix seconds, 8 bytes big
+// endian), a random 16 byte nonce and the HMAC-SHA256 of all of that
+// with the key. Knocks whose time is more than the window away from
+// ours are ignored, as are nonces seen within the window (replays).
+type knockGate struct {
+	conn   *net.UDPConn
+	key    []byte
+	ttl    time.Duration
+	window time.Duration
+	log    *L.Logger
+
+	mu      sync.Mutex
+	allowed map[string]time.Time // client IP -> expiry
+	nonces  map[[knockNonce]byte]time.Time
+
+	wg sync.WaitGroup
+}
+
+const (
+	knockMagic = "GPK1"
+	knockNonce = 16
+	knockLen   = len(knockMagic) + 8 + knockNonce + sha256.Size
+
+	defaultKnockTTL    = time.Hour
+	defaultKnockWindow = 30 * time.Second
+)
+
+// Make the gate in 'c' and bind its UDP port; nil if there is none
+func newKnockGate(c *KnockConf, log *L.Logger) (*knockGate, error) {
+	if len(c.Listen) == 0 {
+		return nil, nil
+	}
+	if len(c.Key) < 16 {
+		return nil, fmt.Errorf("knock: key must be at least 16 characters")
+	}
+
+	a, err := net.ResolveUDPAddr("udp", c.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("knock: %s", err)
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, fmt.Errorf("knock: %s", err)
+	}
+
+	g := &knockGate{
+		conn:    conn,
+		key:     []byte(c.Key),
+		ttl:     time.Duration(c.TTL),
+		window:  time.Duration(c.Window),
+		log:     log.New("knock", 0),
+		allowed: make(map[string]time.Time),
+		nonces:  make(map[[knockNonce]byte]time.Time),
+	}
+	if g.ttl <= 0 {
+		g.ttl = defaultKnockTTL
+	}
+	if g.window <= 0 {
+		g.window = defaultKnockWindow
+	}
+	return g, nil
+}
+
+// Return the gate of listener 'lc'; nil if it isn't hidden
+func (g *knockGate) For(lc *ListenConf) *knockGate {
+	if !lc.Knock {
+		return nil
+	}
+	return g
+}
+
+// Return true if 'ip' may connect; a nil gate lets everyone in
+func (g *knockGate) Allowed(ip net.IP) bool {
+	if g == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	exp, ok := g.allowed[ip.String()]
+	return ok && time.Now().Before(exp)
+}
+
+func (g *knockGate) Start() {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.serve()
+	}()
+}
+
+func (g *knockGate) Stop() {
+	g.conn.Close()
+	g.wg.Wait()
+}
+
+func (g *knockGate) serve() {
+	b := make([]byte, 512)
+	last := time.Now()
+	for {
+		n, from, err := g.conn.ReadFromUDP(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(last) > g.window {
+			g.expire(now)
+			last = now
+		}
+
+		if err := g.check(b[:n], now); err != nil {
+			g.log.Debug("%s: bad knock: %s", from, err)
+			continue
+		}
+
+		g.mu.Lock()
+		g.allowed[from.IP.String()] = now.Add(g.ttl)
+		g.mu.Unlock()
+		g.log.Info("%s knocked; allowed for %s", from.IP, g.ttl)
+	}
+}
+
+// Verify knock 'b' received at 'now' and remember its nonce
+func (g *knockGate) check(b []byte, now time.Time) error {
+	if len(b) != knockLen || string(b[:len(knockMagic)]) != knockMagic {
+		return fmt.Errorf("not a knock")
+	}
+
+	body := b[:knockLen-sha256.Size]
+	h := hmac.New(sha256.New, g.key)
+	h.Write(body)
+	if !hmac.Equal(h.Sum(nil), b[len(body):]) {
+		return fmt.Errorf("wrong signature")
+	}
+
+	t := time.Unix(int64(binary.BigEndian.Uint64(b[len(knockMagic):])), 0)
+	if d := now.Sub(t); d > g.window || d < -g.window {
+		return fmt.Errorf("time is off by %s", d)
+	}
+
+	var nonce [knockNonce]byte
+	copy(nonce[:], b[len(knockMagic)+8:])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.nonces[nonce]; ok {
+		return fmt.Errorf("replayed")
+	}
+	g.nonces[nonce] = now
+	return nil
+}
+
+// Forget expired addresses and nonces too old to be replayed
+func (g *knockGate) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for ip, exp := range g.allowed {
+		if !now.Before(exp) {
+			delete(g.allowed, ip)
+		}
+	}
+	for n, t := range g.nonces {
+		if now.Sub(t) > 2*g.window {
+			delete(g.nonces, n)
+		}
+	}
+}
+
+// Return a knock signed with 'key' for time 'now'
+func makeKnock(key []byte, now time.Time) []byte {
+	b := make([]byte, 0, knockLen)
+	b = append(b, knockMagic...)
+
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(now.Unix()))
+	b = append(b, t[:]...)
+
+	var nonce [knockNonce]byte
+	rand.Read(nonce[:])
+	b = append(b, nonce[:]...)
+
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(b)
+}
+
+// Run the knock subcommand with 'args'; return the exit code
+func knockMain(args []string) int {
+	fs := flag.NewFlagSet("knock", flag.ExitOnError)
+	key := fs.StringP("key", "k", "", "Shared key of the knock gate")
+
+	fs.Usage = func() {
+		fmt.Printf("goproxy knock - open a hidden listener to this host\nUsage: %s knock [options] host:port\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(*key) == 0 || len(fs.Args()) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c, err := net.Dial("udp", fs.Args()[0])
+	if err != nil {
+		warn("knock: %s", err)
+		return exitFatal
+	}
+	defer c.Close()
+
+	if _, err := c.Write(makeKnock([]byte(*key), time.Now())); err != nil {
+		warn("knock: %s", err)
+		return exitFatal
+	}
+	return 0
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
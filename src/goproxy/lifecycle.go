@@ -0,0 +1,156 @@
+// lifecycle.go -- ordered startup and shutdown of subsystems
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Subsystems are started in the order they are added -- so dependencies
+// must be added first -- and stopped in the reverse order. Each is given
+// a bounded time to stop; a subsystem that doesn't stop in time is
+// abandoned and the shutdown moves on.
+type lifecycle struct {
+	subs    []subsystem
+	started int
+	log     *L.Logger
+
+	// the first subsystem failure; and closed on Stop
+	failed chan error
+	done   chan struct{}
+}
+
+// A subsystem that can stop serving on its own (e.g., its listener
+// fails); the error is sent on the Failed channel.
+type failer interface {
+	Failed() <-chan error
+}
+
+type subsystem struct {
+	name string
+	p    Proxy
+	tout time.Duration
+}
+
+// Default time allowed for a subsystem to stop
+const stopTimeout = 10 * time.Second
+
+func newLifecycle(log *L.Logger) *lifecycle {
+	return &lifecycle{
+		log:    log,
+		failed: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// Add a subsystem named 'name'; 'tout' bounds the time it may take to
+// stop (0 for the default).
+func (l *lifecycle) Add(name string, p Proxy, tout time.Duration) {
+	if tout <= 0 {
+		tout = stopTimeout
+	}
+	l.subs = append(l.subs, subsystem{name, p, tout})
+}
+
+// Start all subsystems in order
+func (l *lifecycle) Start() {
+	for ; l.started < len(l.subs); l.started++ {
+		s := &l.subs[l.started]
+		l.log.Debug("starting %s ..", s.name)
+		s.p.Start()
+
+		if f, ok := s.p.(failer); ok {
+			go l.watch(s.name, f)
+		}
+	}
+}
+
+// Failed returns a channel that yields the first error of any
+// subsystem that stopped on its own.
+func (l *lifecycle) Failed() <-chan error {
+	return l.failed
+}
+
+func (l *lifecycle) watch(name string, f failer) {
+	select {
+	case err := <-f.Failed():
+		select {
+		case l.failed <- fmt.Errorf("%s: %s", name, err):
+		default:
+		}
+	case <-l.done:
+	}
+}
+
+// Stop the started subsystems in reverse order; returns the errors of
+// all the ones that didn't stop cleanly.
+func (l *lifecycle) Stop() error {
+	var errs multiError
+
+	close(l.done)
+
+	for l.started > 0 {
+		l.started--
+		s := &l.subs[l.started]
+
+		t0 := time.Now()
+		if err := stopOne(s); err != nil {
+			l.log.Warn("%s", err)
+			errs = append(errs, err)
+			continue
+		}
+		l.log.Debug("stopped %s in %s", s.name, format(time.Since(t0)))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Stop 's' within its timeout; a panic in Stop is an error too
+func stopOne(s *subsystem) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("%s: panic while stopping: %v", s.name, r)
+			}
+		}()
+		s.p.Stop()
+		done <- nil
+	}()
+
+	t := time.NewTimer(s.tout)
+	defer t.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return fmt.Errorf("%s: didn't stop in %s", s.name, s.tout)
+	}
+}
+
+// A list of errors reported as one
+type multiError []error
+
+func (m multiError) Error() string {
+	v := make([]string, len(m))
+	for i, e := range m {
+		v[i] = e.Error()
+	}
+	return strings.Join(v, "; ")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
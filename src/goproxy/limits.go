@@ -0,0 +1,85 @@
+// limits.go -- startup checks of the system limits we run under
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Descriptors we hold besides those of the connections: logs, the
+// listeners, the admin API, resolvers
+const fdSlack = 64
+
+// Below this many open files we warn even without max_conns
+const lowNofile = 4096
+
+// Raise the open file limit to 'rlimit_nofile' if set; and warn when
+// the open file limit or the ephemeral port range can't carry
+// 'max_conns' connections -- rather than failing under load with
+// "too many open files" or "cannot assign requested address". Runs
+// before we drop privileges, which may be needed to raise the hard
+// limit.
+func checkLimits(cfg *Conf, log *L.Logger) {
+	soft, hard, err := nofileLimit()
+	if err != nil {
+		log.Debug("can't get the open file limit: %s", err)
+		return
+	}
+
+	if want := uint64(cfg.RlimitNofile); want > soft {
+		if soft, hard, err = raiseNofile(want); err != nil {
+			log.Warn("can't raise the open file limit to %d: %s", want, err)
+		}
+		if soft < want {
+			log.Warn("open file limit is %d, not the %d of rlimit_nofile", soft, want)
+		}
+	}
+
+	ports := "unknown"
+	lo, hi, err := ephemeralPorts()
+	if err == nil {
+		ports = fmt.Sprintf("%d-%d", lo, hi)
+	}
+	log.Info("limits: open files %d (hard %d), ephemeral ports %s", soft, hard, ports)
+
+	// each proxied connection holds two descriptors
+	if n := uint64(cfg.MaxConns); n > 0 {
+		if need := 2*n + fdSlack; need > soft {
+			log.Warn("max_conns %d needs about %d open files; the limit is %d (see rlimit_nofile)",
+				n, need, soft)
+		}
+		if err == nil && n > uint64(hi-lo+1) {
+			log.Warn("max_conns %d exceeds the %d ephemeral ports (%s); connections to one destination will run out",
+				n, hi-lo+1, ports)
+		}
+	} else if soft < lowNofile {
+		log.Warn("open file limit %d allows only about %d connections (see rlimit_nofile)",
+			soft, (soft-min(soft, fdSlack))/2)
+	}
+}
+
+// Return the range of local ports the kernel picks from for outgoing
+// connections
+func ephemeralPorts() (int, int, error) {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var lo, hi int
+	if _, err := fmt.Sscan(string(b), &lo, &hi); err != nil || lo > hi {
+		return 0, 0, fmt.Errorf("can't parse ip_local_port_range %q", b)
+	}
+	return lo, hi, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
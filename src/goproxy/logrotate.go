@@ -0,0 +1,167 @@
+// logrotate.go -- size based rotation of log files
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// sizeRotator rotates a log file when it grows beyond a size. The
+// logger keeps the file open; so the file is copied to a timestamped
+// file (file.YYYYMMDD-HHMMSS[.gz]) and then truncated. Only the
+// newest 'keep' rotated files are retained.
+type sizeRotator struct {
+	file     string
+	max      int64
+	keep     int
+	compress bool
+	log      *L.Logger
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// How often the file size is checked
+const rotateCheckInterval = 10 * time.Second
+
+// Return a rotator for log file 'fn' if size based rotation is
+// configured and 'fn' is a file; nil otherwise.
+func newSizeRotator(fn string, cfg *RotateConf, log *L.Logger) *sizeRotator {
+	if cfg.MaxSize <= 0 || cfg.External || !filepath.IsAbs(fn) {
+		return nil
+	}
+
+	r := &sizeRotator{
+		file:     fn,
+		max:      int64(cfg.MaxSize),
+		keep:     cfg.Keep,
+		compress: cfg.Compress,
+		log:      log,
+		stop:     make(chan bool),
+	}
+
+	if r.keep <= 0 {
+		r.keep = 7
+	}
+	return r
+}
+
+func (r *sizeRotator) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		t := time.NewTicker(rotateCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-t.C:
+				if err := r.check(); err != nil {
+					r.log.Warn("log rotation: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *sizeRotator) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// Rotate the file if it is too big
+func (r *sizeRotator) check() error {
+	fi, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() < r.max {
+		return nil
+	}
+
+	if err = r.rotate(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// Copy the log to its rotated name and truncate it
+func (r *sizeRotator) rotate() error {
+	src, err := os.OpenFile(r.file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := fmt.Sprintf("%s.%s", r.file, time.Now().Format("20060102-150405"))
+	if r.compress {
+		dst += ".gz"
+	}
+
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	var w io.WriteCloser = fd
+	if r.compress {
+		w = gzip.NewWriter(fd)
+	}
+
+	_, err = io.Copy(w, src)
+	if r.compress {
+		if e := w.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return src.Truncate(0)
+}
+
+// Remove all but the newest 'keep' rotated files
+func (r *sizeRotator) prune() error {
+	v, err := filepath.Glob(r.file + ".[0-9]*-[0-9]*")
+	if err != nil {
+		return err
+	}
+
+	if len(v) <= r.keep {
+		return nil
+	}
+
+	// the timestamps sort in time order
+	sort.Strings(v)
+	for _, fn := range v[:len(v)-r.keep] {
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,173 @@
+// logsample.go -- sampling of noisy log messages
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Classes of noisy log messages; a flood of connections produces one
+// of these for every connection.
+const (
+	logRatelimit = "ratelimit" // global or per-host ratelimit reached
+	logACL       = "acl"       // client denied by the ACL
+	logDestLimit = "destlimit" // destination at its connection limit
+	logOverload  = "overload"  // connection shed due to overload
+	logShadow    = "shadow"    // what shadow rules would deny
+	logDNSLeak   = "dnsleak"   // client resolved a name on its own
+)
+
+// Sampling rates used if none are configured: 1 in N messages
+var defaultLogSample = map[string]int{
+	logRatelimit: 100,
+	logACL:       100,
+	logDestLimit: 10,
+	logOverload:  100,
+	logDNSLeak:   10,
+}
+
+// A logSampler logs only 1 in N messages of each class; the number of
+// suppressed messages is logged periodically. A nil logSampler logs
+// every message.
+type logSampler struct {
+	rate     map[string]uint64
+	interval time.Duration
+	log      *L.Logger
+
+	mu  sync.Mutex
+	cls map[string]*sampleCount
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+type sampleCount struct {
+	seen       uint64
+	suppressed uint64
+}
+
+func newLogSampler(cfg *LogSampleConf, log *L.Logger) *logSampler {
+	rates := cfg.Classes
+	if len(rates) == 0 {
+		rates = defaultLogSample
+	}
+
+	s := &logSampler{
+		rate:     make(map[string]uint64),
+		interval: time.Duration(cfg.Interval),
+		log:      log,
+		cls:      make(map[string]*sampleCount),
+		stop:     make(chan bool),
+	}
+
+	for k, n := range rates {
+		if n > 1 {
+			s.rate[k] = uint64(n)
+		}
+	}
+
+	if s.interval <= 0 {
+		s.interval = time.Minute
+	}
+	return s
+}
+
+// Start the periodic summary of suppressed messages
+func (s *logSampler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				s.summary()
+				return
+			case <-t.C:
+				s.summary()
+			}
+		}
+	}()
+}
+
+func (s *logSampler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Log a debug message of class 'c' to 'l' if it is sampled
+func (s *logSampler) Debug(l *L.Logger, c string, f string, v ...interface{}) {
+	if s.sample(c) {
+		l.Debug(f, v...)
+	}
+}
+
+// Log an info message of class 'c' to 'l' if it is sampled
+func (s *logSampler) Info(l *L.Logger, c string, f string, v ...interface{}) {
+	if s.sample(c) {
+		l.Info(f, v...)
+	}
+}
+
+// Return true if this message of class 'c' should be logged
+func (s *logSampler) sample(c string) bool {
+	if s == nil {
+		return true
+	}
+
+	n, ok := s.rate[c]
+	if !ok {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	x, ok := s.cls[c]
+	if !ok {
+		x = &sampleCount{}
+		s.cls[c] = x
+	}
+
+	x.seen++
+	if (x.seen-1)%n == 0 {
+		return true
+	}
+	x.suppressed++
+	return false
+}
+
+// Log and reset the counts of suppressed messages
+func (s *logSampler) summary() {
+	s.mu.Lock()
+	cls := s.cls
+	s.cls = make(map[string]*sampleCount)
+	s.mu.Unlock()
+
+	var v []string
+	for c := range cls {
+		v = append(v, c)
+	}
+	sort.Strings(v)
+
+	for _, c := range v {
+		if x := cls[c]; x.suppressed > 0 {
+			s.log.Info("log sampling: suppressed %d of %d %q messages in the last %s",
+				x.suppressed, x.seen, c, s.interval)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
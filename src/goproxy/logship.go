@@ -0,0 +1,388 @@
+// logship.go -- ship log files to a remote collector
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A logShipper tails a log file and POSTs new lines in batches to a
+// Loki push endpoint or a generic NDJSON endpoint. Batches that can't
+// be sent are spooled to disk and sent -- in order, before any new
+// lines -- when the remote is back. The spool is bounded; when it is
+// full the oldest batches are dropped.
+type logShipper struct {
+	file     string
+	url      string
+	format   string
+	labels   map[string]string
+	batch    int
+	interval time.Duration
+	spool    string
+	maxSpool int64
+
+	clt *http.Client
+	log *L.Logger
+
+	// tail state
+	fd  *os.File
+	fi  os.FileInfo
+	off int64
+	buf []byte // partial line read from the file
+
+	seq     uint64
+	dropped uint64
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// Supported formats of the shipped batches
+const (
+	shipLoki   = "loki"
+	shipNDJSON = "ndjson"
+)
+
+// Upper bound on a line we ship; longer lines are truncated
+const maxShipLine = 64 * 1024
+
+func newLogShipper(cfg *LogShipConf, log *L.Logger) (*logShipper, error) {
+	s := &logShipper{
+		file:     cfg.File,
+		url:      cfg.URL,
+		format:   cfg.Format,
+		labels:   cfg.Labels,
+		batch:    cfg.Batch,
+		interval: time.Duration(cfg.Interval),
+		spool:    cfg.Spool,
+		maxSpool: int64(cfg.MaxSpool),
+		clt:      &http.Client{Timeout: 30 * time.Second},
+		log:      log.New("logship-"+filepath.Base(cfg.File), 0),
+		stop:     make(chan bool),
+	}
+
+	if len(s.format) == 0 {
+		s.format = shipLoki
+	}
+	if s.batch <= 0 {
+		s.batch = 1000
+	}
+	if s.interval <= 0 {
+		s.interval = 5 * time.Second
+	}
+	if s.maxSpool <= 0 {
+		s.maxSpool = 100 * 1024 * 1024
+	}
+	if len(s.labels) == 0 {
+		s.labels = map[string]string{"job": "goproxy"}
+	}
+
+	if len(s.spool) > 0 {
+		if err := os.MkdirAll(s.spool, 0700); err != nil {
+			return nil, fmt.Errorf("logship: %s", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *logShipper) Start() {
+	// Only lines written from now on are shipped
+	if _, err := s.reopen(); err == nil {
+		s.off, _ = s.fd.Seek(0, io.SeekEnd)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				s.ship()
+				if s.fd != nil {
+					s.fd.Close()
+				}
+				return
+			case <-t.C:
+				s.ship()
+			}
+		}
+	}()
+}
+
+func (s *logShipper) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+
+	if s.dropped > 0 {
+		s.log.Warn("dropped %d batches", s.dropped)
+	}
+}
+
+// Ship the spooled batches and then the lines added since the last time
+func (s *logShipper) ship() {
+	sent := s.drainSpool()
+
+	lines, err := s.readLines()
+	if err != nil {
+		s.log.Warn("%s", err)
+	}
+
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > s.batch {
+			n = s.batch
+		}
+
+		b := s.encode(lines[:n])
+		lines = lines[n:]
+
+		// once sending fails, keep order by spooling the rest
+		if sent {
+			err := s.send(b)
+			if err == nil {
+				continue
+			}
+			s.log.Debug("%s: %s", s.url, err)
+			sent = false
+		}
+		s.spoolBatch(b)
+	}
+}
+
+// Return the complete lines added to the file since the last read.
+// The rest of a rotated file is read before its replacement.
+func (s *logShipper) readLines() ([]string, error) {
+	var v []string
+
+	if s.fd != nil {
+		v = s.readFrom()
+	}
+
+	reset, err := s.reopen()
+	if err != nil {
+		return v, err
+	}
+	if reset {
+		v = append(v, s.readFrom()...)
+	}
+	return v, nil
+}
+
+// Read complete lines from the current offset to EOF
+func (s *logShipper) readFrom() []string {
+	if _, err := s.fd.Seek(s.off, io.SeekStart); err != nil {
+		return nil
+	}
+
+	var v []string
+	rd := bufio.NewReader(s.fd)
+	for {
+		b, err := rd.ReadSlice('\n')
+		s.off += int64(len(b))
+		if len(s.buf) < maxShipLine {
+			s.buf = append(s.buf, b...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		ln := bytes.TrimRight(s.buf, "\r\n")
+		if len(ln) > maxShipLine {
+			ln = ln[:maxShipLine]
+		}
+		if len(ln) > 0 {
+			v = append(v, string(ln))
+		}
+		s.buf = s.buf[:0]
+	}
+	return v
+}
+
+// Open the file if it isn't open or was rotated. A file that shrank
+// (truncated on rotation) is read from the beginning. Returns true if
+// the offset was reset.
+func (s *logShipper) reopen() (bool, error) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		return false, fmt.Errorf("logship: %s", err)
+	}
+
+	if s.fd != nil && os.SameFile(fi, s.fi) {
+		if fi.Size() < s.off {
+			s.off = 0
+			s.buf = s.buf[:0]
+			return true, nil
+		}
+		return false, nil
+	}
+
+	fd, err := os.Open(s.file)
+	if err != nil {
+		return false, fmt.Errorf("logship: %s", err)
+	}
+
+	if s.fd != nil {
+		s.fd.Close()
+	}
+	s.fd, s.fi = fd, fi
+	s.off = 0
+	s.buf = s.buf[:0]
+	return true, nil
+}
+
+// Encode 'lines' as a request body in the configured format
+func (s *logShipper) encode(lines []string) []byte {
+	now := time.Now()
+
+	var b bytes.Buffer
+	switch s.format {
+	case shipNDJSON:
+		enc := json.NewEncoder(&b)
+		for _, ln := range lines {
+			m := make(map[string]string, len(s.labels)+2)
+			for k, v := range s.labels {
+				m[k] = v
+			}
+			m["time"] = now.Format(time.RFC3339Nano)
+			m["line"] = ln
+			enc.Encode(m)
+		}
+
+	default:
+		ts := strconv.FormatInt(now.UnixNano(), 10)
+		vals := make([][2]string, len(lines))
+		for i, ln := range lines {
+			vals[i] = [2]string{ts, ln}
+		}
+
+		type stream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		json.NewEncoder(&b).Encode(struct {
+			Streams []stream `json:"streams"`
+		}{[]stream{{s.labels, vals}}})
+	}
+	return b.Bytes()
+}
+
+// POST one batch
+func (s *logShipper) send(b []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	ct := "application/json"
+	if s.format == shipNDJSON {
+		ct = "application/x-ndjson"
+	}
+	req.Header.Set("Content-Type", ct)
+
+	res, err := s.clt.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
+// Save a batch that couldn't be sent; without a spool it is dropped
+func (s *logShipper) spoolBatch(b []byte) {
+	if len(s.spool) == 0 {
+		s.dropped++
+		return
+	}
+
+	s.seq++
+	fn := filepath.Join(s.spool, fmt.Sprintf("%d-%06d.batch", time.Now().UnixNano(), s.seq%1000000))
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		s.log.Warn("can't spool batch: %s", err)
+		s.dropped++
+		return
+	}
+	s.trimSpool()
+}
+
+// Send the spooled batches oldest first; returns true if the spool is
+// now empty.
+func (s *logShipper) drainSpool() bool {
+	if len(s.spool) == 0 {
+		return true
+	}
+
+	v, _ := s.spooled()
+	for _, fn := range v {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			os.Remove(fn)
+			continue
+		}
+
+		if err = s.send(b); err != nil {
+			s.log.Debug("%s: %s; %d batches spooled", s.url, err, len(v))
+			return false
+		}
+		os.Remove(fn)
+	}
+	return true
+}
+
+// Drop the oldest batches until the spool fits in maxSpool
+func (s *logShipper) trimSpool() {
+	v, sz := s.spooled()
+	for i := 0; sz > s.maxSpool && i < len(v); i++ {
+		if fi, err := os.Stat(v[i]); err == nil {
+			sz -= fi.Size()
+		}
+		os.Remove(v[i])
+		s.dropped++
+	}
+}
+
+// Return the spooled batches oldest first and their total size
+func (s *logShipper) spooled() ([]string, int64) {
+	v, _ := filepath.Glob(filepath.Join(s.spool, "*.batch"))
+	sort.Strings(v)
+
+	var sz int64
+	for _, fn := range v {
+		if fi, err := os.Stat(fn); err == nil {
+			sz += fi.Size()
+		}
+	}
+	return v, sz
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,82 @@
+// mime.go -- content-type and file-extension filtering for HTTP responses
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Return the blocked content-type or extension if the response 'res'
+// to request 'r' of 'user' matches the listener's MIME filter; empty
+// string otherwise.
+func mimeBlocked(f *MimeFilter, r *http.Request, user string, res *http.Response) string {
+	if len(f.Block) == 0 {
+		return ""
+	}
+
+	if len(user) > 0 {
+		for _, u := range f.Users {
+			if u == user {
+				return ""
+			}
+		}
+	}
+
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		for _, n := range f.Exempt {
+			if n.Contains(ip) {
+				return ""
+			}
+		}
+	}
+
+	ct, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	ext := strings.ToLower(path.Ext(r.URL.Path))
+
+	// A download's real name may only be in Content-Disposition
+	if _, pv, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		if fn := pv["filename"]; len(fn) > 0 {
+			ext = strings.ToLower(path.Ext(fn))
+		}
+	}
+
+	for _, b := range f.Block {
+		b = strings.ToLower(b)
+		switch {
+		case strings.HasPrefix(b, "."):
+			if b == ext {
+				return b
+			}
+
+		case strings.HasSuffix(b, "/*"):
+			if strings.HasPrefix(ct, b[:len(b)-1]) {
+				return b
+			}
+
+		case b == ct:
+			return b
+		}
+	}
+	return ""
+}
+
+// Extract the IP address from a "host:port" string
+func remoteIP(addr string) net.IP {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(h)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,274 @@
+// mirror.go -- copy traffic to a shadow destination
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A mirror copies a listener's traffic to a shadow destination, e.g. a
+// staging server or an IDS: HTTP requests are sent again to another
+// origin and tunnels have what the client sends copied to a TCP
+// address. Mirroring is best effort and never holds up the real
+// traffic: the shadow's responses are thrown away, and when it falls
+// behind or there are too many mirrors in flight we stop mirroring
+// rather than wait. A nil mirror copies nothing.
+type mirror struct {
+	http    *url.URL
+	tcp     string
+	dest    []string
+	maxBody int64
+
+	tr  *http.Transport
+	sem chan bool // bounds the mirrors in flight
+	log *L.Logger
+}
+
+// Mirror limits unless told otherwise
+const (
+	defaultMirrorBody = 1024 * 1024
+	maxMirrors        = 256
+	mirrorTimeout     = 10 * time.Second
+
+	// tunnel reads queued for a slow shadow before we give up on it
+	mirrorQueue = 64
+)
+
+// Make the mirror in 'c'; nil if there is none
+func newMirror(c *MirrorConf, log *L.Logger) (*mirror, error) {
+	if len(c.HTTP) == 0 && len(c.TCP) == 0 {
+		return nil, nil
+	}
+
+	m := &mirror{
+		tcp:     c.TCP,
+		dest:    domainList(c.Dest),
+		maxBody: int64(c.MaxBody),
+		sem:     make(chan bool, maxMirrors),
+		log:     log,
+	}
+	if m.maxBody <= 0 {
+		m.maxBody = defaultMirrorBody
+	}
+
+	if len(c.HTTP) > 0 {
+		u, err := url.Parse(c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %s", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("mirror: %s is not an http or https URL", c.HTTP)
+		}
+		m.http = u
+		m.tr = &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: mirrorTimeout}).DialContext,
+			TLSHandshakeTimeout: mirrorTimeout,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     time.Minute,
+		}
+	}
+
+	if len(c.TCP) > 0 {
+		if _, _, err := net.SplitHostPort(c.TCP); err != nil {
+			return nil, fmt.Errorf("mirror: %s", err)
+		}
+	}
+	return m, nil
+}
+
+// Return true if requests to 'host' are mirrored
+func (m *mirror) matches(host string) bool {
+	return len(m.dest) == 0 || domainMatch(m.dest, host)
+}
+
+// Take a slot for a mirror; false if there are too many in flight
+func (m *mirror) acquire() bool {
+	select {
+	case m.sem <- true:
+		return true
+	default:
+		m.log.Debug("mirror: too many in flight; skipped one")
+		return false
+	}
+}
+
+func (m *mirror) release() {
+	<-m.sem
+}
+
+// Return a body for request 'r' that keeps a copy of what is read for
+// the mirror; nil if 'r' isn't mirrored.
+func (m *mirror) Body(r *http.Request) *mirrorBody {
+	if m == nil || m.http == nil || !m.matches(r.URL.Hostname()) {
+		return nil
+	}
+	if r.ContentLength > m.maxBody {
+		return nil
+	}
+	return &mirrorBody{ReadCloser: r.Body, max: m.maxBody, eof: r.Body == nil}
+}
+
+// Send request 'r' again to the HTTP mirror once the real request has
+// sent all of 'b'
+func (m *mirror) Request(r *http.Request, b *mirrorBody) {
+	if b == nil {
+		return
+	}
+
+	body, ok := b.bytes()
+	if !ok || !m.acquire() {
+		return
+	}
+
+	u := *r.URL
+	u.Scheme, u.Host = m.http.Scheme, m.http.Host
+
+	req, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		m.release()
+		return
+	}
+	req.Header = cloneCleanHeader(r.Header)
+	req.Host = r.Host
+	req.Header.Set("X-Goproxy-Mirror", "1")
+
+	go func() {
+		defer m.release()
+
+		res, err := m.tr.RoundTrip(req)
+		if err != nil {
+			m.log.Debug("mirror: %s %s: %s", r.Method, u.String(), err)
+			return
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, m.maxBody))
+		res.Body.Close()
+	}()
+}
+
+// A request body that keeps a copy of what is read, up to a limit
+type mirrorBody struct {
+	io.ReadCloser
+	max int64
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	over bool
+	eof  bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	if !b.over {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.max {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+// Return the body read; false if it wasn't all read or is too large
+func (b *mirrorBody) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.over || !b.eof {
+		return nil, false
+	}
+	return b.buf.Bytes(), true
+}
+
+// Return the stream to copy a tunnel to 'host' into; nil if the tunnel
+// isn't mirrored.
+func (m *mirror) Tunnel(host string) *tcpMirror {
+	if m == nil || len(m.tcp) == 0 || !m.matches(host) || !m.acquire() {
+		return nil
+	}
+
+	t := &tcpMirror{
+		m:  m,
+		ch: make(chan []byte, mirrorQueue),
+	}
+	go t.run()
+	return t
+}
+
+// One tunnel's copy to the TCP mirror
+type tcpMirror struct {
+	m  *mirror
+	ch chan []byte
+
+	// set when the mirror fell behind; we drop the rest
+	stalled bool
+}
+
+// Queue a copy of 'b' for the mirror; suitable for CancellableCopier's
+// LhsTap.
+func (t *tcpMirror) Write(b []byte) {
+	if t.stalled {
+		return
+	}
+
+	select {
+	case t.ch <- append([]byte(nil), b...):
+	default:
+		// a mirror with a gap in it is no use; stop here
+		t.stalled = true
+		t.m.log.Debug("mirror: %s is too slow; stopped mirroring a tunnel", t.m.tcp)
+	}
+}
+
+// End the copy; must be called once the tunnel is done
+func (t *tcpMirror) Close() {
+	close(t.ch)
+}
+
+func (t *tcpMirror) run() {
+	defer t.m.release()
+
+	c, err := net.DialTimeout("tcp", t.m.tcp, mirrorTimeout)
+	if err != nil {
+		t.m.log.Debug("mirror: %s", err)
+		for range t.ch {
+		}
+		return
+	}
+	defer c.Close()
+
+	// the shadow's replies go nowhere
+	go io.Copy(ioutil.Discard, c)
+
+	for b := range t.ch {
+		c.SetWriteDeadline(time.Now().Add(mirrorTimeout))
+		if _, err := c.Write(b); err != nil {
+			t.m.log.Debug("mirror: %s", err)
+			for range t.ch {
+			}
+			return
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,107 @@
+// mtu.go -- TCP segment size and path MTU discovery of our sockets
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// The smallest MSS worth clamping to: the IPv4 minimum MTU of 576 less
+// the headers
+const minMSS = 536
+
+// The MSS clamp and path MTU discovery mode of the sockets of a
+// listener: the listening socket, whose connections inherit them, and
+// the ones we dial. Transparent and tunneled deployments need them to
+// avoid PMTU blackholes when ICMP doesn't make it back through the
+// encapsulation. A nil mtuPolicy leaves the system defaults.
+type mtuPolicy struct {
+	mss  int // 0 for the system default
+	pmtu int // -1 for the system default
+}
+
+// Make the policy in 'c'; nil if it is the system default
+func newMTUPolicy(c *MTUConf) (*mtuPolicy, error) {
+	if c.MSS == 0 && len(c.PMTU) == 0 {
+		return nil, nil
+	}
+	if !mtuSupported {
+		return nil, fmt.Errorf("mtu: not supported on this platform")
+	}
+
+	m := &mtuPolicy{mss: c.MSS, pmtu: -1}
+	if m.mss != 0 && (m.mss < minMSS || m.mss > 65495) {
+		return nil, fmt.Errorf("mtu: mss %d is not between %d and 65495", m.mss, minMSS)
+	}
+	if len(c.PMTU) > 0 {
+		p, ok := pmtuModes[c.PMTU]
+		if !ok {
+			return nil, fmt.Errorf("mtu: pmtu must be do, want, dont or probe, not %q", c.PMTU)
+		}
+		m.pmtu = p
+	}
+	return m, nil
+}
+
+// Set the options of listening socket 'ln'; the connections it accepts
+// inherit them.
+func (m *mtuPolicy) Listener(ln *net.TCPListener) error {
+	if m == nil {
+		return nil
+	}
+
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	v6 := ln.Addr().(*net.TCPAddr).IP.To4() == nil
+	var serr error
+	if err = rc.Control(func(fd uintptr) { serr = setMTU(fd, v6, m.mss, m.pmtu) }); err != nil {
+		return err
+	}
+	return serr
+}
+
+// Return the dialer control that sets the options of outbound sockets
+// before they connect; nil if there are none to set
+func (m *mtuPolicy) Control() func(network, address string, c syscall.RawConn) error {
+	if m == nil {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		v6 := network == "tcp6"
+		var serr error
+		if err := c.Control(func(fd uintptr) { serr = setMTU(fd, v6, m.mss, m.pmtu) }); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// Return a dialer control that runs 'a' then 'b'; either may be nil
+func chainControl(a, b func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := a(network, address, c); err != nil {
+			return err
+		}
+		return b(network, address, c)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
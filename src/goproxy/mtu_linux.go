@@ -0,0 +1,45 @@
+// mtu_linux.go -- TCP segment size and path MTU discovery on linux
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"syscall"
+)
+
+const mtuSupported = true
+
+// The path MTU discovery modes; IPv6 uses the same values
+var pmtuModes = map[string]int{
+	"do":    syscall.IP_PMTUDISC_DO,
+	"want":  syscall.IP_PMTUDISC_WANT,
+	"dont":  syscall.IP_PMTUDISC_DONT,
+	"probe": syscall.IP_PMTUDISC_PROBE,
+}
+
+// Set the MSS clamp 'mss' and path MTU discovery mode 'pmtu' of socket
+// 'fd'; 0 and -1 leave them be. An IPv6 socket also carries IPv4
+// (mapped) connections, so it gets the IPv4 mode too.
+func setMTU(fd uintptr, v6 bool, mss, pmtu int) error {
+	if mss > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss); err != nil {
+			return err
+		}
+	}
+	if pmtu < 0 {
+		return nil
+	}
+
+	err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, pmtu)
+	if v6 {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, pmtu)
+	}
+	return err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,22 @@
+// mtu_other.go -- TCP segment size and path MTU discovery elsewhere
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+const mtuSupported = false
+
+var pmtuModes = map[string]int{}
+
+func setMTU(fd uintptr, v6 bool, mss, pmtu int) error {
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,165 @@
+// opa.go -- per request decisions of an Open Policy Agent
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+const defaultOPATimeout = time.Second
+
+// An opaClient asks an Open Policy Agent whether a request of the
+// listeners with "opa: true" may go on, after our own checks let it.
+// The policy -- in Rego, of any complexity -- lives with the agent
+// rather than in our config. Each request is POSTed to its data API as
+// {"input": {...}}; the answer is a boolean "result" or an object with
+// "allow" and, for the logs, "reason". An undefined result denies. So
+// does an agent that doesn't answer, unless we fail open. A nil
+// opaClient allows everything.
+type opaClient struct {
+	url      string
+	clt      *http.Client
+	failOpen bool
+	log      *L.Logger
+}
+
+// A request as the policy sees it
+type opaInput struct {
+	Listener string `json:"listener"`
+	Protocol string `json:"protocol"` // socks or http
+	User     string `json:"user,omitempty"`
+	Client   string `json:"client"` // IP
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Method   string `json:"method,omitempty"` // of HTTP requests
+	URL      string `json:"url,omitempty"`
+	Time     string `json:"time"` // RFC 3339, local
+}
+
+// Make the client in 'c'; nil if there is no agent
+func newOPAClient(c *OPAConf, log *L.Logger) *opaClient {
+	if len(c.URL) == 0 {
+		return nil
+	}
+
+	t := time.Duration(c.Timeout)
+	if t <= 0 {
+		t = defaultOPATimeout
+	}
+	return &opaClient{
+		url:      c.URL,
+		clt:      &http.Client{Timeout: t},
+		failOpen: c.FailOpen,
+		log:      log.New("opa", 0),
+	}
+}
+
+// Return the client of listener 'lc'; nil if it doesn't ask the agent
+func (o *opaClient) For(lc *ListenConf) *opaClient {
+	if !lc.OPA {
+		return nil
+	}
+	return o
+}
+
+// Return true if the agent allows request 'in'; else why not
+func (o *opaClient) Allow(in *opaInput) (bool, string) {
+	if o == nil {
+		return true, ""
+	}
+
+	in.Time = time.Now().Format(time.RFC3339)
+	ok, why, err := o.ask(in)
+	if err != nil {
+		o.log.Warn("%s", err)
+		if o.failOpen {
+			return true, ""
+		}
+		return false, "opa: " + err.Error()
+	}
+	return ok, why
+}
+
+func (o *opaClient) ask(in *opaInput) (bool, string, error) {
+	b, err := json.Marshal(map[string]interface{}{"input": in})
+	if err != nil {
+		return false, "", err
+	}
+
+	res, err := o.clt.Post(o.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("%s: %s", o.url, res.Status)
+	}
+
+	var v struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return false, "", fmt.Errorf("%s: %s", o.url, err)
+	}
+
+	var ok bool
+	if len(v.Result) == 0 {
+		return false, "opa: undefined", nil
+	}
+	if json.Unmarshal(v.Result, &ok) == nil {
+		return ok, "opa", nil
+	}
+
+	var d struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err = json.Unmarshal(v.Result, &d); err != nil {
+		return false, "", fmt.Errorf("%s: result is %s", o.url, v.Result)
+	}
+	why := "opa"
+	if len(d.Reason) > 0 {
+		why += ": " + d.Reason
+	}
+	return d.Allow, why, nil
+}
+
+// Return request 'r' as the policy sees it
+func (p *HTTPProxy) opaInput(r *http.Request) *opaInput {
+	in := &opaInput{
+		Listener: p.conf.String(),
+		Protocol: "http",
+		Client:   remoteIP(r.RemoteAddr).String(),
+		Host:     r.URL.Hostname(),
+		User:     p.user(r),
+		Method:   r.Method,
+	}
+	if r.Method != "CONNECT" {
+		in.URL = r.URL.String()
+	}
+
+	in.Port, _ = strconv.Atoi(r.URL.Port())
+	if in.Port == 0 {
+		in.Port = 80
+		if r.URL.Scheme == "https" {
+			in.Port = 443
+		}
+	}
+	return in
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,48 @@
+// outbound.go -- reuse and close policy of outbound connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// HTTP connections kept for reuse per destination unless the listener
+// says otherwise
+const defaultIdlePerHost = 32
+
+// Return the SO_LINGER seconds for outbound linger policy 's': -1 for
+// the OS default, 0 to reset on close.
+func parseLinger(s string) (int, error) {
+	switch s {
+	case "":
+		return -1, nil
+	case "abort":
+		return 0, nil
+	}
+
+	d, err := parseDuration(s)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("linger: want \"abort\" or a duration of 1s or more, not %q", s)
+	}
+	return int(d / time.Second), nil
+}
+
+// Set the linger policy 'sec' of outbound connection 'c'
+func setLinger(c net.Conn, sec int) {
+	if sec < 0 {
+		return
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(sec)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
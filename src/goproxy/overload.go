@@ -0,0 +1,200 @@
+// overload.go -- shed new connections when overloaded
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// An overloadGuard samples the goroutine count, heap size and
+// scheduling latency every second. When any of them crosses its
+// threshold we are overloaded: new connections from clients that
+// already have several are shed. Past 1.25 times a threshold we are
+// critical and every new connection is shed; so the proxy degrades
+// instead of running out of memory. A nil overloadGuard sheds nothing.
+type overloadGuard struct {
+	cfg OverloadConf
+	log *L.Logger
+
+	level int32  // overloadNone, overloadHigh or overloadCritical
+	shed  uint64 // connections shed
+
+	mu     sync.Mutex
+	reason string
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+const (
+	overloadNone = iota
+	overloadHigh
+	overloadCritical
+)
+
+var overloadNames = []string{"ok", "overloaded", "critical"}
+
+// Clients with at least this many active connections are shed first
+const defaultShedClientConns = 4
+
+// Return a guard for the thresholds in 'cfg'; nil if none are set
+func newOverloadGuard(cfg *OverloadConf, log *L.Logger) *overloadGuard {
+	if cfg.Goroutines <= 0 && cfg.Memory <= 0 && cfg.Latency <= 0 {
+		return nil
+	}
+
+	o := &overloadGuard{
+		cfg:  *cfg,
+		log:  log.New("overload", 0),
+		stop: make(chan bool),
+	}
+	if o.cfg.ClientConns <= 0 {
+		o.cfg.ClientConns = defaultShedClientConns
+	}
+	return o
+}
+
+func (o *overloadGuard) Start() {
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		o.loop()
+	}()
+}
+
+func (o *overloadGuard) Stop() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+// Return true if a new connection from a client with 'active'
+// connections must be shed
+func (o *overloadGuard) Shed(active int) bool {
+	if o == nil {
+		return false
+	}
+
+	switch atomic.LoadInt32(&o.level) {
+	case overloadNone:
+		return false
+	case overloadHigh:
+		if active < o.cfg.ClientConns {
+			return false
+		}
+	}
+
+	atomic.AddUint64(&o.shed, 1)
+	return true
+}
+
+// The overload state as described in GET /stats
+type overloadStats struct {
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+	Shed   uint64 `json:"shed"`
+}
+
+func (o *overloadGuard) Stats() *overloadStats {
+	if o == nil {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return &overloadStats{
+		State:  overloadNames[atomic.LoadInt32(&o.level)],
+		Reason: o.reason,
+		Shed:   atomic.LoadUint64(&o.shed),
+	}
+}
+
+func (o *overloadGuard) loop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-t.C:
+			o.check()
+		}
+	}
+}
+
+// Sample the load and update the level; transitions are logged
+func (o *overloadGuard) check() {
+	var why []string
+	level := overloadNone
+
+	over := func(name string, v, max float64, f string) {
+		if max <= 0 || v < max {
+			return
+		}
+
+		l := overloadHigh
+		if v >= 1.25*max {
+			l = overloadCritical
+		}
+		if l > level {
+			level = l
+		}
+		why = append(why, fmt.Sprintf("%s "+f+" >= "+f, name, v, max))
+	}
+
+	over("goroutines", float64(runtime.NumGoroutine()), float64(o.cfg.Goroutines), "%.0f")
+
+	if o.cfg.Memory > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		over("heap MB", float64(ms.HeapAlloc)/(1<<20), float64(o.cfg.Memory)/(1<<20), "%.0f")
+	}
+
+	if o.cfg.Latency > 0 {
+		lat := schedLatency()
+		over("latency ms", lat.Seconds()*1000, time.Duration(o.cfg.Latency).Seconds()*1000, "%.1f")
+	}
+
+	reason := strings.Join(why, ", ")
+
+	o.mu.Lock()
+	o.reason = reason
+	o.mu.Unlock()
+
+	old := atomic.SwapInt32(&o.level, int32(level))
+	switch {
+	case int(old) == level:
+	case level == overloadNone:
+		o.log.Info("load is back to normal; shed %d connections so far",
+			atomic.LoadUint64(&o.shed))
+	default:
+		o.log.Warn("%s: %s", overloadNames[level], reason)
+	}
+}
+
+// Return how long a new goroutine waits before it runs; this is what
+// a newly accepted connection waits before it is served.
+func schedLatency() time.Duration {
+	ch := make(chan time.Duration, 1)
+	t0 := time.Now()
+	go func() {
+		ch <- time.Since(t0)
+	}()
+	return <-ch
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,64 @@
+// policy.go -- named policies shared by listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+// Fill the settings that 'lc' leaves unset from its policy 'p'. This
+// runs before the defaults are applied so a policy's values win over
+// the defaults and the global timeouts.
+func (lc *ListenConf) usePolicy(p *PolicyConf) {
+	if len(lc.Allow) == 0 {
+		lc.Allow = p.Allow
+	}
+	if len(lc.Deny) == 0 {
+		lc.Deny = p.Deny
+	}
+
+	lc.Timeouts.inherit(&p.Timeouts)
+
+	if lc.Ratelimit.Global == 0 {
+		lc.Ratelimit.Global = p.Ratelimit.Global
+	}
+	if lc.Ratelimit.PerHost == 0 {
+		lc.Ratelimit.PerHost = p.Ratelimit.PerHost
+	}
+	if lc.Ratelimit.Idle == 0 {
+		lc.Ratelimit.Idle = p.Ratelimit.Idle
+	}
+	if lc.Sizelimit.Upload == 0 {
+		lc.Sizelimit.Upload = p.Sizelimit.Upload
+	}
+	if lc.Sizelimit.Download == 0 {
+		lc.Sizelimit.Download = p.Sizelimit.Download
+	}
+
+	if len(lc.Mimefilter.Block) == 0 {
+		lc.Mimefilter.Block = p.Mimefilter.Block
+	}
+	if len(lc.Mimefilter.Exempt) == 0 {
+		lc.Mimefilter.Exempt = p.Mimefilter.Exempt
+	}
+	if len(lc.Mimefilter.Users) == 0 {
+		lc.Mimefilter.Users = p.Mimefilter.Users
+	}
+
+	if len(lc.DenyCategories) == 0 {
+		lc.DenyCategories = p.DenyCategories
+	}
+	if len(lc.DenyProtocols) == 0 {
+		lc.DenyProtocols = p.DenyProtocols
+	}
+	if !lc.Safesearch.Enable {
+		lc.Safesearch = p.Safesearch
+	}
+	if len(lc.Schedule.Active) == 0 {
+		lc.Schedule = p.Schedule
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
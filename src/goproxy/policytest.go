@@ -0,0 +1,222 @@
+// policytest.go -- "goproxy test-policy": check a config against cases
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	flag "github.com/ogier/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A policy test case: would 'Listener' let 'Client' (logged in as
+// 'User') reach 'Dest' at 'Time'? Expect is allow or deny.
+type policyCase struct {
+	Name     string `yaml:"name"`
+	Listener string `yaml:"listener"` // its name or listen address
+	Client   string `yaml:"client"`
+	User     string `yaml:"user"`
+	Dest     string `yaml:"dest"`
+	Time     string `yaml:"time"` // RFC 3339; now if empty
+	Expect   string `yaml:"expect"`
+}
+
+// What the cases are checked against: the config and the databases
+// it names
+type policyEnv struct {
+	cfg  *Conf
+	cat  CategoryDB
+	bl   *blocklist
+	auth *authenticator
+	acls *aclTable
+	lc   map[string]*ListenConf
+}
+
+// Run the test-policy subcommand with 'args'; return the exit code
+func testPolicyMain(args []string) int {
+	fs := flag.NewFlagSet("test-policy", flag.ExitOnError)
+	verbose := fs.BoolP("verbose", "V", false, "Show the cases that pass too")
+
+	fs.Usage = func() {
+		fmt.Printf("goproxy test-policy - check the policy of a config against test cases\nUsage: %s test-policy [options] config-file cases-file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	cfg, _, err := ReadYAML(fs.Args()[0])
+	if err != nil {
+		warn("test-policy: %s", err)
+		return exitConfig
+	}
+
+	b, err := ioutil.ReadFile(fs.Args()[1])
+	if err != nil {
+		warn("test-policy: %s", err)
+		return exitUsage
+	}
+	var cases []policyCase
+	if err := yaml.Unmarshal(b, &cases); err != nil {
+		warn("test-policy: %s: %s", fs.Args()[1], err)
+		return exitUsage
+	}
+
+	env, err := newPolicyEnv(cfg)
+	if err != nil {
+		warn("test-policy: %s", err)
+		return exitConfig
+	}
+
+	if env.runCases(os.Stdout, cases, *verbose) > 0 {
+		return exitFatal
+	}
+	return 0
+}
+
+func newPolicyEnv(cfg *Conf) (*policyEnv, error) {
+	cat, err := NewCategoryDB(&cfg.Categories)
+	if err != nil {
+		return nil, err
+	}
+	bl, err := newBlocklist(cfg.Blocklist)
+	if err != nil {
+		return nil, err
+	}
+	// only the users file is used; we never ask the backend
+	auth, err := newAuthenticator(&cfg.Auth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &policyEnv{
+		cfg:  cfg,
+		cat:  cat,
+		bl:   bl,
+		auth: auth,
+		acls: newACLTable(),
+		lc:   make(map[string]*ListenConf),
+	}
+	for _, v := range cfg.listeners() {
+		for i := range v {
+			lc := &v[i]
+			e.lc[lc.Listen] = lc
+			e.lc[lc.String()] = lc
+		}
+	}
+	return e, nil
+}
+
+// Check 'cases' and report the failures -- and with 'verbose' the
+// passes -- to 'w'; return the number that failed.
+func (e *policyEnv) runCases(w io.Writer, cases []policyCase, verbose bool) int {
+	var failed int
+	for i := range cases {
+		c := &cases[i]
+		name := c.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("case %d", i+1)
+		}
+
+		ok, why, err := e.eval(c)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "ERROR %s: %s\n", name, err)
+			failed++
+		case (c.Expect == "allow") != ok:
+			fmt.Fprintf(w, "FAIL  %s: want %s, got %s (%s)\n", name, c.Expect, verdict(ok), why)
+			failed++
+		case verbose:
+			fmt.Fprintf(w, "ok    %s: %s (%s)\n", name, verdict(ok), why)
+		}
+	}
+
+	fmt.Fprintf(w, "%d cases, %d failed\n", len(cases), failed)
+	return failed
+}
+
+func verdict(ok bool) string {
+	if ok {
+		return "allow"
+	}
+	return "deny"
+}
+
+// Return true if case 'c' is allowed and why; an error if it can't be
+// decided. The checks are those the proxies make, in their order; the
+// ones that depend on load (rate limits, bans, connection limits) are
+// left out.
+func (e *policyEnv) eval(c *policyCase) (bool, string, error) {
+	if c.Expect != "allow" && c.Expect != "deny" {
+		return false, "", fmt.Errorf("expect must be allow or deny, not %q", c.Expect)
+	}
+
+	lc, ok := e.lc[c.Listener]
+	if !ok {
+		return false, "", fmt.Errorf("no listener %q", c.Listener)
+	}
+
+	ip := net.ParseIP(c.Client)
+	if ip == nil {
+		return false, "", fmt.Errorf("client %q is not an IP address", c.Client)
+	}
+
+	now := time.Now()
+	if len(c.Time) > 0 {
+		t, err := time.Parse(time.RFC3339, c.Time)
+		if err != nil {
+			return false, "", fmt.Errorf("time: %s", err)
+		}
+		now = t
+	}
+
+	sch, err := newSchedule(&lc.Schedule)
+	if err != nil {
+		return false, "", err
+	}
+	if !sch.Active(now) {
+		return false, "schedule", nil
+	}
+
+	ok, rule := e.acls.For(lc).match(ip)
+	if !ok {
+		return false, fmt.Sprintf("acl: %s", rule), nil
+	}
+
+	if lc.Auth {
+		if len(c.User) == 0 {
+			return false, "auth: no user", nil
+		}
+		if _, ok := e.auth.users.Load().(map[string]string)[c.User]; !ok && len(e.cfg.Auth.URL) == 0 {
+			return false, "auth: unknown user", nil
+		}
+	}
+
+	host := hostOnly(c.Dest)
+	if len(host) == 0 {
+		return false, "", fmt.Errorf("no dest")
+	}
+	if e.bl.Blocked(host) {
+		return false, "blocklist", nil
+	}
+	if cat := categoryDenied(e.cat, lc.DenyCategories, host); len(cat) > 0 {
+		return false, "category " + cat, nil
+	}
+	return true, fmt.Sprintf("acl: %s", rule), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,118 @@
+// prefer.go -- address family preference for outbound connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Address family to try first when a destination has both IPv4 and
+// IPv6 addresses
+type ipFamily int
+
+const (
+	preferSystem ipFamily = iota // resolver order
+	preferIPv4
+	preferIPv6
+)
+
+// Family preference of a listener: a default and overrides for
+// destinations matching a domain suffix.
+type familyPolicy struct {
+	dflt  ipFamily
+	rules []familyRule
+}
+
+type familyRule struct {
+	suffix string // ".example.com"
+	pref   ipFamily
+}
+
+// Make a family policy from the listener config. Returns nil if the
+// system order is used for every destination.
+func newFamilyPolicy(lc *ListenConf) (*familyPolicy, error) {
+	f := &familyPolicy{}
+
+	var err error
+	if f.dflt, err = parseFamily(lc.Prefer); err != nil {
+		return nil, err
+	}
+
+	for i := range lc.PreferRules {
+		r := &lc.PreferRules[i]
+		p, err := parseFamily(r.Prefer)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, x := range r.Suffix {
+			x = "." + strings.TrimPrefix(canonName(x), ".")
+			f.rules = append(f.rules, familyRule{suffix: x, pref: p})
+		}
+	}
+
+	if f.dflt == preferSystem && len(f.rules) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func parseFamily(s string) (ipFamily, error) {
+	switch strings.ToLower(s) {
+	case "", "system":
+		return preferSystem, nil
+	case "ipv4":
+		return preferIPv4, nil
+	case "ipv6":
+		return preferIPv6, nil
+	}
+	return preferSystem, fmt.Errorf("prefer: unknown address family %q", s)
+}
+
+// Return the preference for 'host'; the longest matching suffix wins
+func (f *familyPolicy) For(host string) ipFamily {
+	if f == nil {
+		return preferSystem
+	}
+
+	p := f.dflt
+	n := 0
+	h := "." + canonName(host)
+	for i := range f.rules {
+		r := &f.rules[i]
+		if len(r.suffix) > n && strings.HasSuffix(h, r.suffix) {
+			p, n = r.pref, len(r.suffix)
+		}
+	}
+	return p
+}
+
+// Reorder 'ips' so that the preferred family for 'host' comes first;
+// the relative order within a family is kept.
+func (f *familyPolicy) Order(host string, ips []net.IP) []net.IP {
+	p := f.For(host)
+	if p == preferSystem || len(ips) < 2 {
+		return ips
+	}
+
+	v := make([]net.IP, 0, len(ips))
+	var rest []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (p == preferIPv4) {
+			v = append(v, ip)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	return append(v, rest...)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -10,18 +10,19 @@
 package main
 
 import (
+	"fmt"
 	u "os/user"
 	"strconv"
 	"syscall"
 )
 
 
-// DropPrivilege changes the uid/gid. It dies if it cannot.
-func DropPrivilege(uids, gids string) {
+// DropPrivilege changes the uid/gid. It returns an error if it cannot.
+func DropPrivilege(uids, gids string) error {
 
 	if me := syscall.Getuid(); me != 0 {
 		warn("Not running as 'root'; can't change uid/gid")
-		return
+		return nil
 	}
 
 	if len(gids) > 0 {
@@ -29,17 +30,17 @@ func DropPrivilege(uids, gids string) {
 		if err != nil {
 			gi, err = u.LookupGroupId(gids)
 			if err != nil {
-				die("can't find group '%s' to drop privilege: %s", gids, err)
+				return fmt.Errorf("can't find group '%s' to drop privilege: %s", gids, err)
 			}
 		}
 
 		gid, err := strconv.Atoi(gi.Gid)
 		if err != nil {
-			die("can't parse integer gid %s: %s", gi.Gid, err)
+			return fmt.Errorf("can't parse integer gid %s: %s", gi.Gid, err)
 		}
 
 		if err = syscall.Setgid(gid); err != nil {
-			die("can't change Gid to %d: %s", gid, err)
+			return fmt.Errorf("can't change Gid to %d: %s", gid, err)
 		}
 	}
 
@@ -49,19 +50,20 @@ func DropPrivilege(uids, gids string) {
 		if err != nil {
 			ui, err = u.LookupId(uids)
 			if err != nil {
-				die("can't find user '%s' to drop privilege: %s", uids, err)
+				return fmt.Errorf("can't find user '%s' to drop privilege: %s", uids, err)
 			}
 		}
 		uid, err := strconv.Atoi(ui.Uid)
 		if err != nil {
-			die("can't parse integer uid %s: %s", ui.Uid, err)
+			return fmt.Errorf("can't parse integer uid %s: %s", ui.Uid, err)
 		}
 
 
 		if err = syscall.Setuid(uid); err != nil {
-			die("can't change Uid to %d: %s", uid, err)
+			return fmt.Errorf("can't change Uid to %d: %s", uid, err)
 		}
 	}
+	return nil
 }
 
 
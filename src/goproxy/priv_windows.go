@@ -9,6 +9,7 @@
 // +build windows
 package main
 
-func DropPrivilege(uids, guids string) {
+func DropPrivilege(uids, guids string) error {
 	warn("can't change uid/gid on this platform")
+	return nil
 }
@@ -0,0 +1,333 @@
+// probe.go -- upstream selection by latency probing
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A pool of upstreams. Each upstream is periodically probed and the
+// lowest latency healthy one is used for each destination region.
+type upstreamPool struct {
+	ups     []*socks5Client
+	regions []*region
+
+	interval   time.Duration
+	hysteresis float64
+
+	log *L.Logger
+
+	// client+destination -> upstream affinity
+	sticky    time.Duration
+	stickyMu  sync.Mutex
+	stickyTab map[string]stickyEntry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// A destination region and its currently preferred upstream
+type region struct {
+	RegionConf
+
+	domains []string // Suffix per domainList
+
+	sync.Mutex
+	best int // index into ups
+	rtt  []time.Duration
+}
+
+type stickyEntry struct {
+	up  int
+	exp time.Time
+}
+
+// Unhealthy upstreams have this latency
+const rttDown = time.Duration(1<<63 - 1)
+
+// Make a pool from the listener config; returns nil if no upstreams
+// are configured.
+func newUpstreamPool(lc *ListenConf, d *net.Dialer, log *L.Logger) (*upstreamPool, error) {
+	urls := lc.Upstreams
+	if len(lc.Upstream) > 0 {
+		urls = append([]string{lc.Upstream}, urls...)
+	}
+
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	u := &upstreamPool{
+		interval:   time.Duration(lc.Probe.Interval),
+		hysteresis: float64(lc.Probe.Hysteresis) / 100.0,
+		log:        log,
+	}
+
+	for _, s := range urls {
+		c, err := newSocks5Client(s, d)
+		if err != nil {
+			return nil, err
+		}
+		u.ups = append(u.ups, c)
+	}
+
+	if lc.Sticky.Enable && len(u.ups) > 1 {
+		u.sticky = time.Duration(lc.Sticky.TTL)
+		if u.sticky <= 0 {
+			u.sticky = 10 * time.Minute
+		}
+		u.stickyTab = make(map[string]stickyEntry)
+	}
+
+	if u.interval <= 0 {
+		u.interval = 30 * time.Second
+	}
+
+	for i := range lc.Probe.Regions {
+		rc := lc.Probe.Regions[i]
+		u.regions = append(u.regions, &region{RegionConf: rc, domains: domainList(rc.Suffix)})
+	}
+
+	// Catch-all region for destinations that don't match any suffix
+	u.regions = append(u.regions, &region{})
+
+	for _, r := range u.regions {
+		r.rtt = make([]time.Duration, len(u.ups))
+	}
+	return u, nil
+}
+
+// Start probing; a pool with just one upstream has nothing to choose
+func (u *upstreamPool) Start() {
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	if len(u.ups) < 2 {
+		return
+	}
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+
+		t := time.NewTicker(u.interval)
+		defer t.Stop()
+		for {
+			u.probe()
+			u.expireSticky()
+			select {
+			case <-u.ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func (u *upstreamPool) Stop() {
+	u.cancel()
+	u.wg.Wait()
+}
+
+// Return the upstream to use for a connection from 'client' to
+// destination 'host'. With sticky routing, a client keeps using the
+// same upstream for a destination until the affinity expires or the
+// upstream goes down.
+func (u *upstreamPool) Pick(client net.IP, host string) *socks5Client {
+	r := u.region(host)
+
+	r.Lock()
+	i := r.best
+	rtt := append([]time.Duration(nil), r.rtt...)
+	r.Unlock()
+
+	if u.stickyTab == nil || client == nil {
+		return u.ups[i]
+	}
+
+	key := client.String() + "|" + strings.ToLower(host)
+	now := time.Now()
+
+	u.stickyMu.Lock()
+	defer u.stickyMu.Unlock()
+
+	e, ok := u.stickyTab[key]
+	if !ok || now.After(e.exp) || rtt[e.up] == rttDown {
+		e.up = stickyHash(key, rtt)
+	}
+
+	e.exp = now.Add(u.sticky)
+	u.stickyTab[key] = e
+	return u.ups[e.up]
+}
+
+// Consistently map 'key' to one of the healthy upstreams (rendezvous
+// hashing); so a pair moves only if its upstream goes down.
+func stickyHash(key string, rtt []time.Duration) int {
+	best := 0
+	var max uint64
+
+	for i := range rtt {
+		if rtt[i] == rttDown {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte{byte(i)})
+		h.Write([]byte(key))
+		if v := h.Sum64(); v >= max {
+			best, max = i, v
+		}
+	}
+	return best
+}
+
+// Remove expired affinities
+func (u *upstreamPool) expireSticky() {
+	if u.stickyTab == nil {
+		return
+	}
+
+	now := time.Now()
+	u.stickyMu.Lock()
+	for k, e := range u.stickyTab {
+		if now.After(e.exp) {
+			delete(u.stickyTab, k)
+		}
+	}
+	u.stickyMu.Unlock()
+}
+
+// Find the region for 'host'; the last region is the catch-all
+func (u *upstreamPool) region(host string) *region {
+	for _, r := range u.regions {
+		if domainMatch(r.domains, host) {
+			return r
+		}
+	}
+	return u.regions[len(u.regions)-1]
+}
+
+// Probe every upstream once for every region and update the choices
+func (u *upstreamPool) probe() {
+	conn := make([]time.Duration, len(u.ups))
+
+	var wg sync.WaitGroup
+	for i, c := range u.ups {
+		wg.Add(1)
+		go func(i int, c *socks5Client) {
+			defer wg.Done()
+			conn[i] = u.probeConnect(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range u.regions {
+		rtt := make([]time.Duration, len(u.ups))
+		for i, c := range u.ups {
+			rtt[i] = conn[i]
+			if rtt[i] != rttDown && len(r.Head) > 0 {
+				rtt[i] = u.probeHead(c, r.Head)
+			}
+		}
+		u.choose(r, rtt)
+	}
+}
+
+// Pick the best upstream for 'r'. The current choice is kept unless
+// it is down or another is faster by more than the hysteresis margin.
+func (u *upstreamPool) choose(r *region, rtt []time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	copy(r.rtt, rtt)
+
+	best := r.best
+	for i, v := range rtt {
+		if v < rtt[best] {
+			best = i
+		}
+	}
+
+	cur := rtt[r.best]
+	if best == r.best || rtt[best] == rttDown {
+		return
+	}
+
+	if cur != rttDown && float64(rtt[best]) > float64(cur)*(1.0-u.hysteresis) {
+		return
+	}
+
+	name := r.Name
+	if len(name) == 0 {
+		name = "default"
+	}
+
+	u.log.Info("region %s: switching upstream %s (%s) -> %s (%s)", name,
+		u.ups[r.best], fmtRTT(cur), u.ups[best], fmtRTT(rtt[best]))
+	r.best = best
+}
+
+// Time a TCP connect to the upstream
+func (u *upstreamPool) probeConnect(c *socks5Client) time.Duration {
+	ctx, cancel := context.WithTimeout(u.ctx, 5*time.Second)
+	defer cancel()
+
+	t0 := time.Now()
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		u.log.Debug("probe %s: %s", c, err)
+		return rttDown
+	}
+	conn.Close()
+	return time.Since(t0)
+}
+
+// Time an HTTP HEAD request to 'url' via the upstream
+func (u *upstreamPool) probeHead(c *socks5Client, url string) time.Duration {
+	ctx, cancel := context.WithTimeout(u.ctx, 10*time.Second)
+	defer cancel()
+
+	clt := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       c.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return rttDown
+	}
+
+	t0 := time.Now()
+	res, err := clt.Do(req.WithContext(ctx))
+	if err != nil {
+		u.log.Debug("probe %s via %s: %s", url, c, err)
+		return rttDown
+	}
+	res.Body.Close()
+	return time.Since(t0)
+}
+
+func fmtRTT(t time.Duration) string {
+	if t == rttDown {
+		return "down"
+	}
+	return format(t)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,153 @@
+// qos.go -- DSCP marking of outbound connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The DSCP class of outbound connections: a default and rules for some
+// destinations. A nil qosPolicy marks nothing.
+type qosPolicy struct {
+	dflt  int // -1 if unmarked
+	cat   CategoryDB
+	rules []qosRule
+}
+
+type qosRule struct {
+	dest  []string
+	ports map[int]bool
+	cats  []string
+	dscp  int
+}
+
+// The DSCP class names of RFC 4594 and the class selectors
+var dscpNames = map[string]int{
+	"be": 0, "default": 0, "ef": 46, "va": 44,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24,
+	"cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+}
+
+// Make the policy in 'c' looking up destination categories in 'cat';
+// nil if nothing is marked
+func newQoSPolicy(c *QoSConf, cat CategoryDB) (*qosPolicy, error) {
+	q := &qosPolicy{dflt: -1, cat: cat}
+
+	var err error
+	if len(c.DSCP) > 0 {
+		if q.dflt, err = parseDSCP(c.DSCP); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Dest) == 0 && len(r.Ports) == 0 && len(r.Categories) == 0 {
+			return nil, fmt.Errorf("qos: rule %d has no dest, ports or categories", i)
+		}
+
+		d, err := parseDSCP(r.DSCP)
+		if err != nil {
+			return nil, fmt.Errorf("qos: rule %d: %w", i, err)
+		}
+
+		qr := qosRule{dest: domainList(r.Dest), cats: r.Categories, dscp: d}
+		if len(r.Ports) > 0 {
+			qr.ports = make(map[int]bool)
+			for _, p := range r.Ports {
+				if p <= 0 || p > 65535 {
+					return nil, fmt.Errorf("qos: rule %d: invalid port %d", i, p)
+				}
+				qr.ports[p] = true
+			}
+		}
+		q.rules = append(q.rules, qr)
+	}
+
+	if q.dflt < 0 && len(q.rules) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func parseDSCP(s string) (int, error) {
+	if d, ok := dscpNames[strings.ToLower(s)]; ok {
+		return d, nil
+	}
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 || d > 63 {
+		return 0, fmt.Errorf("qos: unknown DSCP class %q", s)
+	}
+	return d, nil
+}
+
+// Return the DSCP class of a connection to 'host' port 'port'; -1 if
+// it isn't marked
+func (q *qosPolicy) For(host string, port int) int {
+	if q == nil {
+		return -1
+	}
+
+	for i := range q.rules {
+		r := &q.rules[i]
+		if len(r.dest) > 0 && !domainMatch(r.dest, host) {
+			continue
+		}
+		if r.ports != nil && !r.ports[port] {
+			continue
+		}
+		if len(r.cats) > 0 && !q.inCategory(r.cats, host) {
+			continue
+		}
+		return r.dscp
+	}
+	return q.dflt
+}
+
+// Return true if 'host' is in one of the categories 'cats'
+func (q *qosPolicy) inCategory(cats []string, host string) bool {
+	if q.cat == nil {
+		return false
+	}
+
+	c := q.cat.Lookup(host)
+	for _, x := range cats {
+		if len(c) > 0 && strings.EqualFold(x, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a copy of 'd' that marks its connections to 'addr'
+func (q *qosPolicy) Dialer(d *net.Dialer, addr string) *net.Dialer {
+	if q == nil {
+		return d
+	}
+
+	h, ps, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(ps)
+	dscp := q.For(h, port)
+	if dscp < 0 {
+		return d
+	}
+
+	nd := *d
+	nd.Control = chainControl(d.Control, dscpControl(dscp))
+	return &nd
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
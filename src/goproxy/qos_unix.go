@@ -0,0 +1,38 @@
+// qos_unix.go -- DSCP marking on unix platforms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Return a dialer control that sets the DSCP class 'dscp' of a socket
+// before it connects, so even the SYN is marked
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,24 @@
+// qos_windows.go -- DSCP marking on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Windows ignores the TOS a socket sets; DSCP is marked by its QoS
+// policies instead. So connections go out unmarked.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,266 @@
+// quota.go -- byte quotas of listeners, tenants and users with usage alerts
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A quotaMeter counts the bytes (both ways) moved by the listeners and
+// tenants that have a quota -- and by each user, if users have one --
+// and raises an alert as the usage in the current period crosses each
+// of the alert percentages. Quotas don't
+// cut anyone off; they warn. Usage is kept in memory and starts from
+// zero when we restart -- unless it is shared with the fleet, when it
+// is added up in Redis at each sync and only one proxy raises each
+// alert. A nil quotaMeter counts nothing.
+type quotaMeter struct {
+	alert   *alerter
+	cluster *clusterStore // may be nil
+
+	user *QuotaConf // of each user; nil if users have none
+
+	mu     sync.Mutex
+	byLis  map[string][]*quota // listener name -> its quota and its tenant's
+	byUser map[string]*quota   // made as users first move bytes
+	quotas []*quota
+}
+
+// The quota of one listener, tenant or user as described by GET /quota
+type quota struct {
+	Kind   string    `json:"kind"` // listener, tenant or user
+	Name   string    `json:"name"`
+	Bytes  int64     `json:"quota"`
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"` // of the current period
+	Used   int64     `json:"used"`
+
+	alerts []int // percentages, ascending
+	next   int   // index of the next alert to raise
+	pend   int64 // bytes not yet added to the fleet's usage
+}
+
+// Quota periods
+const (
+	quotaDay   = "day"
+	quotaMonth = "month"
+)
+
+// Alert at these percentages of a quota unless told otherwise
+var defaultQuotaAlerts = []int{80, 100}
+
+// Make a meter for the quotas of the listeners, tenants and users in
+// 'cfg'; nil if there are none
+func newQuotaMeter(cfg *Conf, alert *alerter) *quotaMeter {
+	m := &quotaMeter{
+		alert:  alert,
+		byLis:  make(map[string][]*quota),
+		byUser: make(map[string]*quota),
+	}
+	if cfg.Auth.Quota.Bytes > 0 {
+		m.user = &cfg.Auth.Quota
+	}
+
+	tenants := make(map[string]*quota)
+	for name, t := range cfg.Tenants {
+		if t.Quota.Bytes > 0 {
+			tenants[name] = m.newQuota("tenant", name, &t.Quota)
+		}
+	}
+
+	for _, v := range cfg.listeners() {
+		for i := range v {
+			lc := &v[i]
+			name := lc.String()
+
+			var qv []*quota
+			if lc.Quota.Bytes > 0 {
+				qv = append(qv, m.newQuota("listener", name, &lc.Quota))
+			}
+			if t, ok := tenants[lc.Tenant]; ok {
+				qv = append(qv, t)
+			}
+			if len(qv) > 0 {
+				m.byLis[name] = qv
+			}
+		}
+	}
+
+	if len(m.quotas) == 0 && m.user == nil {
+		return nil
+	}
+	return m
+}
+
+func (m *quotaMeter) newQuota(kind, name string, c *QuotaConf) *quota {
+	q := &quota{
+		Kind:   kind,
+		Name:   name,
+		Bytes:  int64(c.Bytes),
+		Period: c.Period,
+		alerts: append([]int(nil), c.Alerts...),
+	}
+	if len(q.Period) == 0 {
+		q.Period = quotaMonth
+	}
+	if len(q.alerts) == 0 {
+		q.alerts = defaultQuotaAlerts
+	}
+	sort.Ints(q.alerts)
+
+	q.Start = q.periodStart(time.Now())
+	m.quotas = append(m.quotas, q)
+	return q
+}
+
+// Count 'n' bytes moved by 'user' (if any) on 'listener' against their
+// quotas
+func (m *quotaMeter) Add(listener, user string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	qv := m.byLis[listener]
+	if m.user != nil && len(user) > 0 {
+		q, ok := m.byUser[user]
+		if !ok {
+			q = m.newQuota("user", user, m.user)
+			m.byUser[user] = q
+		}
+		qv = append(qv[:len(qv):len(qv)], q)
+	}
+
+	for _, q := range qv {
+		q.roll(now)
+		if m.cluster != nil {
+			q.pend += n
+			continue
+		}
+
+		q.Used += n
+		m.check(q)
+	}
+}
+
+// Start a new period if 'now' is past the current one
+func (q *quota) roll(now time.Time) {
+	if s := q.periodStart(now); !s.Equal(q.Start) {
+		q.Start, q.Used, q.next, q.pend = s, 0, 0, 0
+	}
+}
+
+// Raise the alert if the usage of 'q' crossed one. Must be called with
+// the lock held.
+func (m *quotaMeter) check(q *quota) {
+	pct := int(q.Used * 100 / q.Bytes)
+	if q.next >= len(q.alerts) || pct < q.alerts[q.next] {
+		return
+	}
+
+	// raise just the highest alert crossed
+	for q.next < len(q.alerts) && pct >= q.alerts[q.next] {
+		q.next++
+	}
+
+	at := q.alerts[q.next-1]
+	if m.cluster != nil && !m.cluster.FirstAlert(q, at) {
+		return
+	}
+
+	c := *q
+	c.alerts = nil
+	m.alert.Alert("quota", fmt.Sprintf("%s %s has used %d%% of its %s quota of %d bytes",
+		q.Kind, q.Name, at, q.Period, q.Bytes), &c)
+}
+
+// Add the usage counted since the last sync to that of the fleet and
+// take up its total. Redis isn't waited on with the lock held.
+func (m *quotaMeter) sync(s *clusterStore) error {
+	if m == nil {
+		return nil
+	}
+
+	type pending struct {
+		q     *quota
+		start time.Time
+		n     int64
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	pv := make([]pending, len(m.quotas))
+	for i, q := range m.quotas {
+		q.roll(now)
+		pv[i] = pending{q, q.Start, q.pend}
+		q.pend = 0
+	}
+	m.mu.Unlock()
+
+	var err error
+	for _, p := range pv {
+		var used int64
+		if err == nil {
+			c := *p.q
+			c.Start = p.start
+			used, err = s.AddQuota(&c, p.n)
+		}
+
+		m.mu.Lock()
+		switch q := p.q; {
+		case !q.Start.Equal(p.start):
+		case err != nil:
+			q.pend += p.n
+		default:
+			q.Used = used + q.pend
+			m.check(q)
+		}
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// Return the start of the period that contains 't'
+func (q *quota) periodStart(t time.Time) time.Time {
+	y, mon, d := t.Date()
+	if q.Period == quotaDay {
+		return time.Date(y, mon, d, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, mon, 1, 0, 0, 0, 0, t.Location())
+}
+
+// Admin API for quotas:
+//
+//	GET /quota       usage of each quota in its current period
+func (m *quotaMeter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	qv := []quota{}
+	if m != nil {
+		m.mu.Lock()
+		for _, q := range m.quotas {
+			qv = append(qv, *q)
+		}
+		m.mu.Unlock()
+	}
+	writeJSON(w, qv)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
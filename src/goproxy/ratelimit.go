@@ -0,0 +1,144 @@
+// ratelimit.go -- per client IP rate limits that forget idle clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients not seen for this long are forgotten unless the listener
+// says otherwise
+const defaultRateIdle = time.Minute
+
+// A perIPLimiter allows each client IP 'rate' connections a second
+// with bursts of as many. Clients idle for 'idle' are forgotten -- by
+// then their bucket is full again, so nothing is lost -- so a scan of
+// the address space doesn't grow it without bound. A nil perIPLimiter
+// limits no one.
+//
+// One that is shared with a fleet counts the connections of each
+// client to all of it in Redis, a second at a time; it falls back on
+// its own buckets when Redis doesn't answer.
+type perIPLimiter struct {
+	rate float64
+	idle time.Duration
+
+	cluster *clusterStore // may be nil
+	name    string        // of the listener, in the cluster
+
+	mu      sync.Mutex
+	m       map[string]*ipBucket
+	sweep   time.Time // next sweep for idle clients
+	evicted uint64    // atomic
+}
+
+// The tokens of a client IP as of 'last'
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Make a limiter of 'rate' connections/sec per client IP that forgets
+// clients idle for 'idle'; nil if 'rate' is 0
+func newPerIPLimiter(rate int, idle time.Duration) *perIPLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if idle <= 0 {
+		idle = defaultRateIdle
+	}
+	return &perIPLimiter{
+		rate:  float64(rate),
+		idle:  idle,
+		m:     make(map[string]*ipBucket),
+		sweep: time.Now().Add(idle),
+	}
+}
+
+// Count the clients of the listener 'name' across the fleet in 's'
+func (r *perIPLimiter) share(s *clusterStore, name string) {
+	if r != nil {
+		r.cluster, r.name = s, name
+	}
+}
+
+// Return true if the client at 'a' is over its rate
+func (r *perIPLimiter) Limit(a net.Addr) bool {
+	if r == nil {
+		return false
+	}
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	k := ta.IP.String()
+	if r.cluster != nil {
+		if over, err := r.cluster.RateLimit(r.name, k, int(r.rate)); err == nil {
+			return over
+		}
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.After(r.sweep) {
+		r.evict(now)
+	}
+
+	b, ok := r.m[k]
+	if !ok {
+		b = &ipBucket{tokens: r.rate, last: now}
+		r.m[k] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.rate {
+		b.tokens = r.rate
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return true
+	}
+	b.tokens--
+	return false
+}
+
+// Forget the clients idle since before 'now' less the idle time. Must
+// be called with the lock held.
+func (r *perIPLimiter) evict(now time.Time) {
+	old := now.Add(-r.idle)
+	for k, b := range r.m {
+		if b.last.Before(old) {
+			delete(r.m, k)
+			atomic.AddUint64(&r.evicted, 1)
+		}
+	}
+	r.sweep = now.Add(r.idle / 2)
+}
+
+// Return the number of client IPs tracked and those forgotten
+func (r *perIPLimiter) Len() (int, uint64) {
+	if r == nil {
+		return 0, 0
+	}
+
+	r.mu.Lock()
+	n := len(r.m)
+	r.mu.Unlock()
+	return n, atomic.LoadUint64(&r.evicted)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,267 @@
+// redis.go -- a minimal Redis client: pipelined commands over RESP
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Connections kept open for reuse; and how long a server that failed
+// is left alone
+const (
+	redisIdleConns = 8
+	redisBackoff   = 5 * time.Second
+)
+
+// A redisClient sends commands to one Redis server and reads back
+// their replies. Connections are made as needed -- logging in and
+// selecting the DB -- and up to redisIdleConns kept for the next
+// command; one that fails is closed. After a failure to reach the
+// server commands fail at once for redisBackoff: callers on hot paths
+// go on by themselves instead of each waiting out the timeout.
+type redisClient struct {
+	addr    string
+	pass    string
+	db      int
+	timeout time.Duration
+
+	idle chan *redisConn
+	down int64 // atomic: the server is left alone until then (unix ns)
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// An error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var (
+	errRedisProto = errors.New("redis: protocol error")
+	errRedisDown  = errors.New("redis: down; backing off")
+)
+
+func newRedisClient(addr, pass string, db int, timeout time.Duration) *redisClient {
+	return &redisClient{
+		addr:    addr,
+		pass:    pass,
+		db:      db,
+		timeout: timeout,
+		idle:    make(chan *redisConn, redisIdleConns),
+	}
+}
+
+// Run one command and return its reply: a string, an int64, nil or
+// a []interface{} of them.
+func (r *redisClient) Do(args ...string) (interface{}, error) {
+	v, err := r.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return v[0], nil
+}
+
+// Send 'cmds' at once and return their replies in order; an error
+// reply to any is the error.
+func (r *redisClient) Pipeline(cmds [][]string) ([]interface{}, error) {
+	if time.Now().UnixNano() < atomic.LoadInt64(&r.down) {
+		return nil, errRedisDown
+	}
+
+	c, err := r.get()
+	if err != nil {
+		r.backoff()
+		return nil, err
+	}
+
+	v, err := c.run(cmds, r.timeout)
+	if err != nil {
+		var re redisError
+		if !errors.As(err, &re) {
+			c.Close()
+			r.backoff()
+			return nil, err
+		}
+	}
+	r.put(c)
+	return v, err
+}
+
+// Leave the server alone for a while
+func (r *redisClient) backoff() {
+	atomic.StoreInt64(&r.down, time.Now().Add(redisBackoff).UnixNano())
+}
+
+func (r *redisClient) get() (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+
+	c := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+
+	var login [][]string
+	if len(r.pass) > 0 {
+		login = append(login, []string{"AUTH", r.pass})
+	}
+	if r.db > 0 {
+		login = append(login, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	if len(login) > 0 {
+		if _, err = c.run(login, r.timeout); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *redisClient) put(c *redisConn) {
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Close the idle connections
+func (r *redisClient) Close() {
+	for {
+		select {
+		case c := <-r.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (c *redisConn) run(cmds [][]string, timeout time.Duration) ([]interface{}, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var b bytes.Buffer
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if _, err := c.Write(b.Bytes()); err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+
+	// read every reply, even after an error one, so the connection
+	// stays in step
+	var rerr error
+	v := make([]interface{}, len(cmds))
+	for i := range v {
+		x, err := readRESP(c.rd)
+		if re, ok := err.(redisError); ok {
+			if rerr == nil {
+				rerr = re
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("redis: %s", err)
+		}
+		v[i] = x
+	}
+	return v, rerr
+}
+
+// Read one reply from 'rd'
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	ln, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(ln) < 3 || ln[len(ln)-2] != '\r' {
+		return nil, errRedisProto
+	}
+	s := ln[1 : len(ln)-2]
+
+	switch ln[0] {
+	case '+':
+		return s, nil
+
+	case '-':
+		return nil, redisError(s)
+
+	case ':':
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errRedisProto
+		}
+		return n, nil
+
+	case '$':
+		n, err := strconv.Atoi(s)
+		if err != nil || n < -1 {
+			return nil, errRedisProto
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(s)
+		if err != nil || n < -1 {
+			return nil, errRedisProto
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		// an error inside an array is that of the whole
+		var rerr error
+		v := make([]interface{}, n)
+		for i := range v {
+			x, err := readRESP(rd)
+			if re, ok := err.(redisError); ok {
+				rerr = re
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			v[i] = x
+		}
+		return v, rerr
+	}
+	return nil, errRedisProto
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,169 @@
+// reload.go -- config reload with last-known-good rollback
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A reloader re-reads the config file on SIGHUP or via the admin API.
+// A config that fails to parse or validate is rejected and we keep
+// running on the last good one; a good config becomes the new last
+// good one and the settings that can change at runtime are applied.
+type reloader struct {
+	file  string
+	log   *L.Logger
+	audit *auditLog
+
+	// applies the runtime settings of a new config
+	apply func(c *Conf)
+
+	mu   sync.Mutex
+	good *Conf
+	st   reloadStatus
+}
+
+// The reload status as described by GET /reload
+type reloadStatus struct {
+	Version string    `json:"version"` // of the running config
+	Loaded  time.Time `json:"loaded"`  // when it was loaded
+
+	// The last reload; Attempted is the version of the file we read
+	Attempt   time.Time `json:"attempt"`
+	Attempted string    `json:"attempted,omitempty"`
+	OK        bool      `json:"ok"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// Return the version of the config text 'b'
+func confVersion(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+// Make a new reloader for config file 'fn'; 'cfg' is the config read
+// from it at startup and 'ver' is its version.
+func newReloader(fn string, cfg *Conf, ver string, apply func(c *Conf), audit *auditLog, log *L.Logger) *reloader {
+	now := time.Now()
+	return &reloader{
+		file:  fn,
+		log:   log,
+		audit: audit,
+		apply: apply,
+		good:  cfg,
+		st: reloadStatus{
+			Version:   ver,
+			Loaded:    now,
+			Attempt:   now,
+			Attempted: ver,
+			OK:        true,
+		},
+	}
+}
+
+// Reload the config at the request of 'who'; return the new status
+func (r *reloader) Reload(who string) reloadStatus {
+	cfg, ver, err := ReadYAML(r.file)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := &r.st
+	st.Attempt = time.Now()
+	st.Attempted = ver
+
+	if err != nil {
+		st.OK = false
+		st.Errors = nil
+		for _, s := range strings.Split(err.Error(), "\n") {
+			st.Errors = append(st.Errors, strings.TrimSpace(s))
+		}
+
+		r.log.Error("Config reload failed; keeping version %s:\n%s", st.Version, err)
+		r.audit.Record(who, "", "reload "+r.file, err.Error())
+		return *st
+	}
+
+	if !sameListenerSets(cfg.listeners(), r.good.listeners()) {
+		r.log.Warn("Config reload: changes to the listeners (other than their ACLs, shadow rules and schedules) take effect on restart")
+	}
+
+	r.good = cfg
+	st.Version = ver
+	st.Loaded = st.Attempt
+	st.OK = true
+	st.Errors = nil
+
+	r.log.Info("Config reloaded; version %s", ver)
+	r.audit.Record(who, "", "reload "+r.file, "ok "+ver)
+	r.apply(cfg)
+	return *st
+}
+
+// Return true if the listeners 'a' and 'b' differ at most in the
+// settings a reload can change
+func sameListenerSets(a, b [][]ListenConf) bool {
+	for i := range a {
+		if !sameListeners(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameListeners(a, b []ListenConf) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		x, y := a[i], b[i]
+		x.Allow, x.Deny, x.Schedule, x.Shadow = nil, nil, ScheduleConf{}, ShadowConf{}
+		y.Allow, y.Deny, y.Schedule, y.Shadow = nil, nil, ScheduleConf{}, ShadowConf{}
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// Admin API for reload:
+//
+//	GET  /reload      status of the last reload
+//	POST /reload      reload the config
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		r.mu.Lock()
+		st := r.st
+		r.mu.Unlock()
+		writeJSON(w, &st)
+
+	case "POST":
+		who := "admin"
+		if s := adminWho(req); len(s) > 0 {
+			who = s
+		}
+		st := r.Reload(who)
+		writeJSON(w, &st)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
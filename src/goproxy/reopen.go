@@ -0,0 +1,69 @@
+// reopen.go -- reopen the log files on SIGUSR1
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"path/filepath"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A logReopener reopens the log files on SIGUSR1 so an external
+// logrotate(8) can rename them. The logger can't be told to reopen its
+// file; instead we find its descriptor at startup and, on the signal,
+// dup a freshly opened file over it.
+type logReopener struct {
+	log   *L.Logger
+	audit *auditLog
+	files []logFile
+}
+
+// A log file and the logger's descriptor for it
+type logFile struct {
+	name string
+	fd   int
+}
+
+func newLogReopener(audit *auditLog, log *L.Logger) *logReopener {
+	return &logReopener{
+		log:   log,
+		audit: audit,
+	}
+}
+
+// Add the log file 'fn'; names that aren't absolute paths (STDOUT,
+// SYSLOG) are ignored.
+func (r *logReopener) Add(fn string) {
+	if !filepath.IsAbs(fn) {
+		return
+	}
+
+	fd, err := logFd(fn)
+	if err != nil {
+		r.log.Warn("Can't reopen %s on signal: %s", fn, err)
+		return
+	}
+	r.files = append(r.files, logFile{fn, fd})
+}
+
+// Reopen all the log files
+func (r *logReopener) Reopen() {
+	for _, f := range r.files {
+		if err := reopenFd(f.name, f.fd); err != nil {
+			r.log.Error("Can't reopen %s: %s", f.name, err)
+		}
+	}
+
+	if err := r.audit.Reopen(); err != nil {
+		r.log.Error("%s", err)
+	}
+	r.log.Info("Reopened log files")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
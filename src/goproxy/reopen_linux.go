@@ -0,0 +1,66 @@
+// reopen_linux.go -- find and replace a logger's file descriptor
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Return the descriptor that 'fn' is open for writing on; files open
+// read-only (e.g. by a log shipper) are skipped.
+func logFd(fn string) (int, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(fn, &st); err != nil {
+		return -1, err
+	}
+
+	d, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return -1, err
+	}
+
+	for _, s := range names {
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd <= 2 {
+			continue
+		}
+
+		var x syscall.Stat_t
+		if syscall.Fstat(fd, &x) != nil || x.Dev != st.Dev || x.Ino != st.Ino {
+			continue
+		}
+
+		fl, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+		if e == 0 && fl&syscall.O_ACCMODE != syscall.O_RDONLY {
+			return fd, nil
+		}
+	}
+	return -1, fmt.Errorf("no descriptor is open on it")
+}
+
+// Open 'fn' afresh and make 'fd' refer to it
+func reopenFd(fn string, fd int) error {
+	nf, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer nf.Close()
+
+	return syscall.Dup3(int(nf.Fd()), fd, syscall.O_CLOEXEC)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,28 @@
+// reopen_other.go -- log reopen on platforms without /proc
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+var errNoReopen = errors.New("not supported on this platform")
+
+func logFd(fn string) (int, error) {
+	return -1, errNoReopen
+}
+
+func reopenFd(fn string, fd int) error {
+	return errNoReopen
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
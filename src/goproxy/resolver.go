@@ -0,0 +1,506 @@
+// resolver.go -- name resolution for outbound connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Resolver resolves destination names for the proxies. Static host
+// overrides and an external hosts file are consulted before DNS.
+// Names are sent to the DNS server configured for the longest
+// matching domain suffix; else to the default server (if any) or the
+// system resolver.
+type Resolver struct {
+	static map[string][]net.IP
+
+	routes []dnsRoute
+	dflt   dnsServer
+
+	// EDNS0 client subnet option for our queries; nil if none
+	ecs []byte
+
+	// failed lookups: NXDOMAIN is cached for negTTL; other failures
+	// back off exponentially from backoffMin to backoffMax
+	negTTL     time.Duration
+	backoffMin time.Duration
+	backoffMax time.Duration
+	negMu      sync.Mutex
+	neg        map[string]*negEntry
+
+	// the names in leakDest (the dnsleak domains of the listeners)
+	// of the addresses we resolved recently; a client that asks for
+	// one of these addresses resolved the name on its own
+	revMu    sync.Mutex
+	rev      map[string]revEntry
+	leakDest []string
+
+	// external hosts file; reloaded when it changes
+	file    string
+	mu      sync.RWMutex
+	hosts   map[string][]net.IP
+	mtime   time.Time
+	checked time.Time
+
+	log *L.Logger
+}
+
+// DNS server for names ending in suffix
+type dnsRoute struct {
+	suffix string
+	srv    dnsServer
+}
+
+// A cached lookup failure
+type negEntry struct {
+	err   error
+	until time.Time
+	fails uint
+}
+
+// Upper bound on cached failures
+const maxNegEntries = 65536
+
+// The name an address resolved from, until when we remember it
+type revEntry struct {
+	name  string
+	until time.Time
+}
+
+// Upper bound on and lifetime of remembered addresses
+const (
+	maxRevEntries = 65536
+	revTTL        = 10 * time.Minute
+)
+
+// How often we stat the hosts file for changes
+const hostsCheckInterval = 5 * time.Second
+
+// Make a new resolver from the config
+func NewResolver(cfg *ResolverConf, log *L.Logger) (*Resolver, error) {
+	r := &Resolver{
+		static:     make(map[string][]net.IP),
+		negTTL:     time.Duration(cfg.NegTTL),
+		backoffMin: time.Duration(cfg.BackoffMin),
+		backoffMax: time.Duration(cfg.BackoffMax),
+		neg:        make(map[string]*negEntry),
+		rev:        make(map[string]revEntry),
+		file:       cfg.HostsFile,
+		log:        log,
+	}
+
+	if r.negTTL == 0 {
+		r.negTTL = 10 * time.Second
+	}
+	if r.backoffMin == 0 {
+		r.backoffMin = 1 * time.Second
+	}
+	if r.backoffMax == 0 {
+		r.backoffMax = 30 * time.Second
+	}
+
+	for h, a := range cfg.Hosts {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("resolver: invalid IP %q for %s", a, h)
+		}
+		h = canonName(h)
+		r.static[h] = append(r.static[h], ip)
+	}
+
+	if len(cfg.ECS) > 0 {
+		var err error
+		if r.ecs, err = ecsOption(cfg.ECS); err != nil {
+			return nil, fmt.Errorf("resolver: %s", err)
+		}
+
+		if len(cfg.Servers) == 0 && log != nil {
+			log.Warn("resolver: ecs has no effect without DNS servers")
+		}
+	}
+
+	for i := range cfg.Servers {
+		c := &cfg.Servers[i]
+		srv, err := newDNSServer(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(c.Suffix) == 0 {
+			if r.dflt != nil {
+				return nil, fmt.Errorf("resolver: more than one default server")
+			}
+			r.dflt = srv
+			continue
+		}
+
+		for _, x := range c.Suffix {
+			x = "." + strings.TrimPrefix(canonName(x), ".")
+			r.routes = append(r.routes, dnsRoute{suffix: x, srv: srv})
+		}
+	}
+
+	if len(r.file) > 0 {
+		if err := r.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Return the IP addresses of 'host'
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	h := canonName(host)
+	if v, ok := r.static[h]; ok {
+		return v, nil
+	}
+
+	if v, ok := r.lookupHosts(h); ok {
+		return v, nil
+	}
+
+	if err := r.negative(h); err != nil {
+		return nil, err
+	}
+
+	v, err := r.resolve(ctx, h)
+
+	// Don't blame the name if the caller gave up
+	if ctx.Err() == nil {
+		r.remember(h, err)
+	}
+	if err == nil {
+		r.learn(h, v)
+	}
+	return v, err
+}
+
+// Learn the addresses of names in the domains 'dv' (per domainList)
+// from now on
+func (r *Resolver) WatchLeaks(dv []string) {
+	r.revMu.Lock()
+	r.leakDest = append(r.leakDest, dv...)
+	r.revMu.Unlock()
+}
+
+// Remember that 'ips' are the addresses of 'h' if it is in leakDest
+func (r *Resolver) learn(h string, ips []net.IP) {
+	until := time.Now().Add(revTTL)
+
+	r.revMu.Lock()
+	defer r.revMu.Unlock()
+
+	if !domainMatch(r.leakDest, h) {
+		return
+	}
+	if len(r.rev)+len(ips) > maxRevEntries {
+		r.rev = make(map[string]revEntry)
+	}
+	for _, ip := range ips {
+		r.rev[ip.String()] = revEntry{name: h, until: until}
+	}
+}
+
+// Return the name in leakDest we recently resolved to address 'host';
+// empty if 'host' isn't an address or we didn't.
+func (r *Resolver) NameOf(host string) string {
+	ip := net.ParseIP(host)
+	if r == nil || ip == nil {
+		return ""
+	}
+
+	r.revMu.Lock()
+	defer r.revMu.Unlock()
+
+	e, ok := r.rev[ip.String()]
+	if !ok || time.Now().After(e.until) {
+		return ""
+	}
+	return e.name
+}
+
+// Resolve 'h' via DNS or the system resolver
+func (r *Resolver) resolve(ctx context.Context, h string) ([]net.IP, error) {
+	if srv := r.server(h); srv != nil {
+		return r.lookupDNS(ctx, srv, h)
+	}
+
+	a, err := net.DefaultResolver.LookupIPAddr(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]net.IP, len(a))
+	for i := range a {
+		v[i] = a[i].IP
+	}
+	return v, nil
+}
+
+// Return the cached failure for 'h' if it is still in effect
+func (r *Resolver) negative(h string) error {
+	r.negMu.Lock()
+	defer r.negMu.Unlock()
+
+	if e, ok := r.neg[h]; ok && time.Now().Before(e.until) {
+		return e.err
+	}
+	return nil
+}
+
+// Update the failure cache with the outcome of a lookup of 'h'. A
+// name that doesn't exist is cached for negTTL; transient failures
+// (SERVFAIL, timeouts) back off exponentially.
+func (r *Resolver) remember(h string, err error) {
+	r.negMu.Lock()
+	defer r.negMu.Unlock()
+
+	if err == nil {
+		delete(r.neg, h)
+		return
+	}
+
+	e, ok := r.neg[h]
+	if !ok {
+		if len(r.neg) >= maxNegEntries {
+			r.neg = make(map[string]*negEntry)
+		}
+		e = &negEntry{}
+		r.neg[h] = e
+	}
+
+	e.err = err
+	if de, ok := err.(*net.DNSError); ok && !de.IsTemporary && !de.IsTimeout {
+		e.fails = 0
+		e.until = time.Now().Add(r.negTTL)
+		return
+	}
+
+	d := r.backoffMin << e.fails
+	if d > r.backoffMax || d <= 0 {
+		d = r.backoffMax
+	} else {
+		e.fails++
+	}
+	e.until = time.Now().Add(d)
+}
+
+// Return the DNS server for 'h' or nil for the system resolver
+func (r *Resolver) server(h string) dnsServer {
+	var srv dnsServer
+	var n int
+
+	h = "." + h
+	for i := range r.routes {
+		x := &r.routes[i]
+		if len(x.suffix) > n && strings.HasSuffix(h, x.suffix) {
+			srv, n = x.srv, len(x.suffix)
+		}
+	}
+
+	if srv == nil {
+		srv = r.dflt
+	}
+	return srv
+}
+
+// Query 'srv' for the A and AAAA records of 'h'
+func (r *Resolver) lookupDNS(ctx context.Context, srv dnsServer, h string) ([]net.IP, error) {
+	type result struct {
+		a   *dnsAnswer
+		err error
+	}
+
+	ch := make(chan result, 2)
+	for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(t uint16) {
+			a, err := r.query(ctx, srv, h, t)
+			ch <- result{a, err}
+		}(t)
+	}
+
+	var ips []net.IP
+	var err error
+	for i := 0; i < 2; i++ {
+		x := <-ch
+		switch {
+		case x.err != nil:
+			err = x.err
+		case x.a.rcode == dnsRcodeNXDomain:
+			err = &net.DNSError{Err: "no such host", Name: h, Server: srv.String()}
+		case x.a.rcode != dnsRcodeOK:
+			err = &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", x.a.rcode),
+				Name: h, Server: srv.String(), IsTemporary: true}
+		default:
+			ips = append(ips, x.a.ips...)
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: h, Server: srv.String()}
+	}
+	return nil, err
+}
+
+// Send one query to 'srv'
+func (r *Resolver) query(ctx context.Context, srv dnsServer, h string, t uint16) (*dnsAnswer, error) {
+	q, id, err := dnsQuery(h, t, r.ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := srv.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return dnsParse(b, id)
+}
+
+// Dial 'addr' after resolving its host name; each address is tried in
+// turn -- in the family order given by 'pref' -- with the dialer 'd'
+// returns for it until one succeeds.
+func (r *Resolver) Dial(ctx context.Context, d func(net.IP) *net.Dialer, pref *familyPolicy, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range pref.Order(host, ips) {
+		var c net.Conn
+
+		c, err = d(ip).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// Lookup 'h' in the hosts file; re-read the file if it has changed
+func (r *Resolver) lookupHosts(h string) ([]net.IP, bool) {
+	if len(r.file) == 0 {
+		return nil, false
+	}
+
+	r.mu.RLock()
+	stale := time.Since(r.checked) > hostsCheckInterval
+	r.mu.RUnlock()
+
+	if stale {
+		if err := r.reload(); err != nil {
+			r.log.Warn("%s", err)
+		}
+	}
+
+	r.mu.RLock()
+	v, ok := r.hosts[h]
+	r.mu.RUnlock()
+	return v, ok
+}
+
+// Re-read the hosts file if it changed since we last read it. On
+// error, the previously loaded entries remain in effect.
+func (r *Resolver) reload() error {
+	r.mu.Lock()
+	r.checked = time.Now()
+	mtime := r.mtime
+	r.mu.Unlock()
+
+	fi, err := os.Stat(r.file)
+	if err != nil {
+		return fmt.Errorf("resolver: %s", err)
+	}
+
+	if fi.ModTime().Equal(mtime) {
+		return nil
+	}
+
+	m, err := readHostsFile(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.hosts = m
+	r.mtime = fi.ModTime()
+	r.mu.Unlock()
+
+	if r.log != nil {
+		r.log.Info("resolver: loaded %d names from %s", len(m), r.file)
+	}
+	return nil
+}
+
+// Parse a file in /etc/hosts format
+func readHostsFile(fn string) (map[string][]net.IP, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %s", err)
+	}
+	defer fd.Close()
+
+	m := make(map[string][]net.IP)
+	sc := bufio.NewScanner(fd)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+
+		v := strings.Fields(s)
+		if len(v) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(v[0])
+		if ip == nil || len(v) < 2 {
+			return nil, fmt.Errorf("resolver: %s:%d: malformed line", fn, ln)
+		}
+
+		for _, h := range v[1:] {
+			h = canonName(h)
+			m[h] = append(m[h], ip)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("resolver: %s: %s", fn, err)
+	}
+	return m, nil
+}
+
+// lower case and without the trailing dot
+func canonName(h string) string {
+	return strings.TrimSuffix(strings.ToLower(h), ".")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,61 @@
+// rlimit_unix.go -- open file limit on unix platforms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Return the soft and hard open file limit
+func nofileLimit() (uint64, uint64, error) {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0, 0, err
+	}
+	return uint64(r.Cur), uint64(r.Max), nil
+}
+
+// Raise the open file limit to 'n'; past the hard limit that needs
+// root, without which we go as far as the hard limit. Returns the new
+// soft and hard limit.
+func raiseNofile(n uint64) (uint64, uint64, error) {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0, 0, err
+	}
+
+	want := r
+	setRlim(&want.Cur, n)
+	if uint64(want.Max) < n {
+		setRlim(&want.Max, n)
+	}
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	if err != nil && r.Cur < r.Max {
+		want = r
+		want.Cur = r.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	}
+
+	soft, hard, gerr := nofileLimit()
+	if gerr != nil {
+		return 0, 0, gerr
+	}
+	return soft, hard, err
+}
+
+// Set a field of a syscall.Rlimit; they are int64 on some platforms
+// and uint64 on others
+func setRlim[T int64 | uint64](p *T, n uint64) {
+	*p = T(n)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,28 @@
+// rlimit_windows.go -- open file limit on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+)
+
+var errNoRlimit = errors.New("no open file limit on windows")
+
+func nofileLimit() (uint64, uint64, error) {
+	return 0, 0, errNoRlimit
+}
+
+func raiseNofile(n uint64) (uint64, uint64, error) {
+	return 0, 0, errNoRlimit
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,105 @@
+// safesearch.go -- enforce SafeSearch by rewriting search engine destinations
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// The search engines honor these names (served from the same
+// certificates) as a signal to enforce SafeSearch; we dial them in
+// place of the name the client asked for -- just like a DNS CNAME.
+var safeSearchHosts = map[string]string{
+	"www.bing.com":         "strict.bing.com",
+	"bing.com":             "strict.bing.com",
+	"duckduckgo.com":       "safe.duckduckgo.com",
+	"www.duckduckgo.com":   "safe.duckduckgo.com",
+	"start.duckduckgo.com": "safe.duckduckgo.com",
+}
+
+var youtubeHosts = []string{
+	"www.youtube.com",
+	"m.youtube.com",
+	"youtube.com",
+	"youtubei.googleapis.com",
+	"youtube.googleapis.com",
+	"www.youtube-nocookie.com",
+}
+
+// The public suffixes of Google's country domains: google.com,
+// google.co.uk ..
+var googleSuffixes = wordSet(`
+	com ad ae com.af com.ag al am co.ao com.ar as at com.au az ba com.bd be bf bg
+	com.bh bi bj com.bn com.bo com.br bs bt co.bw by com.bz ca cat cd cf cg ch ci
+	co.ck cl cm cn com.co co.cr com.cu cv com.cy cz de dj dk dm com.do dz com.ec ee
+	com.eg es com.et fi com.fj fm fr ga ge gg com.gh com.gi gl gm gr com.gt gy
+	com.hk hn hr ht hu co.id ie co.il im co.in iq is it je com.jm jo co.jp co.ke
+	com.kh ki kg co.kr com.kw kz la com.lb li lk co.ls lt lu lv com.ly co.ma md me
+	mg mk ml com.mm mn com.mt mu mv mw com.mx com.my co.mz com.na com.ng com.ni ne
+	nl no com.np nr nu co.nz com.om com.pa com.pe com.pg com.ph com.pk pl pn com.pr
+	ps pt com.py com.qa ro rs ru rw com.sa com.sb sc se com.sg sh si sk com.sl sn so
+	sm sr st com.sv td tg co.th com.tj tl tm tn to com.tr tt com.tw co.tz com.ua
+	co.ug co.uk com.uy co.uz com.vc co.ve co.vi com.vn vu ws co.za co.zm co.zw
+`)
+
+// Return the host to dial in place of 'host' when SafeSearch is
+// enforced; returns 'host' unchanged if it isn't a search engine.
+func safeSearchHost(cfg *SafeSearch, host string) string {
+	if !cfg.Enable {
+		return host
+	}
+
+	h := strings.TrimSuffix(strings.ToLower(host), ".")
+	if s, ok := safeSearchHosts[h]; ok {
+		return s
+	}
+
+	for _, y := range youtubeHosts {
+		if h == y {
+			if cfg.Youtube == "moderate" {
+				return "restrictmoderate.youtube.com"
+			}
+			return "restrict.youtube.com"
+		}
+	}
+
+	// Google has a domain per country: google.com, www.google.co.uk ..
+	if strings.HasPrefix(h, "www.") {
+		h = h[4:]
+	}
+	if strings.HasPrefix(h, "google.") && googleSuffixes[h[7:]] {
+		return "forcesafesearch.google.com"
+	}
+	return host
+}
+
+// The set of the whitespace separated words of 's'
+func wordSet(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+// Rewrite a "host:port" address per safeSearchHost()
+func safeSearchAddr(cfg *SafeSearch, addr string) string {
+	if !cfg.Enable {
+		return addr
+	}
+
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(safeSearchHost(cfg, h), p)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,301 @@
+// schedule.go -- times at which listeners accept connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A schedule is a set of weekly windows in a time zone; e.g.
+// "mon-fri 08:00-18:00". A window that ends before it starts runs past
+// midnight into the next day.
+type schedule struct {
+	loc *time.Location
+	win []window
+}
+
+type window struct {
+	days     uint8 // bit i is set for time.Weekday(i)
+	from, to int   // minutes since midnight
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Make a schedule from 'c'; nil if it has no windows (always active)
+func newSchedule(c *ScheduleConf) (*schedule, error) {
+	if len(c.Active) == 0 {
+		return nil, nil
+	}
+
+	s := &schedule{loc: time.Local}
+	if len(c.Timezone) > 0 {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %s", err)
+		}
+		s.loc = loc
+	}
+
+	for _, a := range c.Active {
+		w, err := parseWindow(a)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %q: %s", a, err)
+		}
+		s.win = append(s.win, w)
+	}
+	return s, nil
+}
+
+// Parse "[DAYS] HH:MM-HH:MM"; DAYS is a comma separated list of days
+// or day ranges (mon-fri); every day if omitted.
+func parseWindow(s string) (window, error) {
+	var w window
+
+	f := strings.Fields(s)
+	switch len(f) {
+	case 1:
+		w.days = 0x7f
+	case 2:
+		d, err := parseDays(f[0])
+		if err != nil {
+			return w, err
+		}
+		w.days = d
+		f = f[1:]
+	default:
+		return w, fmt.Errorf("want [days] HH:MM-HH:MM")
+	}
+
+	t := strings.Split(f[0], "-")
+	if len(t) != 2 {
+		return w, fmt.Errorf("want a time range HH:MM-HH:MM")
+	}
+
+	var err error
+	if w.from, err = parseClock(t[0]); err != nil {
+		return w, err
+	}
+	if w.to, err = parseClock(t[1]); err != nil {
+		return w, err
+	}
+	if w.from == w.to {
+		return w, fmt.Errorf("empty time range")
+	}
+	return w, nil
+}
+
+func parseDays(s string) (uint8, error) {
+	var d uint8
+	for _, r := range strings.Split(strings.ToLower(s), ",") {
+		v := strings.Split(r, "-")
+		if len(v) > 2 {
+			return 0, fmt.Errorf("bad day range %q", r)
+		}
+
+		a, ok := dayIndex(v[0])
+		b := a
+		if ok && len(v) == 2 {
+			b, ok = dayIndex(v[1])
+		}
+		if !ok {
+			return 0, fmt.Errorf("bad day %q", r)
+		}
+
+		// ranges can wrap: fri-mon
+		for i := a; ; i = (i + 1) % 7 {
+			d |= 1 << uint(i)
+			if i == b {
+				break
+			}
+		}
+	}
+	return d, nil
+}
+
+func dayIndex(s string) (int, bool) {
+	for i, n := range dayNames {
+		if s == n {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Parse HH:MM; 24:00 is the end of the day
+func parseClock(s string) (int, error) {
+	v := strings.Split(s, ":")
+	if len(v) != 2 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+
+	h, err1 := strconv.Atoi(v[0])
+	m, err2 := strconv.Atoi(v[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Return true if 't' falls in one of the windows; a nil schedule is
+// always active.
+func (s *schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+
+	t = t.In(s.loc)
+	day := int(t.Weekday())
+	min := t.Hour()*60 + t.Minute()
+	yday := (day + 6) % 7
+
+	for _, w := range s.win {
+		if w.from < w.to {
+			if w.days&(1<<uint(day)) != 0 && min >= w.from && min < w.to {
+				return true
+			}
+			continue
+		}
+
+		// past midnight: the evening of a scheduled day or the
+		// morning after one
+		if w.days&(1<<uint(day)) != 0 && min >= w.from {
+			return true
+		}
+		if w.days&(1<<uint(yday)) != 0 && min < w.to {
+			return true
+		}
+	}
+	return false
+}
+
+// The schedules of every listener. A ticker re-evaluates them every
+// minute and logs when a listener goes active or inactive; a reload
+// replaces them while the listeners keep running.
+type scheduleTable struct {
+	log *L.Logger
+
+	mu sync.Mutex
+	m  map[string]*listenerSchedule
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// The schedule of one listener and whether it is active now. A nil
+// listenerSchedule is always active.
+type listenerSchedule struct {
+	name   string
+	sched  *schedule
+	active int32
+}
+
+func newScheduleTable(log *L.Logger) *scheduleTable {
+	return &scheduleTable{
+		log:  log.New("schedule", 0),
+		m:    make(map[string]*listenerSchedule),
+		stop: make(chan bool),
+	}
+}
+
+// Return the schedule of listener 'lc'; the listener must be validated.
+func (t *scheduleTable) For(lc *ListenConf) *listenerSchedule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ls, ok := t.m[lc.String()]
+	if !ok {
+		ls = &listenerSchedule{name: lc.String()}
+		ls.sched, _ = newSchedule(&lc.Schedule)
+		ls.set(ls.sched.Active(time.Now()))
+		t.m[ls.name] = ls
+	}
+	return ls
+}
+
+// Replace the schedules of the listeners in 'cfg' that we have
+func (t *scheduleTable) Update(cfg *Conf) {
+	t.mu.Lock()
+	for _, v := range cfg.listeners() {
+		for i := range v {
+			if ls, ok := t.m[v[i].String()]; ok {
+				ls.sched, _ = newSchedule(&v[i].Schedule)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	t.check(time.Now())
+}
+
+func (t *scheduleTable) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		for {
+			// wake up at the top of every minute
+			now := time.Now()
+			tm := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			select {
+			case <-t.stop:
+				tm.Stop()
+				return
+			case now = <-tm.C:
+				t.check(now)
+			}
+		}
+	}()
+}
+
+func (t *scheduleTable) Stop() {
+	close(t.stop)
+	t.wg.Wait()
+}
+
+// Re-evaluate the schedules at 't'
+func (t *scheduleTable) check(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ls := range t.m {
+		a := ls.sched.Active(now)
+		if a == ls.Active() {
+			continue
+		}
+
+		ls.set(a)
+		if a {
+			t.log.Info("listener %s is active; its schedule started", ls.name)
+		} else {
+			t.log.Info("listener %s is inactive until its schedule starts again", ls.name)
+		}
+	}
+}
+
+// Return true if the listener may accept connections now
+func (ls *listenerSchedule) Active() bool {
+	return ls == nil || atomic.LoadInt32(&ls.active) != 0
+}
+
+func (ls *listenerSchedule) set(a bool) {
+	var v int32
+	if a {
+		v = 1
+	}
+	atomic.StoreInt32(&ls.active, v)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
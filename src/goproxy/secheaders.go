@@ -0,0 +1,65 @@
+// secheaders.go -- inject security headers into proxied HTTP responses
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net/http"
+)
+
+// Security headers we add to the responses of legacy apps that don't
+// send their own. We only see plain HTTP responses; HTTPS is tunneled
+// through untouched. A nil secHeaders adds nothing.
+type secHeaders struct {
+	hdr      [][2]string // name, value
+	override bool
+	dest     []string // domains; each matches itself and its subdomains
+}
+
+// Return the headers to add per 'c'; nil if none
+func newSecHeaders(c *SecHeaderConf) *secHeaders {
+	s := &secHeaders{
+		override: c.Override,
+		dest:     domainList(c.Dest),
+	}
+
+	add := func(k, v string) {
+		if len(v) > 0 {
+			s.hdr = append(s.hdr, [2]string{k, v})
+		}
+	}
+	add("Strict-Transport-Security", c.HSTS)
+	add("Content-Security-Policy", c.CSP)
+	add("X-Frame-Options", c.FrameOptions)
+	add("Referrer-Policy", c.Referrer)
+	if c.NoSniff {
+		add("X-Content-Type-Options", "nosniff")
+	}
+
+	if len(s.hdr) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Add the headers to 'h', a response from 'host'; unless overriding,
+// the ones the app sent are kept.
+func (s *secHeaders) Apply(h http.Header, host string) {
+	if s == nil || (len(s.dest) > 0 && !domainMatch(s.dest, host)) {
+		return
+	}
+
+	for _, kv := range s.hdr {
+		if _, ok := h[kv[0]]; ok && !s.override {
+			continue
+		}
+		h.Set(kv[0], kv[1])
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
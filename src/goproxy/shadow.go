@@ -0,0 +1,83 @@
+// shadow.go -- rules tried on live traffic without enforcing them
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// The shadow rules of a listener: a client ACL that stands in for the
+// listener's own, and destination categories and traffic classes
+// denied in addition to its own. What they would deny -- and, for the
+// ACL, allow -- that the listener's rules don't is logged; nothing
+// else changes. They are replaced with the ACL on reload.
+type shadowRules struct {
+	acl        *aclSets // nil if there is no shadow ACL
+	categories []string
+	protocols  []string
+}
+
+// Make the shadow rules of 'c' with the counts in 'old'; nil if there
+// are none
+func newShadowRules(c *ShadowConf, old map[aclRule]uint64) *shadowRules {
+	s := &shadowRules{
+		categories: c.DenyCategories,
+		protocols:  c.DenyProtocols,
+	}
+	if len(c.Allow) > 0 || len(c.Deny) > 0 {
+		s.acl = newACLSets(c.Allow, c.Deny, "shadow ", old)
+	}
+	if s.acl == nil && len(s.categories) == 0 && len(s.protocols) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Return the shadow rules of the listener; nil if it has none
+func (a *listenerACL) Shadow() *shadowRules {
+	return a.v.Load().(*aclSets).shadow
+}
+
+// Log if the shadow ACL decides client 'ip' other than 'ok', the
+// listener's ACL did; count the decision.
+func (s *shadowRules) Client(ls *logSampler, log *L.Logger, ip net.IP, ok bool) {
+	if s == nil || s.acl == nil {
+		return
+	}
+
+	sok, r := s.acl.match(ip)
+	if r != nil {
+		atomic.AddUint64(&r.Hits, 1)
+	}
+	switch {
+	case ok && !sok:
+		ls.Info(log, logShadow, "shadow: %s would be denied: %s", ip, r)
+	case !ok && sok:
+		ls.Info(log, logShadow, "shadow: %s would be allowed: %s", ip, r)
+	}
+}
+
+// Return the category of 'host' the shadow rules would deny; "" if
+// none.
+func (s *shadowRules) Category(cat CategoryDB, host string) string {
+	if s == nil {
+		return ""
+	}
+	return categoryDenied(cat, s.categories, host)
+}
+
+// Return true if the shadow rules would deny traffic of class 'proto'
+func (s *shadowRules) Protocol(proto string) bool {
+	return s != nil && protoDenied(s.protocols, proto)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,206 @@
+// sniff.go -- serve several proxy protocols on one port
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Return the protocol client 'lhs' speaks -- socks5, socks4, http or
+// the listener's own -- from its first byte, and the connection to
+// serve it on, which replays what we read; "" if the client went away
+// or speaks something we don't serve here.
+//
+// SOCKS starts with its version; TLS with a handshake record (0x16),
+// which we serve if the listener speaks Trojan or VLESS over TLS; a
+// plain VLESS request with 0. Anything else is taken to be HTTP and
+// the HTTP parser decides.
+func (px *socksProxy) sniff(lhs net.Conn) (net.Conn, string) {
+	if t := time.Duration(px.cfg.Timeouts.Handshake); t > 0 {
+		lhs.SetDeadline(time.Now().Add(t))
+	}
+
+	// the handlers expect a message in one read; so we read all there
+	// is rather than a byte
+	b := make([]byte, handshakeBufSize)
+	n, err := lhs.Read(b)
+	if n == 0 {
+		px.acc.Failed(failClientAbort)
+		if err != nil && err != io.EOF {
+			px.log.Debug("%s Unable to read request: %s", lhs.RemoteAddr().String(), err)
+		}
+		return lhs, ""
+	}
+	lhs.SetDeadline(time.Time{})
+
+	c := &prefixConn{lhs.(halfConn), b[:n]}
+	switch b[0] {
+	case 5:
+		return c, "socks5"
+	case 4:
+		return c, "socks4"
+	case 0x16:
+		if px.trojan != nil || (px.vless != nil && px.vless.tls != nil) {
+			return c, px.proto
+		}
+	case 0:
+		if px.vless != nil && px.vless.tls == nil {
+			return c, px.proto
+		}
+	default:
+		return c, "http"
+	}
+
+	px.log.Debug("%s: no handler for protocol byte %#x", lhs.RemoteAddr().String(), b[0])
+	return c, ""
+}
+
+// Serve SOCKSv4 (and 4a) client 'lhs'; only CONNECT is supported.
+func (px *socksProxy) socks4Proxy(lhs net.Conn) {
+	ls := lhs.RemoteAddr().String()
+
+	if t := time.Duration(px.cfg.Timeouts.Handshake); t > 0 {
+		lhs.SetDeadline(time.Now().Add(t))
+	}
+
+	buf := make([]byte, 512)
+	n, err := lhs.Read(buf)
+	if err != nil {
+		px.acc.Failed(failClientAbort)
+		if err != io.EOF {
+			px.log.Debug("%s Unable to read request: %s", ls, err)
+		}
+		return
+	}
+	lhs.SetDeadline(time.Time{})
+
+	// SOCKSv4 has no passwords
+	if px.auth != nil {
+		px.acc.Failed(failAuth)
+		px.log.Debug("%s SOCKSv4: the listener needs a login; denied", ls)
+		lhs.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	cmd, atyp, host, port, err := parseSocks4(buf[:n])
+	if err != nil {
+		px.log.Debug("%s SOCKSv4: %s", ls, err)
+		return
+	}
+
+	// replies carry no address; clients ignore it
+	rep := func(code byte, _ net.Addr) {
+		r := []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+		if code != 0 {
+			r[1] = 0x5b
+		}
+		lhs.Write(r)
+	}
+	rhs, s, err := px.connect(lhs, "", cmd, atyp, host, port, rep, nil)
+	if err != nil || rhs == nil {
+		return
+	}
+	defer rhs.Close()
+
+	px.relay(lhs.(halfConn), rhs.(*net.TCPConn), "", s)
+}
+
+// Parse a SOCKSv4 request:
+//
+//	VN(4) CD DSTPORT DSTIP USERID NUL [HOST NUL]
+//
+// where HOST is present (SOCKSv4a) when DSTIP is 0.0.0.x, x != 0.
+// Returns the command, SOCKSv5 address type, host and port.
+func parseSocks4(b []byte) (cmd, atyp byte, host string, port uint16, err error) {
+	if len(b) < 9 || b[0] != 4 {
+		return 0, 0, "", 0, errors.New("short request")
+	}
+
+	cmd = b[1]
+	port = binary.BigEndian.Uint16(b[2:])
+	ip := net.IP(b[4:8])
+
+	// skip the user id
+	i := 8
+	for i < len(b) && b[i] != 0 {
+		i++
+	}
+	if i == len(b) {
+		return 0, 0, "", 0, errors.New("user id isn't terminated")
+	}
+
+	if ip[0] != 0 || ip[1] != 0 || ip[2] != 0 || ip[3] == 0 {
+		return cmd, 1, ip.String(), port, nil
+	}
+
+	j := i + 1
+	for j < len(b) && b[j] != 0 {
+		j++
+	}
+	if j == len(b) || j == i+1 || j-i-1 > 255 {
+		return 0, 0, "", 0, fmt.Errorf("bad SOCKSv4a host name")
+	}
+	return cmd, 3, string(b[i+1 : j]), port, nil
+}
+
+// A connQueue is a listener whose connections are pushed to it, e.g.
+// by another listener that sniffed them.
+type connQueue struct {
+	addr net.Addr
+	ch   chan net.Conn
+
+	once sync.Once
+	done chan bool
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan bool),
+	}
+}
+
+// Hand 'c' to whoever accepts from the queue; close it if the queue
+// is closed.
+func (q *connQueue) Push(c net.Conn) {
+	select {
+	case q.ch <- c:
+	case <-q.done:
+		c.Close()
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case c := <-q.ch:
+		return c, nil
+	case <-q.done:
+		return nil, &errShutdown
+	}
+}
+
+func (q *connQueue) Close() error {
+	q.once.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -13,10 +13,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 	"context"
-	//"encoding/hex"
+	"encoding/hex"
 
 	L "github.com/opencoff/go-logger"
 	"github.com/opencoff/go-ratelimit"
@@ -36,23 +37,67 @@ type socksProxy struct {
 	cfg  *ListenConf // config block
 
 	bind net.Addr    // address to bind to when connect to remote
+	ext  net.IP      // address clients are told we bound; nil if ours
+	cat  CategoryDB  // destination categories
+	bl   *blocklist  // denied destination domains
+	dst  *destTable  // per destination counters
+	res  *Resolver   // name resolution for direct connections
+
+	upstream *upstreamPool // chained upstream proxies if any
+	routes   *routeTable   // upstreams and egress by destination country or ASN
+	egress   *egressPool   // source addresses for direct connections
+	family   *familyPolicy // address family order for direct connections
+	linger   int           // SO_LINGER of outbound connections; -1 for the OS default
+	qos      *qosPolicy    // DSCP marking of direct connections
+	mtu      *mtuPolicy    // MSS and path MTU discovery of our sockets
+	ka       *keepalivePolicy // keepalive probes of our connections
 	log  *L.Logger   // Shortcut to logger
 	ulog *L.Logger   // URL Logger
 
+	sample *logSampler // sampling of noisy log messages
+	flags  *listenerFlags // runtime feature flags
+	acl    *listenerACL   // client allow/deny lists
+	sch    *listenerSchedule // when the listener accepts connections
+	knock  *knockGate     // hides the listener; nil unless configured
+	auth   *authenticator // users; nil if the listener is open to all
+	opa    *opaClient     // policy agent; nil unless configured
+	ctl    *control       // active connections and bans
+	acc    *acceptStats   // accept and drop counters
+
 	grl  *ratelimit.Ratelimiter
-	prl  *ratelimit.PerIPRatelimiter
+	prl  *perIPLimiter
+
+	chaos *chaos // fault injection; nil unless configured
+	mirror *mirror // shadow copy of tunnels; nil unless configured
+	trojan *trojanServer // speak Trojan instead of SOCKS; nil unless configured
+	vless  *vlessServer  // or VLESS
+	proto  string        // what clients speak: socks5, trojan or vless
+
+	http *HTTPProxy // serves HTTP clients when sniffing; nil otherwise
 
 	ctx  context.Context
 	cancel context.CancelFunc
 
 	wg   sync.WaitGroup
+
+	// the reason the proxy stopped serving on its own
+	failed chan error
 }
 
 // Make a new proxy server
-func NewSocksv5Proxy(cfg *ListenConf, log, ulog *L.Logger) (px *socksProxy, err error) {
+func NewSocksv5Proxy(cfg *ListenConf, res *Resolver, cat CategoryDB, geo *geoDB, bl *blocklist, dst *destTable, ls *logSampler, ff *listenerFlags, acl *listenerACL, sch *listenerSchedule, kn *knockGate, au *authenticator, oa *opaClient, ctl *control, log, ulog *L.Logger) (px *socksProxy, err error) {
+	if len(cfg.Listen) == 0 {
+		return nil, fmt.Errorf("SOCKSv5 listen address is empty")
+	}
+
 	la, err := net.ResolveTCPAddr("tcp", cfg.Listen)
 	if err != nil {
-		die("Can't resolve %s: %s", cfg.Listen, err)
+		return nil, fmt.Errorf("can't resolve %s: %s", cfg.Listen, err)
+	}
+
+	mt, err := newMTUPolicy(&cfg.MTU)
+	if err != nil {
+		return nil, err
 	}
 
 	ln, err := net.ListenTCP("tcp", la)
@@ -60,6 +105,18 @@ func NewSocksv5Proxy(cfg *ListenConf, log, ulog *L.Logger) (px *socksProxy, err
 		return nil, err
 	}
 
+	// Don't hold on to the listen address if the rest of the config
+	// is bad
+	defer func() {
+		if err != nil {
+			ln.Close()
+		}
+	}()
+
+	if err = mt.Listener(ln); err != nil {
+		return nil, err
+	}
+
 	var addr net.Addr
 
 	if len(cfg.Bind) > 0 {
@@ -71,28 +128,141 @@ func NewSocksv5Proxy(cfg *ListenConf, log, ulog *L.Logger) (px *socksProxy, err
 		}
 	}
 
-	log = log.New("socks-"+ln.Addr().String(), 0)
+	var ext net.IP
+	if len(cfg.External) > 0 {
+		if ext = net.ParseIP(cfg.External); ext == nil {
+			return nil, fmt.Errorf("external: %q is not an IP", cfg.External)
+		}
+	}
+
+	tj, err := newTrojanServer(&cfg.Trojan)
+	if err != nil {
+		return nil, err
+	}
+
+	vl, err := newVlessServer(&cfg.Vless)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, proto := "socks", "socks5"
+	switch {
+	case tj != nil:
+		typ, proto = "trojan", "trojan"
+	case vl != nil:
+		typ, proto = "vless", "vless"
+	}
+	log = log.New(logName(typ, cfg, ln), 0)
+
+	d := &net.Dialer{LocalAddr: addr, Timeout: time.Duration(cfg.Timeouts.Dial), Control: mt.Control()}
+	up, err := newUpstreamPool(cfg, d, log)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := newRouteTable(cfg, geo, d)
+	if err != nil {
+		return nil, err
+	}
+
+	eg, err := newEgressPool(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := newFamilyPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lg, err := parseLinger(cfg.Outbound.Linger)
+	if err != nil {
+		return nil, err
+	}
+
+	qos, err := newQoSPolicy(&cfg.QoS, cat)
+	if err != nil {
+		return nil, err
+	}
+
+	mi, err := newMirror(&cfg.Mirror, log)
+	if err != nil {
+		return nil, err
+	}
 
 	grl, _ := ratelimit.New(cfg.Ratelimit.Global, 1)
-	prl, _ := ratelimit.NewPerIPRatelimiter(cfg.Ratelimit.PerHost, 1)
+	prl := newPerIPLimiter(cfg.Ratelimit.PerHost, time.Duration(cfg.Ratelimit.Idle))
+
+	acc := ctl.Listener(cfg, ln)
+
+	// HTTP clients of a sniffing listener are served by an HTTP proxy
+	// of its own; it shares the listener's accept counters
+	var hp *HTTPProxy
+	if cfg.Sniff {
+		hp, err = newHTTPProxy(cfg, ln, acc, res, cat, geo, bl, dst, ls, ff, acl, sch, kn, au, oa, ctl, log, ulog)
+		if err != nil {
+			return nil, err
+		}
+		hp.sniffed = newConnQueue(ln.Addr())
+	}
+	acc.RateLimiter(prl)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	px = &socksProxy{
 		TCPListener:  ln,
 		cfg:          cfg,
 		bind:         addr,
+		ext:          ext,
+		cat:          cat,
+		bl:           bl,
+		dst:          dst,
+		res:          res,
+		upstream:     up,
+		routes:       rt,
+		egress:       eg,
+		family:       fp,
+		linger:       lg,
+		qos:          qos,
+		mtu:          mt,
+		ka:           newKeepalivePolicy(&cfg.Keepalive),
 		log:          log,
 		ulog:         ulog,
+		sample:       ls,
+		flags:        ff,
+		acl:          acl,
+		sch:          sch,
+		knock:        kn,
+		auth:         au,
+		opa:          oa,
+		ctl:          ctl,
+		acc:          acc,
 		grl:          grl,
 		prl:          prl,
+		chaos:        newChaos(&cfg.Chaos),
+		mirror:       mi,
+		trojan:       tj,
+		vless:        vl,
+		proto:        proto,
+		http:         hp,
 		ctx:          ctx,
 		cancel:       cancel,
+		failed:       make(chan error, 1),
 	}
 
+	if px.chaos != nil {
+		log.Warn("fault injection is on: %s", px.chaos)
+	}
 	return
 }
 
 func (px *socksProxy) Start() {
+	if px.upstream != nil {
+		px.upstream.Start()
+	}
+	if px.http != nil {
+		px.http.Start()
+	}
+
 	px.wg.Add(1)
 	go func() {
 		defer px.wg.Done()
@@ -101,10 +271,22 @@ func (px *socksProxy) Start() {
 	}()
 }
 
+// Failed returns a channel that yields an error if the proxy stops
+// serving without being asked to
+func (px *socksProxy) Failed() <-chan error {
+	return px.failed
+}
+
 func (px *socksProxy) Stop() {
 	px.cancel()
 	px.TCPListener.Close()
 	px.wg.Wait()
+	if px.http != nil {
+		px.http.Stop()
+	}
+	if px.upstream != nil {
+		px.upstream.Stop()
+	}
 
 	px.log.Info("SOCKS proxy shutdown")
 }
@@ -138,37 +320,100 @@ func (px *socksProxy) accept() {
 			nerr += 1
 			if nerr > 5 {
 				log.Error("Too many consecutive accept failures! Aborting...")
-				die("Aborting gosocksd due to too many failures!")
+				px.failed <- fmt.Errorf("too many consecutive accept failures: %s", err)
+				return
 			}
 			continue
 		}
 
 		rem := conn.RemoteAddr().String()
 
-		// Ratelimit before anything else we do
+		// a hidden listener says nothing to those who didn't knock
+		if !px.knock.Allowed(remoteIP(rem)) {
+			conn.Close()
+			px.acc.Dropped(dropKnock)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropKnock])
+			continue
+		}
+
+		if !px.sch.Active() {
+			conn.Close()
+			px.sample.Debug(log, logACL, "Denied %s: outside the listener's schedule", rem)
+			px.acc.Dropped(dropSchedule)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropSchedule])
+			continue
+		}
+
+		if px.chaos.Drop() {
+			conn.Close()
+			px.acc.Dropped(dropChaos)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropChaos])
+			continue
+		}
+
+		// Ratelimit before the other checks
 		if px.grl.Limit() {
 			conn.Close()
-			log.Debug("global ratelimit reached: %s", rem)
+			px.sample.Debug(log, logRatelimit, "global ratelimit reached: %s", rem)
+			px.acc.Dropped(dropRatelimit)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropRatelimit])
 			continue
 		}
 
 		if px.prl.Limit(conn.RemoteAddr()) {
 			conn.Close()
-			log.Debug("per-host ratelimit reached: %s", rem)
+			px.sample.Debug(log, logRatelimit, "per-host ratelimit reached: %s", rem)
+			px.acc.Dropped(dropRatelimit)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropRatelimit])
+			continue
+		}
+
+		// a transport's clients are all loopback; see control.kill()
+		if len(px.cfg.Transport.Exec) == 0 && px.ctl.Banned(remoteIP(rem)) {
+			conn.Close()
+			px.sample.Debug(log, logACL, "Denied %s: banned", rem)
+			px.acc.Dropped(dropBanned)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropBanned])
 			continue
 		}
 
+		if px.ctl.Shed(remoteIP(rem)) {
+			conn.Close()
+			px.sample.Info(log, logOverload, "Shed %s: overloaded", rem)
+			px.acc.Dropped(dropOverload)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropOverload])
+			continue
+		}
+
+		px.ka.Set(conn)
+		ac, why := px.ctl.Admit(conn, socksConnMem)
+		if why >= 0 {
+			conn.Close()
+			px.sample.Info(log, logOverload, "Refused %s: %s", rem, admitNames[why])
+			px.acc.Dropped(why)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[why])
+			continue
+		}
+		conn = ac
+
 		// Reset - as soon as things begin to work
 		nerr = 0
 
-		// Check ACL
-		if !AclOK(px.cfg, conn) {
+		// Check ACL; when we keep a URL log, denied clients get as far
+		// as their request so we can log what they asked for.
+		ok, rule := AclOK(px.acl, conn)
+		px.acl.Shadow().Client(px.sample, log, remoteIP(rem), ok)
+		if !ok && px.ulog == nil {
 			conn.Close()
-			log.Debug("Denied %s due to ACL", rem)
+			px.sample.Debug(log, logACL, "Denied %s due to ACL: %s", rem, rule)
+			px.acc.Dropped(dropACL)
+			px.ctl.Trace(log, rem, "dropped: %s", dropNames[dropACL])
 			continue
 		}
 
-		log.Debug("Accepted connection from %s", rem)
+		log.Debug("Accepted connection from %s: %s", rem, rule)
+		px.ctl.Trace(log, rem, "accepted on %s: %s", px.cfg.String(), rule)
+		px.acc.Accepted()
 
 		// Fork off a handler for this new connection
 		px.wg.Add(1)
@@ -181,66 +426,166 @@ func (px *socksProxy) Proxy(lhs net.Conn) {
 
 	defer px.wg.Done()
 
-	// We expect to get some bytes within 10 seconds.
-	//lhs.SetReadDeadline(deadLine(10000))
+	ls := lhs.RemoteAddr().String()
+	proto := px.proto
+	if px.http != nil {
+		if lhs, proto = px.sniff(lhs); proto == "http" {
+			// the HTTP proxy closes it when done
+			px.ctl.Trace(px.log, ls, "speaks http")
+			px.http.sniffed.Push(lhs)
+			return
+		}
+		px.ctl.Trace(px.log, ls, "speaks %q", proto)
+	}
+	defer func() {
+		lhs.Close()
+		px.ctl.Trace(px.log, ls, "closed")
+		px.ctl.TraceDone(ls)
+	}()
 
-	_, err := px.readMethods(lhs)
+	switch proto {
+	case "socks5":
+		px.socks5Proxy(lhs)
+	case "socks4":
+		px.socks4Proxy(lhs)
+	case "trojan":
+		px.trojanProxy(lhs)
+	case "vless":
+		px.vlessProxy(lhs)
+	}
+}
 
-	if err != nil {
-		return
+// Serve SOCKSv5 client 'lhs'
+func (px *socksProxy) socks5Proxy(lhs net.Conn) {
+	// The client must finish the method negotiation and send its
+	// request within the handshake timeout
+	if t := time.Duration(px.cfg.Timeouts.Handshake); t > 0 {
+		lhs.SetDeadline(time.Now().Add(t))
 	}
 
-	// Hard coded response: "We have no need for auth"
-	buf := make([]byte, 2)
-	buf[0] = 5
-	buf[1] = 0
-	lhs.Write(buf)
+	m, err := px.readMethods(lhs)
 
-	// Now we expect to read URL and connect
-	rhs, s, err := px.doConnect(lhs)
 	if err != nil {
 		return
 	}
 
-	// Set read and write deadlines.
-	// XXX In general any socket connection must complete its I/O within
-	//     10 minutes.
-	//
-	/*
-	   tout, _ := time.ParseDuration("3m")
-	   //tout, _ := time.ParseDuration("10m")
+	user, ok := px.login(lhs, m)
+	if !ok {
+		return
+	}
 
-	   dl := time.Now().Add(tout)
-	   lhs.SetDeadline(dl)
-	   rhs.SetDeadline(dl)
-	*/
+	// Now we expect to read URL and connect
+	rhs, s, err := px.doConnect(lhs, user)
+	if err != nil || rhs == nil {
+		return
+	}
+	defer rhs.Close()
 
-	lx := lhs.(*net.TCPConn)
-	rx := rhs.(*net.TCPConn)
+	px.relay(lhs.(halfConn), rhs.(*net.TCPConn), user, s)
+}
 
+// Relay the tunnel between client 'lx', logged in as 'user' if at all,
+// and 's' via 'rx' until either side is done
+func (px *socksProxy) relay(lx, rx halfConn, user, s string) {
 	cp := &CancellableCopier{
 		Lhs:          lx,
 		Rhs:          rx,
-		ReadTimeout:  10,	// XXX Config file
-		WriteTimeout: 15,	// XXX Config file
-		IOBufsize:    16384,
+		ReadTimeout:  time.Duration(px.cfg.Timeouts.Read),
+		WriteTimeout: time.Duration(px.cfg.Timeouts.Write),
+		LhsIdle:      time.Duration(px.cfg.Timeouts.ClientIdle),
+		RhsIdle:      time.Duration(px.cfg.Timeouts.UpstreamIdle),
+		IOBufsize:    relayBufSize,
+		LhsLimit:     int64(px.cfg.Sizelimit.Download),
+		RhsLimit:     int64(px.cfg.Sizelimit.Upload),
 	}
 
-	cp.Copy(px.ctx)
+	// Classify the traffic and see what the client asks of the TLS
+	// server, if it is one
+	var hello tlsHello
+	var proto string
+	cp.LhsFirst = func(b []byte) bool {
+		proto = classify(b)
+		if protoDenied(px.cfg.DenyProtocols, proto) {
+			px.log.Info("%s denied %s: protocol %s", lx.RemoteAddr().String(), s, proto)
+			px.ulogDenied(lx.RemoteAddr().String(), s, "protocol "+proto)
+			px.acc.Failed(failPolicy)
+			return false
+		}
+		if px.acl.Shadow().Protocol(proto) {
+			px.sample.Info(px.log, logShadow, "shadow: %s would be denied %s: protocol %s", lx.RemoteAddr().String(), s, proto)
+		}
 
-	if px.ulog != nil {
-		now := time.Now().UTC()
-		yy, mm, dd := now.Date()
-		hh, m, ss := now.Clock()
-		us := int(now.Nanosecond() / 1e3)
+		hello, _ = inspectTLS(b)
+		if why := sniDenied(px.bl, px.cat, px.cfg.DenyCategories, hello.SNI); len(why) > 0 {
+			px.log.Info("%s denied %s: SNI %s: %s", lx.RemoteAddr().String(), s, hello.SNI, why)
+			px.ulogDenied(lx.RemoteAddr().String(), s, "sni "+hello.SNI+": "+why)
+			px.acc.Failed(failPolicy)
+			return false
+		}
+		return true
+	}
+
+	if m := px.mirror.Tunnel(hostOnly(s)); m != nil {
+		cp.LhsTap = m.Write
+		defer m.Close()
+	}
+
+	// Bound the lifetime of the tunnel
+	ctx := px.ctx
+	if t := time.Duration(px.cfg.Timeouts.Session); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
 
-		ls := lx.RemoteAddr().String()
-		rs := rx.RemoteAddr().String()
-		s := fmt.Sprintf("%s %04d-%02d-%02d %02d:%02d:%02d.%06d %s [%s]",
-			ls, yy, mm, dd, hh, m, ss, us, s, rs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := px.ctl.Track(px.cfg.String(), lx.RemoteAddr().String(), user, s, cancel)
+
+	t0 := time.Now()
+	nd, nu, err := cp.Copy(ctx)
+	px.dst.Close(hostOnly(s), int64(nu), int64(nd))
+	switch err {
+	case errSizeLimit:
+		px.log.Info("%s: %s: %s; closed", lx.RemoteAddr().String(), s, err)
+	case errIdleTimeout:
+		px.log.Debug("%s: %s: %s; closed", lx.RemoteAddr().String(), s, err)
+	}
 
-		px.ulog.Info(s)
+	r := &closeRecord{
+		listener: px.cfg.String(),
+		client:   lx.RemoteAddr().String(),
+		dest:     s,
+		remote:   rx.RemoteAddr().String(),
+		start:    t0,
+		end:      time.Now(),
+		up:       int64(nu),
+		down:     int64(nd),
+		reason:   cancelReason(px.ctx, cp.Reason),
+		tls:      hello,
+		proto:    proto,
 	}
+	px.ctl.Closed(id, r)
+	px.ctl.Trace(px.log, r.client, "tunnel to %s closed: up %d down %d: %s", s, nu, nd, r.reason)
+	logClose(px.log, px.ulog, r)
+}
+
+// Log a request from 'ls' to 'dest' that was denied for reason 'why'
+func (px *socksProxy) ulogDenied(ls, dest, why string) {
+	px.ctl.Trace(px.log, ls, "denied %s: %s", dest, why)
+	if px.ulog != nil {
+		px.ulog.Info("%s %s %s [denied: %s]", ls, ulogTime(), dest, why)
+	}
+}
+
+// Current UTC time for the URL log
+func ulogTime() string {
+	now := time.Now().UTC()
+	yy, mm, dd := now.Date()
+	hh, m, ss := now.Clock()
+	us := int(now.Nanosecond() / 1e3)
+
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", yy, mm, dd, hh, m, ss, us)
 }
 
 // Copy from 's' to 'd'
@@ -264,11 +609,13 @@ func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
 	b := make([]byte, 300)
 	n, err := conn.Read(b)
 	if err != nil && err != io.EOF {
+		px.acc.Failed(failClientAbort)
 		px.log.Error("%s Unable to read version info: %s", rem, err)
 		return
 	}
 
 	if n < 2 {
+		px.acc.Failed(failClientAbort)
 		px.log.Error("%s Insufficient data while reading version: Saw only %d bytes\n",
 			rem, n)
 		err = errors.New("Insufficient data")
@@ -278,11 +625,18 @@ func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
 	m.ver = b[0]
 	m.nmethods = b[1]
 
+	if m.ver != 5 || m.nmethods == 0 {
+		px.log.Debug("%s: bad version %d or no methods", rem, m.ver)
+		err = errors.New("bad method request")
+		return
+	}
+
 	if n-2 < int(m.nmethods) {
 		errs := fmt.Sprintf("%s: insufficient data while reading methods; exp %d bytes, saw %d",
 			rem, m.nmethods, n-2)
 		px.log.Error(errs)
 		err = fmt.Errorf(errs)
+		return
 	}
 
 	//px.log.Debug("%s Methods: %d bytes [%d tot auth meth]\n%s\n", rem, n, int(m.nmethods),
@@ -293,9 +647,9 @@ func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
 	return
 }
 
-// Read the connect request and return a successful connection to
-// the other side
-func (px *socksProxy) doConnect(lhs net.Conn) (rhs net.Conn, s string, err error) {
+// Read the connect request of 'user' and return a successful
+// connection to the other side
+func (px *socksProxy) doConnect(lhs net.Conn, user string) (rhs net.Conn, s string, err error) {
 	ls := lhs.RemoteAddr().String()
 
 	buf := make([]byte, 512)
@@ -309,7 +663,12 @@ func (px *socksProxy) doConnect(lhs net.Conn) (rhs net.Conn, s string, err error
 		return
 	}
 
-	//log.Debug("%s Connect: %d bytes\n%s\n", ls, n, hex.Dump(buf[0:n]))
+	// The request is in; the handshake timeout no longer applies
+	lhs.SetDeadline(time.Time{})
+
+	if px.flags.On(flagPayload) {
+		log.Info("%s Connect: %d bytes\n%s", ls, n, hex.Dump(buf[0:n]))
+	}
 
 	// Packet Format:
 	// field 1: [0] Version# (must be 0x5)
@@ -329,95 +688,229 @@ func (px *socksProxy) doConnect(lhs net.Conn) (rhs net.Conn, s string, err error
 	// field 6: [2] port number in network byte order
 	//
 
-	if n < 7 {
-		log.Error("%s Insufficient data while reading connect: Saw %d, want 7\n",
-			ls, n)
-		err = errors.New("Insufficient data")
+	cmd, atyp, host, port, k, err := parseSocks5(buf[:n])
+	if err != nil {
+		log.Debug("%s SOCKSv5: %s", ls, err)
+		code := byte(1) // general failure
+		if err == errAddrType {
+			code = 8
+		}
+		lhs.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
 		return
 	}
+	n = k
+
+	rep := func(code byte, bnd net.Addr) {
+		px.reply(lhs, buf[:n], code, bnd)
+	}
+	udp := func() error {
+		return px.udpAssociate(lhs, buf[:n])
+	}
+	return px.connect(lhs, user, cmd, atyp, host, port, rep, udp)
+}
+
+// Parse a SOCKSv5 request:
+//
+//	VER(5) CMD RSV ATYP DST.ADDR DST.PORT
+//
+// Returns the command, address type, host, port and the length of
+// the request; what follows it is ignored.
+func parseSocks5(b []byte) (cmd, atyp byte, host string, port uint16, n int, err error) {
+	if len(b) < 4 || b[0] != 5 {
+		return 0, 0, "", 0, 0, errors.New("short request")
+	}
+
+	h, p, k, err := parseSocksAddr(b[3:])
+	if err != nil {
+		return 0, 0, "", 0, 0, err
+	}
+	return b[1], b[3], h, uint16(p), 3 + k, nil
+}
+
+// Carry out command 'cmd' of client 'lhs', logged in as 'user' if at
+// all, for address 'host' (of SOCKS type 'atyp') and 'port'; return a
+// connection to the other side. 'rep' sends the client a SOCKS reply
+// code; 'udp' handles UDP ASSOCIATE and is nil where that isn't
+// supported.
+func (px *socksProxy) connect(lhs net.Conn, user string, cmd, atyp byte, host string, port uint16, rep func(byte, net.Addr), udp func() error) (rhs net.Conn, s string, err error) {
+	ls := lhs.RemoteAddr().String()
+	log := px.log
+	s = host
+
+	px.ctl.Trace(log, ls, "request: command %d %s:%d", cmd, host, port)
 
 	var t string
-	var i int
-
-	switch buf[3] {
-	case 0x1:
-		if n-4 < 4 {
-			log.Error("%s Insufficient data for IPv4 addr: saw %d, want 4\n",
-				ls, n-4)
-			err = errors.New("Insufficient data")
-			return
-		}
-		s += fmt.Sprintf("%d", buf[4])
-		s += fmt.Sprintf(".%d", buf[5])
-		s += fmt.Sprintf(".%d", buf[6])
-		s += fmt.Sprintf(".%d", buf[7])
-
-	case 0x3:
-		m := int(buf[4])
-		if n-4 < m {
-			log.Error("%s Insufficient data for domain: saw %d, want %d\n",
-				ls, n-4, m)
-			err = errors.New("Insufficient data")
-			return
-		}
 
-		for i = 0; i < m; i++ {
-			s += fmt.Sprintf("%c", buf[i+5])
-		}
+	if !px.acl.Allows(remoteIP(ls)) {
+		px.sample.Debug(log, logACL, "Denied %s due to ACL", ls)
+		px.acc.Dropped(dropACL)
+		px.ulogDenied(ls, fmt.Sprintf("%s:%d", s, port), "acl")
+		err = errors.New("denied by ACL")
+		rep(2, nil)
+		return
+	}
 
-	case 0x4:
-		m := 16
-		if n-4 < m {
-			log.Error("%s Insufficient data for IPv6 addr: saw %d, want 16\n",
-				ls, n-4)
-			err = errors.New("Insufficient data")
-			return
-		}
-		s = fmt.Sprintf("[%02x", buf[5])
-		for i = 1; i < m; i++ {
-			s += fmt.Sprintf(":%02x", buf[i+5])
-		}
-		s += "]"
+	// a client that resolved the name itself has leaked it to its DNS
+	if px.cfg.Resolve == "remote" && cmd != 3 && net.ParseIP(host) != nil {
+		log.Info("%s denied %s: an address; resolve is remote", ls, host)
+		px.ulogDenied(ls, fmt.Sprintf("%s:%d", s, port), "address")
+		px.acc.Failed(failPolicy)
+		err = fmt.Errorf("%s is an address; resolve is remote", host)
+		rep(8, nil) // address type not supported
+		return
+	}
+
+	if cmd != 3 && px.dnsLeak(ls, host, port) {
+		err = fmt.Errorf("%s: dns leak", host)
+		rep(2, nil) // connection not allowed by ruleset
+		return
 	}
 
-	var port uint16 = uint16(buf[n-2])<<8 + uint16(buf[n-1])
+	if px.bl.Blocked(s) {
+		log.Info("%s denied %s: blocklist", ls, s)
+		px.ulogDenied(ls, fmt.Sprintf("%s:%d", s, port), "blocklist")
+		px.acc.Failed(failPolicy)
+		err = fmt.Errorf("%s is on the blocklist", s)
+		rep(2, nil) // connection not allowed by ruleset
+		return
+	}
 
-	s += fmt.Sprintf(":%d", port)
+	if c := categoryDenied(px.cat, px.cfg.DenyCategories, s); len(c) > 0 {
+		log.Info("%s denied %s: category %s", ls, s, c)
+		px.ulogDenied(ls, fmt.Sprintf("%s:%d", s, port), "category "+c)
+		px.acc.Failed(failPolicy)
+		err = fmt.Errorf("category %s denied", c)
+		rep(2, nil) // connection not allowed by ruleset
+		return
+	}
+	if c := px.acl.Shadow().Category(px.cat, s); len(c) > 0 {
+		px.sample.Info(log, logShadow, "shadow: %s would be denied %s: category %s", ls, s, c)
+	}
 
-	switch buf[1] {
-	case 1:
+	in := &opaInput{
+		Listener: px.cfg.String(),
+		Protocol: "socks",
+		User:     user,
+		Client:   remoteIP(ls).String(),
+		Host:     s,
+		Port:     int(port),
+	}
+	if ok, why := px.opa.Allow(in); !ok {
+		log.Info("%s denied %s: %s", ls, s, why)
+		px.ulogDenied(ls, fmt.Sprintf("%s:%d", s, port), why)
+		px.acc.Failed(failPolicy)
+		err = fmt.Errorf("%s denied: %s", s, why)
+		rep(2, nil) // connection not allowed by ruleset
+		return
+	}
+
+	if atyp == 0x3 {
+		s = safeSearchHost(&px.cfg.Safesearch, s)
+	}
+
+	dh := s
+	s = net.JoinHostPort(s, strconv.Itoa(int(port)))
+
+	switch {
+	case cmd == 1:
 		t = "tcp"
-	case 2: // bind
-	case 3:
-		t = "udp"
+	case cmd == 3 && udp != nil:
+		// the association is complete when this returns
+		err = udp()
+		return
+	default: // bind
+		log.Debug("%s unsupported command %d", ls, cmd)
+		err = fmt.Errorf("unsupported command %d", cmd)
+		rep(7, nil)
+		return
 	}
 
 	//log.Debug("Connecting to %s ..\n", s)
 
-	/*
-	   tout := time.Duration(px.cfg.Conn_tout) * time.Second
-	   if tout <= 0 {
-	       tout, _ = time.ParseDuration("4s")
-	   }
-	*/
-	d := &net.Dialer{LocalAddr: px.bind, Timeout: 5 * time.Second}
+	if !px.dst.Open(dh) {
+		px.acc.Dropped(dropDestLimit)
+		px.sample.Info(log, logDestLimit, "%s: %s has too many connections", ls, dh)
+		px.ulogDenied(ls, s, "too many connections")
+		err = fmt.Errorf("%s: too many connections", dh)
+		rep(1, nil)
+		return
+	}
 
-	rhs, err = d.Dial(t, s)
+	px.chaos.Delay(px.ctx)
+
+	cip := lhs.RemoteAddr().(*net.TCPAddr).IP
+	rt := px.routes.For(px.ctx, px.res, dh)
+	px.ctl.Trace(log, ls, "connecting to %s, route %s", s, rt)
+	if up := rt.Upstream(px.upstream, cip, dh); up != nil {
+		ctx, cancel := context.WithTimeout(px.ctx, 10*time.Second)
+		rhs, err = up.DialContext(ctx, t, s)
+		cancel()
+	} else {
+		eg := rt.Egress(px.egress)
+		nd := &net.Dialer{Timeout: time.Duration(px.cfg.Timeouts.Dial), Control: px.mtu.Control()}
+		d := func(dst net.IP) *net.Dialer {
+			return px.qos.Dialer(eg.Dialer(nd, cip, dst), s)
+		}
+		rhs, err = px.res.Dial(px.ctx, d, px.family, t, s)
+	}
 	if err != nil {
+		px.dst.Fail(dh)
+		px.dst.Close(dh, 0, 0)
+		px.acc.Failed(failure(err))
+		px.ctl.Trace(log, ls, "connect to %s failed: %s: %s", s, failNames[failure(err)], err)
 		log.Error("%s failed to connect to %s: %s", ls, s, err)
-		buf[1] = 4
-		lhs.Write(buf[:n])
+		rep(4, nil)
 		return
 	}
 
-	buf[1] = 0
-	lhs.Write(buf[:n])
+	setLinger(rhs, px.linger)
+	px.ka.Set(rhs)
+	rep(0, rhs.LocalAddr())
 
 	log.Debug("%s connected to %s [%s]", ls, s, rhs.RemoteAddr().String())
+	px.ctl.Trace(log, ls, "connected to %s [%s]", s, rhs.RemoteAddr().String())
 
 	//log.Info("%s CONNECT %s %s\n", ls, s, rhs.RemoteAddr().String())
 
 	return rhs, s, nil
 }
 
+// Count and log a request of client 'ls' for 'host' if it is an
+// address of a name in the dnsleak domains: the client resolved the
+// name on its own. Return true if the request is blocked for it.
+func (px *socksProxy) dnsLeak(ls, host string, port uint16) bool {
+	name := leakedName(&px.cfg.DNSLeak, px.res, host)
+	if len(name) == 0 {
+		return false
+	}
+
+	px.acc.Leaked()
+	px.sample.Info(px.log, logDNSLeak, "%s: dns leak: %s is an address of %s", ls, host, name)
+	if px.cfg.DNSLeak.Action != "block" {
+		return false
+	}
+	px.ulogDenied(ls, net.JoinHostPort(host, strconv.Itoa(int(port))), "dns leak")
+	px.acc.Failed(failPolicy)
+	return true
+}
+
+// Send a reply with code 'rep' to request 'req'. The reply carries the
+// bound address 'bnd' if it is non-nil -- with the listener's external
+// IP, if any, in place of ours; else it echoes the request's address.
+func (px *socksProxy) reply(lhs net.Conn, req []byte, rep byte, bnd net.Addr) {
+	if bnd == nil {
+		req[1] = rep
+		lhs.Write(req)
+		return
+	}
+
+	host, port, _ := splitHostPort(bnd.String())
+	if px.ext != nil {
+		host = px.ext.String()
+	}
+	a, _ := socksAddr(host, port)
+	b := append([]byte{5, rep, 0}, a...)
+	lhs.Write(b)
+}
+
 // vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
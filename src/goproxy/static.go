@@ -0,0 +1,131 @@
+// static.go -- static responses and redirects served by the HTTP proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// A rule that answers matching requests itself: with a configured
+// page (e.g. a block page) or a redirect (e.g. an internal shortlink).
+// Requests that match never leave the proxy.
+type staticRule struct {
+	host     string // "*.example.com" matches the subdomains
+	path     string // prefix; "" matches any path
+	status   int
+	redirect string
+	ctype    string
+	body     []byte
+}
+
+// Make the rules in 'cv'; the bodies in files are read now.
+func newStaticRules(cv []StaticConf) ([]*staticRule, error) {
+	var rv []*staticRule
+	for i := range cv {
+		c := &cv[i]
+		m := c.Match
+		if i := strings.Index(m, "://"); i >= 0 {
+			m = m[i+3:]
+		}
+
+		s := &staticRule{
+			host:     m,
+			status:   c.Status,
+			redirect: c.Redirect,
+			ctype:    c.Type,
+			body:     []byte(c.Body),
+		}
+		if i := strings.IndexByte(m, '/'); i >= 0 {
+			s.host, s.path = m[:i], m[i:]
+		}
+		s.host = strings.ToLower(s.host)
+		if len(s.host) == 0 {
+			return nil, fmt.Errorf("static: rule %d: no host in %q", i, c.Match)
+		}
+
+		if len(c.File) > 0 {
+			if len(c.Body) > 0 {
+				return nil, fmt.Errorf("static: %s: both body and file", c.Match)
+			}
+			b, err := ioutil.ReadFile(c.File)
+			if err != nil {
+				return nil, fmt.Errorf("static: %s: %s", c.Match, err)
+			}
+			s.body = b
+		}
+
+		if s.status == 0 {
+			s.status = http.StatusOK
+			if len(s.redirect) > 0 {
+				s.status = http.StatusFound
+			}
+		}
+		if len(s.redirect) > 0 && (s.status < 300 || s.status > 399) {
+			return nil, fmt.Errorf("static: %s: redirect with status %d", c.Match, s.status)
+		}
+		if len(http.StatusText(s.status)) == 0 {
+			return nil, fmt.Errorf("static: %s: unknown status %d", c.Match, s.status)
+		}
+		if len(s.ctype) == 0 {
+			s.ctype = "text/html; charset=utf-8"
+		}
+		rv = append(rv, s)
+	}
+	return rv, nil
+}
+
+// Return the first rule in 'rv' that matches 'host' and 'path'
+func matchStatic(rv []*staticRule, host, path string) *staticRule {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, s := range rv {
+		if s.matchHost(host) && s.matchPath(path) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *staticRule) matchHost(h string) bool {
+	if strings.HasPrefix(s.host, "*.") {
+		return strings.HasSuffix(h, s.host[1:])
+	}
+	return h == s.host
+}
+
+// A path prefix matches whole path segments: /foo matches /foo and
+// /foo/bar, but not /foobar.
+func (s *staticRule) matchPath(p string) bool {
+	switch {
+	case len(s.path) == 0 || p == s.path:
+		return true
+	case !strings.HasPrefix(p, s.path):
+		return false
+	}
+	return strings.HasSuffix(s.path, "/") || p[len(s.path)] == '/'
+}
+
+// Write the response of 's'
+func (s *staticRule) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.redirect) > 0 {
+		w.Header().Set("Location", s.redirect)
+	}
+	if len(s.body) > 0 {
+		w.Header().Set("Content-Type", s.ctype)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(s.status)
+	if r.Method != "HEAD" {
+		w.Write(s.body)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
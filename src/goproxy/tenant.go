@@ -0,0 +1,124 @@
+// tenant.go -- per-tenant listener policy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Apply the tenant config to each listener that belongs to a tenant;
+// tenant settings override the listener's own. Listeners must already
+// be expanded to one per port.
+func applyTenants(tenants map[string]TenantConf, v []ListenConf) {
+	for i := range v {
+		lc := &v[i]
+		if len(lc.PortTenants) > 0 {
+			_, p, _ := net.SplitHostPort(lc.Listen)
+			if port, err := strconv.Atoi(p); err == nil {
+				if t, ok := lc.PortTenants[port]; ok {
+					lc.Tenant = t
+				}
+			}
+		}
+
+		t, ok := tenants[lc.Tenant]
+		if !ok {
+			continue
+		}
+
+		if len(t.Allow) > 0 {
+			lc.Allow = t.Allow
+		}
+		if len(t.Deny) > 0 {
+			lc.Deny = t.Deny
+		}
+
+		if len(t.Egress.Pool) > 0 {
+			lc.Bind = ""
+			lc.Egress = t.Egress
+		}
+
+		if t.Ratelimit.Global > 0 {
+			lc.Ratelimit.Global = t.Ratelimit.Global
+		}
+		if t.Ratelimit.PerHost > 0 && len(lc.Transport.Exec) == 0 {
+			lc.Ratelimit.PerHost = t.Ratelimit.PerHost
+		}
+		if t.Sizelimit.Upload > 0 {
+			lc.Sizelimit.Upload = t.Sizelimit.Upload
+		}
+		if t.Sizelimit.Download > 0 {
+			lc.Sizelimit.Download = t.Sizelimit.Download
+		}
+
+		lc.DenyCategories = append(lc.DenyCategories[:len(lc.DenyCategories):len(lc.DenyCategories)],
+			t.DenyCategories...)
+
+		// the tenant is a label of the listener; don't modify the tags
+		// shared with the other ports of this listener.
+		tags := map[string]string{"tenant": lc.Tenant}
+		for k, x := range lc.Tags {
+			if k != "tenant" {
+				tags[k] = x
+			}
+		}
+		lc.Tags = tags
+	}
+}
+
+// Destination tables: one for each tenant and one for listeners
+// without a tenant; so each tenant has its own counters and limits.
+type tenantDests struct {
+	dflt *destTable
+	m    map[string]*destTable
+}
+
+func newTenantDests(cfg *Conf) *tenantDests {
+	td := &tenantDests{
+		dflt: newDestTable(cfg.MaxDestConns),
+		m:    make(map[string]*destTable),
+	}
+
+	for name, t := range cfg.Tenants {
+		max := cfg.MaxDestConns
+		if t.MaxDestConns > 0 {
+			max = t.MaxDestConns
+		}
+		td.m[name] = newDestTable(max)
+	}
+	return td
+}
+
+// Return the destination table of 'tenant'
+func (td *tenantDests) For(tenant string) *destTable {
+	if d, ok := td.m[tenant]; ok {
+		return d
+	}
+	return td.dflt
+}
+
+// GET /dest[?tenant=NAME]
+func (td *tenantDests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("tenant")
+	if len(name) == 0 {
+		td.dflt.ServeHTTP(w, r)
+		return
+	}
+
+	d, ok := td.m[name]
+	if !ok {
+		http.Error(w, "no such tenant "+name, http.StatusNotFound)
+		return
+	}
+	d.ServeHTTP(w, r)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
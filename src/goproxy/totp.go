@@ -0,0 +1,71 @@
+// totp.go -- time based one time passwords (RFC 6238)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The codes of authenticator apps: 6 digits from HMAC-SHA1 of the
+// 30 second step since the epoch
+const (
+	totpDigits = 6
+	totpStep   = 30 * time.Second
+
+	// steps before and after ours whose codes we take, for clocks
+	// that are off and users who type slowly
+	totpSkew = 1
+)
+
+// Decode the base32 TOTP secret 's' as shown by authenticator apps:
+// any case, spaces and padding optional
+func parseTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) < 10 {
+		return nil, fmt.Errorf("not a base32 TOTP secret of at least 80 bits")
+	}
+	return b, nil
+}
+
+// Return the code of 'key' for step 'n'
+func totpCode(key []byte, n uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(b[:])
+	sum := h.Sum(nil)
+
+	// dynamic truncation (RFC 4226 5.3)
+	i := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[i:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// Return true if 'code' is that of 'key' at 'now', give or take
+// totpSkew steps
+func checkTOTP(key []byte, code string, now time.Time) bool {
+	n := uint64(now.Unix() / int64(totpStep/time.Second))
+	for i := n - totpSkew; i <= n+totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, i)), []byte(code)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
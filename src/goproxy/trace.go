@@ -0,0 +1,214 @@
+// trace.go -- verbose tracing of the connections of a client or user
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// The client IPs and users whose connections are traced, each until
+// its expiry; turned on via the admin API to debug one client without
+// turning on debug logs for all.
+type tracer struct {
+	n int32 // IPs and users traced; 0 skips the lock
+
+	mu    sync.Mutex
+	ips   map[string]time.Time
+	users map[string]time.Time
+	conns map[string]string // client address -> traced user it logged in as
+}
+
+func newTracer() *tracer {
+	return &tracer{
+		ips:   make(map[string]time.Time),
+		users: make(map[string]time.Time),
+		conns: make(map[string]string),
+	}
+}
+
+// Return true if the connection of client 'ls' is traced
+func (t *tracer) on(ls string) bool {
+	if atomic.LoadInt32(&t.n) == 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.live(t.ips, remoteIP(ls).String(), now) {
+		return true
+	}
+	u, ok := t.conns[ls]
+	return ok && t.live(t.users, u, now)
+}
+
+// Return true if 'k' of 'm' hasn't expired; forget it if it has.
+// Must be called with the lock held.
+func (t *tracer) live(m map[string]time.Time, k string, now time.Time) bool {
+	exp, ok := m[k]
+	if ok && now.After(exp) {
+		delete(m, k)
+		t.count()
+		return false
+	}
+	return ok
+}
+
+// Update the count and forget the connections of users no longer
+// traced. Must be called with the lock held.
+func (t *tracer) count() {
+	for k, u := range t.conns {
+		if _, ok := t.users[u]; !ok {
+			delete(t.conns, k)
+		}
+	}
+	atomic.StoreInt32(&t.n, int32(len(t.ips)+len(t.users)))
+}
+
+// Trace 'ip' or 'user' -- whichever isn't empty -- for 'ttl'; or stop
+// if 'ttl' is 0.
+func (t *tracer) Set(ip, user string, ttl time.Duration) {
+	m, k := t.ips, ip
+	if len(user) > 0 {
+		m, k = t.users, user
+	}
+
+	t.mu.Lock()
+	if ttl > 0 {
+		m[k] = time.Now().Add(ttl)
+	} else {
+		delete(m, k)
+	}
+	t.count()
+	t.mu.Unlock()
+}
+
+// Return the IPs and users traced and their expiry
+func (t *tracer) active() map[string]map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	v := map[string]map[string]string{
+		"ips":   make(map[string]string),
+		"users": make(map[string]string),
+	}
+	for k, exp := range t.ips {
+		if now.Before(exp) {
+			v["ips"][k] = exp.UTC().Format(time.RFC3339)
+		}
+	}
+	for k, exp := range t.users {
+		if now.Before(exp) {
+			v["users"][k] = exp.UTC().Format(time.RFC3339)
+		}
+	}
+	return v
+}
+
+// Log the state of the connection of client 'ls' to 'log' if it is
+// traced. The traces go out at info so they show whatever the log
+// level.
+func (c *control) Trace(log *L.Logger, ls string, format string, v ...interface{}) {
+	if c == nil || !c.trace.on(ls) {
+		return
+	}
+	log.Info("trace %s: %s", ls, fmt.Sprintf(format, v...))
+}
+
+// Client 'ls' logged in as 'user'; its connection is traced from here
+// on if the user is.
+func (c *control) TraceLogin(ls, user string) {
+	if c == nil || atomic.LoadInt32(&c.trace.n) == 0 {
+		return
+	}
+
+	t := c.trace
+	t.mu.Lock()
+	if t.live(t.users, user, time.Now()) {
+		t.conns[ls] = user
+	}
+	t.mu.Unlock()
+}
+
+// The connection of client 'ls' is closed
+func (c *control) TraceDone(ls string) {
+	if c == nil || atomic.LoadInt32(&c.trace.n) == 0 {
+		return
+	}
+
+	t := c.trace
+	t.mu.Lock()
+	delete(t.conns, ls)
+	t.mu.Unlock()
+}
+
+// Admin API for tracing:
+//
+//	GET    /trace                          IPs and users traced
+//	POST   /trace?ip=A[&ttl=15m]           trace client IP A
+//	POST   /trace?user=U[&ttl=15m]         trace user U
+//	DELETE /trace?ip=A or ?user=U          stop tracing
+func (c *control) ServeTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, c.trace.active())
+		return
+	}
+
+	q := r.URL.Query()
+	ip, user := q.Get("ip"), q.Get("user")
+	switch {
+	case len(user) > 0 && len(ip) > 0:
+		http.Error(w, "ip and user are exclusive", http.StatusBadRequest)
+		return
+	case len(ip) > 0:
+		a := net.ParseIP(ip)
+		if a == nil {
+			http.Error(w, fmt.Sprintf("invalid IP %q", ip), http.StatusBadRequest)
+			return
+		}
+		ip = a.String()
+	case len(user) == 0:
+		http.Error(w, "need an ip or user", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		ttl := defaultFlagTTL
+		if s := q.Get("ttl"); len(s) > 0 {
+			d, err := parseDuration(s)
+			if err != nil || d <= 0 || d > maxFlagTTL {
+				http.Error(w, fmt.Sprintf("invalid ttl %q (max %s)", s, maxFlagTTL),
+					http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		c.trace.Set(ip, user, ttl)
+
+	case "DELETE":
+		c.trace.Set(ip, user, 0)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.trace.active())
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
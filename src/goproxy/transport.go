@@ -0,0 +1,201 @@
+// transport.go -- pluggable obfuscation transports in front of listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// A ptServer runs a pluggable transport (per the Tor pluggable
+// transport spec, version 1) in front of a listener: obfs4proxy or
+// lyrebird for obfs4, webtunnel for a TLS-mimicking shell, or any
+// other server that speaks the spec. The transport listens on the
+// public address, strips the obfuscation and connects to our
+// listener, which then only needs to listen on loopback. We start it,
+// log the arguments clients need (e.g. obfs4's cert) and stop it when
+// we stop. If it dies, we fail like a listener does.
+type ptServer struct {
+	name string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	log  *L.Logger
+
+	failed chan error
+	done   chan bool
+	wg     sync.WaitGroup
+}
+
+// How long the transport may take to exit once told to
+const ptStopTimeout = 5 * time.Second
+
+// Return the transport in front of 'lc'; nil if it has none
+func newPTServer(lc *ListenConf, log *L.Logger) *ptServer {
+	t := &lc.Transport
+	if len(t.Exec) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(t.Exec, t.Args...)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+		"TOR_PT_STATE_LOCATION="+t.State,
+		"TOR_PT_SERVER_TRANSPORTS="+t.Name,
+		"TOR_PT_SERVER_BINDADDR="+t.Name+"-"+t.Listen,
+		"TOR_PT_ORPORT="+lc.Listen,
+	)
+	if o := ptOptions(t.Name, t.Options); len(o) > 0 {
+		cmd.Env = append(cmd.Env, "TOR_PT_SERVER_TRANSPORT_OPTIONS="+o)
+	}
+
+	return &ptServer{
+		name:   t.Name,
+		cmd:    cmd,
+		log:    log.New("transport "+t.Name, 0),
+		failed: make(chan error, 1),
+		done:   make(chan bool),
+	}
+}
+
+// Format 'opt' for TOR_PT_SERVER_TRANSPORT_OPTIONS: "name:k=v;name:k=v"
+func ptOptions(name string, opt map[string]string) string {
+	esc := strings.NewReplacer(`\`, `\\`, `;`, `\;`, `:`, `\:`, `=`, `\=`)
+
+	var keys []string
+	for k := range opt {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var v []string
+	for _, k := range keys {
+		v = append(v, fmt.Sprintf("%s:%s=%s", name, esc.Replace(k), esc.Replace(opt[k])))
+	}
+	return strings.Join(v, ";")
+}
+
+func (t *ptServer) Start() {
+	out, err := t.cmd.StdoutPipe()
+	if err == nil {
+		t.cmd.Stderr = &ptLog{log: t.log}
+		t.in, err = t.cmd.StdinPipe()
+	}
+	if err == nil {
+		err = t.cmd.Start()
+	}
+	if err != nil {
+		t.fail(err)
+		close(t.done)
+		return
+	}
+
+	t.log.Info("started %s (pid %d)", t.cmd.Path, t.cmd.Process.Pid)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.readStdout(out)
+
+		err := t.cmd.Wait()
+		close(t.done)
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		t.fail(err)
+	}()
+}
+
+// Stop the transport: closing its stdin tells it to exit; kill it if
+// it doesn't.
+func (t *ptServer) Stop() {
+	if t.in != nil {
+		t.in.Close()
+	}
+
+	select {
+	case <-t.done:
+	case <-time.After(ptStopTimeout):
+		t.log.Warn("didn't exit; killing it")
+		t.cmd.Process.Kill()
+	}
+	t.wg.Wait()
+}
+
+func (t *ptServer) Failed() <-chan error {
+	return t.failed
+}
+
+func (t *ptServer) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
+// Log what the transport tells us on stdout
+func (t *ptServer) readStdout(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 {
+			continue
+		}
+
+		switch f[0] {
+		case "SMETHOD":
+			// SMETHOD <name> <addr> [ARGS:k=v,k=v]
+			if len(f) >= 3 {
+				args := ""
+				for _, a := range f[3:] {
+					if strings.HasPrefix(a, "ARGS:") {
+						args = "; clients need " + a[5:]
+					}
+				}
+				t.log.Info("%s listening on %s%s", f[1], f[2], args)
+			}
+
+		case "SMETHOD-ERROR", "ENV-ERROR", "VERSION-ERROR":
+			t.log.Error("%s", sc.Text())
+
+		default:
+			t.log.Debug("%s", sc.Text())
+		}
+	}
+}
+
+// The transport's stderr, logged line by line
+type ptLog struct {
+	log *L.Logger
+	buf []byte
+}
+
+func (l *ptLog) Write(b []byte) (int, error) {
+	l.buf = append(l.buf, b...)
+	for {
+		i := strings.IndexByte(string(l.buf), '\n')
+		if i < 0 {
+			break
+		}
+		l.log.Info("%s", strings.TrimRight(string(l.buf[:i]), "\r"))
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,202 @@
+// trojan.go -- Trojan protocol listener
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A trojanServer makes a SOCKS listener speak the Trojan protocol: the
+// client opens TLS and sends
+//
+//	hex(SHA224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF payload
+//
+// where the request is that of SOCKSv5. There are no replies: once the
+// destination is connected the payload and the rest of the stream are
+// relayed. Anything that isn't a Trojan client with a known password
+// -- a browser or a prober -- is handed, unchanged, to the fallback web
+// server; so the listener looks like an ordinary HTTPS site.
+type trojanServer struct {
+	tls      *tls.Config
+	pass     map[string]bool // hex SHA224 of the passwords
+	fallback string
+}
+
+const trojanHashLen = 2 * sha256.Size224
+
+// Make the Trojan server in 'c'; nil if there is none
+func newTrojanServer(c *TrojanConf) (*trojanServer, error) {
+	if len(c.Cert) == 0 && len(c.Key) == 0 && len(c.Passwords) == 0 {
+		return nil, nil
+	}
+	if len(c.Passwords) == 0 {
+		return nil, fmt.Errorf("trojan: no passwords")
+	}
+
+	crt, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("trojan: %s", err)
+	}
+
+	t := &trojanServer{
+		tls: &tls.Config{
+			Certificates: []tls.Certificate{crt},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"http/1.1"},
+		},
+		pass:     make(map[string]bool),
+		fallback: c.Fallback,
+	}
+	for _, p := range c.Passwords {
+		h := sha256.Sum224([]byte(p))
+		t.pass[hex.EncodeToString(h[:])] = true
+	}
+	return t, nil
+}
+
+// Parse the Trojan header in 'b'; return the command, address type,
+// host, port and the payload that follows. ok is false if 'b' isn't
+// from a client that knows a password.
+func (t *trojanServer) parse(b []byte) (cmd, atyp byte, host string, port uint16, rest []byte, ok bool) {
+	crlf := []byte("\r\n")
+
+	n := trojanHashLen
+	if len(b) < n+2+2 || !bytes.Equal(b[n:n+2], crlf) || !t.pass[string(b[:n])] {
+		return
+	}
+	b = b[n+2:]
+
+	h, p, k, err := parseSocksAddr(b[1:])
+	if err != nil || len(b) < 1+k+2 || !bytes.Equal(b[1+k:1+k+2], crlf) {
+		return
+	}
+	return b[0], b[1], h, uint16(p), b[1+k+2:], true
+}
+
+// Serve Trojan client 'lhs'
+func (px *socksProxy) trojanProxy(lhs net.Conn) {
+	c, b := px.greet(lhs, px.trojan.tls)
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	cmd, atyp, host, port, rest, ok := px.trojan.parse(b)
+	if !ok {
+		px.fallback(c, b, px.trojan.fallback, "Trojan")
+		return
+	}
+
+	// there are no replies in Trojan; and no UDP here
+	rhs, s, err := px.connect(c, "", cmd, atyp, host, port, func(byte, net.Addr) {}, nil)
+	if err != nil || rhs == nil {
+		return
+	}
+	defer rhs.Close()
+
+	px.relay(&prefixConn{c, rest}, rhs.(*net.TCPConn), "", s)
+}
+
+// Do the TLS handshake with 'lhs' if 'tc' is set and read the client's
+// first bytes, all within the handshake timeout. Returns the
+// connection to use from here on and what was read; nil if the client
+// went away.
+func (px *socksProxy) greet(lhs net.Conn, tc *tls.Config) (halfConn, []byte) {
+	ls := lhs.RemoteAddr().String()
+
+	if t := time.Duration(px.cfg.Timeouts.Handshake); t > 0 {
+		lhs.SetDeadline(time.Now().Add(t))
+	}
+
+	c := lhs.(halfConn)
+	if tc != nil {
+		sc := tls.Server(lhs, tc)
+		if err := sc.Handshake(); err != nil {
+			px.acc.Failed(failTLS)
+			px.log.Debug("%s TLS handshake: %s", ls, err)
+			return nil, nil
+		}
+		c = sc
+	}
+
+	buf := make([]byte, handshakeBufSize)
+	n, err := c.Read(buf)
+	if err != nil && n == 0 {
+		px.acc.Failed(failClientAbort)
+		if err != io.EOF {
+			px.log.Debug("%s Unable to read request: %s", ls, err)
+		}
+		c.Close()
+		return nil, nil
+	}
+	lhs.SetDeadline(time.Time{})
+	return c, buf[:n]
+}
+
+// Hand 'c', which sent 'b' and isn't a client of protocol 'proto', to
+// the fallback web server 'addr'; close it if there is none
+func (px *socksProxy) fallback(c halfConn, b []byte, addr, proto string) {
+	ls := c.RemoteAddr().String()
+	if len(addr) == 0 {
+		px.log.Debug("%s not a %s client; closed", ls, proto)
+		return
+	}
+
+	px.log.Debug("%s not a %s client; sent to %s", ls, proto, addr)
+
+	d := &net.Dialer{Timeout: time.Duration(px.cfg.Timeouts.Dial)}
+	rhs, err := d.DialContext(px.ctx, "tcp", addr)
+	if err != nil {
+		px.log.Warn("%s fallback: %s", ls, err)
+		return
+	}
+	defer rhs.Close()
+
+	cp := &CancellableCopier{
+		Lhs:          &prefixConn{c, b},
+		Rhs:          rhs.(*net.TCPConn),
+		ReadTimeout:  time.Duration(px.cfg.Timeouts.Read),
+		WriteTimeout: time.Duration(px.cfg.Timeouts.Write),
+		LhsIdle:      time.Duration(px.cfg.Timeouts.ClientIdle),
+		RhsIdle:      time.Duration(px.cfg.Timeouts.UpstreamIdle),
+	}
+
+	ctx := px.ctx
+	if t := time.Duration(px.cfg.Timeouts.Session); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	cp.Copy(ctx)
+}
+
+// A connection whose first reads return what was already read from it
+type prefixConn struct {
+	halfConn
+	pre []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.pre) > 0 {
+		n := copy(b, c.pre)
+		c.pre = c.pre[n:]
+		return n, nil
+	}
+	return c.halfConn.Read(b)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,76 @@
+// tunnel.go -- the record logged when a tunnel closes
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Everything we know about a tunnel when it closes; logged as a single
+// key=value line for billing and forensics.
+type closeRecord struct {
+	listener string
+	client   string
+	dest     string
+	remote   string // address we connected to
+	start    time.Time
+	end      time.Time
+	up       int64 // bytes from the client
+	down     int64 // bytes to the client
+	reason   string
+
+	// the User-Agent of a CONNECT and what the TLS client hello
+	// sent through the tunnel told us
+	ua    string
+	tls   tlsHello
+	proto string // class of the traffic; see classify()
+}
+
+func (r *closeRecord) String() string {
+	s := fmt.Sprintf("time=%q listener=%q client=%q dest=%q remote=%q up=%d down=%d duration=%q close=%q",
+		r.start.UTC().Format(time.RFC3339), r.listener, r.client, r.dest, r.remote,
+		r.up, r.down, r.end.Sub(r.start).String(), r.reason)
+	if len(r.proto) > 0 {
+		s += fmt.Sprintf(" proto=%q", r.proto)
+	}
+	if len(r.ua) > 0 {
+		s += fmt.Sprintf(" ua=%q", r.ua)
+	}
+	if len(r.tls.JA3) > 0 {
+		s += fmt.Sprintf(" sni=%q alpn=%q ja3=%q ja4=%q", r.tls.SNI, r.tls.ALPN, r.tls.JA3, r.tls.JA4)
+	}
+	return s
+}
+
+// Log 'r' to the URL log if there is one; else to 'log' at debug level
+func logClose(log, ulog *L.Logger, r *closeRecord) {
+	if ulog != nil {
+		ulog.Info("%s", r)
+		return
+	}
+	log.Debug("%s", r)
+}
+
+// Refine the close reason 'why' of a tunnel whose copy was cancelled:
+// either we are shutting down ('px' is done) or the admin killed it.
+func cancelReason(px context.Context, why string) string {
+	if why != closeCancelled {
+		return why
+	}
+	if px.Err() != nil {
+		return "shutdown"
+	}
+	return "admin kill"
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,213 @@
+// udp.go -- SOCKSv5 UDP ASSOCIATE relay
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// A UDP association for one client. Datagrams from the client arrive
+// on 'cs' with a SOCKS header and leave via 'ds' -- either directly to
+// the destination or, when chained, verbatim to the upstream relay.
+type udpAssoc struct {
+	px *socksProxy
+
+	cs *net.UDPConn // client facing
+	ds *net.UDPConn // destination (or upstream) facing
+
+	cip   net.IP       // client IP; only it may use this association
+	relay *net.UDPAddr // upstream relay; nil if not chained
+
+	sync.Mutex
+	client *net.UDPAddr // learnt from the first datagram
+}
+
+// Handle a UDP ASSOCIATE request on 'lhs'. The association lives as
+// long as the TCP control connection. 'req' is the client's request
+// and is reused for the reply.
+func (px *socksProxy) udpAssociate(lhs net.Conn, req []byte) error {
+	log := px.log
+	ls := lhs.RemoteAddr().String()
+	laddr := lhs.LocalAddr().(*net.TCPAddr)
+
+	a := &udpAssoc{
+		px:  px,
+		cip: lhs.RemoteAddr().(*net.TCPAddr).IP,
+	}
+
+	var err error
+	var ctrl net.Conn
+
+	if px.upstream != nil {
+		up := px.upstream.Pick(a.cip, "")
+		ctx, cancel := context.WithTimeout(px.ctx, 10*time.Second)
+		ctrl, a.relay, err = up.Associate(ctx)
+		cancel()
+		if err != nil {
+			log.Error("%s upstream UDP associate via %s: %s", ls, up, err)
+			px.reply(lhs, req, 1, nil)
+			return err
+		}
+		defer ctrl.Close()
+	}
+
+	a.cs, err = net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		log.Error("%s can't setup UDP relay: %s", ls, err)
+		px.reply(lhs, req, 1, nil)
+		return err
+	}
+	defer a.cs.Close()
+
+	var baddr *net.UDPAddr
+	if a.relay != nil {
+		if b, ok := px.bind.(*net.TCPAddr); ok {
+			baddr = &net.UDPAddr{IP: b.IP}
+		}
+	} else if px.egress != nil {
+		baddr = &net.UDPAddr{IP: px.egress.Pick(a.cip, nil)}
+	}
+
+	a.ds, err = net.ListenUDP("udp", baddr)
+	if err != nil {
+		log.Error("%s can't setup UDP relay: %s", ls, err)
+		px.reply(lhs, req, 1, nil)
+		return err
+	}
+	defer a.ds.Close()
+
+	px.reply(lhs, req, 0, a.cs.LocalAddr())
+	log.Debug("%s UDP associate on %s", ls, a.cs.LocalAddr())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go a.fromClient(&wg)
+	go a.toClient(&wg)
+
+	// The association ends when the client closes the control
+	// connection, the upstream drops its association or we shutdown.
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(ioutil.Discard, lhs)
+		done <- true
+	}()
+	if ctrl != nil {
+		go func() {
+			io.Copy(ioutil.Discard, ctrl)
+			done <- true
+		}()
+	}
+
+	select {
+	case <-done:
+	case <-px.ctx.Done():
+	}
+
+	a.cs.Close()
+	a.ds.Close()
+	lhs.Close()
+	if ctrl != nil {
+		ctrl.Close()
+	}
+	wg.Wait()
+
+	log.Debug("%s UDP associate on %s ended", ls, a.cs.LocalAddr())
+	return nil
+}
+
+// Relay datagrams from the client to their destinations
+func (a *udpAssoc) fromClient(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	b := make([]byte, 65536)
+	for {
+		n, from, err := a.cs.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+
+		if !from.IP.Equal(a.cip) {
+			continue
+		}
+
+		a.Lock()
+		a.client = from
+		a.Unlock()
+
+		// RSV(2) FRAG(1) ATYP ADDR PORT DATA
+		if n < 4 || b[2] != 0 {
+			// we don't do fragmentation
+			continue
+		}
+
+		if a.relay != nil {
+			a.ds.WriteToUDP(b[:n], a.relay)
+			continue
+		}
+
+		host, port, m, err := parseSocksAddr(b[3:n])
+		if err != nil {
+			continue
+		}
+
+		ips, err := a.px.res.LookupIP(a.px.ctx, host)
+		if err != nil {
+			a.px.log.Debug("%s UDP: can't resolve %s: %s", from, host, err)
+			continue
+		}
+
+		ips = a.px.family.Order(host, ips)
+		a.ds.WriteToUDP(b[3+m:n], &net.UDPAddr{IP: ips[0], Port: port})
+	}
+}
+
+// Relay datagrams from destinations (or the upstream) to the client
+func (a *udpAssoc) toClient(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	b := make([]byte, 65536)
+	for {
+		// leave room to prepend the SOCKS header
+		const hdr = 3 + 1 + 16 + 2
+
+		n, from, err := a.ds.ReadFromUDP(b[hdr:])
+		if err != nil {
+			return
+		}
+
+		a.Lock()
+		client := a.client
+		a.Unlock()
+
+		if client == nil {
+			continue
+		}
+
+		if a.relay != nil {
+			// already has a SOCKS header
+			if from.IP.Equal(a.relay.IP) && from.Port == a.relay.Port {
+				a.cs.WriteToUDP(b[hdr:hdr+n], client)
+			}
+			continue
+		}
+
+		h, _ := socksAddr(from.IP.String(), from.Port)
+		i := hdr - len(h) - 3
+		copy(b[i:], []byte{0, 0, 0})
+		copy(b[i+3:], h)
+		a.cs.WriteToUDP(b[i:hdr+n], client)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
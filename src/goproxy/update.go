@@ -0,0 +1,340 @@
+// update.go -- scheduled downloads of the geoip, blocklist and category DBs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Defaults and bounds of the downloads
+const (
+	defaultUpdateInterval = 24 * time.Hour
+	updateTimeout         = 10 * time.Minute
+	maxUpdateSize         = 1 << 30
+)
+
+// An updater downloads the DB files of its sources every interval, or
+// when asked via the admin API. A download that fails its checksum or
+// doesn't parse is thrown away; else it is renamed over the file --
+// readers see the old file or the new one, never a part -- and the DB
+// reloads it.
+type updater struct {
+	interval time.Duration
+	srcs     []*updateSource
+	clt      *http.Client
+	log      *L.Logger
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+type updateSource struct {
+	UpdateSource
+
+	check func(fn string) error // parse a download
+	load  func() error          // reload the DB from File
+
+	mu sync.Mutex // one download at a time
+	st updateStatus
+}
+
+// A source as described by GET /updates
+type updateStatus struct {
+	URL     string    `json:"url"`
+	File    string    `json:"file"`
+	Checked time.Time `json:"checked"`
+	Updated time.Time `json:"updated"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Size    int64     `json:"size"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Make an updater for the sources in 'c'; each file is one of the
+// geoip DB 'geo', the blocklist 'bl' or the category DB 'cat'. Returns
+// nil if there are no sources.
+func newUpdater(c *UpdateConf, geo *geoDB, bl *blocklist, cat CategoryDB, log *L.Logger) (*updater, error) {
+	if len(c.Sources) == 0 {
+		return nil, nil
+	}
+
+	u := &updater{
+		interval: time.Duration(c.Interval),
+		clt:      &http.Client{Timeout: updateTimeout},
+		log:      log.New("updater", 0),
+		stop:     make(chan bool),
+	}
+	if u.interval <= 0 {
+		u.interval = defaultUpdateInterval
+	}
+
+	fc, _ := cat.(*fileCategoryDB)
+	for i := range c.Sources {
+		s := &updateSource{UpdateSource: c.Sources[i]}
+		s.st.URL, s.st.File = s.URL, s.File
+
+		switch {
+		case geo != nil && s.File == geo.file:
+			s.check = func(fn string) error {
+				_, err := readGeoFile(fn)
+				return err
+			}
+			s.load = geo.Load
+
+		case fc != nil && s.File == fc.file:
+			s.check = func(fn string) error {
+				_, err := readCategories(fn)
+				return err
+			}
+			s.load = fc.Load
+
+		case bl != nil && bl.has(s.File):
+			s.check = func(fn string) error {
+				_, err := readBlocklist(fn, nil)
+				return err
+			}
+			s.load = bl.Reload
+
+		default:
+			return nil, fmt.Errorf("updates: %s is not the geoip, a blocklist or the categories file", s.File)
+		}
+		u.srcs = append(u.srcs, s)
+	}
+	return u, nil
+}
+
+func (u *updater) Start() {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+
+		t := time.NewTicker(u.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case <-t.C:
+				u.Update("")
+			}
+		}
+	}()
+}
+
+func (u *updater) Stop() {
+	close(u.stop)
+	u.wg.Wait()
+}
+
+// Download the source of 'file' -- or every source if it is empty --
+// and return their status
+func (u *updater) Update(file string) []updateStatus {
+	var v []updateStatus
+	for _, s := range u.srcs {
+		if len(file) == 0 || file == s.File {
+			v = append(v, u.update(s))
+		}
+	}
+	return v
+}
+
+func (u *updater) update(s *updateSource) updateStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.st.Checked = time.Now()
+	changed, err := u.fetch(s)
+	switch {
+	case err != nil:
+		s.st.Error = err.Error()
+		u.log.Error("%s: %s; keeping the old file", s.File, err)
+	case changed:
+		s.st.Error = ""
+		s.st.Updated = s.st.Checked
+		u.log.Info("%s: updated from %s (sha256 %s, %d bytes)", s.File, s.URL, s.st.SHA256, s.st.Size)
+	default:
+		s.st.Error = ""
+		u.log.Debug("%s: %s is unchanged", s.File, s.URL)
+	}
+	return s.st
+}
+
+// Download 's' and replace its file; return true if it changed. Must
+// be called with the lock held.
+func (u *updater) fetch(s *updateSource) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if fi, err := os.Stat(s.File); err == nil {
+		req.Header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
+	}
+
+	res, err := u.clt.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("%s: %s", s.URL, res.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.File), "."+filepath.Base(s.File)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// the checksum is of the bytes we download, compressed or not
+	h := sha256.New()
+	var rd io.Reader = io.TeeReader(io.LimitReader(res.Body, maxUpdateSize+1), h)
+	if p, err := url.Parse(s.URL); err == nil && strings.HasSuffix(p.Path, ".gz") {
+		gz, err := gzip.NewReader(rd)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", s.URL, err)
+		}
+
+		// what it unpacks to is bounded too: a small file can unpack
+		// to fill the disk
+		rd = io.LimitReader(gz, maxUpdateSize+1)
+	}
+
+	n, err := io.Copy(tmp, rd)
+	if err == nil && n > maxUpdateSize {
+		return false, fmt.Errorf("%s: larger than %d bytes", s.URL, maxUpdateSize)
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", s.URL, err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	want, err := u.checksum(ctx, s)
+	if err != nil {
+		return false, err
+	}
+	if len(want) > 0 && !strings.EqualFold(want, sum) {
+		return false, fmt.Errorf("%s: sha256 %s, want %s", s.URL, sum, want)
+	}
+	if sum == s.st.SHA256 {
+		return false, nil
+	}
+
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	if err = s.check(tmp.Name()); err != nil {
+		return false, err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, err
+	}
+	if err = os.Rename(tmp.Name(), s.File); err != nil {
+		return false, err
+	}
+
+	s.st.SHA256, s.st.Size = sum, n
+	if err = s.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Return the sha256 a download of 's' must have; empty if any will do
+func (u *updater) checksum(ctx context.Context, s *updateSource) (string, error) {
+	if len(s.SHA256) > 0 || len(s.SumURL) == 0 {
+		return s.SHA256, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.SumURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := u.clt.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", s.SumURL, res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", s.SumURL, err)
+	}
+
+	// "sha256sum" format: the sum and then the file name
+	v := strings.Fields(string(b))
+	if len(v) == 0 || !isSHA256(v[0]) {
+		return "", fmt.Errorf("%s: no sha256 sum", s.SumURL)
+	}
+	return v[0], nil
+}
+
+// Return true if 's' is a hex sha256 sum
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Admin API for the updates:
+//
+//	GET  /updates              status of each source
+//	POST /updates[?file=F]     download the source of F (or all) now
+func (u *updater) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var v []updateStatus
+		for _, s := range u.srcs {
+			s.mu.Lock()
+			v = append(v, s.st)
+			s.mu.Unlock()
+		}
+		writeJSON(w, v)
+
+	case "POST":
+		f := r.URL.Query().Get("file")
+		v := u.Update(f)
+		if len(v) == 0 {
+			http.Error(w, fmt.Sprintf("no source for %q", f), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, v)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,335 @@
+// upstream.go -- SOCKSv5 client for chaining to an upstream proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// An upstream SOCKSv5 proxy
+type socks5Client struct {
+	addr string // host:port of upstream
+	user string
+	pass string
+
+	dialer *net.Dialer
+}
+
+// Make a new upstream client from a URL of the form
+// socks5://[user:pass@]host:port
+func newSocks5Client(s string, d *net.Dialer) (*socks5Client, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", s, err)
+	}
+
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("upstream %s: unsupported scheme %q", s, u.Scheme)
+	}
+
+	if len(u.Port()) == 0 {
+		return nil, fmt.Errorf("upstream %s: missing port", s)
+	}
+
+	c := &socks5Client{
+		addr:   u.Host,
+		dialer: d,
+	}
+
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.pass, _ = u.User.Password()
+		if len(c.user) > 255 || len(c.pass) > 255 {
+			return nil, fmt.Errorf("upstream %s: username/password too long", s)
+		}
+	}
+	return c, nil
+}
+
+func (c *socks5Client) String() string {
+	return "socks5://" + c.addr
+}
+
+// Connect to 'addr' via the upstream proxy
+func (c *socks5Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = c.request(conn, 1, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Setup a UDP association with the upstream. Returns the control
+// connection (the association ends when it is closed) and the
+// address of the upstream's UDP relay.
+func (c *socks5Client) Associate(ctx context.Context) (net.Conn, *net.UDPAddr, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	host, port, err := c.request(conn, 3, "0.0.0.0", 0)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// An unspecified relay address means "same host as the proxy"
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		ip = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// Dial the upstream and complete method negotiation & auth
+func (c *socks5Client) connect(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dl, ok := ctx.Deadline()
+	if !ok {
+		dl = time.Now().Add(10 * time.Second)
+	}
+	conn.SetDeadline(dl)
+
+	meth := byte(0)
+	if len(c.user) > 0 {
+		meth = 2
+	}
+
+	b := make([]byte, 0, 515)
+	b = append(b, 5, 1, meth)
+	if _, err = conn.Write(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, b[:2]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if b[0] != 5 || b[1] != meth {
+		conn.Close()
+		return nil, fmt.Errorf("%s: no acceptable auth method", c)
+	}
+
+	if meth == 2 {
+		// RFC 1929 username/password
+		b = b[:0]
+		b = append(b, 1, byte(len(c.user)))
+		b = append(b, c.user...)
+		b = append(b, byte(len(c.pass)))
+		b = append(b, c.pass...)
+		if _, err = conn.Write(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if _, err = io.ReadFull(conn, b[:2]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if b[1] != 0 {
+			conn.Close()
+			return nil, fmt.Errorf("%s: authentication failed", c)
+		}
+	}
+	return conn, nil
+}
+
+// Send a request 'cmd' for host:port and return the bound address
+// from the reply.
+func (c *socks5Client) request(conn net.Conn, cmd byte, host string, port int) (string, int, error) {
+	b := []byte{5, cmd, 0}
+	a, err := socksAddr(host, port)
+	if err != nil {
+		return "", 0, err
+	}
+
+	b = append(b, a...)
+	if _, err = conn.Write(b); err != nil {
+		return "", 0, err
+	}
+
+	// reply: VER REP RSV ATYP; then a variable length address
+	var h [4]byte
+	if _, err = io.ReadFull(conn, h[:]); err != nil {
+		return "", 0, err
+	}
+
+	if h[1] != 0 {
+		return "", 0, fmt.Errorf("%s: request failed: %s", c, socksReplyText(h[1]))
+	}
+
+	var n int
+	switch h[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		var l [1]byte
+		if _, err = io.ReadFull(conn, l[:]); err != nil {
+			return "", 0, err
+		}
+		n = int(l[0])
+	default:
+		return "", 0, fmt.Errorf("%s: bad address type %d in reply", c, h[3])
+	}
+
+	r := make([]byte, n+2)
+	if _, err = io.ReadFull(conn, r); err != nil {
+		return "", 0, err
+	}
+
+	var bnd string
+	if h[3] == 3 {
+		bnd = string(r[:n])
+	} else {
+		bnd = net.IP(r[:n]).String()
+	}
+	return bnd, int(binary.BigEndian.Uint16(r[n:])), nil
+}
+
+// Encode host:port as a SOCKSv5 ATYP, DST.ADDR, DST.PORT tuple
+func socksAddr(host string, port int) ([]byte, error) {
+	var b []byte
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, 1)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 4)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname too long: %s", host)
+		}
+		b = append(b, 3, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// Decode a SOCKSv5 ATYP, ADDR, PORT tuple from 'b'. Returns the host,
+// port and number of bytes consumed.
+func parseSocksAddr(b []byte) (string, int, int, error) {
+	if len(b) < 1 {
+		return "", 0, 0, errShortAddr
+	}
+
+	var host string
+	var n int
+
+	switch b[0] {
+	case 1:
+		if len(b) < 1+4+2 {
+			return "", 0, 0, errShortAddr
+		}
+		host = net.IP(b[1:5]).String()
+		n = 5
+
+	case 4:
+		if len(b) < 1+16+2 {
+			return "", 0, 0, errShortAddr
+		}
+		host = net.IP(b[1:17]).String()
+		n = 17
+
+	case 3:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return "", 0, 0, errShortAddr
+		}
+		if b[1] == 0 {
+			return "", 0, 0, errBadHost
+		}
+		host = string(b[2 : 2+int(b[1])])
+		n = 2 + int(b[1])
+
+	default:
+		return "", 0, 0, errAddrType
+	}
+
+	port := int(binary.BigEndian.Uint16(b[n:]))
+	return host, port, n + 2, nil
+}
+
+var (
+	errShortAddr = errors.New("insufficient data for address")
+	errAddrType  = errors.New("unknown address type")
+	errBadHost   = errors.New("empty host name")
+)
+
+// Split host:port into host and an integer port
+func splitHostPort(addr string) (string, int, error) {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %s", addr)
+	}
+	return h, port, nil
+}
+
+// Human readable SOCKSv5 reply code
+func socksReplyText(r byte) string {
+	switch r {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("error %d", r)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
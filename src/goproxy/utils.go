@@ -12,6 +12,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -40,32 +43,180 @@ func format(t time.Duration) string {
 	return fmt.Sprintf("%d.%3.3d ms", ma, mf)
 }
 
-// Return true if the new connection 'conn' passes the ACL checks
-// Return false otherwise
-func AclOK(cfg *ListenConf, conn net.Conn) bool {
-	h, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		//p.log.Debug("%s can't extract TCP Addr", conn.RemoteAddr().String())
-		return false
+// Parse a byte count with an optional K, M, G or T suffix
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	var mult int64 = 1
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult = 1 << 10
+	case 'm', 'M':
+		mult = 1 << 20
+	case 'g', 'G':
+		mult = 1 << 30
+	case 't', 'T':
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
 	}
 
-	for _, n := range cfg.Deny {
-		if n.Contains(h.IP) {
-			return false
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * mult, nil
+}
+
+// Format a byte count with the largest K, M, G or T suffix that
+// divides it
+func humanSize(n int64) string {
+	for _, x := range []struct {
+		sfx  string
+		mult int64
+	}{
+		{"T", 1 << 40},
+		{"G", 1 << 30},
+		{"M", 1 << 20},
+		{"K", 1 << 10},
+	} {
+		if n >= x.mult && n%x.mult == 0 {
+			return fmt.Sprintf("%d%s", n/x.mult, x.sfx)
 		}
 	}
+	return fmt.Sprintf("%d", n)
+}
 
-	if len(cfg.Allow) == 0 {
+// Parse a duration string or a bare number of seconds
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	if n, err := strconv.Atoi(s); err == nil {
+		s = fmt.Sprintf("%ds", n)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// Return the log prefix for a listener of type 'typ': its name and
+// tags if it has a name; else the type and listen address.
+func logName(typ string, lc *ListenConf, ln net.Listener) string {
+	if len(lc.Name) == 0 {
+		return typ + "-" + ln.Addr().String()
+	}
+
+	if len(lc.Tags) == 0 {
+		return lc.Name
+	}
+
+	v := make([]string, 0, len(lc.Tags))
+	for k, t := range lc.Tags {
+		v = append(v, k+"="+t)
+	}
+	sort.Strings(v)
+	return lc.Name + "[" + strings.Join(v, ",") + "]"
+}
+
+// Most ports a single listen address may expand to
+const maxListenPorts = 1024
+
+// Expand a listen address of the form host:ports to a list of
+// host:port addresses; ports is a comma separated list of ports or
+// port ranges, e.g. "0.0.0.0:3128-3131,8080".
+func listenAddrs(addr string) ([]string, error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var v []string
+	for _, r := range strings.Split(ports, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i > 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+
+		a, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil || a < 1 || a > 65535 {
+			return nil, fmt.Errorf("invalid port %q", lo)
+		}
+		b, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil || b < a || b > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", r)
+		}
+
+		if len(v)+b-a+1 > maxListenPorts {
+			return nil, fmt.Errorf("more than %d ports in %s", maxListenPorts, addr)
+		}
+		for p := a; p <= b; p++ {
+			v = append(v, net.JoinHostPort(host, strconv.Itoa(p)))
+		}
+	}
+	return v, nil
+}
+
+// Return the host part of a "host:port" address
+func hostOnly(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+// Return true if the host of host:port 'addr' is on loopback
+func loopbackAddr(addr string) bool {
+	h, _, _ := net.SplitHostPort(addr)
+	if h == "localhost" {
 		return true
 	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
 
-	for _, n := range cfg.Allow {
-		if n.Contains(h.IP) {
+// Return the domains in 'dv' in the form domainMatch wants; ".de" is
+// the same as "de"
+func domainList(dv []string) []string {
+	var r []string
+	for _, d := range dv {
+		d = strings.TrimSuffix(strings.ToLower(d), ".")
+		r = append(r, strings.TrimPrefix(d, "."))
+	}
+	return r
+}
+
+// Return true if 'host' is one of the domains in 'dv' (per domainList)
+// or a subdomain of one
+func domainMatch(dv []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range dv {
+		if host == d || strings.HasSuffix(host, "."+d) {
 			return true
 		}
 	}
-
 	return false
 }
 
+// Return true if the new connection 'conn' passes the ACL checks
+// Return false otherwise; and the rule that decided, which counts it
+func AclOK(acl *listenerACL, conn net.Conn) (bool, *aclRule) {
+	h, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		//p.log.Debug("%s can't extract TCP Addr", conn.RemoteAddr().String())
+		return false, nil
+	}
+	return acl.Decide(h.IP)
+}
+
 // vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,1034 @@
+// validate.go -- config defaults and validation
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Defaults for unset config values
+const (
+	defaultLog      = "STDERR"
+	defaultLogLevel = "INFO"
+
+	defaultRateGlobal  = 2000 // conns/sec per listener
+	defaultRatePerHost = 30   // conns/sec per client IP
+)
+
+var defaultTimeouts = TimeoutConf{
+	Dial:         duration(5 * time.Second),
+	Read:         duration(10 * time.Second),
+	Write:        duration(15 * time.Second),
+	TLSHandshake: duration(8 * time.Second),
+	Idle:         duration(60 * time.Second),
+	Handshake:    duration(10 * time.Second),
+}
+
+// Fill in unset values with their defaults
+func (c *Conf) setDefaults() {
+	if len(c.Logging) == 0 {
+		c.Logging = defaultLog
+	}
+	if len(c.LogLevel) == 0 {
+		c.LogLevel = defaultLogLevel
+	}
+
+	c.Timeouts.inherit(&defaultTimeouts)
+	for _, v := range c.listeners() {
+		for i := range v {
+			if p, ok := c.Policies[v[i].Policy]; ok {
+				v[i].usePolicy(&p)
+			}
+			v[i].setDefaults()
+			v[i].Timeouts.inherit(&c.Timeouts)
+		}
+	}
+}
+
+// Fill the unset timeouts of 't' from 'from'
+func (t *TimeoutConf) inherit(from *TimeoutConf) {
+	set := func(d *duration, v duration) {
+		if *d == 0 {
+			*d = v
+		}
+	}
+
+	set(&t.Dial, from.Dial)
+	set(&t.Read, from.Read)
+	set(&t.Write, from.Write)
+	set(&t.Session, from.Session)
+	set(&t.TLSHandshake, from.TLSHandshake)
+	set(&t.Idle, from.Idle)
+	set(&t.Handshake, from.Handshake)
+	set(&t.ClientIdle, from.ClientIdle)
+	set(&t.UpstreamIdle, from.UpstreamIdle)
+}
+
+func (lc *ListenConf) setDefaults() {
+	if lc.Ratelimit.Global == 0 {
+		lc.Ratelimit.Global = defaultRateGlobal
+	}
+	// the clients of a transport all come from loopback
+	if lc.Ratelimit.PerHost == 0 && len(lc.Transport.Exec) == 0 {
+		lc.Ratelimit.PerHost = defaultRatePerHost
+	}
+}
+
+// A problem in the config file; line is 0 if it can't be located
+type confError struct {
+	line int
+	path string
+	msg  string
+}
+
+// All the problems in a config file
+type confErrors struct {
+	file string
+	errs []confError
+}
+
+func (e *confErrors) Error() string {
+	v := make([]string, 0, len(e.errs)+1)
+	v = append(v, fmt.Sprintf("%s: %d problem(s)", e.file, len(e.errs)))
+	for _, x := range e.errs {
+		v = append(v, "  "+x.in(e.file))
+	}
+	return strings.Join(v, "\n")
+}
+
+func (x *confError) in(file string) string {
+	if x.line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", file, x.line, x.path, x.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", file, x.path, x.msg)
+}
+
+// Validate 'c' parsed from the YAML text 'src' of file 'fn'. Returns a
+// *confErrors listing every problem or nil; the warnings are left in
+// c.warns.
+func (c *Conf) validate(fn string, src []byte) error {
+	v := &validator{
+		idx: newYAMLIndex(src),
+	}
+
+	v.conf(c)
+	for i := range v.warns {
+		c.warns = append(c.warns, v.warns[i].in(fn))
+	}
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &confErrors{file: fn, errs: v.errs}
+}
+
+// A path to a config value: a sequence of map keys and list indices
+type confPath []interface{}
+
+func (p confPath) key(k string) confPath {
+	return append(p[:len(p):len(p)], k)
+}
+
+func (p confPath) idx(i int) confPath {
+	return append(p[:len(p):len(p)], i)
+}
+
+func (p confPath) String() string {
+	var s string
+	for _, x := range p {
+		switch x := x.(type) {
+		case string:
+			if len(s) > 0 {
+				s += "."
+			}
+			s += x
+		case int:
+			s += fmt.Sprintf("[%d]", x)
+		}
+	}
+	return s
+}
+
+type validator struct {
+	idx   *yamlIndex
+	errs  []confError
+	warns []confError
+}
+
+func (v *validator) errorf(p confPath, f string, args ...interface{}) {
+	v.errs = append(v.errs, confError{
+		line: v.idx.line(p),
+		path: p.String(),
+		msg:  fmt.Sprintf(f, args...),
+	})
+}
+
+// Note something that works but likely isn't what was meant
+func (v *validator) warnf(p confPath, f string, args ...interface{}) {
+	v.warns = append(v.warns, confError{
+		line: v.idx.line(p),
+		path: p.String(),
+		msg:  fmt.Sprintf(f, args...),
+	})
+}
+
+func (v *validator) rotate(p confPath, r *RotateConf) {
+	v.nonneg(p.key("keep"), r.Keep)
+	if r.External && r.MaxSize > 0 {
+		v.errorf(p, "maxsize can't be set for an externally rotated file")
+	}
+}
+
+// Check that 'n' is not negative
+func (v *validator) nonneg(p confPath, n interface{}) {
+	switch n := n.(type) {
+	case int:
+		if n < 0 {
+			v.errorf(p, "must not be negative (%d)", n)
+		}
+	case duration:
+		if n < 0 {
+			v.errorf(p, "must not be negative (%s)", time.Duration(n))
+		}
+	case size:
+		if n < 0 {
+			v.errorf(p, "must not be negative (%d)", n)
+		}
+	}
+}
+
+func (v *validator) timeouts(p confPath, t *TimeoutConf) {
+	v.nonneg(p.key("dial"), t.Dial)
+	v.nonneg(p.key("read"), t.Read)
+	v.nonneg(p.key("write"), t.Write)
+	v.nonneg(p.key("session"), t.Session)
+	v.nonneg(p.key("tlshandshake"), t.TLSHandshake)
+	v.nonneg(p.key("idle"), t.Idle)
+	v.nonneg(p.key("handshake"), t.Handshake)
+	v.nonneg(p.key("clientidle"), t.ClientIdle)
+	v.nonneg(p.key("upstreamidle"), t.UpstreamIdle)
+}
+
+// Check that 's' is a host:port with a valid port
+func (v *validator) hostPort(p confPath, s string) {
+	if len(s) == 0 {
+		v.errorf(p, "address is empty")
+		return
+	}
+
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		v.errorf(p, "%s", err)
+		return
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.errorf(p, "invalid port %q", port)
+	}
+}
+
+// Check a listen address that may have several ports; returns the
+// expanded addresses.
+func (v *validator) listen(p confPath, s string) []string {
+	if len(s) == 0 {
+		v.errorf(p, "address is empty")
+		return nil
+	}
+
+	a, err := listenAddrs(s)
+	if err != nil {
+		v.errorf(p, "%s", err)
+	}
+	return a
+}
+
+func (v *validator) conf(c *Conf) {
+	var root confPath
+
+	if _, ok := L.ToPriority(c.LogLevel); !ok {
+		v.errorf(root.key("loglevel"), "invalid log level %q", c.LogLevel)
+	}
+
+	v.nonneg(root.key("maxdestconns"), c.MaxDestConns)
+	v.nonneg(root.key("max_buffer_mem"), c.MaxBufferMem)
+	v.nonneg(root.key("max_conns"), c.MaxConns)
+	v.nonneg(root.key("rlimit_nofile"), c.RlimitNofile)
+
+	if len(c.Admin.Listen) > 0 {
+		p := root.key("admin")
+		v.hostPort(p.key("listen"), c.Admin.Listen)
+
+		// anyone who can reach it can ban, kill and reload
+		if len(c.Admin.Tokens) == 0 && !loopbackAddr(c.Admin.Listen) {
+			v.errorf(p.key("listen"), "%s: must be on loopback without tokens", c.Admin.Listen)
+		}
+		for who, tok := range c.Admin.Tokens {
+			if len(tok) < 16 {
+				v.errorf(p.key("tokens").key(who), "token is shorter than 16 characters")
+			}
+		}
+	}
+
+	p := root.key("categories")
+	if len(c.Categories.File) > 0 && len(c.Categories.URL) > 0 {
+		v.errorf(p, "only one of file or url can be set")
+	}
+	v.nonneg(p.key("cachettl"), c.Categories.CacheTTL)
+
+	v.timeouts(root.key("timeouts"), &c.Timeouts)
+
+	v.rotate(root.key("logrotate"), &c.LogRotate)
+	v.rotate(root.key("urllogrotate"), &c.URLLogRotate)
+
+	v.nonneg(root.key("logsample").key("interval"), c.LogSample.Interval)
+	for k, n := range c.LogSample.Classes {
+		v.nonneg(root.key("logsample").key("classes").key(k), n)
+	}
+
+	if len(c.AuditLog) > 0 && !filepath.IsAbs(c.AuditLog) {
+		v.errorf(root.key("auditlog"), "%q is not an absolute path", c.AuditLog)
+	}
+
+	if len(c.GC.GOGC) > 0 {
+		if _, err := parseGOGC(c.GC.GOGC); err != nil {
+			v.errorf(root.key("gc").key("gogc"), "%s", err)
+		}
+	}
+
+	p = root.key("overload")
+	v.nonneg(p.key("goroutines"), c.Overload.Goroutines)
+	v.nonneg(p.key("latency"), c.Overload.Latency)
+	v.nonneg(p.key("clientconns"), c.Overload.ClientConns)
+
+	if len(c.IPFIX.Collector) > 0 {
+		v.hostPort(root.key("ipfix").key("collector"), c.IPFIX.Collector)
+	}
+
+	for i := range c.LogShip {
+		v.logShip(root.key("logship").idx(i), &c.LogShip[i])
+	}
+
+	v.updates(root.key("updates"), c)
+	v.ha(root.key("ha"), &c.HA)
+
+	v.gossip(root.key("gossip"), &c.Gossip)
+	v.opa(root.key("opa"), &c.OPA)
+
+	p = root.key("cluster")
+	if len(c.Cluster.Redis) > 0 {
+		v.hostPort(p.key("redis"), c.Cluster.Redis)
+	}
+	v.nonneg(p.key("db"), c.Cluster.DB)
+	v.nonneg(p.key("timeout"), c.Cluster.Timeout)
+	v.nonneg(p.key("sync"), c.Cluster.Sync)
+	v.resolver(root.key("resolver"), &c.Resolver)
+	v.alerts(root.key("alerts"), &c.Alerts)
+	v.knock(root.key("knock"), &c.Knock)
+	v.auth(root.key("auth"), &c.Auth)
+	if c.Auth.Shared && len(c.Cluster.Redis) == 0 {
+		v.errorf(root.key("auth").key("shared"), "there is no cluster redis")
+	}
+
+	for name, t := range c.Tenants {
+		v.tenant(root.key("tenants").key(name), &t)
+	}
+
+	for name, pc := range c.Policies {
+		v.policy(root.key("policies").key(name), &pc)
+	}
+
+	seen := make(map[string]confPath)
+	names := make(map[string]confPath)
+	for _, x := range []struct {
+		name string
+		lc   []ListenConf
+	}{
+		{"http", c.Http},
+		{"socks", c.Socks},
+		{"trojan", c.Trojan},
+		{"vless", c.Vless},
+	} {
+		for i := range x.lc {
+			lc := &x.lc[i]
+			p := root.key(x.name).idx(i)
+
+			v.listener(p, lc)
+			if x.name == "http" && lc.Sniff {
+				v.errorf(p.key("sniff"), "HTTP listeners can't sniff; a SOCKS listener can serve HTTP instead")
+			}
+			if x.name != "http" && lc.TLS != (TLSConf{}) {
+				v.errorf(p.key("tls"), "only HTTP listeners can use this")
+			}
+			if x.name != "http" && !lc.Sniff {
+				v.httpOnly(p, lc)
+			}
+			if x.name == "http" && len(lc.Resolve) > 0 {
+				v.errorf(p.key("resolve"), "HTTP listeners can't use this")
+			}
+			if x.name == "trojan" {
+				v.trojan(p.key("trojan"), &lc.Trojan)
+			} else if !reflect.DeepEqual(lc.Trojan, TrojanConf{}) {
+				v.errorf(p.key("trojan"), "only trojan listeners can use this")
+			}
+			if x.name == "vless" {
+				v.vless(p.key("vless"), &lc.Vless)
+			} else if !reflect.DeepEqual(lc.Vless, VlessConf{}) {
+				v.errorf(p.key("vless"), "only vless listeners can use this")
+			}
+			if len(lc.Routes) > 0 && len(c.GeoIP.File) == 0 {
+				v.errorf(p.key("routes"), "there is no geoip DB")
+			}
+			if lc.Knock && len(c.Knock.Listen) == 0 {
+				v.errorf(p.key("knock"), "there is no knock gate to open it")
+			}
+			if lc.Auth && (x.name == "trojan" || x.name == "vless") {
+				v.errorf(p.key("auth"), "%s listeners have their own passwords or users", x.name)
+			} else if lc.Auth && len(c.Auth.Users) == 0 && len(c.Auth.URL) == 0 {
+				v.errorf(p.key("auth"), "there are no users file or auth backend")
+			}
+			if lc.OPA && len(c.OPA.URL) == 0 {
+				v.errorf(p.key("opa"), "there is no policy agent to ask")
+			}
+			addrs := v.listen(p.key("listen"), lc.Listen)
+			if len(lc.Transport.Exec) > 0 && len(addrs) > 1 {
+				v.errorf(p.key("transport"), "the listener must have a single address")
+			}
+			if len(lc.Transport.Exec) > 0 {
+				v.transported(p, lc, &c.Auth.Lockout, addrs)
+			}
+			for _, a := range addrs {
+				if o, ok := seen[a]; ok {
+					v.errorf(p.key("listen"), "%s is also used by %s", a, o)
+					break
+				}
+				seen[a] = p
+			}
+			v.tenants(p, lc, c.Tenants, addrs)
+
+			if _, ok := c.Policies[lc.Policy]; !ok && len(lc.Policy) > 0 {
+				v.errorf(p.key("policy"), "unknown policy %q", lc.Policy)
+			}
+
+			if o, ok := names[lc.Name]; ok && len(lc.Name) > 0 {
+				v.errorf(p.key("name"), "%s is also the name of %s", lc.Name, o)
+			}
+			names[lc.Name] = p
+		}
+	}
+}
+
+func (v *validator) logShip(p confPath, c *LogShipConf) {
+	if !filepath.IsAbs(c.File) {
+		v.errorf(p.key("file"), "%q is not an absolute path", c.File)
+	}
+	if !strings.HasPrefix(c.URL, "https://") && !strings.HasPrefix(c.URL, "http://") {
+		v.errorf(p.key("url"), "%q is not a http(s) URL", c.URL)
+	}
+	switch c.Format {
+	case "", shipLoki, shipNDJSON:
+	default:
+		v.errorf(p.key("format"), "unknown format %q", c.Format)
+	}
+	if len(c.Spool) > 0 && !filepath.IsAbs(c.Spool) {
+		v.errorf(p.key("spool"), "%q is not an absolute path", c.Spool)
+	}
+	v.nonneg(p.key("batch"), c.Batch)
+	v.nonneg(p.key("interval"), c.Interval)
+}
+
+func (v *validator) updates(p confPath, c *Conf) {
+	v.nonneg(p.key("interval"), c.Updates.Interval)
+
+	files := map[string]bool{c.GeoIP.File: true, c.Categories.File: true}
+	for _, fn := range c.Blocklist {
+		files[fn] = true
+	}
+	for i := range c.Updates.Sources {
+		s := &c.Updates.Sources[i]
+		q := p.key("sources").idx(i)
+		if !strings.HasPrefix(s.URL, "https://") && !strings.HasPrefix(s.URL, "http://") {
+			v.errorf(q.key("url"), "%q is not a http(s) URL", s.URL)
+		}
+		if len(s.File) == 0 || !files[s.File] {
+			v.errorf(q.key("file"), "%q is not the geoip, a blocklist or the categories file", s.File)
+		}
+		if len(s.SHA256) > 0 && !isSHA256(s.SHA256) {
+			v.errorf(q.key("sha256"), "%q is not a sha256 sum", s.SHA256)
+		}
+		if len(s.SumURL) > 0 && !strings.HasPrefix(s.SumURL, "https://") && !strings.HasPrefix(s.SumURL, "http://") {
+			v.errorf(q.key("sumurl"), "%q is not a http(s) URL", s.SumURL)
+		}
+	}
+}
+
+func (v *validator) ha(p confPath, h *HAConf) {
+	switch h.State {
+	case "", haPrimary, haStandby:
+	default:
+		v.errorf(p.key("state"), "must be primary or standby, not %q", h.State)
+	}
+	if len(h.Peer) > 0 {
+		v.hostPort(p.key("peer"), h.Peer)
+	}
+	v.nonneg(p.key("interval"), h.Interval)
+	v.nonneg(p.key("failures"), h.Failures)
+	if len(h.Takeover) > 0 && !filepath.IsAbs(h.Takeover) {
+		v.errorf(p.key("takeover"), "%q is not an absolute path", h.Takeover)
+	}
+	if len(h.Release) > 0 && !filepath.IsAbs(h.Release) {
+		v.errorf(p.key("release"), "%q is not an absolute path", h.Release)
+	}
+}
+
+func (v *validator) gossip(p confPath, g *GossipConf) {
+	if len(g.Listen) == 0 {
+		return
+	}
+	v.hostPort(p.key("listen"), g.Listen)
+	for i, s := range g.Peers {
+		v.hostPort(p.key("peers").idx(i), s)
+	}
+	if len(g.Key) < 16 {
+		v.errorf(p.key("key"), "must be at least 16 characters")
+	}
+	v.nonneg(p.key("interval"), g.Interval)
+	v.nonneg(p.key("window"), g.Window)
+}
+
+func (v *validator) opa(p confPath, o *OPAConf) {
+	if len(o.URL) > 0 && !strings.HasPrefix(o.URL, "https://") && !strings.HasPrefix(o.URL, "http://") {
+		v.errorf(p.key("url"), "%q is not a http(s) URL", o.URL)
+	}
+	v.nonneg(p.key("timeout"), o.Timeout)
+}
+
+func (v *validator) quota(p confPath, q *QuotaConf) {
+	v.nonneg(p.key("bytes"), q.Bytes)
+	switch q.Period {
+	case "", quotaDay, quotaMonth:
+	default:
+		v.errorf(p.key("period"), "must be day or month, not %q", q.Period)
+	}
+	for i, x := range q.Alerts {
+		if x <= 0 {
+			v.errorf(p.key("alerts").idx(i), "must be a positive percentage (%d)", x)
+		}
+	}
+}
+
+func (v *validator) knock(p confPath, k *KnockConf) {
+	if len(k.Listen) == 0 {
+		return
+	}
+	v.hostPort(p.key("listen"), k.Listen)
+	if len(k.Key) < 16 {
+		v.errorf(p.key("key"), "must be at least 16 characters")
+	}
+	v.nonneg(p.key("ttl"), k.TTL)
+	v.nonneg(p.key("window"), k.Window)
+}
+
+func (v *validator) auth(p confPath, a *AuthConf) {
+	if len(a.Users) > 0 && !filepath.IsAbs(a.Users) {
+		v.errorf(p.key("users"), "%q is not an absolute path", a.Users)
+	}
+	if len(a.URL) > 0 && !strings.HasPrefix(a.URL, "https://") && !strings.HasPrefix(a.URL, "http://") {
+		v.errorf(p.key("url"), "%q is not a http(s) URL", a.URL)
+	}
+	v.nonneg(p.key("timeout"), a.Timeout)
+	v.nonneg(p.key("session"), a.Session)
+	v.nonneg(p.key("negative"), a.Negative)
+
+	for u, s := range a.TOTP {
+		if _, err := parseTOTPSecret(s); err != nil {
+			v.errorf(p.key("totp").key(u), "%s", err)
+		}
+	}
+
+	v.quota(p.key("quota"), &a.Quota)
+
+	lo := &a.Lockout
+	p = p.key("lockout")
+	v.nonneg(p.key("delay"), lo.Delay)
+	v.nonneg(p.key("maxdelay"), lo.MaxDelay)
+	v.nonneg(p.key("failures"), lo.Failures)
+	v.nonneg(p.key("window"), lo.Window)
+	v.nonneg(p.key("ban"), lo.Ban)
+}
+
+func (v *validator) transport(p confPath, t *TransportConf) {
+	if reflect.DeepEqual(*t, TransportConf{}) {
+		return
+	}
+	if len(t.Exec) == 0 {
+		v.errorf(p.key("exec"), "the transport's program must be set")
+	}
+	if len(t.Name) == 0 || strings.ContainsAny(t.Name, " ,-") {
+		v.errorf(p.key("name"), "%q is not a transport name", t.Name)
+	}
+	if len(t.State) == 0 {
+		v.errorf(p.key("state"), "the transport needs a state directory")
+	}
+	v.hostPort(p.key("listen"), t.Listen)
+}
+
+// The clients of a listener behind a transport all come from loopback:
+// what acts on a client address would act on every one of them. The
+// listener itself must not be reachable but through the transport.
+func (v *validator) transported(p confPath, lc *ListenConf, lo *LockoutConf, addrs []string) {
+	for _, a := range addrs {
+		if !loopbackAddr(a) {
+			v.errorf(p.key("listen"), "%s: a listener behind a transport must be on loopback", a)
+		}
+	}
+	if lc.Ratelimit.PerHost > 0 {
+		v.errorf(p.key("ratelimit").key("perhost"), "the clients of a transport all come from loopback")
+	}
+	if lc.Knock {
+		v.errorf(p.key("knock"), "the clients of a transport all come from loopback")
+	}
+	if lc.Auth && (lo.Failures > 0 || lo.Delay > 0) {
+		v.errorf(p.key("auth"), "auth.lockout would lock out every client of the transport at once")
+	}
+}
+
+func (v *validator) trojan(p confPath, t *TrojanConf) {
+	if len(t.Cert) == 0 || len(t.Key) == 0 {
+		v.errorf(p, "cert and key must be set")
+	} else if len(t.Passwords) == 0 {
+		v.errorf(p.key("passwords"), "at least one password must be set")
+	} else if _, err := newTrojanServer(t); err != nil {
+		v.errorf(p, "%s", err)
+	}
+	if len(t.Fallback) > 0 {
+		v.hostPort(p.key("fallback"), t.Fallback)
+	}
+}
+
+func (v *validator) vless(p confPath, c *VlessConf) {
+	if len(c.Users) == 0 {
+		v.errorf(p.key("users"), "at least one user must be set")
+	} else if (len(c.Cert) == 0) != (len(c.Key) == 0) {
+		v.errorf(p, "cert and key must be set together")
+	} else if _, err := newVlessServer(c); err != nil {
+		v.errorf(p, "%s", err)
+	}
+	if len(c.Fallback) > 0 {
+		v.hostPort(p.key("fallback"), c.Fallback)
+	}
+}
+
+func (v *validator) alerts(p confPath, a *AlertConf) {
+	if len(a.Webhook) > 0 && !strings.HasPrefix(a.Webhook, "https://") && !strings.HasPrefix(a.Webhook, "http://") {
+		v.errorf(p.key("webhook"), "%q is not a http(s) URL", a.Webhook)
+	}
+
+	m := &a.Mail
+	if len(m.To) == 0 {
+		return
+	}
+	v.hostPort(p.key("mail").key("server"), m.Server)
+	if len(m.From) == 0 {
+		v.errorf(p.key("mail").key("from"), "sender must be set")
+	}
+}
+
+func (v *validator) tenant(p confPath, t *TenantConf) {
+	if _, err := newEgressPool(&ListenConf{Egress: t.Egress}); err != nil {
+		v.errorf(p.key("egress"), "%s", err)
+	}
+	v.nonneg(p.key("ratelimit").key("global"), t.Ratelimit.Global)
+	v.nonneg(p.key("ratelimit").key("perhost"), t.Ratelimit.PerHost)
+	v.nonneg(p.key("maxdestconns"), t.MaxDestConns)
+	v.quota(p.key("quota"), &t.Quota)
+}
+
+func (v *validator) policy(p confPath, pc *PolicyConf) {
+	v.timeouts(p.key("timeouts"), &pc.Timeouts)
+	v.nonneg(p.key("ratelimit").key("global"), pc.Ratelimit.Global)
+	v.nonneg(p.key("ratelimit").key("perhost"), pc.Ratelimit.PerHost)
+	v.nonneg(p.key("ratelimit").key("idle"), pc.Ratelimit.Idle)
+	v.protocols(p.key("denyprotocols"), pc.DenyProtocols)
+	v.schedule(p.key("schedule"), &pc.Schedule)
+}
+
+func (v *validator) chaos(p confPath, c *ChaosConf) {
+	for _, x := range []struct {
+		key string
+		pct int
+	}{{"drop", c.Drop}, {"truncate", c.Truncate}} {
+		if x.pct < 0 || x.pct > 100 {
+			v.errorf(p.key(x.key), "must be a percentage (%d)", x.pct)
+		}
+	}
+	v.nonneg(p.key("latency"), c.Latency)
+	v.nonneg(p.key("jitter"), c.Jitter)
+}
+
+func (v *validator) cassette(p confPath, c *CassetteConf) {
+	switch c.Mode {
+	case "":
+	case cassetteRecord, cassetteReplay:
+		if len(c.Dir) == 0 {
+			v.errorf(p.key("dir"), "must be set to %s", c.Mode)
+		}
+	default:
+		v.errorf(p.key("mode"), "must be record or replay, not %q", c.Mode)
+	}
+	v.nonneg(p.key("maxbody"), c.MaxBody)
+}
+
+func (v *validator) schedule(p confPath, s *ScheduleConf) {
+	if _, err := newSchedule(s); err != nil {
+		v.errorf(p, "%s", err)
+	}
+}
+
+func (v *validator) protocols(p confPath, deny []string) {
+	for i, s := range deny {
+		if !isProtoClass(s) {
+			v.errorf(p.idx(i), "unknown protocol %q; must be one of %s", s,
+				strings.Join(protoClasses, ", "))
+		}
+	}
+}
+
+// Check that the tenants of listener 'lc' on 'addrs' exist
+func (v *validator) tenants(p confPath, lc *ListenConf, tenants map[string]TenantConf, addrs []string) {
+	if _, ok := tenants[lc.Tenant]; !ok && len(lc.Tenant) > 0 {
+		v.errorf(p.key("tenant"), "unknown tenant %q", lc.Tenant)
+	}
+
+	ports := make(map[string]bool)
+	for _, a := range addrs {
+		_, port, _ := net.SplitHostPort(a)
+		ports[port] = true
+	}
+
+	for port, t := range lc.PortTenants {
+		q := p.key("porttenants").key(strconv.Itoa(port))
+		if _, ok := tenants[t]; !ok {
+			v.errorf(q, "unknown tenant %q", t)
+		}
+		if !ports[strconv.Itoa(port)] {
+			v.errorf(q, "port %d is not one of the listen ports", port)
+		}
+	}
+}
+
+func (v *validator) resolver(p confPath, r *ResolverConf) {
+	for h, a := range r.Hosts {
+		if net.ParseIP(a) == nil {
+			v.errorf(p.key("hosts").key(h), "invalid IP %q", a)
+		}
+	}
+
+	v.nonneg(p.key("negttl"), r.NegTTL)
+	v.nonneg(p.key("backoffmin"), r.BackoffMin)
+	v.nonneg(p.key("backoffmax"), r.BackoffMax)
+	if r.BackoffMax > 0 && r.BackoffMin > r.BackoffMax {
+		v.errorf(p.key("backoffmin"), "larger than backoffmax (%s > %s)",
+			time.Duration(r.BackoffMin), time.Duration(r.BackoffMax))
+	}
+
+	if len(r.ECS) > 0 {
+		if _, err := ecsOption(r.ECS); err != nil {
+			v.errorf(p.key("ecs"), "%s", err)
+		}
+	}
+
+	dflt := 0
+	for i := range r.Servers {
+		s := &r.Servers[i]
+		if _, err := newDNSServer(s); err != nil {
+			v.errorf(p.key("servers").idx(i), "%s", err)
+		}
+		if len(s.Suffix) == 0 {
+			if dflt++; dflt == 2 {
+				v.errorf(p.key("servers").idx(i), "more than one default server")
+			}
+		}
+	}
+}
+
+// Reject the settings of SOCKS listener 'lc' that only make sense for
+// HTTP
+func (v *validator) httpOnly(p confPath, lc *ListenConf) {
+	for _, x := range []struct {
+		key string
+		set bool
+	}{
+		{"cassette", len(lc.Cassette.Mode) > 0},
+		{"static", len(lc.Static) > 0},
+		{"fallback", len(lc.Fallback) > 0},
+		{"forward", !reflect.DeepEqual(lc.Forward, ForwardConf{})},
+		{"anonymity", len(lc.Anonymity) > 0},
+		{"securityheaders", !reflect.DeepEqual(lc.SecurityHeaders, SecHeaderConf{})},
+		{"flush", !reflect.DeepEqual(lc.Flush, FlushConf{})},
+	} {
+		if x.set {
+			v.errorf(p.key(x.key), "only HTTP listeners can use this")
+		}
+	}
+
+	// tunnels can be mirrored; requests only exist in HTTP
+	if len(lc.Mirror.HTTP) > 0 {
+		v.errorf(p.key("mirror").key("http"), "only HTTP listeners can use this")
+	}
+}
+
+func (v *validator) listener(p confPath, lc *ListenConf) {
+	v.timeouts(p.key("timeouts"), &lc.Timeouts)
+
+	if _, err := newEgressPool(lc); err != nil {
+		if len(lc.Bind) > 0 && len(lc.Egress.Pool) == 0 {
+			v.errorf(p.key("bind"), "%s", err)
+		} else {
+			v.errorf(p.key("egress"), "%s", err)
+		}
+	}
+	v.nonneg(p.key("egress").key("interval"), lc.Egress.Interval)
+
+	v.nonneg(p.key("keepalive").key("idle"), lc.Keepalive.Idle)
+	v.nonneg(p.key("keepalive").key("interval"), lc.Keepalive.Interval)
+	v.nonneg(p.key("keepalive").key("count"), lc.Keepalive.Count)
+
+	if len(lc.Mimefilter.Users) > 0 && !lc.Auth {
+		v.warnf(p.key("mimefilter").key("users"), "no effect without auth")
+	}
+
+	// the relay closes a tunnel once both sides are idle past their
+	// timeouts, so probes sent later never go out
+	if ka := lc.Keepalive.Idle; ka > 0 {
+		t := &lc.Timeouts
+		k, idle := "clientidle", t.ClientIdle
+		if idle == 0 {
+			k, idle = "read", t.Read
+		}
+		if t.UpstreamIdle > idle {
+			k, idle = "upstreamidle", t.UpstreamIdle
+		} else if t.UpstreamIdle == 0 && t.Read > idle {
+			k, idle = "read", t.Read
+		}
+		if ka >= idle {
+			v.warnf(p.key("keepalive").key("idle"),
+				"%s is not less than timeouts.%s %s; tunnels close before the first probe",
+				time.Duration(ka), k, time.Duration(idle))
+		}
+	}
+
+	if len(lc.External) > 0 && net.ParseIP(lc.External) == nil {
+		v.errorf(p.key("external"), "invalid IP %q", lc.External)
+	}
+
+	if _, err := parseLinger(lc.Outbound.Linger); err != nil {
+		v.errorf(p.key("outbound").key("linger"), "%s", err)
+	}
+	v.nonneg(p.key("outbound").key("idleperhost"), lc.Outbound.IdlePerHost)
+
+	if _, err := newQoSPolicy(&lc.QoS, nil); err != nil {
+		v.errorf(p.key("qos"), "%s", err)
+	}
+	if _, err := newMTUPolicy(&lc.MTU); err != nil {
+		v.errorf(p.key("mtu"), "%s", err)
+	}
+
+	for i := range lc.Routes {
+		if _, err := newRoute(&lc.Routes[i], nil); err != nil {
+			v.errorf(p.key("routes").idx(i), "%s", err)
+		}
+	}
+
+	switch lc.Resolve {
+	case "", "any", "remote":
+	default:
+		v.errorf(p.key("resolve"), "must be any or remote, not %q", lc.Resolve)
+	}
+	switch lc.DNSLeak.Action {
+	case "":
+	case "log", "block":
+		if len(lc.DNSLeak.Dest) == 0 {
+			v.errorf(p.key("dnsleak").key("dest"), "no domains to check")
+		}
+	default:
+		v.errorf(p.key("dnsleak").key("action"), "must be log or block, not %q", lc.DNSLeak.Action)
+	}
+
+	v.nonneg(p.key("ratelimit").key("global"), lc.Ratelimit.Global)
+	v.nonneg(p.key("ratelimit").key("perhost"), lc.Ratelimit.PerHost)
+	v.nonneg(p.key("ratelimit").key("idle"), lc.Ratelimit.Idle)
+
+	v.protocols(p.key("denyprotocols"), lc.DenyProtocols)
+	v.protocols(p.key("shadow").key("denyprotocols"), lc.Shadow.DenyProtocols)
+	v.quota(p.key("quota"), &lc.Quota)
+	v.schedule(p.key("schedule"), &lc.Schedule)
+	v.chaos(p.key("chaos"), &lc.Chaos)
+	v.cassette(p.key("cassette"), &lc.Cassette)
+
+	if _, err := newStaticRules(lc.Static); err != nil {
+		v.errorf(p.key("static"), "%s", err)
+	}
+	if (len(lc.TLS.Cert) == 0) != (len(lc.TLS.Key) == 0) {
+		v.errorf(p.key("tls"), "cert and key must be set together")
+	} else if _, err := newListenerTLS(&lc.TLS); err != nil {
+		v.errorf(p.key("tls"), "%s", err)
+	}
+	if _, err := newWebFallback(lc.Fallback, nil); err != nil {
+		v.errorf(p.key("fallback"), "%s", err)
+	}
+	if _, err := newMirror(&lc.Mirror, nil); err != nil {
+		v.errorf(p.key("mirror"), "%s", err)
+	}
+	v.nonneg(p.key("mirror").key("maxbody"), lc.Mirror.MaxBody)
+	v.transport(p.key("transport"), &lc.Transport)
+
+	if _, err := newFlushPolicy(&lc.Flush); err != nil {
+		v.errorf(p.key("flush"), "%s", err)
+	}
+	v.nonneg(p.key("flush").key("interval"), lc.Flush.Interval)
+
+	if _, ok := anonymityLevels[lc.Anonymity]; !ok && len(lc.Anonymity) > 0 {
+		v.errorf(p.key("anonymity"), "must be transparent, anonymous or elite, not %q", lc.Anonymity)
+	} else if _, err := newForwardPolicy(&lc.Forward, lc.Anonymity); err != nil {
+		v.errorf(p.key("forward"), "%s", err)
+	}
+
+	switch lc.Safesearch.Youtube {
+	case "", "strict", "moderate":
+	default:
+		v.errorf(p.key("safesearch").key("youtube"), "must be strict or moderate, not %q", lc.Safesearch.Youtube)
+	}
+
+	if len(lc.Upstream) > 0 {
+		if _, err := newSocks5Client(lc.Upstream, nil); err != nil {
+			v.errorf(p.key("upstream"), "%s", err)
+		}
+	}
+	for i, s := range lc.Upstreams {
+		if _, err := newSocks5Client(s, nil); err != nil {
+			v.errorf(p.key("upstreams").idx(i), "%s", err)
+		}
+	}
+
+	v.nonneg(p.key("probe").key("interval"), lc.Probe.Interval)
+	if h := lc.Probe.Hysteresis; h < 0 || h > 100 {
+		v.errorf(p.key("probe").key("hysteresis"), "must be a percentage (%d)", h)
+	}
+	v.nonneg(p.key("sticky").key("ttl"), lc.Sticky.TTL)
+
+	if _, err := parseFamily(lc.Prefer); err != nil {
+		v.errorf(p.key("prefer"), "%s", err)
+	}
+	for i := range lc.PreferRules {
+		if _, err := parseFamily(lc.PreferRules[i].Prefer); err != nil {
+			v.errorf(p.key("preferrules").idx(i).key("prefer"), "%s", err)
+		}
+	}
+}
+
+// yamlIndex finds the line of a config value in block style YAML
+// text; it is good enough to point at the offending line in error
+// messages, but is not a YAML parser.
+type yamlIndex struct {
+	toks []yamlTok
+}
+
+// A key or list item; a "- key: val" line is two tokens
+type yamlTok struct {
+	line   int
+	indent int
+	dash   bool
+	key    string
+}
+
+func newYAMLIndex(src []byte) *yamlIndex {
+	y := &yamlIndex{}
+	for i, s := range strings.Split(string(src), "\n") {
+		t := strings.TrimLeft(s, " ")
+		n := len(s) - len(t)
+		if len(t) == 0 || t[0] == '#' {
+			continue
+		}
+
+		for t == "-" || strings.HasPrefix(t, "- ") {
+			y.toks = append(y.toks, yamlTok{line: i + 1, indent: n, dash: true})
+			r := strings.TrimLeft(t[1:], " ")
+			n += len(t) - len(r)
+			t = r
+		}
+
+		if j := strings.Index(t, ":"); j > 0 {
+			k := strings.Trim(t[:j], `"' `)
+			y.toks = append(y.toks, yamlTok{line: i + 1, indent: n, key: k})
+		}
+	}
+	return y
+}
+
+// Return the line of 'p' or the nearest enclosing value we can find;
+// 0 if nothing matches.
+func (y *yamlIndex) line(p confPath) int {
+	line := 0
+	lo, hi, indent := 0, len(y.toks), -1
+
+	for _, x := range p {
+		// the indent of this level is that of its first token
+		if lo >= hi || y.toks[lo].indent <= indent {
+			break
+		}
+		lvl := y.toks[lo].indent
+
+		found := -1
+		nth := 0
+		for i := lo; i < hi; i++ {
+			t := &y.toks[i]
+			if t.indent != lvl {
+				continue
+			}
+
+			switch x := x.(type) {
+			case string:
+				if !t.dash && t.key == x {
+					found = i
+				}
+			case int:
+				if t.dash {
+					if nth == x {
+						found = i
+					}
+					nth++
+				}
+			}
+			if found >= 0 {
+				break
+			}
+		}
+
+		if found < 0 {
+			break
+		}
+
+		// children are the tokens after 'found' that are indented more
+		line = y.toks[found].line
+		indent = lvl
+		lo = found + 1
+		for hi = lo; hi < len(y.toks) && y.toks[hi].indent > lvl; hi++ {
+		}
+	}
+	return line
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
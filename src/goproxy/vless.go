@@ -0,0 +1,165 @@
+// vless.go -- VLESS protocol listener for v2ray/xray clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A vlessServer makes a SOCKS listener speak VLESS, so that v2ray and
+// xray clients can use it as they are. VLESS doesn't encrypt; it runs
+// in TLS (when a certificate is set) or behind something that does.
+// The client sends
+//
+//	VER(0) UUID(16) ADDONS-LEN ADDONS CMD PORT ATYP ADDR payload
+//
+// and, once the destination is connected, gets VER and an empty addons
+// length before the relayed stream. Only TCP (CMD 1) is supported.
+// Clients with an unknown UUID are handed to the fallback web server,
+// as with Trojan.
+type vlessServer struct {
+	tls      *tls.Config
+	users    map[[16]byte]bool
+	fallback string
+}
+
+// Make the VLESS server in 'c'; nil if there is none
+func newVlessServer(c *VlessConf) (*vlessServer, error) {
+	if len(c.Users) == 0 {
+		if len(c.Cert) > 0 || len(c.Key) > 0 || len(c.Fallback) > 0 {
+			return nil, fmt.Errorf("vless: no users")
+		}
+		return nil, nil
+	}
+
+	v := &vlessServer{
+		users:    make(map[[16]byte]bool),
+		fallback: c.Fallback,
+	}
+	for _, u := range c.Users {
+		id, err := parseUUID(u)
+		if err != nil {
+			return nil, fmt.Errorf("vless: %s", err)
+		}
+		v.users[id] = true
+	}
+
+	if len(c.Cert) > 0 || len(c.Key) > 0 {
+		crt, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("vless: %s", err)
+		}
+		v.tls = &tls.Config{
+			Certificates: []tls.Certificate{crt},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"http/1.1"},
+		}
+	}
+	return v, nil
+}
+
+// Parse a UUID: 32 hex digits, optionally with dashes
+func parseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("%q is not a UUID", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Parse the VLESS request in 'b'; return the command, SOCKS address
+// type, host, port and the payload that follows. ok is false if 'b'
+// isn't from a known user.
+func (v *vlessServer) parse(b []byte) (cmd, atyp byte, host string, port uint16, rest []byte, ok bool) {
+	if len(b) < 1+16+1 || b[0] != 0 {
+		return
+	}
+
+	var id [16]byte
+	copy(id[:], b[1:17])
+	if !v.users[id] {
+		return
+	}
+
+	// skip the addons; we have no use for them
+	i := 18 + int(b[17])
+	if len(b) < i+1+2+1 {
+		return
+	}
+	cmd = b[i]
+	port = binary.BigEndian.Uint16(b[i+1:])
+	b = b[i+3:]
+
+	// VLESS numbers its address types 1, 2, 3 for IPv4, domain and
+	// IPv6; we return the SOCKS type
+	var n int
+	switch b[0] {
+	case 1:
+		if n = 1 + 4; len(b) < n {
+			return
+		}
+		atyp, host = 1, net.IP(b[1:n]).String()
+	case 2:
+		if len(b) < 2 {
+			return
+		}
+		if n = 2 + int(b[1]); len(b) < n {
+			return
+		}
+		atyp, host = 3, string(b[2:n])
+	case 3:
+		if n = 1 + 16; len(b) < n {
+			return
+		}
+		atyp, host = 4, net.IP(b[1:n]).String()
+	default:
+		return
+	}
+	return cmd, atyp, host, port, b[n:], true
+}
+
+// Serve VLESS client 'lhs'
+func (px *socksProxy) vlessProxy(lhs net.Conn) {
+	c, b := px.greet(lhs, px.vless.tls)
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	cmd, atyp, host, port, rest, ok := px.vless.parse(b)
+	if !ok {
+		px.fallback(c, b, px.vless.fallback, "VLESS")
+		return
+	}
+
+	// failures just close the connection; success is the response
+	// header: the request's version and no addons
+	rep := func(code byte, _ net.Addr) {
+		if code == 0 {
+			c.Write([]byte{b[0], 0})
+		}
+	}
+	rhs, s, err := px.connect(c, "", cmd, atyp, host, port, rep, nil)
+	if err != nil || rhs == nil {
+		return
+	}
+	defer rhs.Close()
+
+	px.relay(&prefixConn{c, rest}, rhs.(*net.TCPConn), "", s)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,64 @@
+// website.go -- HTTPS proxy listeners that pass for a web site
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	L "github.com/opencoff/go-logger"
+)
+
+// Return the TLS config of an HTTP listener that serves HTTPS per 'c';
+// nil if it serves plain HTTP.
+func newListenerTLS(c *TLSConf) (*tls.Config, error) {
+	if len(c.Cert) == 0 && len(c.Key) == 0 {
+		return nil, nil
+	}
+
+	crt, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{crt},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}, nil
+}
+
+// Return the handler that passes requests that aren't proxy requests
+// -- a browser visiting us as a site -- to the web server at 'u'; nil
+// if there is none. On port 443 with TLS the listener then looks like
+// any other web site.
+func newWebFallback(u string, log *L.Logger) (http.Handler, error) {
+	if len(u) == 0 {
+		return nil, nil
+	}
+
+	t, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("fallback: %s", err)
+	}
+	if (t.Scheme != "http" && t.Scheme != "https") || len(t.Host) == 0 {
+		return nil, fmt.Errorf("fallback: %s is not an http or https URL", u)
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(t)
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Warn("%s: fallback %s: %s", r.RemoteAddr, r.URL.String(), err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return rp, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
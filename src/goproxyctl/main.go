@@ -0,0 +1,660 @@
+// main.go -- goproxyctl: command line client for the goproxy admin API
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+// This will be filled in by "build"
+var RepoVersion string = "UNDEFINED"
+var Buildtime string = "UNDEFINED"
+var ProductVersion string = "UNDEFINED"
+
+// A goproxy admin API client
+type client struct {
+	base  string
+	token string
+	clt   *http.Client
+	json  bool
+}
+
+func main() {
+	server := flag.StringP("server", "s", envOr("GOPROXYCTL_SERVER", "127.0.0.1:9191"),
+		"Admin API address of goproxy")
+	token := flag.StringP("token", "t", os.Getenv("GOPROXYCTL_TOKEN"),
+		"Admin API token (one of admin.tokens)")
+	jsonFlag := flag.BoolP("json", "j", false, "Show the raw JSON output")
+	verFlag := flag.BoolP("version", "v", false, "Show version info and quit")
+
+	usage := fmt.Sprintf("%s [options] command [args]", os.Args[0])
+
+	flag.Usage = func() {
+		fmt.Printf(`goproxyctl - Control a running goproxy via its admin API
+Usage: %s
+
+Commands:
+    conns list          List the active connections
+    conns kill ID       Kill connection ID
+    stats               Show summary counters
+    accept              Show accept queues and drops of each listener
+    errors              Show the failures of each listener by cause and DNS leaks
+    quota               Show the usage of the listener and tenant quotas
+    acl                 Show the ACL rules of each listener and their hits
+    reload              Reload the config
+    reload status       Show the config version and the last reload
+    updates             Show the downloads of the geoip, blocklist and
+                        category files
+    updates refresh [F] Download file F (default all) now
+    ha                  Show the HA state, connections and transitions
+    ha STATE [REASON]   Change the HA state to primary, standby or fault
+                        (e.g. from a keepalived notify script)
+    ha check            Exit 1 unless goproxy is up and not in fault
+                        (for a keepalived track_script)
+    ban list            List the banned IPs
+    ban add IP [TTL]    Ban IP for TTL (e.g. 30m); default until restart
+    ban del IP          Lift the ban on IP
+    trace list          List the client IPs and users traced
+    trace add WHO [TTL] Log every step of the connections of client IP
+                        or user WHO for TTL; default 15m
+    trace del WHO       Stop tracing WHO
+
+Options:
+`, usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *verFlag {
+		fmt.Printf("goproxyctl - %s [%s; %s]\n", ProductVersion, RepoVersion, Buildtime)
+		os.Exit(0)
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		die("No command!\nUsage: %s", usage)
+	}
+
+	base := *server
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	c := &client{
+		base:  strings.TrimSuffix(base, "/"),
+		token: *token,
+		clt:   &http.Client{Timeout: 10 * time.Second},
+		json:  *jsonFlag,
+	}
+
+	var err error
+	switch cmd := strings.Join(args[:min(2, len(args))], " "); {
+	case cmd == "conns list" || cmd == "conns":
+		err = c.connsList()
+	case cmd == "conns kill" && len(args) == 3:
+		err = c.show("POST", "/conns/kill", url.Values{"id": {args[2]}})
+	case cmd == "stats":
+		err = c.stats()
+	case cmd == "accept":
+		err = c.accept()
+	case cmd == "errors":
+		err = c.errors()
+	case cmd == "quota":
+		err = c.quota()
+	case cmd == "acl":
+		err = c.acl()
+	case cmd == "reload":
+		err = c.reload("POST")
+	case cmd == "reload status":
+		err = c.reload("GET")
+	case cmd == "ha":
+		err = c.ha()
+	case cmd == "ha check":
+		err = c.haCheck()
+	case (cmd == "ha primary" || cmd == "ha standby" || cmd == "ha fault") && len(args) <= 3:
+		q := url.Values{"state": {args[1]}}
+		if len(args) == 3 {
+			q.Set("reason", args[2])
+		}
+		err = c.show("POST", "/ha", q)
+	case cmd == "updates":
+		err = c.updates("GET", nil)
+	case cmd == "updates refresh" && (len(args) == 2 || len(args) == 3):
+		var q url.Values
+		if len(args) == 3 {
+			q = url.Values{"file": {args[2]}}
+		}
+		err = c.updates("POST", q)
+	case cmd == "ban list" || cmd == "ban":
+		err = c.kv("GET", "/bans", nil, "IP", "UNTIL")
+	case cmd == "ban add" && (len(args) == 3 || len(args) == 4):
+		q := url.Values{"ip": {args[2]}}
+		if len(args) == 4 {
+			q.Set("ttl", args[3])
+		}
+		err = c.show("POST", "/bans", q)
+	case cmd == "ban del" && len(args) == 3:
+		err = c.show("DELETE", "/bans", url.Values{"ip": {args[2]}})
+	case cmd == "trace list" || cmd == "trace":
+		err = c.show("GET", "/trace", nil)
+	case cmd == "trace add" && (len(args) == 3 || len(args) == 4):
+		q := traceWho(args[2])
+		if len(args) == 4 {
+			q.Set("ttl", args[3])
+		}
+		err = c.show("POST", "/trace", q)
+	case cmd == "trace del" && len(args) == 3:
+		err = c.show("DELETE", "/trace", traceWho(args[2]))
+	default:
+		die("Unknown command %q\nUsage: %s", strings.Join(args, " "), usage)
+	}
+
+	if err != nil {
+		die("%s", err)
+	}
+}
+
+// Make an API call and return the response body
+func (c *client) call(method, path string, q url.Values) ([]byte, error) {
+	u := c.base + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.clt.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, res.Status,
+			strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// Make an API call and print its JSON response
+func (c *client) show(method, path string, q url.Values) error {
+	b, err := c.call(method, path, q)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(b)
+	return nil
+}
+
+// Return the query naming 'who' as a client IP or else a user
+func traceWho(who string) url.Values {
+	if net.ParseIP(who) != nil {
+		return url.Values{"ip": {who}}
+	}
+	return url.Values{"user": {who}}
+}
+
+func (c *client) connsList() error {
+	b, err := c.call("GET", "/conns", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v []struct {
+		ID       uint64    `json:"id"`
+		Listener string    `json:"listener"`
+		Client   string    `json:"client"`
+		Dest     string    `json:"dest"`
+		Start    time.Time `json:"start"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tLISTENER\tCLIENT\tDEST\tAGE\n")
+	for _, x := range v {
+		age := time.Since(x.Start) / time.Second * time.Second
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", x.ID, x.Listener, x.Client, x.Dest, age)
+	}
+	return w.Flush()
+}
+
+func (c *client) stats() error {
+	b, err := c.call("GET", "/stats", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, k := range sortedKeys(m) {
+		if sub, ok := m[k].(map[string]interface{}); ok {
+			for _, j := range sortedKeys(sub) {
+				fmt.Fprintf(w, "%s.%s\t%v\n", k, j, sub[j])
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%v\n", k, m[k])
+	}
+	return w.Flush()
+}
+
+func (c *client) accept() error {
+	b, err := c.call("GET", "/accept", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v struct {
+		Listeners map[string]struct {
+			Accepted uint64            `json:"accepted"`
+			Drops    map[string]uint64 `json:"drops"`
+			Queue    int               `json:"queue"`
+			Backlog  int               `json:"backlog"`
+			Clients  int               `json:"ratelimit_clients"`
+		} `json:"listeners"`
+		Kernel map[string]uint64 `json:"kernel"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(v.Listeners))
+	for k := range v.Listeners {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	drops := []string{"ratelimit", "acl", "banned", "overload", "destlimit", "schedule", "chaos", "knock", "memory", "maxconns"}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "LISTENER\tACCEPTED\tQUEUE\tBACKLOG\tCLIENTS\t%s\n", strings.ToUpper(strings.Join(drops, "\t")))
+	for _, k := range names {
+		x := v.Listeners[k]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d", k, x.Accepted, x.Queue, x.Backlog, x.Clients)
+		for _, d := range drops {
+			fmt.Fprintf(w, "\t%d", x.Drops[d])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	w.Flush()
+
+	if len(v.Kernel) > 0 {
+		fmt.Printf("\nkernel: listen overflows %d, listen drops %d\n",
+			v.Kernel["listen_overflows"], v.Kernel["listen_drops"])
+	}
+	return nil
+}
+
+func (c *client) errors() error {
+	b, err := c.call("GET", "/accept", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v struct {
+		Listeners map[string]struct {
+			Errors   map[string]uint64 `json:"errors"`
+			DNSLeaks uint64            `json:"dns_leaks"`
+		} `json:"listeners"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(v.Listeners))
+	for k := range v.Listeners {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	// ours first, then the destination's and client's
+	errs := []string{"acl", "ratelimit", "auth", "policy", "dns", "dial-timeout", "refused", "unreachable", "no-ports", "tls", "upstream", "client-abort"}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "LISTENER\t%s\tDNS-LEAKS\n", strings.ToUpper(strings.Join(errs, "\t")))
+	for _, k := range names {
+		x := v.Listeners[k]
+		fmt.Fprintf(w, "%s", k)
+		for _, e := range errs {
+			fmt.Fprintf(w, "\t%d", x.Errors[e])
+		}
+		fmt.Fprintf(w, "\t%d\n", x.DNSLeaks)
+	}
+	return w.Flush()
+}
+
+func (c *client) quota() error {
+	b, err := c.call("GET", "/quota", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v []struct {
+		Kind   string    `json:"kind"`
+		Name   string    `json:"name"`
+		Quota  int64     `json:"quota"`
+		Period string    `json:"period"`
+		Start  time.Time `json:"start"`
+		Used   int64     `json:"used"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "KIND\tNAME\tPERIOD\tSINCE\tUSED\tQUOTA\t%%\n")
+	for _, x := range v {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", x.Kind, x.Name, x.Period,
+			x.Start.Format("2006-01-02"), x.Used, x.Quota, x.Used*100/x.Quota)
+	}
+	w.Flush()
+	return nil
+}
+
+func (c *client) acl() error {
+	b, err := c.call("GET", "/acl", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v []struct {
+		Listener string `json:"listener"`
+		Rules    []struct {
+			Kind string `json:"kind"`
+			Net  string `json:"net"`
+			Name string `json:"name"`
+			Hits uint64 `json:"hits"`
+		} `json:"rules"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "LISTENER\tKIND\tNET\tNAME\tHITS\n")
+	for _, x := range v {
+		for _, r := range x.Rules {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", x.Listener, r.Kind, r.Net, r.Name, r.Hits)
+		}
+	}
+	return w.Flush()
+}
+
+// Reload the config (POST) or show the reload status (GET); a failed
+// reload is an error.
+func (c *client) reload(method string) error {
+	b, err := c.call(method, "/reload", nil)
+	if err != nil {
+		return err
+	}
+
+	var st struct {
+		Version   string    `json:"version"`
+		Loaded    time.Time `json:"loaded"`
+		Attempt   time.Time `json:"attempt"`
+		Attempted string    `json:"attempted"`
+		OK        bool      `json:"ok"`
+		Errors    []string  `json:"errors"`
+	}
+	if err = json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+
+	if c.json {
+		os.Stdout.Write(b)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "version\t%s\n", st.Version)
+		fmt.Fprintf(w, "loaded\t%s\n", st.Loaded.Format(time.RFC3339))
+		fmt.Fprintf(w, "last reload\t%s\n", st.Attempt.Format(time.RFC3339))
+		w.Flush()
+	}
+
+	if !st.OK {
+		return fmt.Errorf("reload of version %s failed; still running %s:\n%s",
+			st.Attempted, st.Version, strings.Join(st.Errors, "\n"))
+	}
+	return nil
+}
+
+type haStatus struct {
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"`
+	Peer        string    `json:"peer"`
+	PeerUp      bool      `json:"peer_up"`
+	Open        int64     `json:"open"`
+	Accepted    uint64    `json:"accepted"`
+	Transitions []struct {
+		Time   time.Time `json:"time"`
+		From   string    `json:"from"`
+		To     string    `json:"to"`
+		Reason string    `json:"reason"`
+		Open   int64     `json:"open"`
+		Error  string    `json:"error"`
+	} `json:"transitions"`
+}
+
+func (c *client) ha() error {
+	b, err := c.call("GET", "/ha", nil)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var st haStatus
+	if err = json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "state\t%s since %s\n", st.State, st.Since.Format(time.RFC3339))
+	if len(st.Peer) > 0 {
+		fmt.Fprintf(w, "peer\t%s up=%v\n", st.Peer, st.PeerUp)
+	}
+	fmt.Fprintf(w, "open\t%d\n", st.Open)
+	fmt.Fprintf(w, "accepted\t%d\n\n", st.Accepted)
+	fmt.Fprintf(w, "TIME\tFROM\tTO\tOPEN\tREASON\n")
+	for _, x := range st.Transitions {
+		why := x.Reason
+		if len(x.Error) > 0 {
+			why += "; " + x.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", x.Time.Format(time.RFC3339), x.From, x.To, x.Open, why)
+	}
+	return w.Flush()
+}
+
+// Fail unless goproxy answers and isn't in fault
+func (c *client) haCheck() error {
+	b, err := c.call("GET", "/ha", nil)
+	if err != nil {
+		return err
+	}
+
+	var st haStatus
+	if err = json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	if st.State == "fault" {
+		return fmt.Errorf("in fault since %s", st.Since.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Show the downloads (GET) or download now (POST); a failed download
+// is an error.
+func (c *client) updates(method string, q url.Values) error {
+	if method == "POST" {
+		// a download takes as long as it takes
+		c.clt.Timeout = 10 * time.Minute
+	}
+	b, err := c.call(method, "/updates", q)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var v []struct {
+		URL     string    `json:"url"`
+		File    string    `json:"file"`
+		Checked time.Time `json:"checked"`
+		Updated time.Time `json:"updated"`
+		SHA256  string    `json:"sha256"`
+		Size    int64     `json:"size"`
+		Error   string    `json:"error"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	when := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	var failed []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "FILE\tCHECKED\tUPDATED\tSIZE\tSHA256\n")
+	for _, x := range v {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.16s\n", x.File, when(x.Checked), when(x.Updated), x.Size, x.SHA256)
+		if len(x.Error) > 0 {
+			failed = append(failed, x.Error)
+		}
+	}
+	w.Flush()
+
+	if method == "POST" && len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// Make an API call that returns a JSON object of strings and print it
+// as a two column table
+func (c *client) kv(method, path string, q url.Values, k, v string) error {
+	b, err := c.call(method, path, q)
+	if err != nil || c.json {
+		if err == nil {
+			os.Stdout.Write(b)
+		}
+		return err
+	}
+
+	var m map[string]string
+	if err = json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for x := range m {
+		keys = append(keys, x)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\t%s\n", k, v)
+	for _, x := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", x, m[x])
+	}
+	return w.Flush()
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	v := make([]string, 0, len(m))
+	for k := range m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+func envOr(k, dflt string) string {
+	if s := os.Getenv(k); len(s) > 0 {
+		return s
+	}
+	return dflt
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// die with error
+func die(f string, v ...interface{}) {
+	z := fmt.Sprintf("%s: %s", os.Args[0], f)
+	s := fmt.Sprintf(z, v...)
+	if n := len(s); s[n-1] != '\n' {
+		s += "\n"
+	}
+
+	os.Stderr.WriteString(s)
+	os.Exit(1)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98: